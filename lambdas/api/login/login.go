@@ -2,17 +2,42 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
 )
 
+// ActiveTenantMetadataKey is the client metadata key read by the pre-token Lambda
+const ActiveTenantMetadataKey = "tenant_id"
+
+// TenantClientCacheTTL is how long a discovered user pool and client are reused. Discovery
+// lists every pool in the account, so it dominates login latency when it is not cached.
+const TenantClientCacheTTL = 15 * time.Minute
+
+// ErrTenantNotFound is returned when no user pool or client exists for the requested tenant
+var ErrTenantNotFound = errors.New("tenant not found")
+
+// tenantClient is a cached result of the user pool and client discovery
+type tenantClient struct {
+	userPoolID string
+	clientID   string
+	expires    time.Time
+}
+
 // LoginService handles authentication with AWS Cognito
 type LoginService struct {
 	cognitoClient *cognitoidentityprovider.Client
+	cloudWatch    *cloudwatch.Client // Reads the auth metrics back for the stats endpoint
 	stackName     string
+
+	mu      sync.Mutex
+	clients map[string]tenantClient // Tenant -> discovered pool and client
 }
 
 // LoginRequest represents the login request payload
@@ -20,6 +45,16 @@ type LoginRequest struct {
 	Tenant   string `json:"tenant"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// ActiveTenant optionally selects another tenant the user is a member of; the pre-token
+	// Lambda validates the membership and pins it as the tenant_id claim
+	ActiveTenant string `json:"active_tenant,omitempty"`
+}
+
+// SwitchTenantRequest represents a request to change the active tenant without re-login
+type SwitchTenantRequest struct {
+	Tenant       string `json:"tenant"`        // Home tenant whose pool issued the refresh token
+	RefreshToken string `json:"refresh_token"` // Refresh token from the login response
+	ActiveTenant string `json:"active_tenant"` // Tenant to switch to
 }
 
 // LoginResponse represents the login response with tokens
@@ -35,28 +70,28 @@ type LoginResponse struct {
 func NewLoginService(cfg aws.Config, stackName string) *LoginService {
 	return &LoginService{
 		cognitoClient: cognitoidentityprovider.NewFromConfig(cfg),
+		cloudWatch:    cloudwatch.NewFromConfig(cfg),
 		stackName:     stackName,
+		clients:       make(map[string]tenantClient),
 	}
 }
 
 // Authenticate performs user authentication with Cognito
 func (s *LoginService) Authenticate(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
+	resp, err := s.authenticate(ctx, req)
+	recordOutcome("login", err)
+	return resp, err
+}
+
+func (s *LoginService) authenticate(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
 	// Validate input
 	if req.Tenant == "" || req.Username == "" || req.Password == "" {
-		return nil, fmt.Errorf("tenant, username, and password are required")
-	}
-
-	// Discover the user pool and client by the naming convention
-	userPoolName := fmt.Sprintf("%s-%s-user-pool", s.stackName, req.Tenant)
-	userPoolID, err := s.findUserPoolByName(ctx, userPoolName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find user pool for tenant %s: %w", req.Tenant, err)
+		return nil, &AuthError{Reason: ReasonInvalidRequest, Err: fmt.Errorf("tenant, username, and password are required")}
 	}
 
-	// Get the user pool client
-	clientID, err := s.findUserPoolClient(ctx, userPoolID, fmt.Sprintf("%s-%s-client", s.stackName, req.Tenant))
+	userPoolID, clientID, err := s.resolveTenantClient(ctx, req.Tenant)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find user pool client: %w", err)
+		return nil, err
 	}
 
 	// Prepare auth parameters
@@ -65,41 +100,154 @@ func (s *LoginService) Authenticate(ctx context.Context, req *LoginRequest) (*Lo
 		"PASSWORD": req.Password,
 	}
 
-	// Call Cognito InitiateAuth
-	input := &cognitoidentityprovider.InitiateAuthInput{
-		AuthFlow:       types.AuthFlowTypeUserPasswordAuth,
-		ClientId:       aws.String(clientID),
-		AuthParameters: authParams,
+	// Call Cognito; a tenant selection goes through AdminInitiateAuth, the only password
+	// flow that hands client metadata to the pre-token trigger
+	var authResult *types.AuthenticationResultType
+	var challenge types.ChallengeNameType
+	if req.ActiveTenant != "" {
+		result, err := s.cognitoClient.AdminInitiateAuth(ctx, &cognitoidentityprovider.AdminInitiateAuthInput{
+			AuthFlow:       types.AuthFlowTypeAdminUserPasswordAuth,
+			UserPoolId:     aws.String(userPoolID),
+			ClientId:       aws.String(clientID),
+			AuthParameters: authParams,
+			ClientMetadata: map[string]string{ActiveTenantMetadataKey: req.ActiveTenant},
+		})
+		if err != nil {
+			return nil, authError(fmt.Errorf("authentication failed: %w", err))
+		}
+		authResult, challenge = result.AuthenticationResult, result.ChallengeName
+	} else {
+		input := &cognitoidentityprovider.InitiateAuthInput{
+			AuthFlow:       types.AuthFlowTypeUserPasswordAuth,
+			ClientId:       aws.String(clientID),
+			AuthParameters: authParams,
+		}
+
+		result, err := s.cognitoClient.InitiateAuth(ctx, input)
+		if err != nil {
+			return nil, authError(fmt.Errorf("authentication failed: %w", err))
+		}
+		authResult, challenge = result.AuthenticationResult, result.ChallengeName
+	}
+
+	// Check if we got authentication result; challenges (MFA, new password) are not supported
+	if authResult == nil {
+		if challenge != "" {
+			recordChallenge(challenge)
+			return nil, &AuthError{Reason: ReasonChallengeRequired, Err: fmt.Errorf("unsupported authentication challenge %s", challenge)}
+		}
+		return nil, fmt.Errorf("unexpected authentication response")
+	}
+
+	// Build response
+	response := &LoginResponse{
+		TokenType: "Bearer",
+		ExpiresIn: authResult.ExpiresIn,
+	}
+
+	// Include tokens if present
+	if authResult.AccessToken != nil {
+		response.AccessToken = *authResult.AccessToken
+	}
+	if authResult.IdToken != nil {
+		response.IDToken = *authResult.IdToken
+	}
+	if authResult.RefreshToken != nil {
+		response.RefreshToken = *authResult.RefreshToken
+	}
+
+	return response, nil
+}
+
+// SwitchTenant exchanges a refresh token for new ID and access tokens whose active
+// tenant_id is another tenant the user belongs to. The pre-token Lambda validates the
+// membership, so an invalid request fails like a failed refresh. Cognito does not
+// issue a new refresh token, and a later plain refresh returns to the home tenant.
+func (s *LoginService) SwitchTenant(ctx context.Context, req *SwitchTenantRequest) (*LoginResponse, error) {
+	resp, err := s.switchTenant(ctx, req)
+	recordOutcome("switch_tenant", err)
+	return resp, err
+}
+
+func (s *LoginService) switchTenant(ctx context.Context, req *SwitchTenantRequest) (*LoginResponse, error) {
+	if req.Tenant == "" || req.RefreshToken == "" || req.ActiveTenant == "" {
+		return nil, &AuthError{Reason: ReasonInvalidRequest, Err: fmt.Errorf("tenant, refresh_token, and active_tenant are required")}
 	}
 
-	result, err := s.cognitoClient.InitiateAuth(ctx, input)
+	userPoolID, clientID, err := s.resolveTenantClient(ctx, req.Tenant)
 	if err != nil {
-		return nil, fmt.Errorf("authentication failed: %w", err)
+		return nil, err
 	}
 
-	// Check if we got authentication result
+	// AdminInitiateAuth passes client metadata to the pre-token trigger on refresh too
+	result, err := s.cognitoClient.AdminInitiateAuth(ctx, &cognitoidentityprovider.AdminInitiateAuthInput{
+		AuthFlow:       types.AuthFlowTypeRefreshTokenAuth,
+		UserPoolId:     aws.String(userPoolID),
+		ClientId:       aws.String(clientID),
+		AuthParameters: map[string]string{"REFRESH_TOKEN": req.RefreshToken},
+		ClientMetadata: map[string]string{ActiveTenantMetadataKey: req.ActiveTenant},
+	})
+	if err != nil {
+		return nil, authError(fmt.Errorf("tenant switch failed: %w", err))
+	}
 	if result.AuthenticationResult == nil {
+		if result.ChallengeName != "" {
+			recordChallenge(result.ChallengeName)
+			return nil, &AuthError{Reason: ReasonChallengeRequired, Err: fmt.Errorf("unsupported authentication challenge %s", result.ChallengeName)}
+		}
 		return nil, fmt.Errorf("unexpected authentication response")
 	}
 
-	// Build response
 	response := &LoginResponse{
 		TokenType: "Bearer",
 		ExpiresIn: result.AuthenticationResult.ExpiresIn,
 	}
-
-	// Include tokens if present
 	if result.AuthenticationResult.AccessToken != nil {
 		response.AccessToken = *result.AuthenticationResult.AccessToken
 	}
 	if result.AuthenticationResult.IdToken != nil {
 		response.IDToken = *result.AuthenticationResult.IdToken
 	}
-	if result.AuthenticationResult.RefreshToken != nil {
-		response.RefreshToken = *result.AuthenticationResult.RefreshToken
+	return response, nil
+}
+
+// resolveTenantClient discovers a tenant's user pool and client by the naming convention,
+// caching the result for TenantClientCacheTTL. Unknown tenants are not cached, so a newly
+// onboarded tenant can log in right away.
+func (s *LoginService) resolveTenantClient(ctx context.Context, tenant string) (string, string, error) {
+	start := time.Now()
+	s.mu.Lock()
+	cached, ok := s.clients[tenant]
+	s.mu.Unlock()
+	if ok && start.Before(cached.expires) {
+		recordPoolDiscovery(time.Since(start), true)
+		return cached.userPoolID, cached.clientID, nil
 	}
 
-	return response, nil
+	userPoolName := fmt.Sprintf("%s-%s-user-pool", s.stackName, tenant)
+	userPoolID, err := s.findUserPoolByName(ctx, userPoolName)
+	if err != nil {
+		return "", "", discoveryError(fmt.Errorf("failed to find user pool for tenant %s: %w", tenant, err))
+	}
+
+	clientID, err := s.findUserPoolClient(ctx, userPoolID, fmt.Sprintf("%s-%s-client", s.stackName, tenant))
+	if err != nil {
+		return "", "", discoveryError(fmt.Errorf("failed to find user pool client: %w", err))
+	}
+	recordPoolDiscovery(time.Since(start), false)
+
+	s.mu.Lock()
+	s.clients[tenant] = tenantClient{userPoolID: userPoolID, clientID: clientID, expires: time.Now().Add(TenantClientCacheTTL)}
+	s.mu.Unlock()
+	return userPoolID, clientID, nil
+}
+
+// discoveryError classifies a failed pool or client discovery
+func discoveryError(err error) error {
+	if errors.Is(err, ErrTenantNotFound) {
+		return &AuthError{Reason: ReasonUnknownTenant, Err: err}
+	}
+	return authError(err)
 }
 
 // findUserPoolByName discovers a user pool by its name
@@ -121,7 +269,7 @@ func (s *LoginService) findUserPoolByName(ctx context.Context, poolName string)
 		}
 	}
 
-	return "", fmt.Errorf("user pool not found: %s", poolName)
+	return "", fmt.Errorf("%w: no user pool %s", ErrTenantNotFound, poolName)
 }
 
 // findUserPoolClient discovers a user pool client by name
@@ -155,5 +303,5 @@ func (s *LoginService) findUserPoolClient(ctx context.Context, userPoolID, clien
 		}
 	}
 
-	return "", fmt.Errorf("user pool client not found: %s", clientName)
+	return "", fmt.Errorf("%w: no user pool client %s", ErrTenantNotFound, clientName)
 }
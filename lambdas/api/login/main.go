@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -14,27 +16,54 @@ import (
 
 var (
 	loginService *LoginService
+	stackName    string
+	serviceOnce  sync.Once
 )
 
+// Init only validates the environment; the AWS config is loaded lazily so that
+// no credentials are resolved before the first invocation (SnapStart-safe).
 func init() {
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-
 	// Get stack name from environment variables
-	stackName := os.Getenv("STACK_NAME")
+	stackName = os.Getenv("STACK_NAME")
 	if stackName == "" {
 		log.Fatal("STACK_NAME environment variable not set")
 	}
+}
+
+// initLoginService loads the AWS configuration and creates the login service on first use
+func initLoginService(ctx context.Context) {
+	serviceOnce.Do(func() {
+		// Load AWS configuration
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+
+		// Initialize login service
+		loginService = NewLoginService(cfg, stackName)
+		log.Printf("Login service initialized for stack: %s", stackName)
+	})
+}
+
+// API Gateway resources of the endpoints besides /login; every other resource routed to
+// this function is treated as /login
+const (
+	switchTenantPath = "/session/switch-tenant"
+	authStatsPath    = "/admin/auth/stats"
+)
 
-	// Initialize login service
-	loginService = NewLoginService(cfg, stackName)
-	log.Printf("Login service initialized for stack: %s", stackName)
+// handleRequest dispatches the Lambda event by API Gateway resource without Chi router
+func handleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.Resource {
+	case switchTenantPath:
+		return handleSwitchTenant(ctx, request)
+	case authStatsPath:
+		return handleAuthStats(ctx, request)
+	}
+	return handleLogin(ctx, request)
 }
 
-// handleLogin processes the Lambda event directly without Chi router
+// handleLogin processes a login request
 func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Only accept POST method
 	if request.HTTPMethod != http.MethodPost {
@@ -57,6 +86,7 @@ func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (ev
 	}
 
 	// Authenticate user
+	initLoginService(ctx)
 	resp, err := loginService.Authenticate(ctx, &loginReq)
 	if err != nil {
 		log.Printf("Authentication failed: %v", err)
@@ -86,6 +116,116 @@ func handleLogin(ctx context.Context, request events.APIGatewayProxyRequest) (ev
 	}, nil
 }
 
+// handleSwitchTenant exchanges a refresh token for tokens with another active tenant
+func handleSwitchTenant(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.HTTPMethod != http.MethodPost {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusMethodNotAllowed,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Method not allowed"}`,
+		}, nil
+	}
+
+	var switchReq SwitchTenantRequest
+	if err := json.Unmarshal([]byte(request.Body), &switchReq); err != nil {
+		log.Printf("Failed to parse request body: %v", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Invalid request body"}`,
+		}, nil
+	}
+
+	// Expired refresh tokens and tenants the user does not belong to both fail here
+	initLoginService(ctx)
+	resp, err := loginService.SwitchTenant(ctx, &switchReq)
+	if err != nil {
+		log.Printf("Tenant switch failed: %v", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusUnauthorized,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Tenant switch failed"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal response: %v", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Internal server error"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// handleAuthStats returns the login metrics aggregated over ?window= (default 1h).
+// The route uses the tenant authorizer, and only tokens with the admin scope may read it.
+func handleAuthStats(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.HTTPMethod != http.MethodGet {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusMethodNotAllowed,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Method not allowed"}`,
+		}, nil
+	}
+
+	scope, _ := request.RequestContext.Authorizer["scope"].(string)
+	if !hasAdminScope(scope) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusForbidden,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Admin scope required"}`,
+		}, nil
+	}
+
+	window := DefaultStatsWindow
+	if value := request.QueryStringParameters["window"]; value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < MinStatsWindow || parsed > MaxStatsWindow {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       `{"error":"window must be a duration between 5m and 24h"}`,
+			}, nil
+		}
+		window = parsed.Truncate(time.Minute)
+	}
+
+	initLoginService(ctx)
+	resp, err := loginService.AuthStats(ctx, window)
+	if err != nil {
+		log.Printf("Auth stats failed: %v", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Internal server error"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal response: %v", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       `{"error":"Internal server error"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
 func main() {
-	lambda.Start(handleLogin)
+	lambda.Start(handleRequest)
 }
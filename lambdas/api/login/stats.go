@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+const (
+	// DefaultStatsWindow is the period aggregated by the stats endpoint when none is given
+	DefaultStatsWindow = time.Hour
+
+	// MinStatsWindow and MaxStatsWindow bound the stats window; CloudWatch keeps one-minute
+	// data points for 15 days, so a day is always available at full resolution
+	MinStatsWindow = 5 * time.Minute
+	MaxStatsWindow = 24 * time.Hour
+)
+
+// AuthStatsResponse aggregates the login metrics of all Lambda instances over a window
+type AuthStatsResponse struct {
+	From          string             `json:"from"`       // RFC 3339
+	To            string             `json:"to"`         // RFC 3339
+	Successes     map[string]float64 `json:"successes"`  // By operation (login, switch_tenant)
+	Failures      map[string]float64 `json:"failures"`   // By reason; reasons without failures are left out
+	Challenges    map[string]float64 `json:"challenges"` // By Cognito challenge name
+	PoolCache     PoolCacheStats     `json:"pool_cache"`
+	PoolDiscovery PoolDiscoveryStats `json:"pool_discovery"`
+}
+
+// PoolCacheStats counts tenant pool lookups served from and missing the per-instance cache
+type PoolCacheStats struct {
+	Hits    float64 `json:"hits"`
+	Misses  float64 `json:"misses"`
+	HitRate float64 `json:"hit_rate"` // Hits / (hits + misses); 0 without lookups
+}
+
+// PoolDiscoveryStats describes the latency of uncached pool and client discoveries
+type PoolDiscoveryStats struct {
+	Count     float64 `json:"count"`
+	AverageMs float64 `json:"average_ms"`
+	P90Ms     float64 `json:"p90_ms"` // Highest p90 of the aggregated periods
+	MaxMs     float64 `json:"max_ms"`
+}
+
+// hasAdminScope reports whether the space-separated scope claim contains the admin scope,
+// either bare ("admin") or from a resource server ("<resource-server>/admin"), matching the
+// authorizer's rule
+func hasAdminScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == "admin" || strings.HasSuffix(s, "/admin") {
+			return true
+		}
+	}
+	return false
+}
+
+// metricQuery is one series the stats endpoint reads, and where its value goes
+type metricQuery struct {
+	name      string
+	dimension string // Dimension name; empty for metrics without dimensions
+	value     string // Dimension value
+	stat      string
+	apply     func(stats *AuthStatsResponse, values []float64)
+}
+
+// sum adds up the values of all periods
+func sum(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+// AuthStats aggregates the login metrics over the window ending now
+func (s *LoginService) AuthStats(ctx context.Context, window time.Duration) (*AuthStatsResponse, error) {
+	to := time.Now().UTC().Truncate(time.Minute)
+	from := to.Add(-window)
+	stats := &AuthStatsResponse{
+		From:       from.Format(time.RFC3339),
+		To:         to.Format(time.RFC3339),
+		Successes:  map[string]float64{},
+		Failures:   map[string]float64{},
+		Challenges: map[string]float64{},
+	}
+
+	var latencySum, latencyCount float64
+	queries := []metricQuery{
+		{name: "PoolCacheHit", stat: "Sum", apply: func(r *AuthStatsResponse, v []float64) { r.PoolCache.Hits = sum(v) }},
+		{name: "PoolCacheMiss", stat: "Sum", apply: func(r *AuthStatsResponse, v []float64) { r.PoolCache.Misses = sum(v) }},
+		{name: "PoolDiscoveryLatency", stat: "Sum", apply: func(_ *AuthStatsResponse, v []float64) { latencySum = sum(v) }},
+		{name: "PoolDiscoveryLatency", stat: "SampleCount", apply: func(_ *AuthStatsResponse, v []float64) { latencyCount = sum(v) }},
+		{name: "PoolDiscoveryLatency", stat: "p90", apply: func(r *AuthStatsResponse, v []float64) {
+			for _, value := range v {
+				r.PoolDiscovery.P90Ms = max(r.PoolDiscovery.P90Ms, value)
+			}
+		}},
+		{name: "PoolDiscoveryLatency", stat: "Maximum", apply: func(r *AuthStatsResponse, v []float64) {
+			for _, value := range v {
+				r.PoolDiscovery.MaxMs = max(r.PoolDiscovery.MaxMs, value)
+			}
+		}},
+	}
+	for _, operation := range []string{"login", "switch_tenant"} {
+		queries = append(queries, metricQuery{name: "AuthSuccess", dimension: "Operation", value: operation, stat: "Sum",
+			apply: func(r *AuthStatsResponse, v []float64) { r.Successes[operation] = sum(v) }})
+	}
+	for _, reason := range AuthFailureReasons {
+		queries = append(queries, metricQuery{name: "AuthFailure", dimension: "Reason", value: reason, stat: "Sum",
+			apply: func(r *AuthStatsResponse, v []float64) {
+				if total := sum(v); total > 0 {
+					r.Failures[reason] = total
+				}
+			}})
+	}
+	for _, challenge := range types.ChallengeNameType("").Values() {
+		queries = append(queries, metricQuery{name: "AuthChallenge", dimension: "Challenge", value: string(challenge), stat: "Sum",
+			apply: func(r *AuthStatsResponse, v []float64) {
+				if total := sum(v); total > 0 {
+					r.Challenges[string(challenge)] = total
+				}
+			}})
+	}
+
+	dataQueries := make([]cwtypes.MetricDataQuery, len(queries))
+	for i, query := range queries {
+		metric := &cwtypes.Metric{
+			Namespace:  aws.String(AuthMetricNamespace),
+			MetricName: aws.String(query.name),
+		}
+		if query.dimension != "" {
+			metric.Dimensions = []cwtypes.Dimension{{Name: aws.String(query.dimension), Value: aws.String(query.value)}}
+		}
+		dataQueries[i] = cwtypes.MetricDataQuery{
+			Id: aws.String(fmt.Sprintf("q%d", i)),
+			MetricStat: &cwtypes.MetricStat{
+				Metric: metric,
+				Period: aws.Int32(int32(window.Seconds())),
+				Stat:   aws.String(query.stat),
+			},
+		}
+	}
+
+	values := make(map[string][]float64, len(queries))
+	paginator := cloudwatch.NewGetMetricDataPaginator(s.cloudWatch, &cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(from),
+		EndTime:           aws.Time(to),
+		MetricDataQueries: dataQueries,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth metrics: %w", err)
+		}
+		for _, result := range page.MetricDataResults {
+			id := aws.ToString(result.Id)
+			values[id] = append(values[id], result.Values...)
+		}
+	}
+	for i, query := range queries {
+		query.apply(stats, values[fmt.Sprintf("q%d", i)])
+	}
+
+	stats.PoolDiscovery.Count = latencyCount
+	if latencyCount > 0 {
+		stats.PoolDiscovery.AverageMs = latencySum / latencyCount
+	}
+	if lookups := stats.PoolCache.Hits + stats.PoolCache.Misses; lookups > 0 {
+		stats.PoolCache.HitRate = stats.PoolCache.Hits / lookups
+	}
+	return stats, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// AuthMetricNamespace holds the login metrics. They are written as CloudWatch embedded
+// metric format log lines, so recording them costs no API call on the login path.
+const AuthMetricNamespace = "UploadDemo/Auth"
+
+// Auth failure reasons, the values of the Reason dimension of the AuthFailure metric
+const (
+	ReasonInvalidRequest        = "invalid_request"
+	ReasonUnknownTenant         = "unknown_tenant"
+	ReasonNotAuthorized         = "not_authorized"
+	ReasonUserNotFound          = "user_not_found"
+	ReasonUserNotConfirmed      = "user_not_confirmed"
+	ReasonPasswordResetRequired = "password_reset_required"
+	ReasonChallengeRequired     = "challenge_required"
+	ReasonThrottled             = "throttled"
+	ReasonOther                 = "other"
+)
+
+// AuthFailureReasons lists every reason, so the stats endpoint can query each series
+var AuthFailureReasons = []string{
+	ReasonInvalidRequest, ReasonUnknownTenant, ReasonNotAuthorized, ReasonUserNotFound,
+	ReasonUserNotConfirmed, ReasonPasswordResetRequired, ReasonChallengeRequired,
+	ReasonThrottled, ReasonOther,
+}
+
+// AuthError is a failed login or tenant switch classified by reason
+type AuthError struct {
+	Reason string
+	Err    error
+}
+
+func (e *AuthError) Error() string { return e.Err.Error() }
+
+func (e *AuthError) Unwrap() error { return e.Err }
+
+// authError wraps err with the reason derived from the Cognito error it carries
+func authError(err error) error {
+	reason := ReasonOther
+	var notAuthorized *types.NotAuthorizedException
+	var userNotFound *types.UserNotFoundException
+	var notConfirmed *types.UserNotConfirmedException
+	var resetRequired *types.PasswordResetRequiredException
+	var tooManyRequests *types.TooManyRequestsException
+	var limitExceeded *types.LimitExceededException
+	switch {
+	case errors.As(err, &notAuthorized):
+		reason = ReasonNotAuthorized
+	case errors.As(err, &userNotFound):
+		reason = ReasonUserNotFound
+	case errors.As(err, &notConfirmed):
+		reason = ReasonUserNotConfirmed
+	case errors.As(err, &resetRequired):
+		reason = ReasonPasswordResetRequired
+	case errors.As(err, &tooManyRequests), errors.As(err, &limitExceeded):
+		reason = ReasonThrottled
+	}
+	return &AuthError{Reason: reason, Err: err}
+}
+
+// failureReason returns the reason of a failed login or tenant switch
+func failureReason(err error) string {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.Reason
+	}
+	return ReasonOther
+}
+
+// emfMetric is one metric of an embedded metric format record
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emitMetric writes a single-value embedded metric format record to stdout, from where
+// CloudWatch Logs extracts the metric. dimensions may be empty.
+func emitMetric(name, unit string, value float64, dimensions map[string]string) {
+	dimensionKeys := make([]string, 0, len(dimensions))
+	record := map[string]any{name: value}
+	for key, dimensionValue := range dimensions {
+		dimensionKeys = append(dimensionKeys, key)
+		record[key] = dimensionValue
+	}
+	record["_aws"] = map[string]any{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  AuthMetricNamespace,
+			"Dimensions": [][]string{dimensionKeys},
+			"Metrics":    []emfMetric{{Name: name, Unit: unit}},
+		}},
+	}
+
+	// Marshalling strings and numbers cannot fail; the log package would prefix the line
+	// with a timestamp, which CloudWatch would not parse as a record
+	line, _ := json.Marshal(record)
+	fmt.Fprintln(os.Stdout, string(line))
+}
+
+// recordPoolDiscovery records the latency of a tenant pool and client lookup and whether
+// it was served from the cache
+func recordPoolDiscovery(latency time.Duration, cached bool) {
+	if cached {
+		emitMetric("PoolCacheHit", "Count", 1, nil)
+		return
+	}
+	emitMetric("PoolCacheMiss", "Count", 1, nil)
+	emitMetric("PoolDiscoveryLatency", "Milliseconds", float64(latency.Milliseconds()), nil)
+}
+
+// recordChallenge counts a Cognito challenge returned instead of tokens
+func recordChallenge(challenge types.ChallengeNameType) {
+	emitMetric("AuthChallenge", "Count", 1, map[string]string{"Challenge": string(challenge)})
+}
+
+// recordOutcome counts a login or tenant switch: successes by operation, failures by reason
+func recordOutcome(operation string, err error) {
+	if err != nil {
+		emitMetric("AuthFailure", "Count", 1, map[string]string{"Reason": failureReason(err)})
+		return
+	}
+	emitMetric("AuthSuccess", "Count", 1, map[string]string{"Operation": operation})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// LoadTenantAccessPoints reads TENANT_ACCESS_POINTS, a JSON object mapping tenants to the
+// ARN of their S3 Access Point, e.g. {"acme": "arn:aws:s3:eu-central-1:123456789012:accesspoint/acme"}.
+// Tenants without an entry use the shared bucket directly.
+func LoadTenantAccessPoints() (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_ACCESS_POINTS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var accessPoints map[string]string
+	if err := json.Unmarshal([]byte(raw), &accessPoints); err != nil {
+		return nil, fmt.Errorf("TENANT_ACCESS_POINTS is not a valid JSON object: %w", err)
+	}
+	for tenant, accessPoint := range accessPoints {
+		parsed, err := arn.Parse(accessPoint)
+		if err != nil || parsed.Service != "s3" || parsed.Region == "" || !strings.HasPrefix(parsed.Resource, "accesspoint/") {
+			return nil, fmt.Errorf("TENANT_ACCESS_POINTS tenant %s: not a regional S3 access point ARN: %q", tenant, accessPoint)
+		}
+	}
+	return accessPoints, nil
+}
+
+// LoadTenantMultiRegionAccessPoints reads TENANT_MULTI_REGION_ACCESS_POINTS, a JSON object
+// mapping tenants to the ARN of a Multi-Region Access Point over the bucket and its replicas,
+// e.g. {"acme": "arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap"}
+func LoadTenantMultiRegionAccessPoints() (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_MULTI_REGION_ACCESS_POINTS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var accessPoints map[string]string
+	if err := json.Unmarshal([]byte(raw), &accessPoints); err != nil {
+		return nil, fmt.Errorf("TENANT_MULTI_REGION_ACCESS_POINTS is not a valid JSON object: %w", err)
+	}
+	for tenant, accessPoint := range accessPoints {
+		parsed, err := arn.Parse(accessPoint)
+		if err != nil || parsed.Service != "s3" || parsed.Region != "" || !strings.HasPrefix(parsed.Resource, "accesspoint/") {
+			return nil, fmt.Errorf("TENANT_MULTI_REGION_ACCESS_POINTS tenant %s: not a Multi-Region Access Point ARN: %q", tenant, accessPoint)
+		}
+	}
+	return accessPoints, nil
+}
+
+// bucketFor returns what tenant S3 calls address as their bucket: the sandbox bucket for
+// sandboxed tenants, the tenant's access point ARN when it has one, otherwise the shared
+// bucket. The SDK routes access point ARNs to the access point endpoint, and presigned URLs
+// then point there too, so the access point policy (and its network origin, for VPC-only
+// access points) applies to clients as well.
+func (s *UploadService) bucketFor(tenantID string) string {
+	if s.sandbox.Includes(tenantID) {
+		return s.sandbox.Bucket
+	}
+	if accessPoint, ok := s.accessPts[tenantID]; ok {
+		return accessPoint
+	}
+	return s.bucketName
+}
+
+// presignBucketFor returns what presigned single-object PUTs of a tenant address. The
+// signature scheme follows from it: the SDK signs regional buckets and access points with
+// SigV4, and Multi-Region Access Points with SigV4a over all regions, so the same URL is
+// accepted by whichever region the uploader is routed to. Multipart part URLs always use
+// bucketFor, since every part has to reach the region the upload was created in.
+func (s *UploadService) presignBucketFor(tenantID string) string {
+	if accessPoint, ok := s.mrapArns[tenantID]; ok && !s.sandbox.Includes(tenantID) {
+		return accessPoint
+	}
+	return s.bucketFor(tenantID)
+}
+
+// copySource formats the CopySource of a CopyObject request, URL-encoding each key segment.
+// Objects behind an access point are addressed as <access point ARN>/object/<key>.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	if strings.HasPrefix(bucket, "arn:") {
+		return bucket + "/object/" + strings.Join(segments, "/")
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
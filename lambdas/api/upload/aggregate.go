@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// DefaultAggregateMaxBytes is the buffered size after which a tenant's buffer is written
+	DefaultAggregateMaxBytes = 1024 * 1024
+
+	// MaxAggregateMaxBytes bounds the buffer size, since every aggregating tenant holds one
+	// buffer in the Lambda's memory
+	MaxAggregateMaxBytes = 16 * 1024 * 1024
+
+	// DefaultAggregateMaxAge is how long the oldest buffered record may wait to be written
+	DefaultAggregateMaxAge = time.Minute
+
+	// aggregatorUsername is the session principal of flushes, which carry records of
+	// several callers
+	aggregatorUsername = "upload-aggregator"
+)
+
+// AggregationConfig selects the tenants whose simple uploads are buffered and written
+// together, and when a buffer is written
+type AggregationConfig struct {
+	Tenants  []string // Aggregating tenants; "*" aggregates every tenant
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// LoadAggregationConfig reads UPLOAD_AGGREGATE_TENANTS (comma-separated, "*" for all),
+// UPLOAD_AGGREGATE_MAX_BYTES and UPLOAD_AGGREGATE_MAX_AGE. It returns nil when no tenant
+// aggregates.
+func LoadAggregationConfig() (*AggregationConfig, error) {
+	tenants := envList("UPLOAD_AGGREGATE_TENANTS")
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+
+	maxBytes, err := envInt64("UPLOAD_AGGREGATE_MAX_BYTES", DefaultAggregateMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 || maxBytes > MaxAggregateMaxBytes {
+		return nil, fmt.Errorf("UPLOAD_AGGREGATE_MAX_BYTES must be between 1 and %d", MaxAggregateMaxBytes)
+	}
+	maxAge, err := envDuration("UPLOAD_AGGREGATE_MAX_AGE", DefaultAggregateMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("UPLOAD_AGGREGATE_MAX_AGE must be a positive duration")
+	}
+	return &AggregationConfig{Tenants: tenants, MaxBytes: maxBytes, MaxAge: maxAge}, nil
+}
+
+// aggregateBuffer holds a tenant's records until they are written to one NDJSON object.
+// The key is chosen up front so callers learn where their record will be stored.
+type aggregateBuffer struct {
+	key     string
+	body    bytes.Buffer
+	digest  contentDigest // Digests of body, kept up to date as records are appended
+	records int
+	started time.Time
+}
+
+// RecordAggregator buffers simple uploads per tenant in the Lambda instance's memory and
+// writes each buffer as one object once it is large or old enough, trading durability for
+// far fewer PutObject calls. A frozen instance runs no timers, so the flush extension
+// checks the buffers' age after every invocation and writes them all on shutdown. Records
+// still buffered when the instance crashes are lost. A nil *RecordAggregator aggregates nothing.
+type RecordAggregator struct {
+	service *UploadService
+	config  *AggregationConfig
+
+	mu      sync.Mutex
+	buffers map[string]*aggregateBuffer
+}
+
+// NewRecordAggregator creates an aggregator writing through the service; nil config
+// disables aggregation
+func NewRecordAggregator(service *UploadService, config *AggregationConfig) *RecordAggregator {
+	if config == nil {
+		return nil
+	}
+	return &RecordAggregator{service: service, config: config, buffers: make(map[string]*aggregateBuffer)}
+}
+
+// Enabled reports whether the tenant's simple uploads are aggregated
+func (a *RecordAggregator) Enabled(tenantID string) bool {
+	return a != nil && (slices.Contains(a.config.Tenants, "*") || slices.Contains(a.config.Tenants, tenantID))
+}
+
+// Append buffers one JSON document as a record of the tenant's current buffer and returns
+// the key of the object it will be written to. A full or expired buffer is written first;
+// when that fails the record is refused, so buffered records are never dropped to make room.
+func (a *RecordAggregator) Append(ctx context.Context, tenantID string, document []byte) (string, error) {
+	var record bytes.Buffer
+	if err := json.Compact(&record, document); err != nil {
+		return "", fmt.Errorf("invalid JSON document: %w", err)
+	}
+	record.WriteByte('\n')
+
+	// Writes happen under the lock: an instance serves one request at a time, so only the
+	// shutdown flush ever waits for it
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buffer := a.buffers[tenantID]
+	if buffer != nil && (int64(buffer.body.Len()+record.Len()) > a.config.MaxBytes || time.Since(buffer.started) > a.config.MaxAge) {
+		if err := a.write(ctx, tenantID, buffer); err != nil {
+			return "", err
+		}
+		buffer = nil
+	}
+	if buffer == nil {
+		buffer = &aggregateBuffer{key: generateS3KeyForRecords(tenantID), started: time.Now()}
+		a.buffers[tenantID] = buffer
+	}
+	buffer.body.Write(record.Bytes())
+	buffer.digest.Write(record.Bytes())
+	buffer.records++
+
+	// A buffer filled by this record is written right away; if that fails it stays
+	// buffered and the next append retries
+	if int64(buffer.body.Len()) >= a.config.MaxBytes {
+		if err := a.write(ctx, tenantID, buffer); err != nil {
+			log.Printf("Failed to write full aggregate buffer for tenant %s, keeping it buffered: %v", tenantID, err)
+		}
+	}
+	return buffer.key, nil
+}
+
+// FlushExpired writes the buffers whose oldest record has waited MaxAge
+func (a *RecordAggregator) FlushExpired(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.flush(ctx, func(buffer *aggregateBuffer) bool { return time.Since(buffer.started) > a.config.MaxAge })
+}
+
+// FlushAll writes every buffer, e.g. when the instance shuts down
+func (a *RecordAggregator) FlushAll(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.flush(ctx, func(*aggregateBuffer) bool { return true })
+}
+
+// flush writes the selected buffers; failed ones are kept for the next attempt
+func (a *RecordAggregator) flush(ctx context.Context, selected func(*aggregateBuffer) bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for tenantID, buffer := range a.buffers {
+		if !selected(buffer) {
+			continue
+		}
+		if err := a.write(ctx, tenantID, buffer); err != nil {
+			log.Printf("Failed to write aggregate buffer of %d records for tenant %s: %v", buffer.records, tenantID, err)
+		}
+	}
+}
+
+// write stores a buffer as one NDJSON object and drops it from the buffers. It runs as the
+// aggregator principal rather than as whichever caller triggered it, since the buffer holds
+// records of several callers. Callers hold a.mu.
+func (a *RecordAggregator) write(ctx context.Context, tenantID string, buffer *aggregateBuffer) error {
+	writeCtx := WithUsername(WithTenantID(context.Background(), tenantID), aggregatorUsername)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		writeCtx, cancel = context.WithDeadline(writeCtx, deadline)
+		defer cancel()
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(a.service.bucketFor(tenantID)),
+		Key:         aws.String(buffer.key),
+		Body:        bytes.NewReader(buffer.body.Bytes()),
+		ContentType: aws.String(recordsContentType),
+	}
+	a.service.encryption.ApplyPutObject(input, tenantID)
+	buffer.digest.ApplyPutObject(input)
+
+	if _, err := a.service.s3Clients.Get(tenantID).PutObject(writeCtx, input); err != nil {
+		return fmt.Errorf("failed to write aggregated records: %w", err)
+	}
+	delete(a.buffers, tenantID)
+	log.Printf("Wrote %d aggregated records (%d bytes) for tenant %s to %s", buffer.records, buffer.body.Len(), tenantID, buffer.key)
+	return nil
+}
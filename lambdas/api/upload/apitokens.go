@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-chi/chi/v5"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/render"
+)
+
+const (
+	// APITokenPrefix starts every API token, so the authorizer can tell them from JWTs:
+	// "udt_<token ID>_<secret>"
+	APITokenPrefix = "udt_"
+
+	// DefaultAPITokenTTL is how long a minted API token is valid when not specified
+	DefaultAPITokenTTL = 90 * 24 * time.Hour
+
+	// MaxAPITokenTTL is the longest lifetime a tenant admin can give an API token
+	MaxAPITokenTTL = 365 * 24 * time.Hour
+
+	// apiTokenTenantIndex is the table index listing a tenant's tokens
+	apiTokenTenantIndex = "tenant-index"
+
+	// apiTokenSecretBytes is the amount of randomness in a token's secret
+	apiTokenSecretBytes = 32
+
+	// maxAPITokenNameLength bounds token names, which appear as the token's username
+	maxAPITokenNameLength = 64
+)
+
+// Operations an API token can be scoped to
+const (
+	APITokenOperationUpload   = "upload"   // Simple, record and multipart uploads
+	APITokenOperationDownload = "download" // Object content, receipts and presigned GETs
+	APITokenOperationDelete   = "delete"   // Soft delete and restore
+)
+
+// apiTokenOperations lists the valid operations
+var apiTokenOperations = []string{APITokenOperationUpload, APITokenOperationDownload, APITokenOperationDelete}
+
+var (
+	// ErrAPITokenNotFound is returned when revoking a token the tenant does not have
+	ErrAPITokenNotFound = errors.New("API token not found")
+
+	// ErrTenantAdminRequired is returned when a caller without the admin scope manages API tokens
+	ErrTenantAdminRequired = errors.New("tenant admin scope required")
+
+	// ErrAPITokenScope is returned when an API token is used outside its operations or containers
+	ErrAPITokenScope = errors.New("request is outside the API token's scope")
+)
+
+// APITokenService lets tenant admins mint, list and revoke long-lived API tokens for
+// machine clients such as CI systems. Tokens are stored by ID with the SHA-256 of the
+// whole token, so a table read never reveals a usable token; the authorizer validates
+// them against the same table. Revoking deletes the record, which takes effect once the
+// API Gateway authorizer cache has expired.
+type APITokenService struct {
+	dynamoClient *dynamodb.Client
+	tableName    string
+}
+
+// NewAPITokenService creates an API token service backed by the given table
+func NewAPITokenService(cfg aws.Config, tableName string) *APITokenService {
+	return &APITokenService{
+		dynamoClient: dynamodb.NewFromConfig(cfg),
+		tableName:    tableName,
+	}
+}
+
+// hashAPIToken returns the stored hash of a token
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requireTenantAdmin checks that the caller carries the admin scope, either bare ("admin")
+// or from a resource server ("<resource-server>/admin"), like the authorizer does
+func requireTenantAdmin(ctx context.Context) error {
+	scope, _ := GetScope(ctx)
+	for _, s := range strings.Fields(scope) {
+		if s == "admin" || strings.HasSuffix(s, "/admin") {
+			return nil
+		}
+	}
+	return ErrTenantAdminRequired
+}
+
+// validateCreateAPITokenRequest validates the mint request and returns the token lifetime
+// and its canonical containers
+func validateCreateAPITokenRequest(tenantID string, req *CreateAPITokenRequest) (time.Duration, []string, error) {
+	if tenantID == "" {
+		return 0, nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if req.Name == "" || len(req.Name) > maxAPITokenNameLength {
+		return 0, nil, fmt.Errorf("name must be between 1 and %d characters", maxAPITokenNameLength)
+	}
+	if len(req.Operations) == 0 {
+		return 0, nil, fmt.Errorf("operations cannot be empty")
+	}
+	for _, operation := range req.Operations {
+		if !slices.Contains(apiTokenOperations, operation) {
+			return 0, nil, fmt.Errorf("unknown operation %q, must be one of %s", operation, strings.Join(apiTokenOperations, ", "))
+		}
+	}
+
+	containers := make([]string, 0, len(req.Containers))
+	for _, container := range req.Containers {
+		canonical, err := keyutil.Canonicalize(container)
+		if err != nil {
+			return 0, nil, err
+		}
+		if canonical == TrashPrefix || strings.HasPrefix(canonical, TrashPrefix+"/") {
+			return 0, nil, fmt.Errorf("%w: %s", ErrTrashedObjectKey, container)
+		}
+		containers = append(containers, canonical)
+	}
+	slices.Sort(containers)
+	containers = slices.Compact(containers)
+
+	ttl := DefaultAPITokenTTL
+	if req.ExpiresInDays != 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	if ttl <= 0 || ttl > MaxAPITokenTTL {
+		return 0, nil, fmt.Errorf("expiresInDays must be between 1 and %d", int(MaxAPITokenTTL/(24*time.Hour)))
+	}
+	return ttl, containers, nil
+}
+
+// CreateAPIToken mints an API token. The token is only returned here; the table keeps its hash.
+func (s *APITokenService) CreateAPIToken(ctx context.Context, tenantID, username string, req *CreateAPITokenRequest) (*CreateAPITokenResponse, error) {
+	if err := requireTenantAdmin(ctx); err != nil {
+		return nil, err
+	}
+	ttl, containers, err := validateCreateAPITokenRequest(tenantID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	idBytes := make([]byte, 8)
+	secret := make([]byte, apiTokenSecretBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate token secret: %w", err)
+	}
+	tokenID := hex.EncodeToString(idBytes)
+	token := APITokenPrefix + tokenID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	operations := slices.Clone(req.Operations)
+	slices.Sort(operations)
+	operations = slices.Compact(operations)
+	item := map[string]types.AttributeValue{
+		"token_id":   &types.AttributeValueMemberS{Value: tokenID},
+		"token_hash": &types.AttributeValueMemberS{Value: hashAPIToken(token)},
+		"tenant_id":  &types.AttributeValueMemberS{Value: tenantID},
+		"name":       &types.AttributeValueMemberS{Value: req.Name},
+		"operations": &types.AttributeValueMemberSS{Value: operations},
+		"created_by": &types.AttributeValueMemberS{Value: username},
+		"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+	}
+	if len(containers) > 0 {
+		item["containers"] = &types.AttributeValueMemberSS{Value: containers}
+	}
+	_, err = s.dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(token_id)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store API token: %w", err)
+	}
+
+	log.Printf("AUDIT api token minted: token=%s tenant=%s user=%s name=%q operations=%s containers=%s expires=%s%s",
+		tokenID, tenantID, username, req.Name, strings.Join(operations, ","), strings.Join(containers, ","),
+		expiresAt.UTC().Format(time.RFC3339), clientFields(ctx))
+
+	return &CreateAPITokenResponse{
+		APIToken: APIToken{
+			TokenID:    tokenID,
+			Name:       req.Name,
+			Operations: operations,
+			Containers: containers,
+			CreatedBy:  username,
+			CreatedAt:  now.Unix(),
+			ExpiresAt:  expiresAt.Unix(),
+		},
+		Token: token,
+	}, nil
+}
+
+// ListAPITokens returns the tenant's unexpired API tokens, without their secrets
+func (s *APITokenService) ListAPITokens(ctx context.Context, tenantID string) (*ListAPITokensResponse, error) {
+	if err := requireTenantAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	resp := &ListAPITokensResponse{Tokens: []APIToken{}}
+	now := time.Now().Unix()
+	paginator := dynamodb.NewQueryPaginator(s.dynamoClient, &dynamodb.QueryInput{
+		TableName:              aws.String(s.tableName),
+		IndexName:              aws.String(apiTokenTenantIndex),
+		KeyConditionExpression: aws.String("tenant_id = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list API tokens: %w", err)
+		}
+		for _, item := range page.Items {
+			token := APIToken{
+				TokenID:    stringAttribute(item, "token_id"),
+				Name:       stringAttribute(item, "name"),
+				Operations: stringSetAttribute(item, "operations"),
+				Containers: stringSetAttribute(item, "containers"),
+				CreatedBy:  stringAttribute(item, "created_by"),
+			}
+			token.CreatedAt, _ = strconv.ParseInt(numberAttribute(item, "created_at"), 10, 64)
+			token.ExpiresAt, _ = strconv.ParseInt(numberAttribute(item, "expires_at"), 10, 64)
+			// Expired items linger until the table's TTL deletes them
+			if token.ExpiresAt <= now {
+				continue
+			}
+			resp.Tokens = append(resp.Tokens, token)
+		}
+	}
+	slices.SortFunc(resp.Tokens, func(a, b APIToken) int {
+		return int(a.CreatedAt - b.CreatedAt)
+	})
+	return resp, nil
+}
+
+// RevokeAPIToken deletes one of the tenant's API tokens
+func (s *APITokenService) RevokeAPIToken(ctx context.Context, tenantID, username, tokenID string) error {
+	if err := requireTenantAdmin(ctx); err != nil {
+		return err
+	}
+
+	// The condition keeps tenants from revoking each other's tokens by ID
+	_, err := s.dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"token_id": &types.AttributeValueMemberS{Value: tokenID},
+		},
+		ConditionExpression: aws.String("tenant_id = :tenant"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenant": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return fmt.Errorf("%w: %s", ErrAPITokenNotFound, tokenID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke API token: %w", err)
+	}
+
+	log.Printf("AUDIT api token revoked: token=%s tenant=%s user=%s%s", tokenID, tenantID, username, clientFields(ctx))
+	return nil
+}
+
+// stringSetAttribute reads a string set attribute, nil when absent
+func stringSetAttribute(item map[string]types.AttributeValue, name string) []string {
+	if attr, ok := item[name].(*types.AttributeValueMemberSS); ok {
+		return attr.Value
+	}
+	return nil
+}
+
+// numberAttribute reads a number attribute as its string form, "" when absent
+func numberAttribute(item map[string]types.AttributeValue, name string) string {
+	if attr, ok := item[name].(*types.AttributeValueMemberN); ok {
+		return attr.Value
+	}
+	return ""
+}
+
+// APITokenScope is what the authorizer validated for a request made with an API token
+type APITokenScope struct {
+	TokenID    string
+	Operations []string
+	Containers []string // Folders under the tenant prefix; empty allows the whole prefix
+}
+
+// Allows reports whether the token may perform the operation
+func (s APITokenScope) Allows(operation string) bool {
+	return slices.Contains(s.Operations, operation)
+}
+
+// AllowsKey reports whether the token may address the object key
+func (s APITokenScope) AllowsKey(tenantID, objectKey string) bool {
+	if len(s.Containers) == 0 {
+		return true
+	}
+	for _, container := range s.Containers {
+		if strings.HasPrefix(objectKey, tenantID+"/"+container+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAPITokenKey fails with ErrAPITokenScope when the request's API token may not address
+// the object key; requests with user tokens pass
+func checkAPITokenKey(ctx context.Context, tenantID, objectKey string) error {
+	scope, ok := GetAPITokenScope(ctx)
+	if ok && !scope.AllowsKey(tenantID, objectKey) {
+		return fmt.Errorf("%w: %s", ErrAPITokenScope, objectKey)
+	}
+	return nil
+}
+
+// APITokenOperation rejects requests made with API tokens not scoped to the operation. Routes
+// outside every operation (upload links, delegated credentials, token management) use
+// DenyAPITokens instead.
+func APITokenOperation(operation string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scope, ok := GetAPITokenScope(r.Context()); ok && !scope.Allows(operation) {
+				render.Error(w, r, http.StatusForbidden, "API token does not allow "+operation)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APITokenObjectKey rejects requests made with API tokens for objects outside the token's
+// containers. It serves the /objects/{key} routes; the key's suffix (/content, /receipt)
+// does not change which container it is in.
+func APITokenObjectKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetAPITokenScope(r.Context()); ok {
+			tenantID, _ := GetTenantID(r.Context())
+			objectKey, err := url.PathUnescape(chi.URLParam(r, "*"))
+			if err != nil || checkAPITokenKey(r.Context(), tenantID, objectKey) != nil {
+				render.Error(w, r, http.StatusForbidden, "Object is outside the API token's containers")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APITokenNewUploads rejects requests made with API tokens whose containers do not hold the
+// folder new uploads go to. New objects get generated keys in the day's folder
+// (<tenant>/YYYY/MM/DD/), which the client cannot choose, so a token limited to other
+// containers cannot start uploads; it can still finish those started in its containers.
+func APITokenNewUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetAPITokenScope(r.Context()); ok {
+			tenantID, _ := GetTenantID(r.Context())
+			// Every key generator uses the same day folder, so one generated key stands for all
+			if checkAPITokenKey(r.Context(), tenantID, generateS3Key(tenantID)) != nil {
+				render.Error(w, r, http.StatusForbidden, "New uploads are stored outside the API token's containers")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DenyAPITokens rejects requests made with API tokens, for routes meant for interactive users
+func DenyAPITokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetAPITokenScope(r.Context()); ok {
+			render.Error(w, r, http.StatusForbidden, "Not available to API tokens")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// useTokenService points the /tokens routes at a DynamoDB stub with the given responses
+func useTokenService(t *testing.T, responses map[string]string) *dynamoStub {
+	t.Helper()
+	stub, client := newDynamoStub(t, responses)
+	previous := tokenService
+	tokenService = &APITokenService{dynamoClient: client, tableName: "tokens"}
+	t.Cleanup(func() { tokenService = previous })
+	return stub
+}
+
+func TestLambdaHandlerMintsAPITokenForAdmin(t *testing.T) {
+	stub := useTokenService(t, map[string]string{"PutItem": `{}`})
+
+	req := authorizedRequest(http.MethodPost, "/tokens", `{"name": "ci", "operations": ["upload"]}`, time.Now().Add(time.Hour))
+	req.RequestContext.Authorizer["scope"] = "admin"
+	req.RequestContext.Authorizer["act_as_tenants"] = "tenant-b"
+	resp := handle(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusCreated, resp.Body)
+	}
+	calls := stub.calls()
+	if len(calls) != 1 || calls[0].Operation != "PutItem" {
+		t.Fatalf("DynamoDB calls = %+v, want one PutItem", calls)
+	}
+	item, _ := calls[0].Body["Item"].(map[string]any)
+	if tenant, _ := item["tenant_id"].(map[string]any); tenant["S"] != "tenant-a" {
+		t.Fatalf("token stored for %v, want tenant-a", item["tenant_id"])
+	}
+}
+
+func TestLambdaHandlerRejectsAPITokenRoutesWhileImpersonating(t *testing.T) {
+	stub := useTokenService(t, map[string]string{"PutItem": `{}`, "Query": `{"Items": []}`, "DeleteItem": `{}`})
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: http.MethodPost, path: "/tokens", body: `{"name": "ci", "operations": ["upload"]}`},
+		{method: http.MethodGet, path: "/tokens"},
+		{method: http.MethodDelete, path: "/tokens/0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req := authorizedRequest(tt.method, tt.path, tt.body, time.Now().Add(time.Hour))
+			req.RequestContext.Authorizer["scope"] = "admin"
+			req.RequestContext.Authorizer["act_as_tenants"] = "tenant-b"
+			req.Headers[ActAsTenantHeader] = "tenant-b"
+			// A token minted under impersonation would outlive the admin's grant
+			if resp := handle(t, req); resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, resp.Body)
+			}
+		})
+	}
+	if calls := stub.calls(); len(calls) != 0 {
+		t.Fatalf("DynamoDB calls while impersonating: %+v", calls)
+	}
+}
+
+// useStubbedUploads serves the upload routes from an upload service backed by the AWS stub
+func useStubbedUploads(t *testing.T) *awsStub {
+	t.Helper()
+	// Initialize first, so the lazy initialization does not replace the stubbed service
+	initServices(context.Background())
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	previous := uploadService
+	uploadService = service
+	t.Cleanup(func() { uploadService = previous })
+	return stub
+}
+
+// apiTokenRequest is a request made with an upload API token limited to the containers
+func apiTokenRequest(method, path, body, containers string) events.APIGatewayProxyRequest {
+	req := authorizedRequest(method, path, body, time.Now().Add(time.Hour))
+	req.RequestContext.Authorizer["username"] = "token:ci"
+	req.RequestContext.Authorizer["scope"] = ""
+	req.RequestContext.Authorizer["api_token_id"] = "0123456789abcdef"
+	req.RequestContext.Authorizer["api_token_operations"] = APITokenOperationUpload
+	req.RequestContext.Authorizer["api_token_containers"] = containers
+	return req
+}
+
+func TestLambdaHandlerKeepsUploadsInTokenContainers(t *testing.T) {
+	stub := useStubbedUploads(t)
+
+	const foreignKey = "tenant-a/2024/01/02/upload.raw"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		query  map[string]string
+	}{
+		{name: "simple upload", method: http.MethodPost, path: "/upload", body: `{"a": 1}`},
+		{name: "records", method: http.MethodPost, path: "/upload/records", body: `{"a": 1}`},
+		{name: "initiate", method: http.MethodPost, path: "/upload/initiate", body: `{"size": 10, "partSize": 10}`},
+		{name: "complete", method: http.MethodPost, path: "/upload/complete", body: `{"uploadId": "u1", "objectKey": "` + foreignKey + `", "partETags": [{"partNumber": 1, "eTag": "e"}]}`},
+		{name: "abort", method: http.MethodPost, path: "/upload/abort", body: `{"uploadId": "u1", "objectKey": "` + foreignKey + `"}`},
+		{name: "refresh", method: http.MethodPost, path: "/upload/refresh", body: `{"uploadId": "u1", "objectKey": "` + foreignKey + `", "partNumbers": [1]}`},
+		{name: "revoke", method: http.MethodPost, path: "/upload/revoke", body: `{"uploadId": "u1", "objectKey": "tenant-a/photos/upload.raw", "size": 10, "partSize": 10}`},
+		{name: "events", method: http.MethodGet, path: "/upload/u1/events", query: map[string]string{"objectKey": foreignKey}},
+		{name: "links", method: http.MethodPost, path: "/upload/links", body: `{"folder": "photos"}`},
+		{name: "credentials", method: http.MethodPost, path: "/upload/credentials", body: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := apiTokenRequest(tt.method, tt.path, tt.body, "photos")
+			req.QueryStringParameters = tt.query
+			if resp := handle(t, req); resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, resp.Body)
+			}
+		})
+	}
+	if calls := stub.calls(); len(calls) != 0 {
+		t.Fatalf("S3 calls outside the token's containers: %v", calls)
+	}
+}
+
+func TestLambdaHandlerAllowsUploadsInTokenContainers(t *testing.T) {
+	stub := useStubbedUploads(t)
+
+	// Aborting an upload in the token's container reaches S3
+	resp := handle(t, apiTokenRequest(http.MethodPost, "/upload/abort", `{"uploadId": "u1", "objectKey": "tenant-a/photos/upload.raw"}`, "photos"))
+	if resp.StatusCode == http.StatusForbidden || countCalls(stub.calls(), "AbortMultipartUpload") != 1 {
+		t.Fatalf("abort in the token's container: status %d, S3 calls %v", resp.StatusCode, stub.calls())
+	}
+
+	// New uploads are allowed when a container holds the day's folder
+	year := time.Now().UTC().Format("2006")
+	resp = handle(t, apiTokenRequest(http.MethodPost, "/upload/initiate", `{"size": 10, "partSize": 10}`, "photos,"+year))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("initiate status = %d, want %d: %s", resp.StatusCode, http.StatusOK, resp.Body)
+	}
+	if !strings.Contains(resp.Body, `"objectKey":"tenant-a/`+year+`/`) {
+		t.Fatalf("initiate response = %s", resp.Body)
+	}
+}
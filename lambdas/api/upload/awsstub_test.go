@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// stubSessionKeyID is the access key of the tenant sessions the stub's STS hands out. S3
+// requests signed with any other key are refused, so the stub also checks that the service
+// talks to S3 with tenant credentials only.
+const stubSessionKeyID = "ASIATENANTSESSION"
+
+// awsStub is an in-process stand-in for the STS and S3 APIs the upload service calls:
+// AssumeRole, multipart uploads (create, part upload or copy, complete, abort) and single
+// objects (put, get, head, copy, delete). Requests are path-style, as the SDK sends them
+// to an IP endpoint. It keeps just enough state to check the service's calls the way S3
+// would.
+type awsStub struct {
+	server *httptest.Server
+
+	// copyLimit is the largest object CopyObject accepts, 5 GiB like S3 unless a test
+	// lowers it along with maxCopyObjectSize
+	copyLimit int64
+
+	// failOperation names an S3 operation, e.g. "UploadPartCopy", that fails with a server error
+	failOperation string
+
+	mu          sync.Mutex
+	assumeRoles []url.Values           // AssumeRole parameters, in call order
+	s3Calls     []string               // S3 operations, e.g. "CreateMultipartUpload tenant-a/..."
+	uploads     map[string]*stubUpload // In-progress multipart uploads by upload ID
+	objects     map[string]*stubObject // Stored objects by "<bucket>/<key>"
+	nextID      int
+}
+
+type stubObject struct {
+	body   []byte
+	header http.Header // Content headers, metadata and tagging, as stored
+}
+
+type stubUpload struct {
+	bucket, key string
+	header      http.Header // Headers the completed object gets
+	parts       map[int]stubPart
+}
+
+type stubPart struct {
+	eTag string
+	body []byte
+}
+
+// storedHeaders are the request headers S3 keeps with an object, besides x-amz-meta-*
+var storedHeaders = []string{"Content-Type", "Content-Disposition", "Content-Language", "Cache-Control", "X-Amz-Tagging"}
+
+// objectHeader picks the headers an object is stored with from a request
+func objectHeader(r *http.Request) http.Header {
+	header := make(http.Header)
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			header[name] = values
+		}
+	}
+	for _, name := range storedHeaders {
+		if values, ok := r.Header[name]; ok {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// eTag returns the ETag S3 gives a single-part object or a part
+func eTag(body []byte) string {
+	sum := md5.Sum(body)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
+
+// newAWSStub starts the stub and returns an AWS config pointing every client at it
+func newAWSStub(t *testing.T) (*awsStub, aws.Config) {
+	t.Helper()
+	stub := &awsStub{copyLimit: 5 << 30, uploads: make(map[string]*stubUpload), objects: make(map[string]*stubObject)}
+	stub.server = httptest.NewServer(stub)
+	t.Cleanup(stub.server.Close)
+
+	cfg := aws.Config{
+		Region:       "eu-central-1",
+		BaseEndpoint: aws.String(stub.server.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIALAMBDAROLE", SecretAccessKey: "secret"}, nil
+		}),
+		Retryer: func() aws.Retryer { return aws.NopRetryer{} },
+	}
+	return stub, cfg
+}
+
+// newStubbedUploadService creates an upload service whose STS and S3 calls go to a stub
+func newStubbedUploadService(t *testing.T, opts UploadServiceOptions) (*UploadService, *awsStub) {
+	t.Helper()
+	stub, cfg := newAWSStub(t)
+	return NewUploadService(cfg, "test-bucket", opts), stub
+}
+
+// calls returns the S3 operations received so far
+func (s *awsStub) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.s3Calls...)
+}
+
+// assumedRoles returns the AssumeRole parameters received so far
+func (s *awsStub) assumedRoles() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.assumeRoles...)
+}
+
+// object returns the body of a stored object
+func (s *awsStub) object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return object.body, true
+}
+
+// objectHeader returns the headers a stored object was stored with
+func (s *awsStub) objectHeader(bucket, key string) http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if object, ok := s.objects[bucket+"/"+key]; ok {
+		return object.header.Clone()
+	}
+	return nil
+}
+
+// putObject stores an object as if a client had uploaded it
+func (s *awsStub) putObject(bucket, key string, body []byte, header http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = &stubObject{body: body, header: header}
+}
+
+// upload returns the part ETags of an in-progress multipart upload
+func (s *awsStub) upload(uploadID string) (map[int]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, ok := s.uploads[uploadID]
+	if !ok {
+		return nil, false
+	}
+	parts := make(map[int]string, len(upload.parts))
+	for number, part := range upload.parts {
+		parts[number] = part.eTag
+	}
+	return parts, true
+}
+
+// uploadCount returns how many multipart uploads are in progress
+func (s *awsStub) uploadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *awsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := readPayload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// STS uses the query protocol: a form POST to the root
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		form, _ := url.ParseQuery(string(body))
+		if form.Get("Action") == "AssumeRole" {
+			s.assumeRole(w, form)
+			return
+		}
+	}
+
+	if credential := requestCredential(r); !strings.HasPrefix(credential, stubSessionKeyID+"/") {
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId", "S3 called with "+credential+" instead of a tenant session")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		if s.record(w, "CreateMultipartUpload", key) {
+			return
+		}
+		s.nextID++
+		uploadID := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[uploadID] = &stubUpload{bucket: bucket, key: key, header: objectHeader(r), parts: make(map[int]stubPart)}
+		writeXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadID})
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		upload, ok := s.uploads[query.Get("uploadId")]
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			if s.record(w, "UploadPartCopy", key) {
+				return
+			}
+			if !ok || upload.bucket != bucket || upload.key != key {
+				writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+				return
+			}
+			s.uploadPartCopy(w, r, upload, number)
+			return
+		}
+		if s.record(w, "UploadPart", key) {
+			return
+		}
+		if !ok || upload.bucket != bucket || upload.key != key {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		upload.parts[number] = stubPart{eTag: eTag(body), body: body}
+		w.Header().Set("ETag", upload.parts[number].eTag)
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		if s.record(w, "CompleteMultipartUpload", key) {
+			return
+		}
+		s.complete(w, bucket, key, query.Get("uploadId"), body)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		if s.record(w, "AbortMultipartUpload", key) {
+			return
+		}
+		upload, ok := s.uploads[query.Get("uploadId")]
+		if !ok || upload.bucket != bucket || upload.key != key {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		if s.record(w, "CopyObject", key) {
+			return
+		}
+		s.copyObject(w, r, bucket, key)
+
+	case r.Method == http.MethodPut:
+		if s.record(w, "PutObject", key) {
+			return
+		}
+		s.objects[bucket+"/"+key] = &stubObject{body: body, header: objectHeader(r)}
+		w.Header().Set("ETag", eTag(body))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if r.Method == http.MethodHead {
+			if s.record(w, "HeadObject", key) {
+				return
+			}
+		} else {
+			if s.record(w, "GetObject", key) {
+				return
+			}
+		}
+		object, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			// HEAD responses have no body, so S3 reports the miss by status alone
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		for name, values := range object.header {
+			if name != "X-Amz-Tagging" {
+				w.Header()[name] = values
+			}
+		}
+		w.Header().Set("ETag", eTag(object.body))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.body)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(object.body)
+		}
+
+	case r.Method == http.MethodDelete:
+		if s.record(w, "DeleteObject", key) {
+			return
+		}
+		delete(s.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String()+" is not stubbed")
+	}
+}
+
+// record logs an S3 operation and fails it with a server error if the test asked for
+// that, returning whether it did; callers hold s.mu
+func (s *awsStub) record(w http.ResponseWriter, operation, key string) bool {
+	s.s3Calls = append(s.s3Calls, operation+" "+key)
+	if operation == s.failOperation {
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+		return true
+	}
+	return false
+}
+
+// assumeRole issues session credentials for the requested duration
+func (s *awsStub) assumeRole(w http.ResponseWriter, form url.Values) {
+	s.mu.Lock()
+	s.assumeRoles = append(s.assumeRoles, form)
+	s.mu.Unlock()
+
+	duration, _ := strconv.Atoi(form.Get("DurationSeconds"))
+	if duration == 0 {
+		duration = 3600
+	}
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	type result struct {
+		Credentials credentials
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName          xml.Name `xml:"https://sts.amazonaws.com/doc/2011-06-15/ AssumeRoleResponse"`
+		AssumeRoleResult result
+	}{AssumeRoleResult: result{Credentials: credentials{
+		AccessKeyId:     stubSessionKeyID,
+		SecretAccessKey: "session-secret",
+		SessionToken:    "session-token",
+		Expiration:      time.Now().Add(time.Duration(duration) * time.Second).UTC().Format(time.RFC3339),
+	}}})
+}
+
+// complete assembles a multipart upload, rejecting part lists S3 would reject; callers hold s.mu
+func (s *awsStub) complete(w http.ResponseWriter, bucket, key, uploadID string, body []byte) {
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.bucket != bucket || upload.key != key {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+	var object bytes.Buffer
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+			return
+		}
+		stored, ok := upload.parts[part.PartNumber]
+		if !ok || stored.eTag != part.ETag {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d could not be found", part.PartNumber))
+			return
+		}
+		object.Write(stored.body)
+	}
+	delete(s.uploads, uploadID)
+	s.objects[bucket+"/"+key] = &stubObject{body: object.Bytes(), header: upload.header}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Location: s.server.URL + "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, md5.Sum(object.Bytes()), len(request.Parts)),
+	})
+}
+
+// copySourceObject resolves the X-Amz-Copy-Source of a copy request and checks its
+// X-Amz-Copy-Source-If-Match precondition; callers hold s.mu
+func (s *awsStub) copySourceObject(w http.ResponseWriter, r *http.Request) (*stubObject, bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+		return nil, false
+	}
+	object, ok := s.objects[strings.TrimPrefix(source, "/")]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return nil, false
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != eTag(object.body) {
+		writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return nil, false
+	}
+	return object, true
+}
+
+// copyObject copies an object of up to copyLimit bytes, keeping its headers and
+// replacing the tags if asked to; callers hold s.mu
+func (s *awsStub) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	source, ok := s.copySourceObject(w, r)
+	if !ok {
+		return
+	}
+	if int64(len(source.body)) > s.copyLimit {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "The specified copy source is larger than the maximum allowable size for a copy source")
+		return
+	}
+	header := source.header.Clone()
+	if r.Header.Get("X-Amz-Tagging-Directive") == "REPLACE" {
+		header.Set("X-Amz-Tagging", r.Header.Get("X-Amz-Tagging"))
+	}
+	s.objects[bucket+"/"+key] = &stubObject{body: source.body, header: header}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string
+	}{ETag: eTag(source.body)})
+}
+
+// uploadPartCopy copies a byte range of an object into a part; callers hold s.mu
+func (s *awsStub) uploadPartCopy(w http.ResponseWriter, r *http.Request, upload *stubUpload, number int) {
+	source, ok := s.copySourceObject(w, r)
+	if !ok {
+		return
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(source.body) {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "The x-amz-copy-source-range value must be of the form bytes=first-last where first and last are the zero-based offsets of the first and last bytes to copy")
+		return
+	}
+	body := source.body[start : end+1]
+	upload.parts[number] = stubPart{eTag: eTag(body), body: body}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CopyPartResult"`
+		ETag    string
+	}{ETag: upload.parts[number].eTag})
+}
+
+// requestCredential returns the access key and scope a request was signed with, from the
+// Authorization header or the query of a presigned URL
+func requestCredential(r *http.Request) string {
+	if credential := r.URL.Query().Get("X-Amz-Credential"); credential != "" {
+		return credential
+	}
+	_, credential, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+	credential, _, _ = strings.Cut(credential, ",")
+	return credential
+}
+
+// readPayload reads a request body, removing the aws-chunked framing the SDK uses to send
+// trailing checksums
+func readPayload(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return body, err
+	}
+	var payload bytes.Buffer
+	reader := bufio.NewReader(bytes.NewReader(body))
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("truncated aws-chunked body: %w", err)
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk size %q", sizeField)
+		}
+		if size == 0 {
+			return payload.Bytes(), nil // Trailers follow
+		}
+		if _, err := io.CopyN(&payload, reader, size); err != nil {
+			return nil, fmt.Errorf("truncated aws-chunked chunk: %w", err)
+		}
+		reader.ReadString('\n')
+	}
+}
+
+func writeXML(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(body)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
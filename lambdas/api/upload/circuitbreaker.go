@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig controls when a circuit breaker opens
+type CircuitBreakerConfig struct {
+	Failures int64         // Failures within Window that open the breaker; 0 disables it
+	Window   time.Duration // Sliding window for counting failures
+	Cooldown time.Duration // How long the breaker stays open before letting a probe through
+}
+
+// LoadSTSBreakerConfig reads the STS circuit breaker settings from environment variables
+func LoadSTSBreakerConfig() (CircuitBreakerConfig, error) {
+	var cfg CircuitBreakerConfig
+	var err error
+	if cfg.Failures, err = envInt64("STS_BREAKER_FAILURES", 5); err != nil {
+		return cfg, err
+	}
+	if cfg.Window, err = envDuration("STS_BREAKER_WINDOW", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Cooldown, err = envDuration("STS_BREAKER_COOLDOWN", 30*time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Failures < 0 || cfg.Window <= 0 || cfg.Cooldown <= 0 {
+		return cfg, fmt.Errorf("STS breaker needs non-negative failures and positive window and cooldown")
+	}
+	return cfg, nil
+}
+
+// CircuitOpenError is returned while a circuit breaker is rejecting calls
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s unavailable: circuit open, retry after %s", e.Name, e.RetryAfter)
+}
+
+// CircuitBreaker fails fast once a dependency keeps failing. It opens after the configured
+// number of failures within the window, rejects calls for the cooldown, then lets a single
+// probe through: success closes it, failure opens it for another cooldown.
+type CircuitBreaker struct {
+	name   string
+	config CircuitBreakerConfig
+
+	mu        sync.Mutex
+	failures  []time.Time // Failure times within the window, oldest first
+	openUntil time.Time   // Zero while closed
+	probing   bool        // A half-open probe is in flight
+}
+
+// NewCircuitBreaker creates a closed circuit breaker; it returns nil when disabled
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	if config.Failures == 0 {
+		return nil
+	}
+	return &CircuitBreaker{name: name, config: config}
+}
+
+// Allow reports whether a call may proceed, returning a CircuitOpenError otherwise.
+// A nil breaker allows everything.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return &CircuitOpenError{Name: b.name, RetryAfter: b.openUntil.Sub(now)}
+	}
+	if b.probing {
+		return &CircuitOpenError{Name: b.name, RetryAfter: b.config.Cooldown}
+	}
+	// Half-open: let one call through to test the dependency
+	b.probing = true
+	return nil
+}
+
+// Record feeds the outcome of an allowed call back into the breaker.
+// Cancellations are the caller's doing and are not counted against the dependency.
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		// Only the probe decides; stragglers admitted before the breaker opened do not
+		if b.probing {
+			log.Printf("Circuit breaker %s closed", b.name)
+			b.probing = false
+			b.openUntil = time.Time{}
+			b.failures = b.failures[:0]
+		}
+		return
+	}
+
+	if b.probing {
+		// The probe failed: stay open for another cooldown
+		b.probing = false
+		b.openUntil = now.Add(b.config.Cooldown)
+		log.Printf("Circuit breaker %s probe failed, open for another %s: %v", b.name, b.config.Cooldown, err)
+		return
+	}
+
+	// Drop failures that fell out of the window, then count this one
+	cutoff := now.Add(-b.config.Window)
+	kept := b.failures[:0]
+	for _, t := range b.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.failures = append(kept, now)
+
+	if int64(len(b.failures)) >= b.config.Failures && b.openUntil.IsZero() {
+		b.openUntil = now.Add(b.config.Cooldown)
+		b.failures = b.failures[:0]
+		log.Printf("Circuit breaker %s opened for %s after %d failures within %s: %v",
+			b.name, b.config.Cooldown, b.config.Failures, b.config.Window, err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	// ClientNameHeader names the calling application, e.g. "upload-cli"; the SDKs and tools
+	// set it, other callers are asked to
+	ClientNameHeader = "X-Client-Name"
+
+	// ClientVersionHeader carries the calling application's version, e.g. "2.3.1"
+	ClientVersionHeader = "X-Client-Version"
+
+	// Client names and versions longer than these are cut, to keep log lines and metric
+	// dimensions short
+	maxClientNameLength    = 32
+	maxClientVersionLength = 16
+)
+
+// ClientInfo identifies the application making a request, from ClientNameHeader and
+// ClientVersionHeader or, when the caller does not send them, its User-Agent product
+type ClientInfo struct {
+	Name     string // Empty when unknown
+	Version  string // Empty when unknown
+	Declared bool   // Name came from ClientNameHeader rather than the User-Agent
+}
+
+// String formats the client for log lines, e.g. `client=upload-cli/2.3.1`
+func (c ClientInfo) String() string {
+	switch {
+	case c.Name == "":
+		return "client=-"
+	case c.Version == "":
+		return "client=" + c.Name
+	}
+	return "client=" + c.Name + "/" + c.Version
+}
+
+// clientInfo identifies the client of r
+func clientInfo(r *http.Request) ClientInfo {
+	if name := sanitizeClientToken(r.Header.Get(ClientNameHeader), maxClientNameLength); name != "" {
+		return ClientInfo{
+			Name:     name,
+			Version:  sanitizeClientToken(r.Header.Get(ClientVersionHeader), maxClientVersionLength),
+			Declared: true,
+		}
+	}
+	// The first User-Agent product, e.g. "curl/8.5.0" or "Mozilla/5.0"
+	product, _, _ := strings.Cut(r.UserAgent(), " ")
+	name, version, _ := strings.Cut(product, "/")
+	return ClientInfo{
+		Name:    sanitizeClientToken(name, maxClientNameLength),
+		Version: sanitizeClientToken(version, maxClientVersionLength),
+	}
+}
+
+// sanitizeClientToken lowercases a client name or version and maps it onto [a-z0-9._+-],
+// returning "" when nothing usable remains. The values end up in metric dimensions, so
+// they are kept to a small alphabet.
+func sanitizeClientToken(value string, maxLength int) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(value)) {
+		if b.Len() == maxLength {
+			break
+		}
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("._+-", r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	if strings.Trim(b.String(), "_") == "" {
+		return ""
+	}
+	return b.String()
+}
+
+// ClientIdentification stores the request's ClientInfo in the context for log lines, metrics
+// and the audit trail, and counts requests and server errors per client and version in the
+// ClientRequests and ClientErrors metrics
+func ClientIdentification(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientInfo(r)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(WithClient(r.Context(), client)))
+
+		dimensions := map[string]string{
+			"Client":        clientDimension(client.Name),
+			"ClientVersion": clientDimension(client.Version),
+		}
+		emitMetric("ClientRequests", "Count", 1, dimensions)
+		if status := ww.Status(); status >= http.StatusInternalServerError {
+			dimensions["Status"] = strconv.Itoa(status)
+			emitMetric("ClientErrors", "Count", 1, dimensions)
+		}
+	})
+}
+
+// clientDimension names unknown clients and versions in metrics
+func clientDimension(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// clientFields returns the client fields for audit log lines
+func clientFields(ctx context.Context) string {
+	client, _ := GetClient(ctx)
+	return " " + client.String()
+}
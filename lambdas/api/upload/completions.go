@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PendingCompletionRetention is how long a pending completion record is kept for the retry worker
+const PendingCompletionRetention = 7 * 24 * time.Hour
+
+// CompletionStore records multipart completions in flight. A record is written before
+// CompleteMultipartUpload and removed once the outcome is final, so an upload whose
+// completion was cut short (Lambda timeout, S3 errors) is left for the completion
+// retry worker instead of being stuck until the bucket's lifecycle rule aborts it.
+type CompletionStore struct {
+	dynamoClient *dynamodb.Client
+	tableName    string
+}
+
+// NewCompletionStore creates a completion store backed by the given table
+func NewCompletionStore(cfg aws.Config, tableName string) *CompletionStore {
+	return &CompletionStore{
+		dynamoClient: dynamodb.NewFromConfig(cfg),
+		tableName:    tableName,
+	}
+}
+
+// Put records a completion about to be attempted, including the part list needed to retry it
+// and the bucket (or access point) the upload was created in, since that differs per tenant
+func (s *CompletionStore) Put(ctx context.Context, tenantID, bucket string, session TenantSession, req *CompleteUploadRequest) error {
+	parts, err := json.Marshal(req.PartETags)
+	if err != nil {
+		return fmt.Errorf("failed to encode parts: %w", err)
+	}
+
+	now := time.Now()
+	item := map[string]types.AttributeValue{
+		"upload_id":  &types.AttributeValueMemberS{Value: req.UploadID},
+		"tenant_id":  &types.AttributeValueMemberS{Value: tenantID},
+		"object_key": &types.AttributeValueMemberS{Value: req.ObjectKey},
+		"bucket":     &types.AttributeValueMemberS{Value: bucket},
+		"parts":      &types.AttributeValueMemberS{Value: string(parts)},
+		"attempts":   &types.AttributeValueMemberN{Value: "0"},
+		"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(PendingCompletionRetention).Unix(), 10)},
+	}
+	// Keep the requesting identity so retried completions are tagged and attributed like the original
+	if session.Username != "" {
+		item["username"] = &types.AttributeValueMemberS{Value: session.Username}
+	}
+	if session.Scope != "" {
+		item["scope"] = &types.AttributeValueMemberS{Value: session.Scope}
+	}
+	if session.AdminOverride {
+		item["admin_override"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+
+	_, err = s.dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record pending completion: %w", err)
+	}
+	return nil
+}
+
+// PendingCompletion is the part of a pending completion record shown in upload timelines
+type PendingCompletion struct {
+	TenantID  string
+	CreatedAt time.Time
+	Attempts  int // Retries made by the completion retry worker
+}
+
+// Get returns the pending completion of an upload, or nil when there is none
+func (s *CompletionStore) Get(ctx context.Context, uploadID string) (*PendingCompletion, error) {
+	output, err := s.dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"upload_id": &types.AttributeValueMemberS{Value: uploadID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pending completion: %w", err)
+	}
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	pending := &PendingCompletion{}
+	if v, ok := output.Item["tenant_id"].(*types.AttributeValueMemberS); ok {
+		pending.TenantID = v.Value
+	}
+	if v, ok := output.Item["created_at"].(*types.AttributeValueMemberN); ok {
+		createdAt, _ := strconv.ParseInt(v.Value, 10, 64)
+		pending.CreatedAt = time.Unix(createdAt, 0)
+	}
+	if v, ok := output.Item["attempts"].(*types.AttributeValueMemberN); ok {
+		pending.Attempts, _ = strconv.Atoi(v.Value)
+	}
+	return pending, nil
+}
+
+// Delete removes the record once the completion succeeded or can never succeed
+func (s *CompletionStore) Delete(ctx context.Context, uploadID string) error {
+	_, err := s.dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"upload_id": &types.AttributeValueMemberS{Value: uploadID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to clear pending completion: %w", err)
+	}
+	return nil
+}
+
+// isRetryableCompletionError reports whether a failed completion is worth retrying later:
+// timeouts, throttling and server errors are; client errors such as InvalidPart are not
+func isRetryableCompletionError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPresignConcurrency is how many presigned URLs an instance generates at once.
+	// A multipart upload needs up to MaxUploadParts, so a few large initiates fit side by side.
+	DefaultPresignConcurrency = 20000
+
+	// DefaultAssumeConcurrency is how many AssumeRole calls an instance makes at once
+	DefaultAssumeConcurrency = 10
+
+	// DefaultConcurrencyQueueTimeout is how long a request waits for capacity before it is
+	// rejected with 503
+	DefaultConcurrencyQueueTimeout = 2 * time.Second
+)
+
+// ConcurrencyConfig bounds the expensive operations a Lambda instance runs at once
+type ConcurrencyConfig struct {
+	PresignLimit int64         // Presigned URLs generated at once; 0 disables the limit
+	AssumeLimit  int64         // AssumeRole calls in flight; 0 disables the limit
+	QueueTimeout time.Duration // Longest wait for capacity before rejecting
+}
+
+// LoadConcurrencyConfig reads the concurrency limits from environment variables
+func LoadConcurrencyConfig() (ConcurrencyConfig, error) {
+	var cfg ConcurrencyConfig
+	var err error
+	if cfg.PresignLimit, err = envInt64("PRESIGN_CONCURRENCY_LIMIT", DefaultPresignConcurrency); err != nil {
+		return cfg, err
+	}
+	if cfg.AssumeLimit, err = envInt64("ASSUME_CONCURRENCY_LIMIT", DefaultAssumeConcurrency); err != nil {
+		return cfg, err
+	}
+	if cfg.QueueTimeout, err = envDuration("CONCURRENCY_QUEUE_TIMEOUT", DefaultConcurrencyQueueTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.PresignLimit < 0 || cfg.AssumeLimit < 0 || cfg.QueueTimeout < 0 {
+		return cfg, fmt.Errorf("concurrency limits and queue timeout must not be negative")
+	}
+	return cfg, nil
+}
+
+// OverloadedError is returned when a request waited for capacity longer than the queue timeout
+type OverloadedError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("%s capacity exhausted, retry after %s", e.Name, e.RetryAfter)
+}
+
+// concurrencyWaiter is a request queued for capacity
+type concurrencyWaiter struct {
+	weight int64
+	ready  chan struct{} // Closed once the capacity is granted
+}
+
+// ConcurrencyLimiter is a weighted semaphore with a FIFO queue. Requests take as many units
+// as the work they do (URLs to sign, calls to make) and wait in order for capacity, so a burst
+// of large requests queues instead of generating everything at once, and a large request is
+// not starved by a stream of small ones. A request larger than the limit runs alone.
+type ConcurrencyLimiter struct {
+	name    string
+	limit   int64
+	timeout time.Duration
+
+	mu      sync.Mutex
+	used    int64
+	waiters list.List // *concurrencyWaiter, oldest first
+}
+
+// NewConcurrencyLimiter creates a limiter of the given capacity; it returns nil when limit is 0
+func NewConcurrencyLimiter(name string, limit int64, timeout time.Duration) *ConcurrencyLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &ConcurrencyLimiter{name: name, limit: limit, timeout: timeout}
+}
+
+// Acquire waits for weight units of capacity and returns the function giving them back.
+// It returns an OverloadedError once the queue timeout passes, or the context's error.
+// A nil limiter grants everything at once.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, weight int64) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	weight = min(max(weight, 1), l.limit)
+	start := time.Now()
+
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && l.used+weight <= l.limit {
+		l.used += weight
+		l.emitSaturation()
+		l.mu.Unlock()
+		return l.releaser(weight), nil
+	}
+	waiter := &concurrencyWaiter{weight: weight, ready: make(chan struct{})}
+	element := l.waiters.PushBack(waiter)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-waiter.ready:
+		l.emitWait(time.Since(start))
+		return l.releaser(weight), nil
+	case <-timer.C:
+		err = &OverloadedError{Name: l.name, RetryAfter: max(l.timeout, time.Second)}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	select {
+	case <-waiter.ready:
+		// Granted while giving up: hand the capacity on
+		l.used -= weight
+	default:
+		l.waiters.Remove(element)
+	}
+	// Leaving the head of the queue may let smaller requests behind it through
+	l.grant()
+	l.mu.Unlock()
+
+	emitMetric("ConcurrencyRejected", "Count", 1, map[string]string{"Limiter": l.name})
+	return nil, err
+}
+
+// releaser returns a function giving weight units back, safe to call more than once
+func (l *ConcurrencyLimiter) releaser(weight int64) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.used -= weight
+			l.grant()
+			l.mu.Unlock()
+		})
+	}
+}
+
+// grant admits queued requests in order while capacity lasts; l.mu must be held
+func (l *ConcurrencyLimiter) grant() {
+	granted := false
+	for element := l.waiters.Front(); element != nil; element = l.waiters.Front() {
+		waiter := element.Value.(*concurrencyWaiter)
+		if l.used+waiter.weight > l.limit {
+			break
+		}
+		l.used += waiter.weight
+		l.waiters.Remove(element)
+		close(waiter.ready)
+		granted = true
+	}
+	if granted {
+		l.emitSaturation()
+	}
+}
+
+// emitSaturation records the share of capacity in use; l.mu must be held
+func (l *ConcurrencyLimiter) emitSaturation() {
+	emitMetric("ConcurrencySaturation", "Percent", float64(l.used)*100/float64(l.limit),
+		map[string]string{"Limiter": l.name})
+}
+
+// emitWait records how long an admitted request queued
+func (l *ConcurrencyLimiter) emitWait(wait time.Duration) {
+	emitMetric("ConcurrencyWait", "Milliseconds", float64(wait.Milliseconds()),
+		map[string]string{"Limiter": l.name})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// unsafeContentTypes are the media types browsers render as active content, so an uploaded
+// object served with one of them can run script in the origin it is served from
+var unsafeContentTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+}
+
+// ContentPolicy decides how a tenant's objects are served to browsers
+type ContentPolicy struct {
+	ForceAttachment    bool `json:"force_attachment"`     // Always send Content-Disposition: attachment
+	RewriteUnsafeTypes bool `json:"rewrite_unsafe_types"` // Serve HTML, SVG, XML and script as text/plain
+}
+
+// ContentPolicies holds the default content policy and per-tenant overrides. A nil
+// *ContentPolicies is valid and serves every object as stored.
+type ContentPolicies struct {
+	Default ContentPolicy
+	Tenants map[string]ContentPolicy
+}
+
+// LoadContentPolicies reads TENANT_CONTENT_POLICIES, a JSON object mapping tenants (or "*"
+// for the default) to policies, e.g. {"*": {"rewrite_unsafe_types": true}, "acme": {"force_attachment": true}}.
+// Fields left out keep the default's value. It returns nil when the variable is unset.
+func LoadContentPolicies() (*ContentPolicies, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_CONTENT_POLICIES"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("TENANT_CONTENT_POLICIES is not a valid JSON object: %w", err)
+	}
+	policies := &ContentPolicies{Tenants: map[string]ContentPolicy{}}
+	if entry, ok := entries["*"]; ok {
+		if err := json.Unmarshal(entry, &policies.Default); err != nil {
+			return nil, fmt.Errorf("TENANT_CONTENT_POLICIES default: %w", err)
+		}
+	}
+	for tenant, entry := range entries {
+		if tenant == "*" {
+			continue
+		}
+		policy := policies.Default
+		if err := json.Unmarshal(entry, &policy); err != nil {
+			return nil, fmt.Errorf("TENANT_CONTENT_POLICIES tenant %s: %w", tenant, err)
+		}
+		policies.Tenants[tenant] = policy
+	}
+	return policies, nil
+}
+
+// For returns the content policy of a tenant
+func (c *ContentPolicies) For(tenantID string) ContentPolicy {
+	if c == nil {
+		return ContentPolicy{}
+	}
+	if policy, ok := c.Tenants[tenantID]; ok {
+		return policy
+	}
+	return c.Default
+}
+
+// Headers returns the Content-Type and Content-Disposition to serve an object with. The
+// disposition is empty unless attachments are forced.
+func (p ContentPolicy) Headers(objectKey, contentType string) (string, string) {
+	if p.RewriteUnsafeTypes {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		switch {
+		case err != nil:
+			// Browsers sniff what they cannot parse, so unparsable types are not served as is
+			contentType = "application/octet-stream"
+		case unsafeContentTypes[mediaType]:
+			contentType = "text/plain"
+			if charset := params["charset"]; charset != "" {
+				contentType = mime.FormatMediaType("text/plain", map[string]string{"charset": charset})
+			}
+		}
+	}
+
+	var disposition string
+	if p.ForceAttachment {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(objectKey)})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+	}
+	return contentType, disposition
+}
+
+// ApplyGetObject sets the response header overrides of a presigned GET, so S3 itself serves
+// the object according to the policy
+func (p ContentPolicy) ApplyGetObject(input *s3.GetObjectInput, contentType string) {
+	servedType, disposition := p.Headers(aws.ToString(input.Key), contentType)
+	if servedType != contentType {
+		input.ResponseContentType = aws.String(servedType)
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+}
+
+// ApplyGetObjectByKey is ApplyGetObject for objects whose stored type was not read, as in
+// batch presigning. With unsafe types rewritten, the type is derived from the key's extension
+// and always overrides the stored one, so an HTML object stored under a .png key is served
+// as an image rather than as HTML.
+func (p ContentPolicy) ApplyGetObjectByKey(input *s3.GetObjectInput) {
+	key := aws.ToString(input.Key)
+	servedType, disposition := p.Headers(key, mime.TypeByExtension(path.Ext(key)))
+	if p.RewriteUnsafeTypes {
+		input.ResponseContentType = aws.String(servedType)
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/sessiontags"
+)
+
+const (
+	// MinCredentialValidity is the minimum remaining lifetime for credentials used by
+	// short server-side operations (PutObject, CompleteMultipartUpload, AbortMultipartUpload)
+	MinCredentialValidity = 5 * time.Minute
+
+	// CredentialRefreshInterval is how often the background refresher checks cached credentials
+	CredentialRefreshInterval = 1 * time.Minute
+
+	// CredentialActiveWindow is how recently a tenant must have made a request for its
+	// credentials to be renewed proactively
+	CredentialActiveWindow = 15 * time.Minute
+)
+
+// ErrMissingSourceIdentity is returned when SourceIdentity is mandatory but the request has no usable username
+var ErrMissingSourceIdentity = errors.New("username required for source identity")
+
+// cachedCredentials holds assumed-role credentials for a single tenant
+type cachedCredentials struct {
+	creds      aws.Credentials
+	lastActive time.Time
+}
+
+// TenantCredentialCache caches assumed-role credentials per tenant session (tenant plus the
+// user, scope and impersonation tags) within a Lambda instance.
+// Credentials are always assumed for the tenant's full session length (LongSessionDuration
+// unless configured) so one set serves both short operations and presigning. A background refresher renews credentials of recently active
+// tenants before they expire, keeping AssumeRole off the request path for steady traffic.
+// Note that Lambda freezes the instance between invocations, so the refresher only runs
+// while the instance is thawed; requests still fall back to a synchronous AssumeRole.
+type TenantCredentialCache struct {
+	stsClient             STSAssumer
+	roleArn               string
+	requireSourceIdentity bool                // Refuse sessions that cannot carry a SourceIdentity
+	breaker               *CircuitBreaker     // Fails fast while STS is throttling or erroring; nil disables
+	sessions              *SessionConfig      // Per-tenant session lengths; nil applies the defaults
+	assuming              *ConcurrencyLimiter // Bounds the AssumeRole calls in flight; nil is unbounded
+
+	mu      sync.Mutex
+	entries map[TenantSession]*cachedCredentials
+}
+
+// NewTenantCredentialCache creates an empty credential cache
+func NewTenantCredentialCache(stsClient STSAssumer, roleArn string, opts UploadServiceOptions) *TenantCredentialCache {
+	return &TenantCredentialCache{
+		stsClient:             stsClient,
+		roleArn:               roleArn,
+		requireSourceIdentity: opts.RequireSourceIdentity,
+		breaker:               NewCircuitBreaker("sts", opts.STSBreaker),
+		sessions:              opts.SessionSettings,
+		assuming:              NewConcurrencyLimiter("assume", opts.Concurrency.AssumeLimit, opts.Concurrency.QueueTimeout),
+		entries:               make(map[TenantSession]*cachedCredentials),
+	}
+}
+
+// Get returns credentials for the tenant that remain valid for at least minValidity,
+// assuming the role only when no suitable cached credentials exist. Credentials are cached
+// per session identity (user, scope, impersonation) taken from ctx, since each carries its own tags.
+func (c *TenantCredentialCache) Get(ctx context.Context, tenantID string, minValidity time.Duration) (aws.Credentials, error) {
+	// Credentials can never outlive the session, so cap the requirement to what STS can issue
+	maxValidity := c.sessions.For(tenantID).MaxCredentialValidity()
+	if minValidity > maxValidity {
+		minValidity = maxValidity
+	}
+
+	key := TenantSessionFromContext(ctx, tenantID)
+	if c.requireSourceIdentity && sessiontags.SourceIdentity(key.Username) == "" {
+		return aws.Credentials{}, ErrMissingSourceIdentity
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		entry.lastActive = now
+		if entry.creds.Expires.Sub(now) >= minValidity {
+			creds := entry.creds
+			c.mu.Unlock()
+			return creds, nil
+		}
+	}
+	var stale aws.Credentials
+	if ok {
+		stale = entry.creds
+	}
+	c.mu.Unlock()
+
+	creds, err := c.assume(ctx, key, now)
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) && stale.Expires.Sub(now) >= MinCredentialValidity {
+		// STS is unhealthy: cached credentials that are still usable beat failing the request,
+		// even if they expire before presigned URLs would
+		log.Printf("STS circuit open, serving cached credentials for tenant %s expiring in %s",
+			tenantID, stale.Expires.Sub(now).Round(time.Second))
+		return stale, nil
+	}
+	return creds, err
+}
+
+// assume calls STS and stores the resulting credentials in the cache
+func (c *TenantCredentialCache) assume(ctx context.Context, key TenantSession, lastActive time.Time) (aws.Credentials, error) {
+	release, err := c.assuming.Acquire(ctx, 1)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	defer release()
+	if err := c.breaker.Allow(); err != nil {
+		return aws.Credentials{}, err
+	}
+	session := c.sessions.For(key.TenantID).Session
+	creds, err := AssumeRoleForTenant(ctx, c.stsClient, c.roleArn, key, int32(session/time.Second))
+	c.breaker.Record(err)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && entry.lastActive.After(lastActive) {
+		lastActive = entry.lastActive
+	}
+	c.entries[key] = &cachedCredentials{creds: creds, lastActive: lastActive}
+	c.mu.Unlock()
+
+	return creds, nil
+}
+
+// Delegate assumes the role for a session handed out to a client, going through the AssumeRole
+// limit and STS circuit breaker but bypassing the cache: the credentials are never reused by the service
+func (c *TenantCredentialCache) Delegate(ctx context.Context, session TenantSession, duration time.Duration) (aws.Credentials, error) {
+	release, err := c.assuming.Acquire(ctx, 1)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	defer release()
+	if err := c.breaker.Allow(); err != nil {
+		return aws.Credentials{}, err
+	}
+	creds, err := AssumeRoleForTenant(ctx, c.stsClient, c.roleArn, session, int32(duration/time.Second))
+	c.breaker.Record(err)
+	return creds, err
+}
+
+// RunRefresher periodically renews credentials of recently active tenants until ctx is done
+func (c *TenantCredentialCache) RunRefresher(ctx context.Context) {
+	ticker := time.NewTicker(CredentialRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh(ctx)
+		}
+	}
+}
+
+// refresh renews expiring credentials for active tenants and evicts idle, expired entries
+func (c *TenantCredentialCache) refresh(ctx context.Context) {
+	now := time.Now()
+	due := make(map[TenantSession]time.Time)
+
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		active := now.Sub(entry.lastActive) <= CredentialActiveWindow
+		remaining := entry.creds.Expires.Sub(now)
+		switch {
+		case active && remaining < c.sessions.For(key.TenantID).RefreshThreshold():
+			due[key] = entry.lastActive
+		case !active && remaining <= 0:
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for key, lastActive := range due {
+		if _, err := c.assume(ctx, key, lastActive); err != nil {
+			log.Printf("Failed to pre-warm credentials for tenant %s: %v", key.TenantID, err)
+			continue
+		}
+		log.Printf("Pre-warmed credentials for tenant %s", key.TenantID)
+	}
+}
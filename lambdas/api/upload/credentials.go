@@ -7,7 +7,7 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/sessiontags"
 )
 
 // TenantInfo is a key type for storing tenant information in context
@@ -16,12 +16,87 @@ type TenantInfo string
 // TokenExpiration is a key type for storing token expiration in context
 type TokenExpiration string
 
+// Username is a key type for storing the authenticated username in context
+type Username string
+
+// Scope is a key type for storing the token scopes in context
+type Scope string
+
+// Impersonation is a key type for storing admin impersonation state in context
+type Impersonation string
+
+// SourceIP is a key type for storing the client source IP in context
+type SourceIP string
+
+// GeoKey is a key type for storing the caller's geo enrichment in context
+type GeoKey string
+
+// ClientCertKey is a key type for storing the mTLS client certificate in context
+type ClientCertKey string
+
+// SessionPolicyKey is a key type for storing an inline session policy in context
+type SessionPolicyKey string
+
+// RequestIDKey is a key type for storing the API Gateway request ID in context
+type RequestIDKey string
+
+// ClientKey is a key type for storing the calling application in context
+type ClientKey string
+
+// APITokenKey is a key type for storing the scope of an API token in context
+type APITokenKey string
+
 // ContextTenantKey is the key used to store tenant information in context
 const ContextTenantKey TenantInfo = "tenant_id"
 
 // ContextTokenExpirationKey is the key used to store token expiration in context
 const ContextTokenExpirationKey TokenExpiration = "token_expiration"
 
+// ContextUsernameKey is the key used to store the authenticated username in context
+const ContextUsernameKey Username = "username"
+
+// ContextScopeKey is the key used to store the space-separated token scopes in context
+const ContextScopeKey Scope = "scope"
+
+// ContextActAsTenantsKey is the key used to store the tenants an admin may act as,
+// as reported by the authorizer
+const ContextActAsTenantsKey Impersonation = "act_as_tenants"
+
+// ContextAdminOverrideKey is the key used to store the admin's home tenant while they act on
+// behalf of another tenant
+const ContextAdminOverrideKey Impersonation = "admin_override"
+
+// ContextSourceIPKey is the key used to store the client source IP reported by API Gateway
+const ContextSourceIPKey SourceIP = "source_ip"
+
+// ContextGeoKey is the key used to store the GeoInfo of the caller's source IP
+const ContextGeoKey GeoKey = "geo"
+
+// ContextClientCertKey is the key used to store the mTLS client certificate reported by the authorizer
+const ContextClientCertKey ClientCertKey = "client_cert"
+
+// ContextSessionPolicyKey is the key used to store the inline session policy that tenant
+// credentials for S3 calls made with the context must carry
+const ContextSessionPolicyKey SessionPolicyKey = "session_policy"
+
+// ContextRequestIDKey is the key used to store the API Gateway request ID
+const ContextRequestIDKey RequestIDKey = "request_id"
+
+// ContextClientKey is the key used to store the ClientInfo of the calling application
+const ContextClientKey ClientKey = "client"
+
+// ContextAPITokenKey is the key used to store the APITokenScope of requests made with an API token
+const ContextAPITokenKey APITokenKey = "api_token"
+
+// ClientCert identifies the mTLS client certificate of a request. API Gateway validated it
+// against the domain's truststore, and the authorizer checked its tenant binding.
+type ClientCert struct {
+	SubjectDN    string
+	IssuerDN     string
+	SerialNumber string
+	NotAfter     string
+}
+
 // WithTenantID adds tenant ID to the context
 // This function should be called when processing requests to ensure the tenant context
 // is properly propagated to AWS API calls
@@ -46,10 +121,157 @@ func GetTokenExpiration(ctx context.Context) (int64, bool) {
 	return val, ok
 }
 
+// WithUsername adds the authenticated username to the context
+func WithUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, ContextUsernameKey, username)
+}
+
+// GetUsername retrieves the authenticated username from context
+func GetUsername(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextUsernameKey).(string)
+	return val, ok
+}
+
+// WithScope adds the token scopes to the context
+func WithScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, ContextScopeKey, scope)
+}
+
+// GetScope retrieves the token scopes from context
+func GetScope(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextScopeKey).(string)
+	return val, ok
+}
+
+// WithActAsTenants adds the tenants the caller may impersonate ("*" for any) to the context
+func WithActAsTenants(ctx context.Context, tenants []string) context.Context {
+	return context.WithValue(ctx, ContextActAsTenantsKey, tenants)
+}
+
+// GetActAsTenants retrieves the tenants the caller may impersonate
+func GetActAsTenants(ctx context.Context) []string {
+	val, _ := ctx.Value(ContextActAsTenantsKey).([]string)
+	return val
+}
+
+// WithAdminOverride marks the context as an admin acting on behalf of the tenant in
+// ContextTenantKey; homeTenantID is the admin's own tenant, kept for auditing
+func WithAdminOverride(ctx context.Context, homeTenantID string) context.Context {
+	return context.WithValue(ctx, ContextAdminOverrideKey, homeTenantID)
+}
+
+// GetAdminOverride returns the admin's home tenant when the request is an impersonation
+func GetAdminOverride(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextAdminOverrideKey).(string)
+	return val, ok
+}
+
+// WithSourceIP adds the client source IP to the context.
+// Unlike RemoteAddr (which middleware.RealIP may rewrite from request headers),
+// this value comes from API Gateway and cannot be spoofed by the client.
+func WithSourceIP(ctx context.Context, sourceIP string) context.Context {
+	return context.WithValue(ctx, ContextSourceIPKey, sourceIP)
+}
+
+// GetSourceIP retrieves the client source IP from context
+func GetSourceIP(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextSourceIPKey).(string)
+	return val, ok
+}
+
+// WithGeo adds the caller's geo enrichment to the context
+func WithGeo(ctx context.Context, geo GeoInfo) context.Context {
+	return context.WithValue(ctx, ContextGeoKey, geo)
+}
+
+// GetGeo retrieves the caller's geo enrichment; false when GeoIP is not configured
+func GetGeo(ctx context.Context) (GeoInfo, bool) {
+	val, ok := ctx.Value(ContextGeoKey).(GeoInfo)
+	return val, ok
+}
+
+// WithClientCert adds the mTLS client certificate to the context
+func WithClientCert(ctx context.Context, cert ClientCert) context.Context {
+	return context.WithValue(ctx, ContextClientCertKey, cert)
+}
+
+// GetClientCert retrieves the mTLS client certificate; false when the request had none
+func GetClientCert(ctx context.Context) (ClientCert, bool) {
+	val, ok := ctx.Value(ContextClientCertKey).(ClientCert)
+	return val, ok
+}
+
+// WithSessionPolicy makes tenant credentials used with ctx carry the inline session policy
+func WithSessionPolicy(ctx context.Context, policy string) context.Context {
+	return context.WithValue(ctx, ContextSessionPolicyKey, policy)
+}
+
+// GetSessionPolicy retrieves the inline session policy from context
+func GetSessionPolicy(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextSessionPolicyKey).(string)
+	return val, ok
+}
+
+// WithRequestID adds the API Gateway request ID to the context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, ContextRequestIDKey, requestID)
+}
+
+// GetRequestID retrieves the API Gateway request ID from context
+func GetRequestID(ctx context.Context) (string, bool) {
+	val, ok := ctx.Value(ContextRequestIDKey).(string)
+	return val, ok
+}
+
+// WithClient adds the calling application to the context
+func WithClient(ctx context.Context, client ClientInfo) context.Context {
+	return context.WithValue(ctx, ContextClientKey, client)
+}
+
+// GetClient retrieves the calling application from context
+func GetClient(ctx context.Context) (ClientInfo, bool) {
+	val, ok := ctx.Value(ContextClientKey).(ClientInfo)
+	return val, ok
+}
+
+// WithAPITokenScope marks the request as made with an API token of the given scope
+func WithAPITokenScope(ctx context.Context, scope APITokenScope) context.Context {
+	return context.WithValue(ctx, ContextAPITokenKey, scope)
+}
+
+// GetAPITokenScope retrieves the API token scope; false for requests with user tokens
+func GetAPITokenScope(ctx context.Context) (APITokenScope, bool) {
+	val, ok := ctx.Value(ContextAPITokenKey).(APITokenScope)
+	return val, ok
+}
+
+// TenantSession describes the identity an assumed-role session is created for.
+// It doubles as the credential cache key, since sessions with different tags are not interchangeable.
+type TenantSession struct {
+	TenantID      string
+	Username      string // Cognito username; set as the username tag and SourceIdentity when present
+	Scope         string // Token scopes; set as the scope tag when present
+	AdminOverride bool   // Admin acting on behalf of TenantID (admin_override=true tag)
+	SessionPolicy string // Inline session policy narrowing the role, e.g. network-bound presigning; empty for none
+}
+
+// TenantSessionFromContext builds the session identity for a tenant from the request context
+func TenantSessionFromContext(ctx context.Context, tenantID string) TenantSession {
+	session := TenantSession{TenantID: tenantID}
+	session.Username, _ = GetUsername(ctx)
+	session.Scope, _ = GetScope(ctx)
+	_, session.AdminOverride = GetAdminOverride(ctx)
+	session.SessionPolicy, _ = GetSessionPolicy(ctx)
+	return session
+}
+
 // AssumeRoleForTenant assumes an IAM role with tenant-specific session tags
 // This enables fine-grained access control based on the tenant identity
-// durationSeconds controls how long the credentials are valid (max 10800 for our role)
-func AssumeRoleForTenant(ctx context.Context, stsClient *sts.Client, roleArn, tenantID string, durationSeconds int32) (aws.Credentials, error) {
+// durationSeconds controls how long the credentials are valid (max 43200 for our role)
+// The username and scope tags plus SourceIdentity let CloudTrail and S3 access logs attribute
+// object writes to individual users; admin_override marks impersonated sessions.
+func AssumeRoleForTenant(ctx context.Context, stsClient STSAssumer, roleArn string, session TenantSession, durationSeconds int32) (aws.Credentials, error) {
+	tenantID := session.TenantID
 	if tenantID == "" {
 		return aws.Credentials{}, fmt.Errorf("tenant ID cannot be empty")
 	}
@@ -61,18 +283,22 @@ func AssumeRoleForTenant(ctx context.Context, stsClient *sts.Client, roleArn, te
 	// Create a session name with tenant ID and timestamp for uniqueness
 	sessionName := fmt.Sprintf("tenant-%s-session-%d", tenantID, time.Now().Unix())
 
-	// Prepare assume role input with tenant session tag
+	// Prepare assume role input with the tenant session tags
 	assumeRoleInput := &sts.AssumeRoleInput{
 		RoleArn:         aws.String(roleArn),
 		RoleSessionName: aws.String(sessionName),
-		Tags: []types.Tag{
-			{
-				Key:   aws.String("tenant_id"),
-				Value: aws.String(tenantID),
-			},
-		},
 		DurationSeconds: aws.Int32(durationSeconds),
 	}
+	sessiontags.Apply(assumeRoleInput, sessiontags.Session{
+		TenantID:      tenantID,
+		Username:      session.Username,
+		Scope:         session.Scope,
+		AdminOverride: session.AdminOverride,
+	})
+
+	if session.SessionPolicy != "" {
+		assumeRoleInput.Policy = aws.String(session.SessionPolicy)
+	}
 
 	// Assume the role
 	assumeRoleOutput, err := stsClient.AssumeRole(ctx, assumeRoleInput)
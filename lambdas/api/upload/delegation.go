@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/sessiontags"
+)
+
+const (
+	// DefaultDelegatedCredentialsDuration is how long delegated credentials are valid unless
+	// the caller's token or the tenant's session ends earlier
+	DefaultDelegatedCredentialsDuration = time.Hour
+
+	// DelegatedUploadFolder is the folder under the tenant prefix that delegated credentials
+	// can write to; each user gets their own subfolder
+	DelegatedUploadFolder = "mobile-uploads"
+)
+
+// ErrDelegationDisabled is returned when the tenant may not receive delegated credentials
+var ErrDelegationDisabled = errors.New("delegated credentials are not enabled for this tenant")
+
+// ErrTokenExpiresTooSoon is returned when the caller's token ends before the operation
+// could finish, e.g. before the shortest credentials STS can issue
+var ErrTokenExpiresTooSoon = errors.New("token expires too soon")
+
+// DelegatedCredentials are temporary AWS credentials a client uses with the AWS SDK's own
+// upload support (e.g. TransferManager), confined to writing under Prefix of Bucket
+type DelegatedCredentials struct {
+	AccessKeyID     string            `json:"accessKeyId"`
+	SecretAccessKey string            `json:"secretAccessKey"`
+	SessionToken    string            `json:"sessionToken"`
+	ExpiresAt       int64             `json:"expiresAt"` // Unix timestamp
+	Region          string            `json:"region"`
+	Bucket          string            `json:"bucket"` // Bucket name or access point ARN to address
+	Prefix          string            `json:"prefix"` // Object keys must start with it
+	RequiredHeaders map[string]string `json:"requiredHeaders,omitempty"`
+}
+
+// DelegatesCredentials reports whether the tenant may receive delegated credentials
+func (s *UploadService) DelegatesCredentials(tenantID string) bool {
+	return slices.Contains(s.delegates, "*") || slices.Contains(s.delegates, tenantID)
+}
+
+// DelegateCredentials assumes the tenant role for a session that can only write objects
+// under the caller's folder of DelegatedUploadFolder, and hands the credentials to the
+// client. Mobile clients can then use the AWS SDK's multipart uploads directly instead of
+// presigned URLs. The Lambda role's AssumeRole with an inline session policy takes the place
+// of a Cognito Identity Pool or GetFederationToken: the session keeps the tenant and user
+// tags, so the role's tenant prefix conditions still apply, and the policy narrows it
+// further. The credentials are not cached, since they leave the service.
+func (s *UploadService) DelegateCredentials(ctx context.Context, tenantID string) (*DelegatedCredentials, error) {
+	if !s.DelegatesCredentials(tenantID) {
+		return nil, ErrDelegationDisabled
+	}
+
+	session := TenantSessionFromContext(ctx, tenantID)
+	userFolder := sessiontags.SourceIdentity(session.Username)
+	if userFolder == "" {
+		return nil, ErrMissingSourceIdentity
+	}
+	prefix := fmt.Sprintf("%s/%s/%s/", tenantID, DelegatedUploadFolder, userFolder)
+
+	// The credentials must not outlive the caller's token or the tenant's session
+	duration := min(s.delegateTTL, s.sessions.For(tenantID).Session)
+	if tokenExp, ok := GetTokenExpiration(ctx); ok {
+		duration = min(duration, time.Until(time.Unix(tokenExp, 0)))
+	}
+	if duration < MinTenantSessionDuration {
+		return nil, fmt.Errorf("%w for delegated credentials (needs at least %v)", ErrTokenExpiresTooSoon, MinTenantSessionDuration)
+	}
+
+	bucket := s.bucketFor(tenantID)
+	session.SessionPolicy = delegatedSessionPolicy(objectResourceARN(bucket, prefix))
+	creds, err := s.s3Clients.credentials.Delegate(ctx, session, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("AUDIT delegated credentials: user=%s tenant=%s prefix=%s expires=%s%s",
+		session.Username, tenantID, prefix, creds.Expires.UTC().Format(time.RFC3339), clientFields(ctx))
+
+	return &DelegatedCredentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ExpiresAt:       creds.Expires.Unix(),
+		Region:          s.s3Clients.awsConfig.Region,
+		Bucket:          bucket,
+		Prefix:          prefix,
+		RequiredHeaders: s.encryption.PutHeaders(tenantID),
+	}, nil
+}
+
+// objectResourceARN returns the ARN pattern of the objects under prefix, addressed through
+// the shared bucket or the tenant's access point
+func objectResourceARN(bucket, prefix string) string {
+	if arn.IsARN(bucket) {
+		return bucket + "/object/" + prefix + "*"
+	}
+	return "arn:aws:s3:::" + bucket + "/" + prefix + "*"
+}
+
+// delegatedSessionPolicy builds the inline session policy of delegated credentials: single
+// and multipart writes (CreateMultipartUpload, UploadPart and CompleteMultipartUpload are
+// all s3:PutObject) and aborts, on the given objects only. No reads, lists or deletes.
+func delegatedSessionPolicy(resource string) string {
+	// Marshalling strings and string slices cannot fail
+	policy, _ := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":   "Allow",
+			"Action":   []string{"s3:PutObject", "s3:AbortMultipartUpload"},
+			"Resource": resource,
+		}},
+	})
+	return string(policy)
+}
+
+// LoadDelegationTenants reads DELEGATED_CREDENTIALS_TENANTS (comma-separated, "*" for all)
+// and DELEGATED_CREDENTIALS_DURATION
+func LoadDelegationTenants() ([]string, time.Duration, error) {
+	tenants := envList("DELEGATED_CREDENTIALS_TENANTS")
+	duration, err := envDuration("DELEGATED_CREDENTIALS_DURATION", DefaultDelegatedCredentialsDuration)
+	if err != nil {
+		return nil, 0, err
+	}
+	if duration < MinTenantSessionDuration || duration > MaxTenantSessionDuration {
+		return nil, 0, fmt.Errorf("DELEGATED_CREDENTIALS_DURATION must be between %s and %s", MinTenantSessionDuration, MaxTenantSessionDuration)
+	}
+	return tenants, duration, nil
+}
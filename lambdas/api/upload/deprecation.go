@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Deprecation describes a deprecated endpoint. Its responses carry a Deprecation header
+// (RFC 9745) and, once a date is set, a Sunset header (RFC 8594), and every use is counted
+// by client so their owners can be contacted before the endpoint goes away.
+type Deprecation struct {
+	Method  string                     // HTTP method
+	Pattern string                     // Matched route pattern without trailing slash, e.g. "/objects/*"
+	Applies func(r *http.Request) bool // Narrows the deprecation to some requests; nil applies to all
+	Since   time.Time                  // When the endpoint was deprecated
+	Sunset  time.Time                  // When it stops working; zero while not scheduled
+}
+
+// Route names the deprecated endpoint as "<method> <pattern>"
+func (d Deprecation) Route() string {
+	return d.Method + " " + d.Pattern
+}
+
+// deprecations is the registry of deprecated endpoints
+var deprecations = []Deprecation{
+	{
+		// Proxied simple uploads pass the body through the Lambda; clients should ask for a
+		// presigned PUT with ?mode=redirect instead
+		Method:  http.MethodPost,
+		Pattern: "/upload",
+		Applies: func(r *http.Request) bool {
+			return r.URL.Query().Get("mode") != UploadModeRedirect
+		},
+		Since: time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+// LoadDeprecations returns the registry with the sunset dates of DEPRECATION_SUNSETS, a JSON
+// object mapping routes to dates, e.g. {"POST /upload": "2027-04-30"}
+func LoadDeprecations() ([]Deprecation, error) {
+	registry := make([]Deprecation, len(deprecations))
+	copy(registry, deprecations)
+
+	raw := strings.TrimSpace(os.Getenv("DEPRECATION_SUNSETS"))
+	if raw == "" {
+		return registry, nil
+	}
+	var sunsets map[string]string
+	if err := json.Unmarshal([]byte(raw), &sunsets); err != nil {
+		return nil, fmt.Errorf("DEPRECATION_SUNSETS is not a valid JSON object: %w", err)
+	}
+	for route, value := range sunsets {
+		sunset, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return nil, fmt.Errorf("DEPRECATION_SUNSETS route %s: date must look like 2006-01-02: %q", route, value)
+		}
+		found := false
+		for i := range registry {
+			if registry[i].Route() == route {
+				registry[i].Sunset, found = sunset, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("DEPRECATION_SUNSETS route %s is not deprecated", route)
+		}
+	}
+	return registry, nil
+}
+
+// DeprecationHeaders marks responses of deprecated endpoints and counts their use. The
+// route is only known once the router has matched it, so the headers are added when the
+// handler starts its response.
+func DeprecationHeaders(registry []Deprecation) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&deprecationWriter{ResponseWriter: w, request: r, registry: registry}, r)
+		})
+	}
+}
+
+// deprecationWriter adds the deprecation headers before the response header is written
+type deprecationWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	registry []Deprecation
+	checked  bool
+}
+
+func (w *deprecationWriter) WriteHeader(status int) {
+	w.check()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deprecationWriter) Write(b []byte) (int, error) {
+	w.check()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *deprecationWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// check looks the matched route up in the registry once
+func (w *deprecationWriter) check() {
+	if w.checked {
+		return
+	}
+	w.checked = true
+
+	routeCtx := chi.RouteContext(w.request.Context())
+	if routeCtx == nil {
+		return
+	}
+	pattern := routeCtx.RoutePattern()
+	for _, deprecation := range w.registry {
+		if deprecation.Method != w.request.Method || deprecation.Pattern != pattern {
+			continue
+		}
+		if deprecation.Applies != nil && !deprecation.Applies(w.request) {
+			continue
+		}
+
+		h := w.Header()
+		h.Set("Deprecation", fmt.Sprintf("@%d", deprecation.Since.Unix()))
+		if !deprecation.Sunset.IsZero() {
+			h.Set("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+		}
+
+		client, _ := GetClient(w.request.Context())
+		tenantID, _ := GetTenantID(w.request.Context())
+		log.Printf("Deprecated route %s used: tenant=%s %s", deprecation.Route(), tenantID, client)
+		emitMetric("DeprecatedRouteRequests", "Count", 1, map[string]string{
+			"Route":  deprecation.Route(),
+			"Client": clientDimension(client.Name),
+		})
+		return
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Object metadata holding the hex digests of objects the service writes itself
+const (
+	SHA256MetadataKey = "sha256"
+	MD5MetadataKey    = "md5"
+)
+
+// contentDigest computes the SHA-256 and MD5 of an object body as it is written, so objects
+// the service stores itself carry their digests without reading the content a second time.
+// The zero value is ready to use.
+type contentDigest struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+// Write adds p to both digests; it never fails
+func (d *contentDigest) Write(p []byte) (int, error) {
+	d.init()
+	d.sha256.Write(p)
+	d.md5.Write(p)
+	return len(p), nil
+}
+
+// init creates the hashes of a zero contentDigest
+func (d *contentDigest) init() {
+	if d.sha256 == nil {
+		d.sha256, d.md5 = sha256.New(), md5.New()
+	}
+}
+
+// ApplyPutObject sets the digests of everything written so far on a PutObject of that
+// content. S3 verifies both on receipt and stores the SHA-256 as the object's checksum,
+// which upload receipts attest; the hex metadata serves clients that only see object
+// metadata, since the ETag of an SSE-KMS object is no MD5.
+func (d *contentDigest) ApplyPutObject(input *s3.PutObjectInput) {
+	d.init()
+	sha256Sum, md5Sum := d.sha256.Sum(nil), d.md5.Sum(nil)
+	input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sha256Sum))
+	input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(md5Sum))
+	if input.Metadata == nil {
+		input.Metadata = make(map[string]string, 2)
+	}
+	input.Metadata[SHA256MetadataKey] = hex.EncodeToString(sha256Sum)
+	input.Metadata[MD5MetadataKey] = hex.EncodeToString(md5Sum)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// DefaultDownloadProxyMaxBytes is the default size cap for objects served through the Lambda.
+	// Lambda responses are limited to 6 MB and the body is base64 encoded (+33%), so 4 MiB
+	// leaves room for headers.
+	DefaultDownloadProxyMaxBytes = 4 * 1024 * 1024
+
+	// MaxDownloadProxyMaxBytes is the largest configurable cap that still fits a Lambda response
+	MaxDownloadProxyMaxBytes = 4*1024*1024 + 512*1024
+
+	// MaxPresignBatchKeys caps the objects of one batch presign, e.g. a page of a gallery
+	MaxPresignBatchKeys = 100
+)
+
+var (
+	// ErrObjectNotFound is returned when the requested object does not exist
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrObjectTooLarge is returned when an object exceeds the download proxy size cap
+	ErrObjectTooLarge = errors.New("object exceeds download proxy size limit")
+
+	// ErrRangeNotSatisfiable is returned when the requested byte range lies outside the object
+	ErrRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+	// ErrNotModified is returned when a conditional read matches the client's cached copy
+	ErrNotModified = errors.New("object not modified")
+
+	// ErrTooManyPresignKeys is returned when a batch presign asks for more than MaxPresignBatchKeys URLs
+	ErrTooManyPresignKeys = fmt.Errorf("request exceeds %d object keys", MaxPresignBatchKeys)
+)
+
+// ObjectContent is an object (or a byte range of it) read through the download proxy
+type ObjectContent struct {
+	Body         []byte
+	ContentType  string
+	ContentRange string // Set when a byte range was served, e.g. "bytes 0-99/1234"
+	ETag         string
+	LastModified *time.Time
+	Replication  string // Cross-region replication status; empty when the object is not replicated
+	Disposition  string // Content-Disposition required by the tenant's content policy, if any
+}
+
+// ObjectContentOptions carries the HTTP request headers that shape a proxied read
+type ObjectContentOptions struct {
+	Range           string     // Range header value; only a single byte range is honored
+	IfNoneMatch     string     // If-None-Match header value (ETags or "*")
+	IfModifiedSince *time.Time // Parsed If-Modified-Since header, nil when absent or invalid
+}
+
+// isSingleByteRange reports whether a Range header is a single byte range S3 can serve.
+// S3 ignores multi-range requests, so they are treated as requests for the whole object.
+func isSingleByteRange(rangeHeader string) bool {
+	return strings.HasPrefix(rangeHeader, "bytes=") && !strings.Contains(rangeHeader, ",")
+}
+
+// GetObjectContent reads a small object from the tenant's prefix so it can be returned
+// through API Gateway. An optional single byte range is passed to S3, and the size cap
+// then applies to the range rather than the whole object. Conditional headers are
+// evaluated by S3; ErrNotModified is returned when the client's copy is current.
+// Objects or ranges larger than maxBytes are rejected without reading the body.
+func (s *UploadService) GetObjectContent(ctx context.Context, tenantID, objectKey string, opts ObjectContentOptions, maxBytes int64) (*ObjectContent, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if err := validateTenantObjectKey(tenantID, objectKey); err != nil {
+		return nil, err
+	}
+
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(objectKey),
+	}
+	if isSingleByteRange(opts.Range) {
+		input.Range = aws.String(opts.Range)
+	}
+	if opts.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if opts.IfModifiedSince != nil {
+		input.IfModifiedSince = opts.IfModifiedSince
+	}
+
+	getResp, err := tenantS3Client.GetObject(ctx, input)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrObjectNotFound
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			return nil, ErrRangeNotSatisfiable
+		}
+		// S3 reports a matching conditional GET as a 304 response error
+		var respErr *smithyhttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified {
+			return nil, ErrNotModified
+		}
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer getResp.Body.Close()
+
+	if aws.ToInt64(getResp.ContentLength) > maxBytes {
+		return nil, ErrObjectTooLarge
+	}
+
+	// Guard against a missing or wrong Content-Length by never reading past the cap
+	body, err := io.ReadAll(io.LimitReader(getResp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, ErrObjectTooLarge
+	}
+
+	object := &ObjectContent{
+		Body:         body,
+		ContentRange: aws.ToString(getResp.ContentRange),
+		ETag:         aws.ToString(getResp.ETag),
+		LastModified: getResp.LastModified,
+		Replication:  normalizeReplicationStatus(getResp.ReplicationStatus),
+	}
+	object.ContentType, object.Disposition = s.content.For(tenantID).Headers(objectKey, aws.ToString(getResp.ContentType))
+	return object, nil
+}
+
+// validatePresignDownloadBatchRequest validates the batch presign request
+func validatePresignDownloadBatchRequest(ctx context.Context, tenantID string, req *PresignDownloadBatchRequest) error {
+	if tenantID == "" {
+		return fmt.Errorf("tenant ID cannot be empty")
+	}
+	if len(req.ObjectKeys) == 0 {
+		return fmt.Errorf("object keys cannot be empty")
+	}
+	if len(req.ObjectKeys) > MaxPresignBatchKeys {
+		return ErrTooManyPresignKeys
+	}
+	for _, objectKey := range req.ObjectKeys {
+		if err := validateLiveObjectKey(tenantID, objectKey); err != nil {
+			return err
+		}
+		if err := checkAPITokenKey(ctx, tenantID, objectKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignDownloadBatch presigns GETs of several objects in the tenant's prefix, so viewers can
+// load a page of thumbnails with one API call. Every key is validated before any URL is
+// signed, so one foreign key fails the whole batch. Objects are not read: URLs of missing
+// objects are returned too and fail with 404 at S3.
+func (s *UploadService) PresignDownloadBatch(ctx context.Context, tenantID string, req *PresignDownloadBatchRequest) (*PresignDownloadBatchResponse, error) {
+	if err := validatePresignDownloadBatchRequest(ctx, tenantID, req); err != nil {
+		return nil, err
+	}
+
+	// Require tenant credentials that outlive the presigned URLs, bound to the tenant's networks if configured
+	presignExpiration := calculatePresignExpiration(ctx, s.sessions.For(tenantID))
+	ctx = WithCredentialValidity(ctx, presignExpiration)
+	ctx, err := s.bindings.Bind(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	deadline, err := s.presignDeadline(ctx, tenantID, presignExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := s.presigning.Acquire(ctx, int64(len(req.ObjectKeys)))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	presignClient := s3.NewPresignClient(s.s3Clients.Get(tenantID))
+	policy := s.content.For(tenantID)
+	urls := make(map[string]string, len(req.ObjectKeys))
+	for _, objectKey := range req.ObjectKeys {
+		if _, ok := urls[objectKey]; ok {
+			continue
+		}
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(s.bucketFor(tenantID)),
+			Key:    aws.String(objectKey),
+		}
+		policy.ApplyGetObjectByKey(input)
+		presignReq, err := presignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(presignExpiration))
+		if err != nil {
+			return nil, fmt.Errorf("failed to presign download of %s: %w", objectKey, err)
+		}
+		urls[objectKey] = presignReq.URL
+	}
+
+	return &PresignDownloadBatchResponse{Urls: urls, ExpiresAt: deadline.ExpiresAt.Unix()}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+)
+
+// FuzzPresignDownloadBatchRequest decodes arbitrary batch presign bodies like
+// handlePresignDownloadBatch does. Whatever validation accepts must be a bounded batch of
+// canonical, live keys in the caller's prefix.
+func FuzzPresignDownloadBatchRequest(f *testing.F) {
+	f.Add(uint8(0), []byte(`{"objectKeys": ["tenant-a/photos/1.jpg", "tenant-a/photos/2.jpg"]}`))
+	f.Add(uint8(0), []byte(`{"objectKeys": ["tenant-a/.trash/photos/1.jpg"]}`))
+	f.Add(uint8(0), []byte(`{"objectKeys": ["tenant-b/photos/1.jpg"]}`))
+
+	f.Fuzz(func(t *testing.T, codec uint8, body []byte) {
+		var req PresignDownloadBatchRequest
+		if err := decodeBody(codec, body, &req); err != nil {
+			return
+		}
+		if err := validatePresignDownloadBatchRequest(context.Background(), "tenant-a", &req); err != nil {
+			return
+		}
+		if len(req.ObjectKeys) == 0 || len(req.ObjectKeys) > MaxPresignBatchKeys {
+			t.Fatalf("accepted a batch of %d keys", len(req.ObjectKeys))
+		}
+		for _, key := range req.ObjectKeys {
+			if err := keyutil.RequireCanonical(key); err != nil {
+				t.Fatalf("accepted non-canonical key %q: %v", key, err)
+			}
+			if !strings.HasPrefix(key, "tenant-a/") || strings.HasPrefix(key, "tenant-a/"+TrashPrefix+"/") {
+				t.Fatalf("accepted key %q outside the tenant's live objects", key)
+			}
+		}
+	})
+}
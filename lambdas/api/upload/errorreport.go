@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxBufferedErrorReports bounds the events held until the next flush; more are dropped
+	maxBufferedErrorReports = 100
+
+	// errorReportClient identifies the reporter in the sink's auth header
+	errorReportClient = "upload-api/1.0"
+)
+
+// ErrorReportConfig selects the error sink and how many events reach it
+type ErrorReportConfig struct {
+	DSN         string  // Sentry-style DSN: https://<public key>@<host>/<project ID>
+	SampleRate  float64 // Fraction of events sent, between 0 and 1
+	Environment string  // Reported as the event's environment
+}
+
+// LoadErrorReportConfig reads ERROR_REPORT_DSN, ERROR_REPORT_SAMPLE_RATE and
+// ERROR_REPORT_ENVIRONMENT. It returns nil when no DSN is configured.
+func LoadErrorReportConfig() (*ErrorReportConfig, error) {
+	dsn := strings.TrimSpace(os.Getenv("ERROR_REPORT_DSN"))
+	if dsn == "" {
+		return nil, nil
+	}
+	sampleRate, err := envFloat("ERROR_REPORT_SAMPLE_RATE", 1)
+	if err != nil {
+		return nil, err
+	}
+	if sampleRate < 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("ERROR_REPORT_SAMPLE_RATE must be between 0 and 1")
+	}
+	return &ErrorReportConfig{
+		DSN:         dsn,
+		SampleRate:  sampleRate,
+		Environment: strings.TrimSpace(os.Getenv("ERROR_REPORT_ENVIRONMENT")),
+	}, nil
+}
+
+// errorEvent is an event in the Sentry store format, which Sentry-compatible sinks accept
+type errorEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Exception   *errorException   `json:"exception"`
+	Tags        map[string]string `json:"tags"`
+	Request     *errorRequest     `json:"request,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type errorException struct {
+	Values []errorExceptionValue `json:"values"`
+}
+
+type errorExceptionValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type errorRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// ErrorReporter captures handler errors and panics with tenant, route and request ID tags
+// and sends them to a Sentry-compatible sink. Events are buffered and sent by the flush
+// extension after the response, so reporting never delays a client or runs while Lambda
+// has the environment frozen. A nil *ErrorReporter reports nothing.
+type ErrorReporter struct {
+	endpoint    string
+	auth        string
+	sampleRate  float64
+	environment string
+	client      *http.Client
+
+	mu     sync.Mutex
+	events []errorEvent
+}
+
+// NewErrorReporter creates a reporter for the DSN; nil config disables reporting
+func NewErrorReporter(config *ErrorReportConfig) (*ErrorReporter, error) {
+	if config == nil {
+		return nil, nil
+	}
+	dsn, err := url.Parse(config.DSN)
+	if err != nil || dsn.User == nil || dsn.User.Username() == "" || dsn.Host == "" {
+		return nil, fmt.Errorf("ERROR_REPORT_DSN must look like https://<key>@<host>/<project>")
+	}
+	path, project, ok := cutLast(strings.TrimSuffix(dsn.Path, "/"), "/")
+	if !ok || project == "" {
+		return nil, fmt.Errorf("ERROR_REPORT_DSN has no project ID")
+	}
+
+	return &ErrorReporter{
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", dsn.Scheme, dsn.Host, path, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=%s",
+			dsn.User.Username(), errorReportClient),
+		sampleRate:  config.SampleRate,
+		environment: config.Environment,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// cutLast splits s around the last separator
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// CaptureError reports an error a handler answered with a server error
+func (e *ErrorReporter) CaptureError(r *http.Request, err error) {
+	if e == nil || err == nil {
+		return
+	}
+	e.capture(r, reflect.TypeOf(err).String(), err.Error(), nil)
+}
+
+// CapturePanic reports a panic recovered from a handler, with its stack
+func (e *ErrorReporter) CapturePanic(r *http.Request, recovered any, stack []byte) {
+	if e == nil {
+		return
+	}
+	e.capture(r, "panic", fmt.Sprint(recovered), map[string]string{"stack": string(stack)})
+}
+
+// Middleware reports panics and re-raises them, so the recoverer still answers the request.
+// It must run inside middleware.Recoverer.
+func (e *ErrorReporter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered != http.ErrAbortHandler {
+					e.CapturePanic(r, recovered, debug.Stack())
+				}
+				panic(recovered)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// capture samples and buffers an event
+func (e *ErrorReporter) capture(r *http.Request, errorType, message string, extra map[string]string) {
+	if e.sampleRate < 1 && mathrand.Float64() >= e.sampleRate {
+		return
+	}
+
+	tags := map[string]string{"method": r.Method}
+	if tenantID, ok := GetTenantID(r.Context()); ok {
+		tags["tenant_id"] = tenantID
+	}
+	if requestID, ok := GetRequestID(r.Context()); ok {
+		tags["request_id"] = requestID
+	}
+	if client, ok := GetClient(r.Context()); ok && client.Name != "" {
+		tags["client"] = client.Name
+		tags["client_version"] = clientDimension(client.Version)
+	}
+	if routeCtx := chi.RouteContext(r.Context()); routeCtx != nil && routeCtx.RoutePattern() != "" {
+		tags["route"] = routeCtx.RoutePattern()
+	}
+
+	event := errorEvent{
+		EventID:     newEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "upload-api",
+		Environment: e.environment,
+		Message:     message,
+		Exception:   &errorException{Values: []errorExceptionValue{{Type: errorType, Value: message}}},
+		Tags:        tags,
+		// The path only; query strings may carry tokens
+		Request: &errorRequest{Method: r.Method, URL: r.URL.Path},
+		Extra:   extra,
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.events) >= maxBufferedErrorReports {
+		return
+	}
+	e.events = append(e.events, event)
+}
+
+// Flush sends the buffered events. Events that cannot be sent are logged and dropped, so a
+// failing sink never grows the buffer.
+func (e *ErrorReporter) Flush(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	events := e.events
+	e.events = nil
+	e.mu.Unlock()
+
+	for i, event := range events {
+		if err := e.send(ctx, event); err != nil {
+			log.Printf("Failed to send error report %s, dropping %d reports: %v", event.EventID, len(events)-i, err)
+			return
+		}
+	}
+}
+
+// send posts one event to the sink's store endpoint
+func (e *ErrorReporter) send(ctx context.Context, event errorEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", e.auth)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newEventID returns a random 32-hex-digit event ID
+func newEventID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
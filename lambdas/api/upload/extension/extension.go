@@ -0,0 +1,232 @@
+// Package extension runs an internal Lambda extension next to the function handler, so
+// state buffered in memory (aggregated uploads, and any metrics or audit entries that get
+// buffered later) is written out before Lambda freezes or terminates the environment.
+//
+// Registered flushers run after every invocation, once the handler has produced its
+// response: Lambda only freezes the environment when the extension asks for its next
+// event, so the flush adds to the billed duration but not to the client's latency. They
+// run again on SIGTERM, which Lambda only sends to functions with a registered extension,
+// within the short window before the process is killed.
+package extension
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ShutdownTimeout bounds the flush on SIGTERM; Lambda kills the process about 500 ms
+	// after the signal when only internal extensions are registered
+	ShutdownTimeout = 400 * time.Millisecond
+
+	// extensionsAPIVersion is the path prefix of the Lambda Extensions API
+	extensionsAPIVersion = "2020-01-01"
+)
+
+// Reason tells a flusher why it runs
+type Reason string
+
+const (
+	// ReasonInvocation is a flush after an invocation, before the environment is frozen.
+	// Flushers typically only write what is due.
+	ReasonInvocation Reason = "invocation"
+
+	// ReasonShutdown is the final flush before the environment is terminated. Flushers
+	// should write everything they hold.
+	ReasonShutdown Reason = "shutdown"
+)
+
+// Flusher writes out buffered state
+type Flusher func(ctx context.Context, reason Reason)
+
+// Extension is the in-process extension. The zero value is not usable; create it with
+// Start. A nil *Extension ignores every call, for running outside Lambda.
+type Extension struct {
+	name     string
+	endpoint string
+	id       string
+	client   *http.Client
+
+	mu       sync.Mutex
+	flushers []namedFlusher
+
+	// done receives a signal whenever the handler has returned from an invocation
+	done chan struct{}
+}
+
+type namedFlusher struct {
+	name  string
+	flush Flusher
+}
+
+// invokeEvent is the part of an Extensions API event the extension needs
+type invokeEvent struct {
+	EventType  string `json:"eventType"`
+	DeadlineMs int64  `json:"deadlineMs"`
+	RequestID  string `json:"requestId"`
+}
+
+// Start registers the extension and starts its event loop and SIGTERM handler. It must be
+// called before the runtime starts (lambda.Start), since extensions can only register
+// during the init phase. Outside Lambda it returns nil.
+func Start(name string) (*Extension, error) {
+	endpoint := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	e := &Extension{
+		name:     name,
+		endpoint: endpoint,
+		client:   &http.Client{}, // No timeout: the next-event call blocks until an invocation
+		done:     make(chan struct{}, 1),
+	}
+	if err := e.register(); err != nil {
+		return nil, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go e.shutdownOnSignal(signals)
+	go e.run()
+	return e, nil
+}
+
+// Register adds a flusher; flushers run in registration order
+func (e *Extension) Register(name string, flush Flusher) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.flushers = append(e.flushers, namedFlusher{name: name, flush: flush})
+}
+
+// InvocationDone tells the extension the handler has returned, so the flushers can run.
+// The handler wrapper calls it once per invocation, after the response is built.
+func (e *Extension) InvocationDone() {
+	if e == nil {
+		return
+	}
+	select {
+	case e.done <- struct{}{}:
+	default:
+		// A signal is already pending; the extension flushes once for both
+	}
+}
+
+// register announces the extension for INVOKE events. Internal extensions cannot receive
+// SHUTDOWN events; SIGTERM takes their place.
+func (e *Extension) register() error {
+	body := strings.NewReader(`{"events": ["INVOKE"]}`)
+	req, err := http.NewRequest(http.MethodPost, e.url("register"), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Lambda-Extension-Name", e.name)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to register extension %s: %w", e.name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to register extension %s: status %d", e.name, resp.StatusCode)
+	}
+	e.id = resp.Header.Get("Lambda-Extension-Identifier")
+	return nil
+}
+
+// run is the event loop. Asking for the next event tells Lambda the extension is done with
+// the previous invocation, so each flush happens before that call.
+func (e *Extension) run() {
+	for {
+		event, err := e.next()
+		if err != nil {
+			log.Printf("Extension %s stopped: %v", e.name, err)
+			return
+		}
+		if event.EventType != "INVOKE" {
+			continue
+		}
+
+		// Wait for the handler, but never past the invocation deadline: a handler that
+		// timed out never reports back
+		deadline := time.UnixMilli(event.DeadlineMs)
+		select {
+		case <-e.done:
+		case <-time.After(time.Until(deadline)):
+			log.Printf("Extension %s: invocation %s did not finish before its deadline", e.name, event.RequestID)
+			continue
+		}
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		e.flush(ctx, ReasonInvocation)
+		cancel()
+	}
+}
+
+// next blocks until Lambda delivers the next event
+func (e *Extension) next() (*invokeEvent, error) {
+	req, err := http.NewRequest(http.MethodGet, e.url("event/next"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Lambda-Extension-Identifier", e.id)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("next event: status %d", resp.StatusCode)
+	}
+	var event invokeEvent
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		return nil, fmt.Errorf("next event: %w", err)
+	}
+	return &event, nil
+}
+
+// shutdownOnSignal runs the final flush when Lambda sends SIGTERM
+func (e *Extension) shutdownOnSignal(signals <-chan os.Signal) {
+	<-signals
+	log.Printf("Extension %s: SIGTERM received, flushing", e.name)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	e.flush(ctx, ReasonShutdown)
+}
+
+// flush runs every flusher, recovering from panics so one flusher cannot keep the others
+// from running
+func (e *Extension) flush(ctx context.Context, reason Reason) {
+	e.mu.Lock()
+	flushers := append([]namedFlusher(nil), e.flushers...)
+	e.mu.Unlock()
+
+	for _, f := range flushers {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Extension %s: flusher %s panicked: %v", e.name, f.name, r)
+				}
+			}()
+			f.flush(ctx, reason)
+		}()
+	}
+}
+
+// url builds an Extensions API URL
+func (e *Extension) url(path string) string {
+	return fmt.Sprintf("http://%s/%s/extension/%s", e.endpoint, extensionsAPIVersion, path)
+}
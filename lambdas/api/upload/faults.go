@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// FaultInjectionEnvVar enables fault injection into AWS SDK calls when set.
+// Format: comma-separated key=value pairs, for example
+//
+//	latency=500ms,latency_rate=0.5,throttle_rate=0.1,error_rate=0.05,operations=AssumeRole|UploadPart
+//
+// This is intended for tests and game days only and must never be set in production.
+const FaultInjectionEnvVar = "FAULT_INJECTION"
+
+// FaultConfig describes the faults injected into AWS SDK calls
+type FaultConfig struct {
+	Latency      time.Duration   // Extra latency added before the call
+	LatencyRate  float64         // Fraction of calls that get the extra latency (0-1)
+	ThrottleRate float64         // Fraction of calls failing with a ThrottlingException
+	ErrorRate    float64         // Fraction of calls failing with an HTTP 500
+	Operations   map[string]bool // Operation names to target; empty means all operations
+}
+
+// LoadFaultConfig parses the fault injection settings from the environment.
+// It returns nil when fault injection is disabled.
+func LoadFaultConfig() (*FaultConfig, error) {
+	spec := strings.TrimSpace(os.Getenv(FaultInjectionEnvVar))
+	if spec == "" {
+		return nil, nil
+	}
+	return parseFaultConfig(spec)
+}
+
+// parseFaultConfig parses a fault injection spec string
+func parseFaultConfig(spec string) (*FaultConfig, error) {
+	cfg := &FaultConfig{LatencyRate: 1, Operations: make(map[string]bool)}
+
+	for _, pair := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault injection setting %q: expected key=value", pair)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(value)
+		case "latency_rate":
+			cfg.LatencyRate, err = parseRate(value)
+		case "throttle_rate":
+			cfg.ThrottleRate, err = parseRate(value)
+		case "error_rate":
+			cfg.ErrorRate, err = parseRate(value)
+		case "operations":
+			for _, op := range strings.Split(value, "|") {
+				if op = strings.TrimSpace(op); op != "" {
+					cfg.Operations[op] = true
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault injection setting %q: %w", pair, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parseRate parses a probability between 0 and 1
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+// String summarizes the configuration for logging
+func (c *FaultConfig) String() string {
+	ops := "all"
+	if len(c.Operations) > 0 {
+		names := make([]string, 0, len(c.Operations))
+		for op := range c.Operations {
+			names = append(names, op)
+		}
+		ops = strings.Join(names, "|")
+	}
+	return fmt.Sprintf("latency=%v@%.2f throttle=%.2f error=%.2f operations=%s",
+		c.Latency, c.LatencyRate, c.ThrottleRate, c.ErrorRate, ops)
+}
+
+// AddToStack registers the fault injection middleware on an SDK client stack.
+// It is appended to aws.Config.APIOptions so every client built from the config
+// (STS, S3 and the S3 presigner) is affected.
+// The middleware runs after the retry middleware, so injected throttles and 500s are
+// retried by the SDK exactly like real ones.
+func (c *FaultConfig) AddToStack(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("FaultInjection",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			operation := awsmiddleware.GetOperationName(ctx)
+			if len(c.Operations) > 0 && !c.Operations[operation] {
+				return next.HandleFinalize(ctx, in)
+			}
+
+			if c.Latency > 0 && rand.Float64() < c.LatencyRate {
+				select {
+				case <-time.After(c.Latency):
+				case <-ctx.Done():
+					return middleware.FinalizeOutput{}, middleware.Metadata{}, ctx.Err()
+				}
+			}
+
+			if rand.Float64() < c.ThrottleRate {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, &smithy.GenericAPIError{
+					Code:    "ThrottlingException",
+					Message: fmt.Sprintf("injected throttling fault for %s", operation),
+				}
+			}
+
+			if rand.Float64() < c.ErrorRate {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, &smithyhttp.ResponseError{
+					Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusInternalServerError}},
+					Err:      fmt.Errorf("injected server error for %s", operation),
+				}
+			}
+
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoCacheSize bounds the per-instance lookup cache; it is cleared when full
+const geoCacheSize = 4096
+
+// GeoInfo is the location and network of a caller's source IP
+type GeoInfo struct {
+	Country string // ISO 3166-1 alpha-2 code, empty when unknown
+	ASN     uint   // Autonomous system number, 0 when unknown
+	ASOrg   string // Autonomous system organization
+}
+
+// String formats the fields for log lines, e.g. `country=DE asn=3320 as_org="Deutsche Telekom AG"`
+func (g GeoInfo) String() string {
+	country := g.Country
+	if country == "" {
+		country = "-"
+	}
+	return fmt.Sprintf("country=%s asn=%d as_org=%q", country, g.ASN, g.ASOrg)
+}
+
+// GeoIP resolves source IPs with local MaxMind databases, typically shipped in a Lambda
+// layer under /opt. A nil *GeoIP is valid and resolves nothing, so callers need no checks.
+type GeoIP struct {
+	country *geoip2.Reader // GeoLite2/GeoIP2 Country or City database; nil if not configured
+	asn     *geoip2.Reader // GeoLite2/GeoIP2 ASN database; nil if not configured
+
+	mu    sync.Mutex
+	cache map[string]GeoInfo
+}
+
+// LoadGeoIP opens the databases named by GEOIP_COUNTRY_DB and GEOIP_ASN_DB. It returns
+// nil when neither is set. The files are memory-mapped, so opening them at init reads
+// nothing over the network.
+func LoadGeoIP() (*GeoIP, error) {
+	countryPath := strings.TrimSpace(os.Getenv("GEOIP_COUNTRY_DB"))
+	asnPath := strings.TrimSpace(os.Getenv("GEOIP_ASN_DB"))
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+
+	g := &GeoIP{cache: make(map[string]GeoInfo)}
+	var err error
+	if countryPath != "" {
+		if g.country, err = geoip2.Open(countryPath); err != nil {
+			return nil, fmt.Errorf("failed to open GEOIP_COUNTRY_DB: %w", err)
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = geoip2.Open(asnPath); err != nil {
+			return nil, fmt.Errorf("failed to open GEOIP_ASN_DB: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// Lookup returns what the databases know about ip; unknown or invalid addresses yield
+// an empty GeoInfo
+func (g *GeoIP) Lookup(ip string) GeoInfo {
+	if g == nil || ip == "" {
+		return GeoInfo{}
+	}
+
+	g.mu.Lock()
+	info, ok := g.cache[ip]
+	g.mu.Unlock()
+	if ok {
+		return info
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return GeoInfo{}
+	}
+	if g.country != nil {
+		if record, err := g.country.Country(addr); err == nil {
+			info.Country = record.Country.IsoCode
+		}
+	}
+	if g.asn != nil {
+		if record, err := g.asn.ASN(addr); err == nil {
+			info.ASN = record.AutonomousSystemNumber
+			info.ASOrg = record.AutonomousSystemOrganization
+		}
+	}
+
+	g.mu.Lock()
+	if len(g.cache) >= geoCacheSize {
+		clear(g.cache)
+	}
+	g.cache[ip] = info
+	g.mu.Unlock()
+	return info
+}
+
+// GeoMiddleware resolves the API Gateway source IP once per request and stores the
+// result in the context for access and audit log lines
+func GeoMiddleware(g *GeoIP) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sourceIP, _ := GetSourceIP(r.Context())
+			next.ServeHTTP(w, r.WithContext(WithGeo(r.Context(), g.Lookup(sourceIP))))
+		})
+	}
+}
+
+// geoFields returns the geo fields for audit log lines, or "" when enrichment is off
+func geoFields(ctx context.Context) string {
+	geo, ok := GetGeo(ctx)
+	if !ok {
+		return ""
+	}
+	return " " + geo.String()
+}
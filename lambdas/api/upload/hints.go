@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Tenant tiers for upload throttling hints
+const (
+	TierPremium    = "premium"
+	TierStandard   = "standard"
+	TierRestricted = "restricted"
+)
+
+// tierHints are the hints of each tier before the load factor is applied. The restricted
+// tier is meant for tenants that keep saturating egress at the expense of others.
+var tierHints = map[string]UploadHints{
+	TierPremium:    {MaxParallelParts: 8},
+	TierStandard:   {MaxParallelParts: 4},
+	TierRestricted: {MaxParallelParts: 2, MaxBytesPerSecond: 5 * 1024 * 1024},
+}
+
+// UploadHintConfig assigns tenants to tiers and scales the tier hints by a load factor
+type UploadHintConfig struct {
+	DefaultTier string
+	TenantTiers map[string]string
+	LoadFactor  float64 // In (0, 1]; operators lower it to shed load across all tenants
+}
+
+// LoadUploadHintConfig reads UPLOAD_TIER_DEFAULT (default "standard"), TENANT_TIERS (a JSON
+// object of tenant -> tier) and UPLOAD_HINT_LOAD_FACTOR (default 1)
+func LoadUploadHintConfig() (*UploadHintConfig, error) {
+	cfg := &UploadHintConfig{DefaultTier: TierStandard, LoadFactor: 1}
+
+	if tier := strings.TrimSpace(os.Getenv("UPLOAD_TIER_DEFAULT")); tier != "" {
+		cfg.DefaultTier = tier
+	}
+	if _, ok := tierHints[cfg.DefaultTier]; !ok {
+		return nil, fmt.Errorf("UPLOAD_TIER_DEFAULT: unknown tier %q", cfg.DefaultTier)
+	}
+
+	if raw := strings.TrimSpace(os.Getenv("TENANT_TIERS")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.TenantTiers); err != nil {
+			return nil, fmt.Errorf("TENANT_TIERS is not a valid JSON object: %w", err)
+		}
+		for tenant, tier := range cfg.TenantTiers {
+			if _, ok := tierHints[tier]; !ok {
+				return nil, fmt.Errorf("TENANT_TIERS: unknown tier %q for tenant %s", tier, tenant)
+			}
+		}
+	}
+
+	if value := strings.TrimSpace(os.Getenv("UPLOAD_HINT_LOAD_FACTOR")); value != "" {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || factor <= 0 || factor > 1 {
+			return nil, fmt.Errorf("UPLOAD_HINT_LOAD_FACTOR must be in (0, 1]: %q", value)
+		}
+		cfg.LoadFactor = factor
+	}
+	return cfg, nil
+}
+
+// For returns the hints for a tenant. Hints are advisory: S3 does not enforce them,
+// so they only steer well-behaved clients such as the load test tool.
+func (c *UploadHintConfig) For(tenantID string) *UploadHints {
+	if c == nil {
+		return nil
+	}
+	tier, ok := c.TenantTiers[tenantID]
+	if !ok {
+		tier = c.DefaultTier
+	}
+
+	hints := tierHints[tier]
+	hints.Tier = tier
+	hints.MaxParallelParts = max(1, int(float64(hints.MaxParallelParts)*c.LoadFactor))
+	if hints.MaxBytesPerSecond > 0 {
+		hints.MaxBytesPerSecond = int64(float64(hints.MaxBytesPerSecond) * c.LoadFactor)
+	}
+	return &hints
+}
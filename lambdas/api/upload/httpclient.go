@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// HTTPClientConfig tunes the HTTP client shared by all AWS SDK clients (S3, STS).
+// Zero values keep the SDK defaults. The SDK allows only 10 idle connections per host,
+// which causes connection churn when many tenants presign or upload concurrently.
+type HTTPClientConfig struct {
+	MaxIdleConns        int64         // Idle connections kept across all hosts
+	MaxIdleConnsPerHost int64         // Idle connections kept per host (S3 endpoint, STS endpoint)
+	IdleConnTimeout     time.Duration // How long an idle connection stays in the pool
+	Timeout             time.Duration // Overall timeout per request, including reading the body
+	DialTimeout         time.Duration // TCP connect timeout
+	TLSHandshakeTimeout time.Duration // TLS handshake timeout
+	KeepAlive           time.Duration // TCP keep-alive probe interval; negative disables keep-alive
+	HTTP2               bool          // Attempt HTTP/2 (the SDK default)
+}
+
+// LoadHTTPClientConfig reads the AWS SDK HTTP client tuning from environment variables
+func LoadHTTPClientConfig() (*HTTPClientConfig, error) {
+	cfg := &HTTPClientConfig{}
+
+	var err error
+	if cfg.MaxIdleConns, err = envInt64("HTTP_CLIENT_MAX_IDLE_CONNS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxIdleConnsPerHost, err = envInt64("HTTP_CLIENT_MAX_IDLE_CONNS_PER_HOST", 0); err != nil {
+		return nil, err
+	}
+	if cfg.IdleConnTimeout, err = envDuration("HTTP_CLIENT_IDLE_CONN_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Timeout, err = envDuration("HTTP_CLIENT_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.DialTimeout, err = envDuration("HTTP_CLIENT_DIAL_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.TLSHandshakeTimeout, err = envDuration("HTTP_CLIENT_TLS_HANDSHAKE_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if cfg.KeepAlive, err = envDuration("HTTP_CLIENT_KEEP_ALIVE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.HTTP2, err = envBool("HTTP_CLIENT_HTTP2", true); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("HTTP client idle connection limits cannot be negative")
+	}
+
+	return cfg, nil
+}
+
+// NewHTTPClient builds the SDK HTTP client with the configured overrides applied
+func (c *HTTPClientConfig) NewHTTPClient() *awshttp.BuildableClient {
+	client := awshttp.NewBuildableClient().
+		WithTransportOptions(func(tr *http.Transport) {
+			if c.MaxIdleConns > 0 {
+				tr.MaxIdleConns = int(c.MaxIdleConns)
+			}
+			if c.MaxIdleConnsPerHost > 0 {
+				tr.MaxIdleConnsPerHost = int(c.MaxIdleConnsPerHost)
+			}
+			if c.IdleConnTimeout > 0 {
+				tr.IdleConnTimeout = c.IdleConnTimeout
+			}
+			if c.TLSHandshakeTimeout > 0 {
+				tr.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+			}
+			if !c.HTTP2 {
+				// A non-nil empty TLSNextProto map is how net/http disables HTTP/2
+				tr.ForceAttemptHTTP2 = false
+				tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+			}
+		}).
+		WithDialerOptions(func(d *net.Dialer) {
+			if c.DialTimeout > 0 {
+				d.Timeout = c.DialTimeout
+			}
+			if c.KeepAlive != 0 {
+				d.KeepAlive = c.KeepAlive
+			}
+		})
+
+	if c.Timeout > 0 {
+		client = client.WithTimeout(c.Timeout)
+	}
+	return client
+}
+
+// String summarizes the overrides for the startup log
+func (c *HTTPClientConfig) String() string {
+	return fmt.Sprintf("maxIdleConns=%d maxIdleConnsPerHost=%d idleConnTimeout=%s timeout=%s dialTimeout=%s tlsHandshakeTimeout=%s keepAlive=%s http2=%t",
+		c.MaxIdleConns, c.MaxIdleConnsPerHost, c.IdleConnTimeout, c.Timeout, c.DialTimeout, c.TLSHandshakeTimeout, c.KeepAlive, c.HTTP2)
+}
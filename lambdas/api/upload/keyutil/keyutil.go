@@ -0,0 +1,118 @@
+// Package keyutil validates and canonicalizes client-influenced S3 object key components.
+// Every code path that builds or accepts an object key from client input should go through
+// this package so that traversal sequences, control characters and oversized keys are
+// rejected consistently.
+package keyutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxKeyLength is the maximum length of a full object key in bytes (S3 limit)
+	MaxKeyLength = 1024
+
+	// MaxSegmentLength is the maximum length of a single path segment in bytes
+	MaxSegmentLength = 255
+)
+
+// ErrInvalidKey is returned (wrapped) for any key or segment that fails validation
+var ErrInvalidKey = errors.New("invalid object key")
+
+// ValidateSegment checks a single key segment such as a container key component or file name
+func ValidateSegment(segment string) error {
+	switch {
+	case segment == "":
+		return fmt.Errorf("%w: empty segment", ErrInvalidKey)
+	case segment == "." || segment == "..":
+		return fmt.Errorf("%w: relative segment %q", ErrInvalidKey, segment)
+	case len(segment) > MaxSegmentLength:
+		return fmt.Errorf("%w: segment longer than %d bytes", ErrInvalidKey, MaxSegmentLength)
+	case !utf8.ValidString(segment):
+		return fmt.Errorf("%w: segment is not valid UTF-8", ErrInvalidKey)
+	case strings.ContainsAny(segment, "/\\"):
+		return fmt.Errorf("%w: segment %q contains a path separator", ErrInvalidKey, segment)
+	}
+
+	for _, r := range segment {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%w: segment contains control character %U", ErrInvalidKey, r)
+		}
+	}
+	return nil
+}
+
+// Canonicalize validates a slash-separated key and returns its canonical form.
+// Absolute-looking keys (leading slash or drive letter) are rejected, empty segments from
+// repeated or trailing slashes are dropped, and every remaining segment is validated.
+func Canonicalize(key string) (string, error) {
+	if strings.HasPrefix(key, "/") || strings.HasPrefix(key, "\\") {
+		return "", fmt.Errorf("%w: absolute key %q", ErrInvalidKey, key)
+	}
+
+	segments := make([]string, 0, strings.Count(key, "/")+1)
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			continue
+		}
+		if err := ValidateSegment(segment); err != nil {
+			return "", err
+		}
+		segments = append(segments, segment)
+	}
+
+	if len(segments) == 0 {
+		return "", fmt.Errorf("%w: empty key", ErrInvalidKey)
+	}
+	if isDriveLetter(segments[0]) {
+		return "", fmt.Errorf("%w: absolute key %q", ErrInvalidKey, key)
+	}
+
+	canonical := strings.Join(segments, "/")
+	if len(canonical) > MaxKeyLength {
+		return "", fmt.Errorf("%w: key longer than %d bytes", ErrInvalidKey, MaxKeyLength)
+	}
+	return canonical, nil
+}
+
+// Join validates each segment and joins them into a key. The result is canonical, so it
+// passes RequireCanonical when the client echoes it back.
+func Join(segments ...string) (string, error) {
+	for _, segment := range segments {
+		if err := ValidateSegment(segment); err != nil {
+			return "", err
+		}
+	}
+
+	key := strings.Join(segments, "/")
+	if len(segments) > 0 && isDriveLetter(segments[0]) {
+		return "", fmt.Errorf("%w: absolute key %q", ErrInvalidKey, key)
+	}
+	if len(key) > MaxKeyLength {
+		return "", fmt.Errorf("%w: key longer than %d bytes", ErrInvalidKey, MaxKeyLength)
+	}
+	return key, nil
+}
+
+// RequireCanonical validates a key that must already be in canonical form, such as an
+// object key the service issued earlier and the client echoes back
+func RequireCanonical(key string) error {
+	canonical, err := Canonicalize(key)
+	if err != nil {
+		return err
+	}
+	if canonical != key {
+		return fmt.Errorf("%w: key %q is not canonical", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// isDriveLetter reports whether a segment looks like a Windows drive such as "C:"
+func isDriveLetter(segment string) bool {
+	return len(segment) == 2 && segment[1] == ':' &&
+		(segment[0] >= 'a' && segment[0] <= 'z' || segment[0] >= 'A' && segment[0] <= 'Z')
+}
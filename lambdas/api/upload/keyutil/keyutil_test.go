@@ -0,0 +1,85 @@
+package keyutil
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// checkCanonical fails the test unless key is a canonical key: relative, without empty or
+// relative segments, with only valid segments and within the length limit
+func checkCanonical(t *testing.T, key string) {
+	t.Helper()
+	if len(key) > MaxKeyLength {
+		t.Fatalf("key of %d bytes exceeds %d", len(key), MaxKeyLength)
+	}
+	segments := strings.Split(key, "/")
+	if isDriveLetter(segments[0]) {
+		t.Fatalf("key %q starts with a drive letter", key)
+	}
+	for _, segment := range segments {
+		if err := ValidateSegment(segment); err != nil {
+			t.Fatalf("key %q has an invalid segment: %v", key, err)
+		}
+	}
+	if err := RequireCanonical(key); err != nil {
+		t.Fatalf("RequireCanonical(%q): %v", key, err)
+	}
+}
+
+func FuzzCanonicalize(f *testing.F) {
+	for _, seed := range []string{
+		"tenant-a/photos/cat.jpg",
+		"tenant-a//photos/",
+		"../tenant-b/secret",
+		"tenant-a/./x",
+		"/etc/passwd",
+		`\\server\share`,
+		"C:/Windows",
+		"tenant-a/a\x00b",
+		"tenant-a/\xff",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, key string) {
+		canonical, err := Canonicalize(key)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Fatalf("Canonicalize(%q) error %v does not wrap ErrInvalidKey", key, err)
+			}
+			return
+		}
+		checkCanonical(t, canonical)
+
+		// Canonicalizing only drops empty segments
+		if canonical != strings.Join(strings.FieldsFunc(key, func(r rune) bool { return r == '/' }), "/") {
+			t.Fatalf("Canonicalize(%q) = %q changed more than empty segments", key, canonical)
+		}
+		if again, err := Canonicalize(canonical); err != nil || again != canonical {
+			t.Fatalf("Canonicalize(%q) = %q, %v; want it unchanged", canonical, again, err)
+		}
+	})
+}
+
+func FuzzJoin(f *testing.F) {
+	f.Add("tenant-a", "photos", "cat.jpg")
+	f.Add("tenant-a", "..", "secret")
+	f.Add("tenant-a", "a/b", "c")
+	f.Add("C:", "Windows", "system32")
+	f.Add("tenant-a", "", "x")
+
+	f.Fuzz(func(t *testing.T, tenant, folder, name string) {
+		key, err := Join(tenant, folder, name)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Fatalf("Join error %v does not wrap ErrInvalidKey", err)
+			}
+			return
+		}
+		checkCanonical(t, key)
+		if key != tenant+"/"+folder+"/"+name {
+			t.Fatalf("Join(%q, %q, %q) = %q", tenant, folder, name, key)
+		}
+	})
+}
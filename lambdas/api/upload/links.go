@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+)
+
+const (
+	// DefaultUploadLinkTTL is how long a minted upload link can be redeemed when not specified
+	DefaultUploadLinkTTL = 24 * time.Hour
+
+	// MaxUploadLinkTTL is the longest lifetime a tenant user can request for an upload link
+	MaxUploadLinkTTL = 7 * 24 * time.Hour
+
+	// UploadLinkURLDuration is the lifetime of the presigned PUT handed out on redemption
+	UploadLinkURLDuration = 15 * time.Minute
+
+	// DefaultUploadLinkFolder is the folder under the tenant prefix receiving partner uploads
+	DefaultUploadLinkFolder = "partner-uploads"
+
+	// uploadLinkTokenBytes is the amount of randomness in a link token
+	uploadLinkTokenBytes = 32
+)
+
+// ErrUploadLinkUnavailable is returned when a link token is unknown, expired or already used.
+// The cases are deliberately not distinguished so tokens cannot be probed.
+var ErrUploadLinkUnavailable = errors.New("upload link not found, expired or already used")
+
+// UploadLinkService mints and redeems one-time upload links for external partners.
+// Links are stored in DynamoDB by the SHA-256 of their token, so a table read never
+// reveals a usable token. Redemption is a conditional update, which makes each link
+// single-use even under concurrent requests.
+type UploadLinkService struct {
+	dynamoClient *dynamodb.Client
+	tableName    string
+	uploads      *UploadService
+}
+
+// NewUploadLinkService creates an upload link service backed by the given table
+func NewUploadLinkService(cfg aws.Config, tableName string, uploads *UploadService) *UploadLinkService {
+	return &UploadLinkService{
+		dynamoClient: dynamodb.NewFromConfig(cfg),
+		tableName:    tableName,
+		uploads:      uploads,
+	}
+}
+
+// hashUploadLinkToken returns the table key for a link token
+func hashUploadLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateCreateUploadLinkRequest validates the mint request and returns the link lifetime
+func validateCreateUploadLinkRequest(tenantID string, req *CreateUploadLinkRequest) (time.Duration, error) {
+	if tenantID == "" {
+		return 0, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if req.Folder != "" {
+		if _, err := keyutil.Canonicalize(req.Folder); err != nil {
+			return 0, err
+		}
+	}
+
+	ttl := DefaultUploadLinkTTL
+	if req.ExpiresInSeconds != 0 {
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > MaxUploadLinkTTL {
+		return 0, fmt.Errorf("expiresInSeconds must be between 1 and %d", int64(MaxUploadLinkTTL/time.Second))
+	}
+	return ttl, nil
+}
+
+// CreateUploadLink mints a single-use link that lets a partner upload one file into the
+// tenant's prefix. The minting user is recorded on the link for audit attribution.
+func (s *UploadLinkService) CreateUploadLink(ctx context.Context, tenantID, username string, req *CreateUploadLinkRequest) (*CreateUploadLinkResponse, error) {
+	ttl, err := validateCreateUploadLinkRequest(tenantID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := DefaultUploadLinkFolder
+	if req.Folder != "" {
+		folder, _ = keyutil.Canonicalize(req.Folder)
+	}
+	objectKey, err := keyutil.Join(tenantID, folder, uuid.New().String()+".raw")
+	if err != nil {
+		return nil, err
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Generate the token handed to the partner; only its hash is stored
+	raw := make([]byte, uploadLinkTokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate link token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	tokenHash := hashUploadLinkToken(token)
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	_, err = s.dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]types.AttributeValue{
+			"token_hash":   &types.AttributeValueMemberS{Value: tokenHash},
+			"tenant_id":    &types.AttributeValueMemberS{Value: tenantID},
+			"object_key":   &types.AttributeValueMemberS{Value: objectKey},
+			"content_type": &types.AttributeValueMemberS{Value: contentType},
+			"minted_by":    &types.AttributeValueMemberS{Value: username},
+			"created_at":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			"expires_at":   &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(token_hash)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store upload link: %w", err)
+	}
+
+	linkID := tokenHash[:12]
+	log.Printf("AUDIT upload link minted: link=%s tenant=%s user=%s key=%s expires=%s%s%s",
+		linkID, tenantID, username, objectKey, expiresAt.UTC().Format(time.RFC3339), clientFields(ctx), geoFields(ctx))
+
+	return &CreateUploadLinkResponse{
+		LinkID:    linkID,
+		Token:     token,
+		Path:      "/links/" + token,
+		ObjectKey: objectKey,
+		ExpiresAt: expiresAt.Unix(),
+	}, nil
+}
+
+// RedeemUploadLink consumes a link token and returns a presigned PUT for its object key.
+// The conditional update fails for unknown, expired and already redeemed tokens alike.
+// When no URL can be presigned, the link is released again so the partner can retry.
+func (s *UploadLinkService) RedeemUploadLink(ctx context.Context, token, sourceIP string) (*RedeemUploadLinkResponse, error) {
+	if token == "" {
+		return nil, ErrUploadLinkUnavailable
+	}
+	tokenHash := hashUploadLinkToken(token)
+	now := time.Now()
+
+	updateResp, err := s.dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"token_hash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		UpdateExpression:    aws.String("SET redeemed_at = :now, redeemed_ip = :ip"),
+		ConditionExpression: aws.String("attribute_exists(token_hash) AND attribute_not_exists(redeemed_at) AND expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":ip":  &types.AttributeValueMemberS{Value: sourceIP},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil, ErrUploadLinkUnavailable
+		}
+		return nil, fmt.Errorf("failed to redeem upload link: %w", err)
+	}
+
+	item := updateResp.Attributes
+	tenantID := stringAttribute(item, "tenant_id")
+	objectKey := stringAttribute(item, "object_key")
+	contentType := stringAttribute(item, "content_type")
+
+	// Sign with a session attributed to the minting user, so CloudTrail shows who let the partner in
+	mintedBy := stringAttribute(item, "minted_by")
+	if mintedBy != "" {
+		ctx = WithUsername(ctx, mintedBy)
+	}
+
+	uploadURL, err := s.uploads.PresignPutObject(ctx, tenantID, objectKey, contentType, UploadLinkURLDuration)
+	if err != nil {
+		if releaseErr := s.release(context.WithoutCancel(ctx), tokenHash, now); releaseErr != nil {
+			log.Printf("Upload link %s stays redeemed after a failed redemption: %v", tokenHash[:12], releaseErr)
+		}
+		return nil, err
+	}
+
+	log.Printf("AUDIT upload link redeemed: link=%s tenant=%s minted_by=%s key=%s ip=%s%s%s",
+		tokenHash[:12], tenantID, mintedBy, objectKey, sourceIP, clientFields(ctx), geoFields(ctx))
+
+	// The encryption headers are signed into the URL, so the partner has to send them too
+	headers := map[string]string{"Content-Type": contentType}
+	for name, value := range s.uploads.encryption.PutHeaders(tenantID) {
+		headers[name] = value
+	}
+
+	return &RedeemUploadLinkResponse{
+		UploadURL: uploadURL,
+		Method:    "PUT",
+		Headers:   headers,
+		ExpiresAt: now.Add(UploadLinkURLDuration).Unix(),
+	}, nil
+}
+
+// release undoes a redemption that handed out no URL. The condition matches only the
+// redemption made at redeemedAt, so a later successful one is never undone.
+func (s *UploadLinkService) release(ctx context.Context, tokenHash string, redeemedAt time.Time) error {
+	_, err := s.dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"token_hash": &types.AttributeValueMemberS{Value: tokenHash},
+		},
+		UpdateExpression:    aws.String("REMOVE redeemed_at, redeemed_ip"),
+		ConditionExpression: aws.String("redeemed_at = :redeemed"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":redeemed": &types.AttributeValueMemberN{Value: strconv.FormatInt(redeemedAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release upload link: %w", err)
+	}
+	return nil
+}
+
+// stringAttribute reads a string attribute from a DynamoDB item, returning "" when absent
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if attr, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return attr.Value
+	}
+	return ""
+}
+
+// PresignPutObject presigns a single PUT of objectKey in the tenant's prefix with the given
+// content type, used for uploads by parties that have no credentials of their own
+func (s *UploadService) PresignPutObject(ctx context.Context, tenantID, objectKey, contentType string, expiration time.Duration) (string, error) {
+	if err := validateTenantObjectKey(tenantID, objectKey); err != nil {
+		return "", err
+	}
+
+	// Require tenant credentials that outlive the presigned URL, bound to the tenant's networks if configured
+	ctx = WithCredentialValidity(ctx, expiration)
+	ctx, err := s.bindings.Bind(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := s.presigning.Acquire(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	presignClient := s3.NewPresignClient(s.s3Clients.Get(tenantID))
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.presignBucketFor(tenantID)),
+		Key:         aws.String(objectKey),
+		ContentType: aws.String(contentType),
+	}
+	s.encryption.ApplyPutObject(input, tenantID)
+	presignResp, err := presignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(expiration))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign upload: %w", err)
+	}
+	return presignResp.URL, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// dynamoStub answers DynamoDB API calls with canned JSON responses per operation, error
+// responses (those with a __type) as 400, and records the requests it received
+type dynamoStub struct {
+	mu        sync.Mutex
+	responses map[string]string
+	requests  []dynamoCall
+}
+
+type dynamoCall struct {
+	Operation string
+	Body      map[string]any
+}
+
+func (d *dynamoStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	raw, _ := io.ReadAll(r.Body)
+	var body map[string]any
+	json.Unmarshal(raw, &body)
+
+	d.mu.Lock()
+	d.requests = append(d.requests, dynamoCall{Operation: operation, Body: body})
+	response, ok := d.responses[operation]
+	d.mu.Unlock()
+
+	if !ok {
+		response = `{"__type":"com.amazon.coral.validate#ValidationException","message":"unexpected call"}`
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if strings.Contains(response, `"__type"`) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	io.WriteString(w, response)
+}
+
+func (d *dynamoStub) calls() []dynamoCall {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]dynamoCall(nil), d.requests...)
+}
+
+// newDynamoStub starts a stub DynamoDB endpoint and returns a client for it
+func newDynamoStub(t *testing.T, responses map[string]string) (*dynamoStub, *dynamodb.Client) {
+	t.Helper()
+	stub := &dynamoStub{responses: responses}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "eu-central-1",
+		BaseEndpoint:     aws.String(server.URL),
+		RetryMaxAttempts: 1,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+	return stub, client
+}
+
+func TestRedeemUploadLinkReleasesOnPresignFailure(t *testing.T) {
+	// The stored key lies outside the tenant's prefix, so presigning fails before any S3 call
+	stub, client := newDynamoStub(t, map[string]string{
+		"UpdateItem": `{"Attributes": {
+			"tenant_id": {"S": "tenant-a"},
+			"object_key": {"S": "tenant-b/partner-uploads/file.raw"},
+			"content_type": {"S": "application/pdf"},
+			"minted_by": {"S": "tom"}
+		}}`,
+	})
+	links := &UploadLinkService{dynamoClient: client, tableName: "links", uploads: &UploadService{}}
+
+	_, err := links.RedeemUploadLink(context.Background(), "token", "192.0.2.1")
+	if !errors.Is(err, ErrForeignObjectKey) {
+		t.Fatalf("RedeemUploadLink error = %v, want %v", err, ErrForeignObjectKey)
+	}
+
+	calls := stub.calls()
+	if len(calls) != 2 {
+		t.Fatalf("got %d DynamoDB calls, want the redemption and its release", len(calls))
+	}
+	redeem, release := calls[0].Body, calls[1].Body
+	if got := release["UpdateExpression"]; got != "REMOVE redeemed_at, redeemed_ip" {
+		t.Fatalf("release UpdateExpression = %v", got)
+	}
+	if release["Key"].(map[string]any)["token_hash"].(map[string]any)["S"] != hashUploadLinkToken("token") {
+		t.Fatalf("release Key = %v, want the redeemed link", release["Key"])
+	}
+	// Only the failed redemption itself may be undone
+	redeemedAt := redeem["ExpressionAttributeValues"].(map[string]any)[":now"]
+	releasedAt := release["ExpressionAttributeValues"].(map[string]any)[":redeemed"]
+	if releasedAt == nil || releasedAt.(map[string]any)["N"] != redeemedAt.(map[string]any)["N"] {
+		t.Fatalf("release condition value = %v, want the redemption time %v", releasedAt, redeemedAt)
+	}
+}
+
+func TestRedeemUploadLinkUnavailable(t *testing.T) {
+	// Unknown, expired and redeemed tokens all fail the conditional update
+	_, client := newDynamoStub(t, map[string]string{
+		"UpdateItem": `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`,
+	})
+	links := &UploadLinkService{dynamoClient: client, tableName: "links", uploads: &UploadService{}}
+
+	if _, err := links.RedeemUploadLink(context.Background(), "token", "192.0.2.1"); !errors.Is(err, ErrUploadLinkUnavailable) {
+		t.Fatalf("RedeemUploadLink error = %v, want %v", err, ErrUploadLinkUnavailable)
+	}
+}
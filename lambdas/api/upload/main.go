@@ -2,67 +2,318 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/extension"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/render"
 )
 
 // Global variables to hold initialized services
 var (
 	uploadService *UploadService
+	linkService   *UploadLinkService // nil when UPLOAD_LINKS_TABLE is not configured
+	tokenService  *APITokenService   // nil when API_TOKENS_TABLE is not configured
+	errorReporter *ErrorReporter     // nil when ERROR_REPORT_DSN is not configured
+	router        *chi.Mux
+
+	// Settings validated at init and consumed by the lazy service initialization
+	sharedBucket     string
+	faultConfig      *FaultConfig
+	httpClientConfig *HTTPClientConfig
+	downloadMaxBytes int64
+	uploadLinksTable string
+	apiTokensTable   string
+	rateLimitCounter *RateLimitCounter // nil when RATE_LIMIT_TABLE is not configured
+	serviceOptions   UploadServiceOptions
+	servicesOnce     sync.Once
 )
 
-// Init initializes the AWS clients and services
+// Init validates configuration and builds the router.
+// Nothing here touches the network or resolves AWS credentials, so the initialized
+// state is safe to checkpoint (e.g. with Lambda SnapStart); AWS clients are created
+// lazily on the first invocation by initServices.
 func init() {
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-
 	// Get the shared bucket name from environment variable
-	sharedBucket := os.Getenv("SHARED_BUCKET")
+	sharedBucket = os.Getenv("SHARED_BUCKET")
 	if sharedBucket == "" {
 		log.Fatal("SHARED_BUCKET environment variable not set")
 	}
 
-	// Initialize upload service with AWS config and bucket name
-	uploadService = NewUploadService(cfg, sharedBucket)
+	// Optionally inject faults into AWS calls for resilience testing (never set in production)
+	var err error
+	faultConfig, err = LoadFaultConfig()
+	if err != nil {
+		log.Fatalf("Failed to load fault injection config: %v", err)
+	}
+
+	// Record metrics per Lambda version as well, for comparing canary and stable versions
+	if err := LoadMetricsVersionDimension(); err != nil {
+		log.Fatalf("Failed to load metrics config: %v", err)
+	}
+	log.Printf("Running build %s on function version %s", currentBuild(), currentBuild().FunctionVersion)
+
+	// Tune the HTTP client shared by the AWS SDK clients
+	httpClientConfig, err = LoadHTTPClientConfig()
+	if err != nil {
+		log.Fatalf("Failed to load HTTP client config: %v", err)
+	}
+
+	// Size cap for objects served by the download proxy
+	downloadMaxBytes, err = envInt64("DOWNLOAD_PROXY_MAX_BYTES", DefaultDownloadProxyMaxBytes)
+	if err != nil {
+		log.Fatalf("Failed to load download proxy config: %v", err)
+	}
+	if downloadMaxBytes <= 0 || downloadMaxBytes > MaxDownloadProxyMaxBytes {
+		log.Fatalf("DOWNLOAD_PROXY_MAX_BYTES must be between 1 and %d", MaxDownloadProxyMaxBytes)
+	}
+
+	// Fail fast instead of piling up on STS while it throttles or errors
+	serviceOptions.STSBreaker, err = LoadSTSBreakerConfig()
+	if err != nil {
+		log.Fatalf("Failed to load STS circuit breaker config: %v", err)
+	}
+
+	// Queue bursts of presigning and AssumeRole instead of running them all at once
+	serviceOptions.Concurrency, err = LoadConcurrencyConfig()
+	if err != nil {
+		log.Fatalf("Failed to load concurrency config: %v", err)
+	}
+
+	// Fail over to a second STS region when the primary endpoint errors
+	serviceOptions.STSEndpoints, err = LoadSTSEndpointConfig()
+	if err != nil {
+		log.Fatalf("Failed to load STS endpoint config: %v", err)
+	}
+
+	// Completions cut short are recorded for the completion retry worker when its table is configured
+	serviceOptions.CompletionPendingTable = os.Getenv("COMPLETION_PENDING_TABLE")
+	serviceOptions.SSEKMSKeyID = os.Getenv("SSE_KMS_KEY_ID")
+
+	// Reported to clients as the restore window of deleted objects
+	trashDays, err := envInt64("TRASH_RETENTION_DAYS", DefaultTrashRetentionDays)
+	if err != nil || trashDays <= 0 {
+		log.Fatalf("TRASH_RETENTION_DAYS must be a positive number of days")
+	}
+	serviceOptions.TrashRetentionDays = int(trashDays)
+
+	// Signed upload receipts are enabled by configuring their KMS signing key
+	serviceOptions.ReceiptSigningKeyID = os.Getenv("RECEIPT_SIGNING_KEY_ID")
+
+	// Parallelism and rate hints returned when initiating multipart uploads
+	serviceOptions.UploadHints, err = LoadUploadHintConfig()
+	if err != nil {
+		log.Fatalf("Failed to load upload hint config: %v", err)
+	}
+
+	// Bounded by the API Gateway integration timeout, which the completion has to fit in as well
+	serviceOptions.ReplicationWaitTimeout, err = envDuration("REPLICATION_WAIT_TIMEOUT", DefaultReplicationWaitTimeout)
+	if err != nil || serviceOptions.ReplicationWaitTimeout <= 0 || serviceOptions.ReplicationWaitTimeout > MaxReplicationWaitTimeout {
+		log.Fatalf("REPLICATION_WAIT_TIMEOUT must be a positive duration up to %s", MaxReplicationWaitTimeout)
+	}
+
+	// Globally distributed uploaders get SigV4a URLs valid in every region of the access point
+	serviceOptions.TenantMRAPs, err = LoadTenantMultiRegionAccessPoints()
+	if err != nil {
+		log.Fatalf("Failed to load tenant Multi-Region Access Points: %v", err)
+	}
+
+	// Mitigate stored XSS through uploaded HTML served to browsers
+	serviceOptions.ContentPolicies, err = LoadContentPolicies()
+	if err != nil {
+		log.Fatalf("Failed to load content policies: %v", err)
+	}
+
+	// Tenants served through their own S3 Access Point instead of the shared bucket
+	serviceOptions.TenantAccessPoints, err = LoadTenantAccessPoints()
+	if err != nil {
+		log.Fatalf("Failed to load tenant access points: %v", err)
+	}
+
+	// Tenants whose presigned URLs only work from their own networks
+	serviceOptions.PresignBindings, err = LoadPresignBindings()
+	if err != nil {
+		log.Fatalf("Failed to load presigned URL network bindings: %v", err)
+	}
+
+	// Tenants sending many tiny documents have them buffered into shared objects
+	serviceOptions.Aggregation, err = LoadAggregationConfig()
+	if err != nil {
+		log.Fatalf("Failed to load upload aggregation config: %v", err)
+	}
+
+	// Mobile clients of these tenants can upload with the AWS SDK directly
+	serviceOptions.DelegationTenants, serviceOptions.DelegationDuration, err = LoadDelegationTenants()
+	if err != nil {
+		log.Fatalf("Failed to load delegated credentials config: %v", err)
+	}
+
+	// Premium tenants can get longer sessions and presigned URL windows
+	serviceOptions.SessionSettings, err = LoadSessionConfig()
+	if err != nil {
+		log.Fatalf("Failed to load tenant session settings: %v", err)
+	}
+
+	// Request bodies with unknown or miscased fields are rejected unless turned off for old clients
+	render.Strict, err = envBool("STRICT_REQUEST_DECODING", true)
+	if err != nil {
+		log.Fatalf("Failed to load request decoding config: %v", err)
+	}
+
+	// Integrators' sandbox tenants store objects in a separate, short-lived bucket
+	serviceOptions.Sandbox, err = LoadSandboxConfig()
+	if err != nil {
+		log.Fatalf("Failed to load sandbox config: %v", err)
+	}
+
+	// One-time partner upload links are enabled by configuring their table
+	uploadLinksTable = os.Getenv("UPLOAD_LINKS_TABLE")
+
+	// Tenant-managed API tokens are enabled by configuring their table (shared with the authorizer)
+	apiTokensTable = os.Getenv("API_TOKENS_TABLE")
 
-	log.Printf("Services initialized with shared bucket: %s", sharedBucket)
+	// Build the router once so middleware state (e.g. rate limit counters) survives across invocations
+	middlewareConfig, err := LoadMiddlewareConfig()
+	if err != nil {
+		log.Fatalf("Failed to load middleware config: %v", err)
+	}
+	serviceOptions.RequireSourceIdentity = middlewareConfig.RequireSourceIdentity
+	rateLimitCounter = middlewareConfig.SustainedCounter
+
+	// Server errors and panics go to a Sentry-compatible sink when a DSN is configured
+	errorReportConfig, err := LoadErrorReportConfig()
+	if err != nil {
+		log.Fatalf("Failed to load error reporting config: %v", err)
+	}
+	errorReporter, err = NewErrorReporter(errorReportConfig)
+	if err != nil {
+		log.Fatalf("Failed to configure error reporting: %v", err)
+	}
+	middlewareConfig.ErrorReporter = errorReporter
+
+	router = setupRouter(middlewareConfig)
+}
+
+// initServices loads the AWS configuration and initializes the services on first use.
+// Credentials are resolved here rather than at init so they are never baked into a snapshot.
+func initServices(ctx context.Context) {
+	servicesOnce.Do(func() {
+		// Load AWS configuration with the tuned HTTP client shared by all SDK clients
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(httpClientConfig.NewHTTPClient()))
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		log.Printf("AWS HTTP client: %s", httpClientConfig)
+
+		if faultConfig != nil {
+			cfg.APIOptions = append(cfg.APIOptions, faultConfig.AddToStack)
+			log.Printf("WARNING: fault injection enabled: %s", faultConfig)
+		}
+
+		// Initialize upload service with AWS config and bucket name
+		uploadService = NewUploadService(cfg, sharedBucket, serviceOptions)
+
+		if uploadLinksTable != "" {
+			linkService = NewUploadLinkService(cfg, uploadLinksTable, uploadService)
+		}
+		if apiTokensTable != "" {
+			tokenService = NewAPITokenService(cfg, apiTokensTable)
+		}
+		rateLimitCounter.SetClient(dynamodb.NewFromConfig(cfg))
+
+		log.Printf("Services initialized with shared bucket: %s", sharedBucket)
+	})
 }
 
 // setupRouter creates and configures the Chi router
-func setupRouter() *chi.Mux {
+func setupRouter(mwConfig *MiddlewareConfig) *chi.Mux {
 	r := chi.NewRouter()
 
-	// Middleware for all routes
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	// Middleware for all routes, assembled from configuration
+	r.Use(mwConfig.GlobalMiddleware()...)
+
+	// Unknown routes get the same error envelope as handler errors
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		render.Error(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+	})
 
 	// API routes
 	r.Route("/upload", func(r chi.Router) {
-		r.Post("/", handleUpload)
-		r.Post("/initiate", handleInitiateUpload)
-		r.Post("/complete", handleCompleteUpload)
-		r.Post("/abort", handleAbortUpload)
-		r.Post("/refresh", handleRefreshUpload)
+		r.Use(mwConfig.AuthMiddleware())
+		r.Use(SandboxWatermark(serviceOptions.Sandbox))
+		r.Use(APITokenOperation(APITokenOperationUpload))
+		r.With(APITokenNewUploads).Post("/", handleUpload)
+		r.With(APITokenNewUploads).Post("/records", handleUploadRecords)
+
+		// Control-plane endpoints also speak CBOR and MessagePack
+		r.Group(func(r chi.Router) {
+			r.Use(render.Codecs)
+			r.Use(SessionRemaining(serviceOptions.SessionSettings))
+			r.With(APITokenNewUploads).Post("/initiate", handleInitiateUpload)
+			r.Post("/complete", handleCompleteUpload)
+			r.Post("/abort", handleAbortUpload)
+			r.Post("/refresh", handleRefreshUpload)
+			r.With(APITokenNewUploads).Post("/revoke", handleRevokeUpload)
+			r.Get("/{uploadId}/events", handleUploadEvents)
+			r.With(DenyAPITokens).Post("/links", handleCreateUploadLink)
+			r.With(DenyAPITokens).Post("/credentials", handleDelegateCredentials)
+		})
+	})
+
+	// Redemption of one-time upload links by external partners (the token is the credential)
+	r.With(render.Codecs).Post("/links/{token}", handleRedeemUploadLink)
+
+	// Presigned GETs for clients that download straight from S3
+	r.Route("/download", func(r chi.Router) {
+		r.Use(mwConfig.AuthMiddleware())
+		r.Use(SandboxWatermark(serviceOptions.Sandbox))
+		r.Use(APITokenOperation(APITokenOperationDownload))
+		r.With(render.Codecs).Post("/presign-batch", handlePresignDownloadBatch)
+	})
+
+	// Download proxy for clients that cannot follow presigned URLs, and soft delete / restore
+	r.Route("/objects", func(r chi.Router) {
+		r.Use(mwConfig.AuthMiddleware())
+		r.Use(SandboxWatermark(serviceOptions.Sandbox))
+		r.With(APITokenOperation(APITokenOperationDownload), APITokenObjectKey).Get("/*", handleObjectGet)
+		r.With(render.Codecs, APITokenOperation(APITokenOperationDelete), APITokenObjectKey).Delete("/*", handleDeleteObject)
+		r.With(render.Codecs, APITokenOperation(APITokenOperationDelete), APITokenObjectKey).Post("/*", handleRestoreObject)
+	})
+
+	// Self-service API tokens for CI systems, managed by tenant admins
+	r.Route("/tokens", func(r chi.Router) {
+		r.Use(mwConfig.AuthMiddleware())
+		r.Use(DenyAPITokens)
+		r.Use(DenyAdminOverride)
+		r.Use(render.Codecs)
+		r.Post("/", handleCreateAPIToken)
+		r.Get("/", handleListAPITokens)
+		r.Delete("/{tokenId}", handleRevokeAPIToken)
 	})
 
-	// Health check endpoint
+	// Health check endpoint, reporting the build and Lambda version that answered
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
+		render.Respond(w, r, http.StatusOK, currentBuild())
 	})
 
 	return r
@@ -73,45 +324,107 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 	// Get tenant ID from the context (set by Lambda authorizer)
 	tenantID, ok := GetTenantID(r.Context())
 	if !ok {
-		http.Error(w, "Tenant ID not found in request context", http.StatusUnauthorized)
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Redirect mode: hand out a presigned PUT instead of proxying the body
+	if r.URL.Query().Get("mode") == UploadModeRedirect {
+		handleUploadRedirect(w, r, tenantID)
 		return
 	}
 
 	// Read request body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		render.Error(w, r, http.StatusBadRequest, "Failed to read request body")
 		return
 	}
 
 	// Validate JSON format
 	var jsonData interface{}
 	if err := json.Unmarshal(body, &jsonData); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		render.Error(w, r, http.StatusBadRequest, "Invalid JSON format")
 		return
 	}
 
 	// Use the context that already has tenant information
 	ctx := r.Context()
 
+	// Aggregating tenants get their document buffered and written later with others
+	if uploadService.AggregatesUploads(tenantID) {
+		filePath, err := uploadService.AggregateUpload(ctx, tenantID, body)
+		if err != nil {
+			log.Printf("Aggregated upload error: %v", err)
+			writeServiceError(w, r, err, "Failed to buffer upload")
+			return
+		}
+		render.Respond(w, r, http.StatusAccepted, UploadResponse{
+			Status:   UploadStatusBuffered,
+			FilePath: filePath,
+			TenantID: tenantID,
+		})
+		return
+	}
+
 	// Upload the file to S3
 	filePath, err := uploadService.UploadFile(ctx, tenantID, body)
 	if err != nil {
 		log.Printf("Upload error: %v", err)
-		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		writeServiceError(w, r, err, "Failed to upload file")
 		return
 	}
 
 	// Return success response with file path
-	response := map[string]string{
-		"status":    "success",
-		"file_path": filePath,
-		"tenant_id": tenantID,
+	render.Respond(w, r, http.StatusCreated, UploadResponse{
+		Status:   "success",
+		FilePath: filePath,
+		TenantID: tenantID,
+	})
+}
+
+// handleUploadRedirect answers a simple upload with a 307 to a presigned PUT. The request
+// is expected without a body; the client sends the file to the Location with the method
+// and headers listed in the response body. Clients must not follow the redirect blindly,
+// since a followed POST does not match the PUT signature.
+func handleUploadRedirect(w http.ResponseWriter, r *http.Request, tenantID string) {
+	resp, err := uploadService.PresignSimpleUpload(r.Context(), tenantID)
+	if err != nil {
+		log.Printf("Upload redirect error: %v", err)
+		writeServiceError(w, r, err, "Failed to prepare upload")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(response)
+	w.Header().Set("Location", resp.UploadURL)
+	render.Respond(w, r, http.StatusTemporaryRedirect, resp)
+}
+
+// handleUploadRecords accepts newline-delimited JSON records and reports per-record results
+func handleUploadRecords(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Read request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		render.Error(w, r, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+
+	// Validate and store the records in batches
+	resp, err := uploadService.UploadRecords(r.Context(), tenantID, body)
+	if err != nil {
+		log.Printf("Upload records error: %v", err)
+		writeServiceError(w, r, err, "Failed to upload records")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
 }
 
 // handleInitiateUpload handles multipart upload initiation
@@ -119,14 +432,14 @@ func handleInitiateUpload(w http.ResponseWriter, r *http.Request) {
 	// Get tenant ID from the context
 	tenantID, ok := GetTenantID(r.Context())
 	if !ok {
-		http.Error(w, "Tenant ID not found in request context", http.StatusUnauthorized)
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
 		return
 	}
 
 	// Parse request body
 	var req InitiateUploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
 		return
 	}
 
@@ -134,14 +447,12 @@ func handleInitiateUpload(w http.ResponseWriter, r *http.Request) {
 	resp, err := uploadService.InitiateMultipartUpload(r.Context(), tenantID, &req)
 	if err != nil {
 		log.Printf("Initiate upload error: %v", err)
-		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		writeServiceError(w, r, err, "Failed to initiate upload")
 		return
 	}
 
 	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(resp)
+	render.Respond(w, r, http.StatusOK, resp)
 }
 
 // handleCompleteUpload handles multipart upload completion
@@ -149,14 +460,30 @@ func handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
 	// Get tenant ID from the context
 	tenantID, ok := GetTenantID(r.Context())
 	if !ok {
-		http.Error(w, "Tenant ID not found in request context", http.StatusUnauthorized)
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
 		return
 	}
 
+	// Tenants that need their data in two regions before acknowledging ask to wait for replication
+	waitForReplication := false
+	if value := r.URL.Query().Get("wait-for-replication"); value != "" {
+		var err error
+		if waitForReplication, err = strconv.ParseBool(value); err != nil {
+			render.Error(w, r, http.StatusBadRequest, "wait-for-replication must be true or false")
+			return
+		}
+	}
+
 	// Parse request body
 	var req CompleteUploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	// API tokens limited to containers may only address uploads in them
+	if err := checkAPITokenKey(r.Context(), tenantID, req.ObjectKey); err != nil {
+		writeServiceError(w, r, err, "Failed to complete upload")
 		return
 	}
 
@@ -164,14 +491,34 @@ func handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
 	resp, err := uploadService.CompleteMultipartUpload(r.Context(), tenantID, &req)
 	if err != nil {
 		log.Printf("Complete upload error: %v", err)
-		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		writeServiceError(w, r, err, "Failed to complete upload")
 		return
 	}
 
+	if waitForReplication {
+		status, err := uploadService.WaitForReplication(r.Context(), tenantID, resp.ObjectKey)
+		if err != nil {
+			log.Printf("Replication wait error for %s: %v", resp.ObjectKey, err)
+			writeServiceError(w, r, err, "Upload completed, but its replication status is unknown")
+			return
+		}
+		resp.ReplicationStatus = status
+
+		// Only a completed replica acknowledges the upload; 202 tells the client to poll
+		// the content endpoint's X-Replication-Status header instead
+		switch status {
+		case ReplicationCompleted:
+		case ReplicationFailed:
+			render.Respond(w, r, http.StatusBadGateway, resp)
+			return
+		default:
+			render.Respond(w, r, http.StatusAccepted, resp)
+			return
+		}
+	}
+
 	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(resp)
+	render.Respond(w, r, http.StatusOK, resp)
 }
 
 // handleAbortUpload handles multipart upload abort
@@ -179,26 +526,32 @@ func handleAbortUpload(w http.ResponseWriter, r *http.Request) {
 	// Get tenant ID from the context
 	tenantID, ok := GetTenantID(r.Context())
 	if !ok {
-		http.Error(w, "Tenant ID not found in request context", http.StatusUnauthorized)
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
 		return
 	}
 
 	// Parse request body
 	var req AbortUploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	// API tokens limited to containers may only address uploads in them
+	if err := checkAPITokenKey(r.Context(), tenantID, req.ObjectKey); err != nil {
+		writeServiceError(w, r, err, "Failed to abort upload")
 		return
 	}
 
 	// Abort multipart upload
 	if err := uploadService.AbortMultipartUpload(r.Context(), tenantID, &req); err != nil {
 		log.Printf("Abort upload error: %v", err)
-		http.Error(w, "Failed to abort upload", http.StatusInternalServerError)
+		writeServiceError(w, r, err, "Failed to abort upload")
 		return
 	}
 
 	// Return success response
-	w.WriteHeader(http.StatusNoContent)
+	render.NoContent(w)
 }
 
 // handleRefreshUpload handles refreshing presigned URLs for multipart upload
@@ -206,14 +559,20 @@ func handleRefreshUpload(w http.ResponseWriter, r *http.Request) {
 	// Get tenant ID from the context
 	tenantID, ok := GetTenantID(r.Context())
 	if !ok {
-		http.Error(w, "Tenant ID not found in request context", http.StatusUnauthorized)
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
 		return
 	}
 
 	// Parse request body
 	var req RefreshUploadRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	// API tokens limited to containers may only address uploads in them
+	if err := checkAPITokenKey(r.Context(), tenantID, req.ObjectKey); err != nil {
+		writeServiceError(w, r, err, "Failed to refresh presigned URLs")
 		return
 	}
 
@@ -221,19 +580,479 @@ func handleRefreshUpload(w http.ResponseWriter, r *http.Request) {
 	resp, err := uploadService.RefreshPresignedUrls(r.Context(), tenantID, &req)
 	if err != nil {
 		log.Printf("Refresh upload error: %v", err)
-		http.Error(w, "Failed to refresh presigned URLs", http.StatusInternalServerError)
+		writeServiceError(w, r, err, "Failed to refresh presigned URLs")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleRevokeUpload aborts an upload whose presigned URLs must stop working and restarts it
+// under a new object key
+func handleRevokeUpload(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Parse request body
+	var req RevokeUploadRequest
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	// API tokens limited to containers may only address uploads in them
+	if err := checkAPITokenKey(r.Context(), tenantID, req.ObjectKey); err != nil {
+		writeServiceError(w, r, err, "Failed to revoke upload")
+		return
+	}
+
+	// Revoke the old URLs and start the replacement upload
+	resp, err := uploadService.RevokeUploadUrls(r.Context(), tenantID, &req)
+	if err != nil {
+		log.Printf("Revoke upload error: %v", err)
+		writeServiceError(w, r, err, "Failed to revoke upload")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleUploadEvents returns the timeline of a multipart upload, for debugging stuck uploads
+func handleUploadEvents(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// S3 addresses multipart uploads by key and upload ID
+	objectKey := r.URL.Query().Get("objectKey")
+	if objectKey == "" {
+		render.Error(w, r, http.StatusBadRequest, "objectKey query parameter required")
+		return
+	}
+	if err := checkAPITokenKey(r.Context(), tenantID, objectKey); err != nil {
+		writeServiceError(w, r, err, "Failed to read upload events")
+		return
+	}
+
+	resp, err := uploadService.UploadEvents(r.Context(), tenantID, chi.URLParam(r, "uploadId"), objectKey)
+	if err != nil {
+		log.Printf("Upload events error: %v", err)
+		writeServiceError(w, r, err, "Failed to read upload events")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handlePresignDownloadBatch returns presigned GET URLs for several of the tenant's objects
+func handlePresignDownloadBatch(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Parse request body
+	var req PresignDownloadBatchRequest
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	resp, err := uploadService.PresignDownloadBatch(r.Context(), tenantID, &req)
+	if err != nil {
+		log.Printf("Presign download batch error: %v", err)
+		writeServiceError(w, r, err, "Failed to presign downloads")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleDelegateCredentials returns write-only AWS credentials for the caller's upload folder
+func handleDelegateCredentials(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	creds, err := uploadService.DelegateCredentials(r.Context(), tenantID)
+	if err != nil {
+		log.Printf("Delegate credentials error: %v", err)
+		writeServiceError(w, r, err, "Failed to issue delegated credentials")
+		return
+	}
+
+	// Credentials must not be stored by intermediaries
+	w.Header().Set("Cache-Control", "no-store")
+	render.Respond(w, r, http.StatusOK, creds)
+}
+
+// handleCreateUploadLink mints a one-time upload link for an external partner
+func handleCreateUploadLink(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+	if linkService == nil {
+		render.Error(w, r, http.StatusNotFound, "Upload links are not enabled")
+		return
+	}
+	username, _ := GetUsername(r.Context())
+
+	// Parse request body
+	var req CreateUploadLinkRequest
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	resp, err := linkService.CreateUploadLink(r.Context(), tenantID, username, &req)
+	if err != nil {
+		log.Printf("Create upload link error: %v", err)
+		writeServiceError(w, r, err, "Failed to create upload link")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusCreated, resp)
+}
+
+// handleRedeemUploadLink exchanges a one-time link token for a presigned upload URL.
+// This route is unauthenticated; the unguessable, single-use token is the credential.
+func handleRedeemUploadLink(w http.ResponseWriter, r *http.Request) {
+	if linkService == nil {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	sourceIP, _ := GetSourceIP(r.Context())
+	resp, err := linkService.RedeemUploadLink(r.Context(), chi.URLParam(r, "token"), sourceIP)
+	if err != nil {
+		log.Printf("Redeem upload link error: %v", err)
+		writeServiceError(w, r, err, "Failed to redeem upload link")
+		return
+	}
+
+	// Return response
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleCreateAPIToken mints an API token; the secret is only returned in this response
+func handleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+	if tokenService == nil {
+		render.Error(w, r, http.StatusNotFound, "API tokens are not enabled")
+		return
+	}
+	username, _ := GetUsername(r.Context())
+
+	// Parse request body
+	var req CreateAPITokenRequest
+	if err := render.Decode(r, &req); err != nil {
+		render.DecodeError(w, r, err, "Invalid request body")
+		return
+	}
+
+	resp, err := tokenService.CreateAPIToken(r.Context(), tenantID, username, &req)
+	if err != nil {
+		log.Printf("Create API token error: %v", err)
+		writeServiceError(w, r, err, "Failed to create API token")
+		return
+	}
+
+	// The token must not be stored by intermediaries
+	w.Header().Set("Cache-Control", "no-store")
+	render.Respond(w, r, http.StatusCreated, resp)
+}
+
+// handleListAPITokens lists the tenant's unexpired API tokens, without their secrets
+func handleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+	if tokenService == nil {
+		render.Error(w, r, http.StatusNotFound, "API tokens are not enabled")
+		return
+	}
+
+	resp, err := tokenService.ListAPITokens(r.Context(), tenantID)
+	if err != nil {
+		log.Printf("List API tokens error: %v", err)
+		writeServiceError(w, r, err, "Failed to list API tokens")
 		return
 	}
 
 	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(resp)
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleRevokeAPIToken revokes an API token. Gateways that cache authorizer results keep
+// accepting the token until their cache entry expires.
+func handleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+	if tokenService == nil {
+		render.Error(w, r, http.StatusNotFound, "API tokens are not enabled")
+		return
+	}
+	username, _ := GetUsername(r.Context())
+
+	if err := tokenService.RevokeAPIToken(r.Context(), tenantID, username, chi.URLParam(r, "tokenId")); err != nil {
+		log.Printf("Revoke API token error: %v", err)
+		writeServiceError(w, r, err, "Failed to revoke API token")
+		return
+	}
+
+	// Return success response
+	render.NoContent(w)
+}
+
+// handleObjectContent serves a small object through the Lambda: GET /objects/{key}/content.
+// The object key keeps its slashes, so the route is a wildcard with a fixed suffix.
+// A single byte range in the Range header is honored with a 206 response, and
+// If-None-Match / If-Modified-Since return 304 when the client's copy is current.
+func handleObjectContent(w http.ResponseWriter, r *http.Request) {
+	// Get tenant ID from the context
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Split the object key from the /content suffix
+	rest, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil || !strings.HasSuffix(rest, "/content") {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	objectKey := strings.TrimSuffix(rest, "/content")
+
+	opts := ObjectContentOptions{
+		Range:       r.Header.Get("Range"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	}
+	if modifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		opts.IfModifiedSince = &modifiedSince
+	}
+
+	object, err := uploadService.GetObjectContent(r.Context(), tenantID, objectKey, opts, downloadMaxBytes)
+	if errors.Is(err, ErrNotModified) {
+		// The client's cached copy is current
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err != nil {
+		log.Printf("Object content error: %v", err)
+		writeServiceError(w, r, err, "Failed to read object")
+		return
+	}
+
+	// Return the object body with its metadata
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(object.Body)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if object.Disposition != "" {
+		w.Header().Set("Content-Disposition", object.Disposition)
+	}
+	if object.ETag != "" {
+		w.Header().Set("ETag", object.ETag)
+	}
+	if object.LastModified != nil {
+		w.Header().Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if object.Replication != "" {
+		w.Header().Set("X-Replication-Status", object.Replication)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if object.ContentRange != "" {
+		w.Header().Set("Content-Range", object.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, _ = w.Write(object.Body)
+}
+
+// handleObjectGet dispatches GET /objects/{key}/content and GET /objects/{key}/receipt;
+// object keys contain slashes, so the suffix selects the handler
+func handleObjectGet(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(chi.URLParam(r, "*"), "/receipt") {
+		render.Codecs(http.HandlerFunc(handleObjectReceipt)).ServeHTTP(w, r)
+		return
+	}
+	handleObjectContent(w, r)
+}
+
+// handleObjectReceipt re-issues the signed upload receipt of an object
+func handleObjectReceipt(w http.ResponseWriter, r *http.Request) {
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	rest, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	objectKey := strings.TrimSuffix(rest, "/receipt")
+
+	receipt, err := uploadService.IssueReceipt(r.Context(), tenantID, objectKey)
+	if err != nil {
+		log.Printf("Receipt error: %v", err)
+		writeServiceError(w, r, err, "Failed to issue receipt")
+		return
+	}
+	render.Respond(w, r, http.StatusOK, receipt)
+}
+
+// handleDeleteObject moves an object into the tenant's trash (DELETE /objects/{key})
+func handleDeleteObject(w http.ResponseWriter, r *http.Request) {
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	objectKey, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil || objectKey == "" {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	resp, err := uploadService.DeleteObject(r.Context(), tenantID, objectKey)
+	if err != nil {
+		log.Printf("Object delete error: %v", err)
+		writeServiceError(w, r, err, "Failed to delete object")
+		return
+	}
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// handleRestoreObject brings a trashed object back (POST /objects/{key}/restore)
+func handleRestoreObject(w http.ResponseWriter, r *http.Request) {
+	tenantID, ok := GetTenantID(r.Context())
+	if !ok {
+		render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+		return
+	}
+
+	// Split the object key from the /restore suffix
+	rest, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil || !strings.HasSuffix(rest, "/restore") {
+		render.Error(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	objectKey := strings.TrimSuffix(rest, "/restore")
+
+	resp, err := uploadService.RestoreObject(r.Context(), tenantID, objectKey)
+	if err != nil {
+		log.Printf("Object restore error: %v", err)
+		writeServiceError(w, r, err, "Failed to restore object")
+		return
+	}
+	render.Respond(w, r, http.StatusOK, resp)
+}
+
+// writeServiceError maps errors returned by the upload service to HTTP responses,
+// falling back to 500 with the given message for unexpected failures
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error, fallbackMessage string) {
+	var openErr *CircuitOpenError
+	var overloadedErr *OverloadedError
+	switch {
+	case errors.As(err, &openErr):
+		// Round up so clients never retry before the breaker lets a probe through
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds()))))
+		render.Error(w, r, http.StatusServiceUnavailable, "Service temporarily unavailable")
+	case errors.As(err, &overloadedErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overloadedErr.RetryAfter.Seconds()))))
+		render.Error(w, r, http.StatusServiceUnavailable, "Service busy, retry later")
+	case errors.Is(err, ErrForeignObjectKey):
+		render.Error(w, r, http.StatusForbidden, "Object key does not belong to tenant")
+	case errors.Is(err, keyutil.ErrInvalidKey):
+		render.Error(w, r, http.StatusBadRequest, "Invalid object key")
+	case errors.Is(err, ErrObjectNotFound):
+		render.Error(w, r, http.StatusNotFound, "Object not found")
+	case errors.Is(err, ErrReceiptsDisabled):
+		render.Error(w, r, http.StatusNotFound, "Upload receipts are not enabled")
+	case errors.Is(err, ErrObjectExists):
+		render.Error(w, r, http.StatusConflict, "An object with this key exists; delete it before restoring")
+	case errors.Is(err, ErrTrashedObjectKey), errors.Is(err, ErrInvalidUploadRequest):
+		render.Error(w, r, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrTooManyRecords):
+		render.Error(w, r, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, ErrTooManyPresignKeys):
+		render.Error(w, r, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, ErrObjectTooLarge):
+		render.Error(w, r, http.StatusRequestEntityTooLarge, "Object exceeds the download proxy size limit")
+	case errors.Is(err, ErrMissingSourceIdentity):
+		render.Error(w, r, http.StatusForbidden, "Username claim required")
+	case errors.Is(err, ErrReplicationNotConfigured):
+		render.Error(w, r, http.StatusConflict, "Upload completed, but the bucket does not replicate it")
+	case errors.Is(err, ErrClientIPUnavailable):
+		render.Error(w, r, http.StatusForbidden, "Client address unavailable for network-bound presigned URLs")
+	case errors.Is(err, ErrUploadLinkUnavailable):
+		render.Error(w, r, http.StatusNotFound, "Upload link not found, expired or already used")
+	case errors.Is(err, ErrDelegationDisabled):
+		render.Error(w, r, http.StatusForbidden, "Delegated credentials are not enabled for this tenant")
+	case errors.Is(err, ErrTokenExpiresTooSoon):
+		render.Error(w, r, http.StatusUnauthorized, "Token expires too soon; sign in again")
+	case errors.Is(err, ErrUploadNotFound):
+		render.Error(w, r, http.StatusNotFound, "Upload not found; it was completed or aborted")
+	case errors.Is(err, ErrTenantAdminRequired):
+		render.Error(w, r, http.StatusForbidden, "Managing API tokens requires the admin scope")
+	case errors.Is(err, ErrAPITokenNotFound):
+		render.Error(w, r, http.StatusNotFound, "API token not found")
+	case errors.Is(err, ErrAPITokenScope):
+		render.Error(w, r, http.StatusForbidden, "Object is outside the API token's containers")
+	case errors.Is(err, ErrRangeNotSatisfiable):
+		render.Error(w, r, http.StatusRequestedRangeNotSatisfiable, "Requested range not satisfiable")
+	default:
+		errorReporter.CaptureError(r, err)
+		render.Error(w, r, http.StatusInternalServerError, fallbackMessage)
+	}
 }
 
 // lambdaHandler is the main Lambda handler function that adapts API Gateway events
 // to the Chi router
 func lambdaHandler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Make sure AWS clients exist before any handler needs them
+	initServices(ctx)
+
 	// Create a new http.Request from the API Gateway event
 	httpReq, err := createHTTPRequest(ctx, req)
 	if err != nil {
@@ -257,11 +1076,52 @@ func lambdaHandler(ctx context.Context, req events.APIGatewayProxyRequest) (even
 			log.Printf("No tenant_id found in authorizer context: %+v", req.RequestContext.Authorizer)
 		}
 		
+		// Extract the username for audit attribution
+		if username, exists := req.RequestContext.Authorizer["username"].(string); exists && username != "" {
+			ctx = WithUsername(ctx, username)
+		}
+
+		// Extract the token scopes (propagated to the assumed-role session tags)
+		if scope, exists := req.RequestContext.Authorizer["scope"].(string); exists && scope != "" {
+			ctx = WithScope(ctx, scope)
+		}
+
+		// Extract the tenants an admin caller may act as (comma-separated, validated by the authorizer)
+		if actAs, exists := req.RequestContext.Authorizer["act_as_tenants"].(string); exists && actAs != "" {
+			ctx = WithActAsTenants(ctx, strings.Split(actAs, ","))
+		}
+
+		// Extract the scope of an API token (only present for requests made with one)
+		if tokenID, exists := req.RequestContext.Authorizer["api_token_id"].(string); exists && tokenID != "" {
+			scope := APITokenScope{TokenID: tokenID}
+			if operations, _ := req.RequestContext.Authorizer["api_token_operations"].(string); operations != "" {
+				scope.Operations = strings.Split(operations, ",")
+			}
+			if containers, _ := req.RequestContext.Authorizer["api_token_containers"].(string); containers != "" {
+				scope.Containers = strings.Split(containers, ",")
+			}
+			ctx = WithAPITokenScope(ctx, scope)
+		}
+
+		// Extract the mTLS client certificate (only present on mTLS-enabled domains)
+		if subject, exists := req.RequestContext.Authorizer["client_cert_subject"].(string); exists && subject != "" {
+			cert := ClientCert{SubjectDN: subject}
+			cert.IssuerDN, _ = req.RequestContext.Authorizer["client_cert_issuer"].(string)
+			cert.SerialNumber, _ = req.RequestContext.Authorizer["client_cert_serial"].(string)
+			cert.NotAfter, _ = req.RequestContext.Authorizer["client_cert_not_after"].(string)
+			ctx = WithClientCert(ctx, cert)
+			log.Printf("Client certificate from REQUEST authorizer context: subject=%s serial=%s", cert.SubjectDN, cert.SerialNumber)
+		}
+
 		// Extract token expiration
-		if tokenExp, exists := req.RequestContext.Authorizer["token_expiration"].(float64); exists {
-			// Convert float64 to int64 (API Gateway converts numbers to float64)
-			ctx = WithTokenExpiration(ctx, int64(tokenExp))
-			log.Printf("Token expiration from REQUEST authorizer context: %d", int64(tokenExp))
+		// Authorizer context values are strings, so the authorizer formats the Unix time as one
+		if tokenExp, exists := req.RequestContext.Authorizer["token_expiration"].(string); exists && tokenExp != "" {
+			if exp, err := strconv.ParseInt(tokenExp, 10, 64); err == nil {
+				ctx = WithTokenExpiration(ctx, exp)
+				log.Printf("Token expiration from REQUEST authorizer context: %d", exp)
+			} else {
+				log.Printf("Invalid token_expiration in authorizer context: %q", tokenExp)
+			}
 		}
 		
 		httpReq = httpReq.WithContext(ctx)
@@ -269,20 +1129,45 @@ func lambdaHandler(ctx context.Context, req events.APIGatewayProxyRequest) (even
 
 	// Create a response recorder to capture Chi's response
 	respRecorder := &responseRecorder{
-		headers:    make(map[string]string),
+		headers:    make(http.Header),
 		statusCode: http.StatusOK, // Default status
 	}
 
 	// Process the request through the Chi router
-	router := setupRouter()
 	router.ServeHTTP(respRecorder, httpReq)
 
-	// Convert the captured response to an API Gateway response
-	return events.APIGatewayProxyResponse{
-		StatusCode: respRecorder.statusCode,
-		Headers:    respRecorder.headers,
-		Body:       string(respRecorder.body),
-	}, nil
+	// Convert the captured response to an API Gateway response.
+	// Binary bodies are base64 encoded; API Gateway decodes them for clients whose
+	// Accept header matches the API's binary media types.
+	resp := events.APIGatewayProxyResponse{
+		StatusCode:        respRecorder.statusCode,
+		MultiValueHeaders: respRecorder.headers,
+		Body:              string(respRecorder.body),
+	}
+	if !isTextContentType(respRecorder.headers.Get("Content-Type")) {
+		resp.Body = base64.StdEncoding.EncodeToString(respRecorder.body)
+		resp.IsBase64Encoded = true
+	}
+	return resp, nil
+}
+
+// isTextContentType reports whether a response body can be returned to API Gateway as-is
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Responses without a content type are the plain-text errors
+		return contentType == ""
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		mediaType == "application/javascript",
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
 }
 
 // createHTTPRequest creates an http.Request from an API Gateway event
@@ -291,6 +1176,10 @@ func createHTTPRequest(ctx context.Context, req events.APIGatewayProxyRequest) (
 	var body io.Reader
 	if req.Body != "" {
 		body = io.NopCloser(strings.NewReader(req.Body))
+		// Bodies matching the API's binary media types arrive base64 encoded
+		if req.IsBase64Encoded {
+			body = base64.NewDecoder(base64.StdEncoding, strings.NewReader(req.Body))
+		}
 	}
 
 	// Determine the full request path
@@ -321,24 +1210,27 @@ func createHTTPRequest(ctx context.Context, req events.APIGatewayProxyRequest) (
 		httpReq.Header.Add(key, value)
 	}
 
+	// The source IP reported by API Gateway is the trusted client address
+	httpReq.RemoteAddr = req.RequestContext.Identity.SourceIP
+	httpReq = httpReq.WithContext(WithSourceIP(httpReq.Context(), req.RequestContext.Identity.SourceIP))
+
+	// The request ID ties error reports to the API Gateway and Lambda logs
+	httpReq = httpReq.WithContext(WithRequestID(httpReq.Context(), req.RequestContext.RequestID))
+
 	return httpReq, nil
 }
 
 // responseRecorder captures Chi's HTTP response
 type responseRecorder struct {
-	headers    map[string]string
+	headers    http.Header
 	body       []byte
 	statusCode int
 }
 
-
-// Header implements the http.ResponseWriter interface
+// Header implements the http.ResponseWriter interface.
+// The same header map is returned on every call so handlers and middleware can set headers.
 func (r *responseRecorder) Header() http.Header {
-	httpHeader := http.Header{}
-	for key, value := range r.headers {
-		httpHeader.Add(key, value)
-	}
-	return httpHeader
+	return r.headers
 }
 
 // Write implements the http.ResponseWriter interface
@@ -352,6 +1244,29 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.statusCode = statusCode
 }
 
+// flushAggregates writes due buffered uploads after an invocation, and all of them when
+// the instance shuts down
+func flushAggregates(ctx context.Context, reason extension.Reason) {
+	if uploadService == nil {
+		return
+	}
+	uploadService.FlushAggregates(ctx, reason == extension.ReasonShutdown)
+}
+
 func main() {
-	lambda.Start(lambdaHandler)
+	// Buffered state is written by an in-process extension after each response and on
+	// shutdown, so it never waits in a frozen environment longer than one invocation
+	flusher, err := extension.Start("upload-flush")
+	if err != nil {
+		log.Fatalf("Failed to start the flush extension: %v", err)
+	}
+	flusher.Register("upload-aggregation", flushAggregates)
+	flusher.Register("error-reports", func(ctx context.Context, _ extension.Reason) {
+		errorReporter.Flush(ctx)
+	})
+
+	lambda.Start(func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		defer flusher.InvocationDone()
+		return lambdaHandler(ctx, req)
+	})
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/render"
+)
+
+// The package's init requires the deployment environment. Package-level variables are
+// initialized before any init function runs, so this sets it up in time.
+var _ = setTestEnvironment()
+
+func setTestEnvironment() bool {
+	for name, value := range map[string]string{
+		"SHARED_BUCKET":                 "test-shared-bucket",
+		"TENANT_ACCESS_ROLE_ARN":        "arn:aws:iam::123456789012:role/test-tenant-access",
+		"AWS_REGION":                    "eu-central-1",
+		"MIDDLEWARE_LOGGING":            "false",
+		"DELEGATED_CREDENTIALS_TENANTS": "tenant-a",
+	} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	return true
+}
+
+// authorizedRequest builds the event API Gateway passes for a request the authorizer
+// allowed. Authorizer context values reach the Lambda as the strings the authorizer sent.
+func authorizedRequest(method, path, body string, tokenExpiration time.Time) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod: method,
+		Path:       path,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]any{
+				"tenant_id":        "tenant-a",
+				"username":         "tom",
+				"token_expiration": strconv.FormatInt(tokenExpiration.Unix(), 10),
+				"scope":            "aws.cognito.signin.user.admin",
+			},
+		},
+	}
+}
+
+// fuzzMediaTypes are the request encodings fuzz targets pick from
+var fuzzMediaTypes = []string{render.MediaTypeJSON, render.MediaTypeCBOR, render.MediaTypeMsgPack}
+
+// decodeBody decodes a request body the way the handlers do, in the encoding selected by
+// codec (an index into fuzzMediaTypes, wrapped)
+func decodeBody(codec uint8, body []byte, v any) error {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", fuzzMediaTypes[int(codec)%len(fuzzMediaTypes)])
+	return render.Decode(req, v)
+}
+
+// handle runs an event through lambdaHandler
+func handle(t *testing.T, req events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	t.Helper()
+	resp, err := lambdaHandler(context.Background(), req)
+	if err != nil {
+		t.Fatalf("lambdaHandler: %v", err)
+	}
+	return resp
+}
+
+func TestLambdaHandlerEnforcesMinTokenValidity(t *testing.T) {
+	// The token check runs before the object is written, so no AWS call is made
+	resp := handle(t, authorizedRequest(http.MethodPost, "/upload", `{"a": 1}`, time.Now().Add(time.Minute)))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusUnauthorized, resp.Body)
+	}
+}
+
+func TestLambdaHandlerDelegationNeedsTokenValidity(t *testing.T) {
+	// Delegated credentials cannot be shorter than STS allows, so a token ending in five
+	// minutes is refused before AssumeRole
+	resp := handle(t, authorizedRequest(http.MethodPost, "/upload/credentials", "{}", time.Now().Add(5*time.Minute)))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusUnauthorized, resp.Body)
+	}
+}
+
+func TestLambdaHandlerSessionRemaining(t *testing.T) {
+	// An invalid body is rejected by the handler, after the session middleware ran and
+	// before any AWS call
+	resp := handle(t, authorizedRequest(http.MethodPost, "/upload/initiate", "{", time.Now().Add(30*time.Minute)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, resp.Body)
+	}
+	header := http.Header(resp.MultiValueHeaders).Get(SessionRemainingHeader)
+	remaining, err := strconv.Atoi(header)
+	if err != nil {
+		t.Fatalf("%s = %q, want seconds", SessionRemainingHeader, header)
+	}
+	if remaining < 29*60 || remaining > 30*60 {
+		t.Fatalf("%s = %d, want about 1800", SessionRemainingHeader, remaining)
+	}
+
+	// Without a token expiration there is nothing to report
+	req := authorizedRequest(http.MethodPost, "/upload/initiate", "{", time.Now())
+	delete(req.RequestContext.Authorizer, "token_expiration")
+	resp = handle(t, req)
+	if header := http.Header(resp.MultiValueHeaders).Get(SessionRemainingHeader); header != "" {
+		t.Fatalf("%s = %q without a token expiration, want none", SessionRemainingHeader, header)
+	}
+}
+
+func TestLambdaHandlerRejectsTooManyParts(t *testing.T) {
+	// Validation runs before any AWS call or presign capacity is taken
+	resp := handle(t, authorizedRequest(http.MethodPost, "/upload/initiate", `{"size": 10001, "partSize": 1}`, time.Now().Add(30*time.Minute)))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, resp.Body)
+	}
+}
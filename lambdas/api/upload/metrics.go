@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// UploadMetricNamespace holds the upload API metrics. They are written as CloudWatch
+// embedded metric format log lines, so recording them costs no API call on the request path.
+const UploadMetricNamespace = "UploadDemo/Upload"
+
+// metricFunctionVersion is added to every metric as the FunctionVersion dimension when
+// METRICS_VERSION_DIMENSION is enabled; empty leaves it out
+var metricFunctionVersion string
+
+// LoadMetricsVersionDimension reads METRICS_VERSION_DIMENSION. When enabled, every metric is
+// also recorded per Lambda version, so the canary and the stable version of a traffic-shifting
+// deployment can be compared while an alias splits requests between them.
+func LoadMetricsVersionDimension() error {
+	enabled, err := envBool("METRICS_VERSION_DIMENSION", false)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		metricFunctionVersion = currentBuild().FunctionVersion
+	}
+	return nil
+}
+
+// emfMetric is one metric of an embedded metric format record
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// emitMetric writes a single-value embedded metric format record to stdout, from where
+// CloudWatch Logs extracts the metric. dimensions may be empty. With a function version
+// dimension configured, the metric is recorded both with and without it, so existing
+// alarms and dashboards keep their series.
+func emitMetric(name, unit string, value float64, dimensions map[string]string) {
+	dimensionKeys := make([]string, 0, len(dimensions))
+	record := map[string]any{name: value}
+	for key, dimensionValue := range dimensions {
+		dimensionKeys = append(dimensionKeys, key)
+		record[key] = dimensionValue
+	}
+	dimensionSets := [][]string{dimensionKeys}
+	if metricFunctionVersion != "" {
+		record["FunctionVersion"] = metricFunctionVersion
+		dimensionSets = append(dimensionSets, append(slices.Clone(dimensionKeys), "FunctionVersion"))
+	}
+	record["_aws"] = map[string]any{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  UploadMetricNamespace,
+			"Dimensions": dimensionSets,
+			"Metrics":    []emfMetric{{Name: name, Unit: unit}},
+		}},
+	}
+
+	// Marshalling strings and numbers cannot fail; the log package would prefix the line
+	// with a timestamp, which CloudWatch would not parse as a record
+	line, _ := json.Marshal(record)
+	fmt.Fprintln(os.Stdout, string(line))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/cors"
+	"github.com/go-chi/httprate"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/sessiontags"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+	"github.com/stefando/uploadDemoAWS/lambda/upload/render"
+)
+
+// Auth modes for the protected upload routes
+const (
+	// AuthModeAuthorizer requires the tenant to come from the API Gateway Lambda authorizer context
+	AuthModeAuthorizer = "authorizer"
+
+	// AuthModeHeader trusts an X-Tenant-ID request header when no authorizer context is present.
+	// Only intended for local testing (e.g. `sam local start-api` without the authorizer).
+	AuthModeHeader = "header"
+
+	// TenantHeader is the request header read in AuthModeHeader
+	TenantHeader = "X-Tenant-ID"
+
+	// ActAsTenantHeader lets an admin act on behalf of another tenant, subject to the
+	// allow-list the authorizer reports for the caller
+	ActAsTenantHeader = "X-Act-As-Tenant"
+
+	// SessionRemainingHeader reports on upload control calls how many seconds the caller's
+	// token has left, so clients can refresh before their upload window closes
+	SessionRemainingHeader = "X-Session-Remaining"
+)
+
+// MiddlewareConfig controls which middleware is installed on the router
+type MiddlewareConfig struct {
+	RealIP            bool          // Rewrite RemoteAddr from X-Forwarded-For / X-Real-IP headers
+	Logging           bool          // Log every request
+	RateLimitRequests int           // Burst tier: requests allowed per window per tenant (or client IP); 0 disables
+	RateLimitWindow   time.Duration // Burst tier window length
+	SustainedRequests int           // Sustained tier: requests allowed per window per tenant (or client IP); 0 disables
+	SustainedWindow   time.Duration // Sustained tier window length
+	CORSOrigins       []string      // Allowed CORS origins; empty disables CORS handling in the Lambda
+	MaxBodyBytes      int64         // Maximum request body size; 0 disables the limit
+	AuthMode          string        // AuthModeAuthorizer or AuthModeHeader
+	RequireClientName bool          // Reject protected requests without ClientNameHeader
+	GeoIP             *GeoIP        // Annotates access and audit logs with country/ASN; nil disables
+	Deprecations      []Deprecation // Deprecated routes, marked with Deprecation/Sunset headers and counted
+
+	// RequireSourceIdentity rejects protected requests without a username, so every S3
+	// operation can be attributed to a user via the session's SourceIdentity
+	RequireSourceIdentity bool
+
+	// ErrorReporter receives recovered panics; nil only logs them
+	ErrorReporter *ErrorReporter
+
+	// SustainedCounter shares the sustained tier's counts across instances; nil counts per instance
+	SustainedCounter *RateLimitCounter
+}
+
+// LoadMiddlewareConfig reads the middleware configuration from environment variables.
+// Defaults reproduce the original hard-coded stack (RealIP, logging, authorizer auth).
+func LoadMiddlewareConfig() (*MiddlewareConfig, error) {
+	cfg := &MiddlewareConfig{
+		CORSOrigins: envList("CORS_ALLOWED_ORIGINS"),
+		AuthMode:    AuthModeAuthorizer,
+	}
+
+	var err error
+	if cfg.RealIP, err = envBool("MIDDLEWARE_REAL_IP", true); err != nil {
+		return nil, err
+	}
+	if cfg.Logging, err = envBool("MIDDLEWARE_LOGGING", true); err != nil {
+		return nil, err
+	}
+	rateLimit, err := envInt64("RATE_LIMIT_REQUESTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RateLimitRequests = int(rateLimit)
+	if cfg.RateLimitWindow, err = envDuration("RATE_LIMIT_WINDOW", time.Minute); err != nil {
+		return nil, err
+	}
+	sustainedLimit, err := envInt64("RATE_LIMIT_SUSTAINED_REQUESTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SustainedRequests = int(sustainedLimit)
+	if cfg.SustainedWindow, err = envDuration("RATE_LIMIT_SUSTAINED_WINDOW", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	// httprate cannot count requests in zero or negative windows
+	if cfg.RateLimitRequests < 0 || cfg.SustainedRequests < 0 || cfg.RateLimitWindow <= 0 || cfg.SustainedWindow <= 0 {
+		return nil, fmt.Errorf("rate limits need non-negative request counts and positive RATE_LIMIT_WINDOW and RATE_LIMIT_SUSTAINED_WINDOW")
+	}
+	cfg.SustainedCounter = NewRateLimitCounter(strings.TrimSpace(os.Getenv("RATE_LIMIT_TABLE")))
+	if cfg.MaxBodyBytes, err = envInt64("MAX_BODY_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RequireSourceIdentity, err = envBool("REQUIRE_SOURCE_IDENTITY", false); err != nil {
+		return nil, err
+	}
+	if cfg.RequireClientName, err = envBool("REQUIRE_CLIENT_NAME", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.GeoIP, err = LoadGeoIP(); err != nil {
+		return nil, err
+	}
+	if cfg.Deprecations, err = LoadDeprecations(); err != nil {
+		return nil, err
+	}
+
+	if mode := strings.TrimSpace(os.Getenv("AUTH_MODE")); mode != "" {
+		cfg.AuthMode = mode
+	}
+	switch cfg.AuthMode {
+	case AuthModeAuthorizer:
+	case AuthModeHeader:
+		log.Printf("WARNING: AUTH_MODE=%s trusts the %s header; never use this in a deployed stack", AuthModeHeader, TenantHeader)
+	default:
+		return nil, fmt.Errorf("AUTH_MODE must be %q or %q", AuthModeAuthorizer, AuthModeHeader)
+	}
+
+	return cfg, nil
+}
+
+// GlobalMiddleware assembles the middleware applied to every route, in order
+func (c *MiddlewareConfig) GlobalMiddleware() []func(http.Handler) http.Handler {
+	var stack []func(http.Handler) http.Handler
+
+	if c.RealIP {
+		stack = append(stack, middleware.RealIP)
+	}
+	// Client identification and geo enrichment run before logging so the access log line can
+	// include them, and client metrics see the status of recovered panics
+	stack = append(stack, ClientIdentification)
+	if c.GeoIP != nil {
+		stack = append(stack, GeoMiddleware(c.GeoIP))
+	}
+	if c.Logging {
+		stack = append(stack, middleware.RequestLogger(accessLogFormatter{}))
+	}
+
+	// Every response names the build serving it, for telling canary responses apart
+	stack = append(stack, VersionHeaders)
+
+	// Always recover from panics so one bad request cannot take down the instance
+	stack = append(stack, middleware.Recoverer)
+	if c.ErrorReporter != nil {
+		stack = append(stack, c.ErrorReporter.Middleware)
+	}
+
+	// CORS runs before limits so preflight requests are answered cheaply
+	if len(c.CORSOrigins) > 0 {
+		stack = append(stack, cors.Handler(cors.Options{
+			AllowedOrigins: c.CORSOrigins,
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "X-Amz-Date", "X-Api-Key", "X-Amz-Security-Token", "Range", "If-None-Match", "If-Modified-Since", ActAsTenantHeader, ClientNameHeader, ClientVersionHeader},
+			ExposedHeaders: append([]string{"Content-Range", "Accept-Ranges", "ETag", "X-Replication-Status", "Content-Disposition", SessionRemainingHeader, SandboxHeader, VersionHeader, FunctionVersionHeader, "Deprecation", "Sunset"}, rateLimitHeaders...),
+			MaxAge:         300,
+		}))
+	}
+
+	if c.MaxBodyBytes > 0 {
+		stack = append(stack, middleware.RequestSize(c.MaxBodyBytes))
+	}
+	if len(c.Deprecations) > 0 {
+		stack = append(stack, DeprecationHeaders(c.Deprecations))
+	}
+
+	// The burst tier runs first, so requests it rejects do not use up the sustained quota
+	if c.RateLimitRequests > 0 {
+		stack = append(stack, httprate.LimitBy(c.RateLimitRequests, c.RateLimitWindow, rateLimitKey,
+			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+				render.Error(w, r, http.StatusTooManyRequests, "Too many requests")
+			}),
+			httprate.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+				render.Error(w, r, http.StatusPreconditionRequired, err.Error())
+			}),
+		))
+	}
+	if c.SustainedRequests > 0 {
+		options := []httprate.Option{
+			httprate.WithResponseHeaders(sustainedRateLimitHeaders),
+			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+				render.Error(w, r, http.StatusTooManyRequests, "Request quota exceeded")
+			}),
+			httprate.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+				render.Error(w, r, http.StatusPreconditionRequired, err.Error())
+			}),
+		}
+		if c.SustainedCounter != nil {
+			options = append(options, httprate.WithLimitCounter(c.SustainedCounter))
+		}
+		stack = append(stack, httprate.LimitBy(c.SustainedRequests, c.SustainedWindow, rateLimitKey, options...))
+	}
+
+	return stack
+}
+
+// accessLogger is where access log lines go, like chi's default request logger
+var accessLogger = log.New(os.Stdout, "", log.LstdFlags)
+
+// accessLogFormatter formats access log lines like chi's default formatter, with the
+// calling client and, when GeoIP is configured, the caller's geo fields appended
+type accessLogFormatter struct{}
+
+func (accessLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	client, _ := GetClient(r.Context())
+	line := accessLogLine{fields: client.String() + geoFields(r.Context())}
+	formatter := &middleware.DefaultLogFormatter{Logger: line, NoColor: true}
+	return formatter.NewLogEntry(r)
+}
+
+// accessLogLine appends the request's fields to the line chi's formatter prints
+type accessLogLine struct {
+	fields string
+}
+
+func (l accessLogLine) Print(v ...interface{}) {
+	accessLogger.Print(fmt.Sprint(v...) + " " + l.fields)
+}
+
+// rateLimitHeaders are the headers both rate limit tiers set, exposed to browser clients
+var rateLimitHeaders = []string{
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+	sustainedRateLimitHeaders.Limit, sustainedRateLimitHeaders.Remaining, sustainedRateLimitHeaders.Reset,
+	"Retry-After",
+}
+
+// rateLimitKey buckets requests by tenant, falling back to the API Gateway source IP
+// for unauthenticated routes. RemoteAddr is not used because middleware.RealIP rewrites
+// it from client-supplied headers. Limits are per Lambda instance, not global, unless the
+// sustained tier keeps its counts in the rate limit table.
+func rateLimitKey(r *http.Request) (string, error) {
+	if tenantID, ok := GetTenantID(r.Context()); ok && tenantID != "" {
+		return "tenant:" + tenantID, nil
+	}
+	sourceIP, _ := GetSourceIP(r.Context())
+	return "ip:" + httprate.CanonicalizeIP(sourceIP), nil
+}
+
+// AuthMiddleware returns the middleware that establishes the tenant for protected routes
+func (c *MiddlewareConfig) AuthMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := GetTenantID(r.Context()); !ok && c.AuthMode == AuthModeHeader {
+				if tenantID := r.Header.Get(TenantHeader); tenantID != "" {
+					r = r.WithContext(WithTenantID(r.Context(), tenantID))
+				}
+			}
+
+			homeTenantID, ok := GetTenantID(r.Context())
+			if !ok {
+				render.Error(w, r, http.StatusUnauthorized, "Tenant ID not found in request context")
+				return
+			}
+
+			if c.RequireSourceIdentity && sessiontags.SourceIdentity(usernameOf(r)) == "" {
+				log.Printf("Rejecting request without a usable username claim for tenant %s", homeTenantID)
+				render.Error(w, r, http.StatusForbidden, "Username claim required")
+				return
+			}
+
+			if client, _ := GetClient(r.Context()); c.RequireClientName && !client.Declared {
+				render.Error(w, r, http.StatusBadRequest, ClientNameHeader+" header required")
+				return
+			}
+
+			if actAs := r.Header.Get(ActAsTenantHeader); actAs != "" && actAs != homeTenantID {
+				if !canActAsTenant(r, actAs) {
+					log.Printf("AUDIT admin impersonation denied: user=%s home_tenant=%s acting_as=%s %s %s%s%s",
+						usernameOf(r), homeTenantID, actAs, r.Method, r.URL.Path, clientFields(r.Context()), geoFields(r.Context()))
+					render.Error(w, r, http.StatusForbidden, "Not allowed to act as tenant")
+					return
+				}
+				log.Printf("AUDIT admin impersonation: user=%s home_tenant=%s acting_as=%s %s %s%s%s",
+					usernameOf(r), homeTenantID, actAs, r.Method, r.URL.Path, clientFields(r.Context()), geoFields(r.Context()))
+				r = r.WithContext(WithAdminOverride(WithTenantID(r.Context(), actAs), homeTenantID))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionRemaining sets SessionRemainingHeader from the token expiration the authorizer
+// passed, capped by the tenant's session length since presigned URLs cannot outlive it.
+// Requests without a known token expiration get no header.
+func SessionRemaining(sessions *SessionConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tokenExp, ok := GetTokenExpiration(r.Context()); ok {
+				remaining := max(time.Until(time.Unix(tokenExp, 0)), 0)
+				if tenantID, ok := GetTenantID(r.Context()); ok {
+					remaining = min(remaining, sessions.For(tenantID).Session)
+				}
+				w.Header().Set(SessionRemainingHeader, strconv.FormatInt(int64(remaining/time.Second), 10))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DenyAdminOverride rejects requests in which an admin acts as another tenant, for routes
+// whose effects would outlive the impersonation (such as minting long-lived API tokens)
+func DenyAdminOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if homeTenantID, ok := GetAdminOverride(r.Context()); ok {
+			tenantID, _ := GetTenantID(r.Context())
+			log.Printf("AUDIT admin impersonation refused: user=%s home_tenant=%s acting_as=%s %s %s%s",
+				usernameOf(r), homeTenantID, tenantID, r.Method, r.URL.Path, clientFields(r.Context()))
+			render.Error(w, r, http.StatusForbidden, "Not available while acting as another tenant")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canActAsTenant checks the requested tenant against the allow-list the authorizer
+// attached for admin callers. Non-admins have an empty list and are always refused.
+func canActAsTenant(r *http.Request, tenantID string) bool {
+	if keyutil.ValidateSegment(tenantID) != nil {
+		return false
+	}
+	for _, allowed := range GetActAsTenants(r.Context()) {
+		if allowed == "*" || allowed == tenantID {
+			return true
+		}
+	}
+	return false
+}
+
+// usernameOf returns the authenticated username for audit log lines
+func usernameOf(r *http.Request) string {
+	username, _ := GetUsername(r.Context())
+	return username
+}
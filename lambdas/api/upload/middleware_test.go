@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMiddlewareConfigRateLimits(t *testing.T) {
+	t.Setenv("RATE_LIMIT_REQUESTS", "100")
+	t.Setenv("RATE_LIMIT_WINDOW", "30s")
+	t.Setenv("RATE_LIMIT_SUSTAINED_REQUESTS", "10000")
+	t.Setenv("RATE_LIMIT_SUSTAINED_WINDOW", "12h")
+	cfg, err := LoadMiddlewareConfig()
+	if err != nil {
+		t.Fatalf("LoadMiddlewareConfig: %v", err)
+	}
+	if cfg.RateLimitRequests != 100 || cfg.RateLimitWindow != 30*time.Second || cfg.SustainedRequests != 10000 || cfg.SustainedWindow != 12*time.Hour {
+		t.Fatalf("rate limits = %d per %s, %d per %s", cfg.RateLimitRequests, cfg.RateLimitWindow, cfg.SustainedRequests, cfg.SustainedWindow)
+	}
+}
+
+func TestLoadMiddlewareConfigRejectsRateLimits(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"RATE_LIMIT_WINDOW", "0s"},
+		{"RATE_LIMIT_WINDOW", "-1m"},
+		{"RATE_LIMIT_SUSTAINED_WINDOW", "0"},
+		{"RATE_LIMIT_SUSTAINED_WINDOW", "-24h"},
+		{"RATE_LIMIT_REQUESTS", "-1"},
+		{"RATE_LIMIT_SUSTAINED_REQUESTS", "-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := LoadMiddlewareConfig()
+			if err == nil {
+				t.Fatal("LoadMiddlewareConfig accepted the limit")
+			}
+			if !strings.Contains(err.Error(), "rate limits") {
+				t.Fatalf("LoadMiddlewareConfig error = %q, want it to name the rate limits", err)
+			}
+		})
+	}
+}
@@ -1,16 +1,68 @@
 package main
 
+// URL delivery modes for presigned part URLs
+const (
+	// URLDeliveryInline returns the presigned URLs directly in the response body
+	URLDeliveryInline = "inline"
+	// URLDeliveryObject stores the presigned URLs in a short-lived S3 object and returns
+	// a presigned GET for it, keeping the response small for uploads with many parts
+	URLDeliveryObject = "object"
+)
+
+// UploadResponse is returned for a single-request JSON upload
+type UploadResponse struct {
+	Status   string `json:"status"`
+	FilePath string `json:"file_path"`
+	TenantID string `json:"tenant_id"`
+}
+
+// UploadStatusBuffered is the status of a simple upload accepted into an aggregation buffer.
+// The document becomes one line of the NDJSON object at file_path once the buffer is written.
+const UploadStatusBuffered = "buffered"
+
+// UploadModeRedirect makes POST /upload answer with a 307 to a presigned PUT instead of
+// accepting the body, so simple uploads are not bound by the API Gateway payload limit
+const UploadModeRedirect = "redirect"
+
+// UploadRedirectResponse tells the client how to upload the file to the redirect target
+type UploadRedirectResponse struct {
+	UploadURL string            `json:"uploadUrl"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"` // Headers that must be sent with the upload
+	FilePath  string            `json:"file_path"`
+	TenantID  string            `json:"tenant_id"`
+	ExpiresAt int64             `json:"expiresAt"`
+}
+
 // InitiateUploadRequest represents the request to initiate a multipart upload
 type InitiateUploadRequest struct {
-	Size     int64 `json:"size"`
-	PartSize int64 `json:"partSize"`
+	Size        int64  `json:"size"`
+	PartSize    int64  `json:"partSize"`
+	URLDelivery string `json:"urlDelivery,omitempty"` // "inline" (default) or "object"
 }
 
 // InitiateUploadResponse contains presigned URLs and upload metadata
 type InitiateUploadResponse struct {
-	PresignedUrls map[int]string `json:"presignedUrls"`
-	UploadID      string         `json:"uploadId"`
-	ObjectKey     string         `json:"objectKey"`
+	PresignedUrls map[int]string `json:"presignedUrls,omitempty"`
+	// PresignedUrlsLocation is a presigned GET URL for a JSON object holding the part URL map,
+	// set instead of PresignedUrls when the "object" delivery mode is used
+	PresignedUrlsLocation string `json:"presignedUrlsLocation,omitempty"`
+	UploadID              string `json:"uploadId"`
+	ObjectKey             string `json:"objectKey"`
+	// Hints asks the client to limit its part upload parallelism and rate
+	Hints *UploadHints `json:"hints,omitempty"`
+	// ExpiresAt is when the part URLs stop working and WarnAt when the client should call
+	// /upload/refresh (Unix timestamps)
+	ExpiresAt int64 `json:"expiresAt"`
+	WarnAt    int64 `json:"warnAt"`
+}
+
+// UploadHints recommends how hard a client should push its part uploads, based on the
+// tenant's tier and the current load factor
+type UploadHints struct {
+	Tier              string `json:"tier"`
+	MaxParallelParts  int    `json:"maxParallelParts"`            // Concurrent part PUTs per upload
+	MaxBytesPerSecond int64  `json:"maxBytesPerSecond,omitempty"` // Per connection; absent means unlimited
 }
 
 // PartTag represents a completed part with its ETag
@@ -28,8 +80,12 @@ type CompleteUploadRequest struct {
 
 // CompleteUploadResponse contains the final object location
 type CompleteUploadResponse struct {
-	ObjectKey string `json:"objectKey"`
-	Location  string `json:"location"`
+	ObjectKey string         `json:"objectKey"`
+	Location  string         `json:"location"`
+	Receipt   *UploadReceipt `json:"receipt,omitempty"` // Signed receipt, when receipts are enabled
+	// ReplicationStatus is the object's cross-region replication status (PENDING, COMPLETED
+	// or FAILED), set when the client asked to wait for replication
+	ReplicationStatus string `json:"replicationStatus,omitempty"`
 }
 
 // AbortUploadRequest represents the request to abort a multipart upload
@@ -38,6 +94,42 @@ type AbortUploadRequest struct {
 	ObjectKey string `json:"objectKey"`
 }
 
+// RevokeUploadRequest represents the request to revoke an upload's presigned URLs. Size,
+// part size and URL delivery describe the replacement upload, as on initiate.
+type RevokeUploadRequest struct {
+	UploadID    string `json:"uploadId"`
+	ObjectKey   string `json:"objectKey"`
+	Size        int64  `json:"size"`
+	PartSize    int64  `json:"partSize"`
+	URLDelivery string `json:"urlDelivery,omitempty"`
+}
+
+// Types of upload timeline events
+const (
+	UploadEventInitiated         = "initiated"          // S3 created the multipart upload
+	UploadEventPartUploaded      = "part_uploaded"      // The latest upload of a part reached S3
+	UploadEventCompletionPending = "completion_pending" // Completion started and awaits its outcome or a retry
+	UploadEventCompleted         = "completed"          // The object exists
+)
+
+// UploadEvent is one entry of an upload's timeline
+type UploadEvent struct {
+	Type       string `json:"type"`
+	Time       string `json:"time"`                 // RFC 3339
+	PartNumber int    `json:"partNumber,omitempty"` // part_uploaded
+	Size       int64  `json:"size,omitempty"`       // part_uploaded and completed, in bytes
+	ETag       string `json:"eTag,omitempty"`       // part_uploaded and completed
+	Attempts   int    `json:"attempts,omitempty"`   // completion_pending: retries made by the retry worker
+}
+
+// UploadEventsResponse is the timeline of a multipart upload, oldest event first
+type UploadEventsResponse struct {
+	UploadID  string        `json:"uploadId"`
+	ObjectKey string        `json:"objectKey"`
+	Status    string        `json:"status"` // in_progress, completing or completed
+	Events    []UploadEvent `json:"events"`
+}
+
 // RefreshUploadRequest represents the request to refresh presigned URLs
 type RefreshUploadRequest struct {
 	UploadID    string `json:"uploadId"`
@@ -48,4 +140,114 @@ type RefreshUploadRequest struct {
 // RefreshUploadResponse contains refreshed presigned URLs
 type RefreshUploadResponse struct {
 	PresignedUrls map[int]string `json:"presignedUrls"`
+	// ExpiresAt is when the refreshed URLs stop working (Unix timestamp): the token's expiry
+	// minus a buffer, capped by the tenant's session credentials
+	ExpiresAt int64 `json:"expiresAt"`
+	// WarnAt is when the client should refresh again (Unix timestamp)
+	WarnAt int64 `json:"warnAt"`
+}
+
+// CreateUploadLinkRequest represents the request to mint a one-time upload link for a partner
+type CreateUploadLinkRequest struct {
+	Folder           string `json:"folder,omitempty"`           // Folder under the tenant prefix (default "partner-uploads")
+	ContentType      string `json:"contentType,omitempty"`      // Content type the partner must upload (default application/octet-stream)
+	ExpiresInSeconds int64  `json:"expiresInSeconds,omitempty"` // Link lifetime (default 24 hours, max 7 days)
+}
+
+// CreateUploadLinkResponse contains the minted link; the token is only returned once
+type CreateUploadLinkResponse struct {
+	LinkID    string `json:"linkId"` // Non-secret identifier used in audit logs
+	Token     string `json:"token"`
+	Path      string `json:"path"` // API path the partner POSTs to in order to redeem the link
+	ObjectKey string `json:"objectKey"`
+	ExpiresAt int64  `json:"expiresAt"` // Unix timestamp
+}
+
+// RedeemUploadLinkResponse tells the partner how to upload the file
+type RedeemUploadLinkResponse struct {
+	UploadURL string            `json:"uploadUrl"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"` // Headers that must be sent with the upload
+	ExpiresAt int64             `json:"expiresAt"`
+}
+
+// Record outcomes reported by the bulk record endpoint
+const (
+	RecordAccepted = "accepted"
+	RecordRejected = "rejected"
+)
+
+// RecordResult reports what happened to one NDJSON record
+type RecordResult struct {
+	Line      int    `json:"line"`                // 1-based line number in the request body
+	Status    string `json:"status"`              // "accepted" or "rejected"
+	ObjectKey string `json:"objectKey,omitempty"` // Batch object holding the record when accepted
+	Error     string `json:"error,omitempty"`     // Rejection reason
+}
+
+// UploadRecordsResponse summarizes a bulk record upload
+type UploadRecordsResponse struct {
+	Accepted   int            `json:"accepted"`
+	Rejected   int            `json:"rejected"`
+	ObjectKeys []string       `json:"objectKeys"` // Batch objects written, in order
+	Results    []RecordResult `json:"results"`    // One entry per non-blank line
+}
+
+// ObjectTrashResponse represents the result of deleting or restoring an object
+type ObjectTrashResponse struct {
+	ObjectKey  string `json:"objectKey"`
+	TrashKey   string `json:"trashKey"`             // Where the deleted object is kept
+	Status     string `json:"status"`               // ObjectTrashed or ObjectRestored
+	PurgeAfter int64  `json:"purgeAfter,omitempty"` // Unix time after which a trashed object is purged (lifecycle runs daily)
+}
+
+// UploadReceipt is a signed statement of what was uploaded and when. Signature is the
+// KMS signature (ECDSA_SHA_256, DER) over the bytes of Payload; Receipt is Payload decoded.
+type UploadReceipt struct {
+	Receipt   ReceiptPayload `json:"receipt"`
+	Payload   string         `json:"payload"`   // Base64 of the exact signed JSON bytes
+	Signature string         `json:"signature"` // Base64
+	KeyID     string         `json:"keyId"`     // KMS key ARN; its public key verifies the signature
+	Algorithm string         `json:"algorithm"`
+}
+
+// PresignDownloadBatchRequest asks for presigned GET URLs of several objects at once
+type PresignDownloadBatchRequest struct {
+	ObjectKeys []string `json:"objectKeys"` // At most MaxPresignBatchKeys
+}
+
+// PresignDownloadBatchResponse holds one presigned GET URL per requested object
+type PresignDownloadBatchResponse struct {
+	Urls      map[string]string `json:"urls"`      // Object key -> presigned GET URL
+	ExpiresAt int64             `json:"expiresAt"` // Unix timestamp when the URLs stop working
+}
+
+// CreateAPITokenRequest asks for a long-lived API token for a machine client
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`                    // Shown in token lists and as the token's username
+	Operations    []string `json:"operations"`              // "upload", "download" and/or "delete"
+	Containers    []string `json:"containers,omitempty"`    // Folders under the tenant prefix downloads and deletes are limited to; empty allows all
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // Default 90, at most 365
+}
+
+// APIToken describes an API token without its secret
+type APIToken struct {
+	TokenID    string   `json:"tokenId"`
+	Name       string   `json:"name"`
+	Operations []string `json:"operations"`
+	Containers []string `json:"containers,omitempty"`
+	CreatedBy  string   `json:"createdBy"`
+	CreatedAt  int64    `json:"createdAt"` // Unix timestamp
+	ExpiresAt  int64    `json:"expiresAt"` // Unix timestamp
+}
+
+// CreateAPITokenResponse carries a newly minted API token; Token is never shown again
+type CreateAPITokenResponse struct {
+	APIToken
+	Token string `json:"token"` // Send as "Authorization: Bearer <token>"
+}
+
+// ListAPITokensResponse lists a tenant's unexpired API tokens, oldest first
+type ListAPITokensResponse struct {
+	Tokens []APIToken `json:"tokens"`
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// maxSessionPolicySize is the STS limit on the plain text of an inline session policy
+const maxSessionPolicySize = 2048
+
+// ErrClientIPUnavailable is returned when a URL must be bound to the client's address
+// but the request carries no usable source IP
+var ErrClientIPUnavailable = errors.New("client source IP unavailable for presigned URL binding")
+
+// PresignBinding restricts the networks a tenant's presigned URLs can be used from. A URL
+// is usable from any listed source range or VPC endpoint.
+type PresignBinding struct {
+	SourceIPs    []string `json:"source_ips,omitempty"`     // CIDR ranges or addresses, matched as aws:SourceIp
+	SourceVpces  []string `json:"source_vpces,omitempty"`   // VPC endpoint IDs, matched as aws:SourceVpce
+	BindClientIP bool     `json:"bind_client_ip,omitempty"` // Also allow the address the URL was requested from
+}
+
+// PresignBindings holds the network bindings of restricted tenants. A nil
+// *PresignBindings is valid and leaves every tenant's presigned URLs unbound.
+type PresignBindings struct {
+	Tenants map[string]PresignBinding
+}
+
+// LoadPresignBindings reads TENANT_PRESIGN_NETWORKS, a JSON object mapping tenants to
+// their bindings, e.g. {"acme": {"source_ips": ["203.0.113.0/24"], "source_vpces": ["vpce-1a2b3c4d"]}}.
+// It returns nil when the variable is unset.
+func LoadPresignBindings() (*PresignBindings, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_PRESIGN_NETWORKS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	cfg := &PresignBindings{}
+	if err := json.Unmarshal([]byte(raw), &cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("TENANT_PRESIGN_NETWORKS is not a valid JSON object: %w", err)
+	}
+	for tenant, network := range cfg.Tenants {
+		if len(network.SourceIPs) == 0 && len(network.SourceVpces) == 0 && !network.BindClientIP {
+			return nil, fmt.Errorf("TENANT_PRESIGN_NETWORKS has no networks for tenant %s", tenant)
+		}
+		for i, cidr := range network.SourceIPs {
+			prefix, err := parsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("TENANT_PRESIGN_NETWORKS tenant %s: %w", tenant, err)
+			}
+			network.SourceIPs[i] = prefix.String()
+		}
+		for _, vpce := range network.SourceVpces {
+			if !strings.HasPrefix(vpce, "vpce-") {
+				return nil, fmt.Errorf("TENANT_PRESIGN_NETWORKS tenant %s: invalid VPC endpoint ID %q", tenant, vpce)
+			}
+		}
+
+		// Check the size with the longest client range so no request can exceed the limit
+		sourceIPs := network.SourceIPs
+		if network.BindClientIP {
+			sourceIPs = append(sourceIPs[:len(sourceIPs):len(sourceIPs)], "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128")
+		}
+		if size := len(presignSessionPolicy(sourceIPs, network.SourceVpces)); size > maxSessionPolicySize {
+			return nil, fmt.Errorf("TENANT_PRESIGN_NETWORKS tenant %s: session policy of %d bytes exceeds %d", tenant, size, maxSessionPolicySize)
+		}
+	}
+	return cfg, nil
+}
+
+// Bind returns a context whose tenant credentials carry the tenant's network binding.
+// Presigned URLs inherit the permissions of the session that signed them, so S3 refuses
+// them outside the bound networks; server-side S3 calls must keep using the unbound ctx,
+// since the Lambda itself calls from outside those networks. Unrestricted tenants get
+// ctx back unchanged.
+func (c *PresignBindings) Bind(ctx context.Context, tenantID string) (context.Context, error) {
+	if c == nil {
+		return ctx, nil
+	}
+	network, ok := c.Tenants[tenantID]
+	if !ok {
+		return ctx, nil
+	}
+
+	sourceIPs := network.SourceIPs
+	if network.BindClientIP {
+		sourceIP, _ := GetSourceIP(ctx)
+		addr, err := netip.ParseAddr(sourceIP)
+		if err != nil {
+			return ctx, ErrClientIPUnavailable
+		}
+		addr = addr.Unmap()
+		clientRange := netip.PrefixFrom(addr, addr.BitLen()).String()
+		sourceIPs = append(sourceIPs[:len(sourceIPs):len(sourceIPs)], clientRange)
+	}
+	return WithSessionPolicy(ctx, presignSessionPolicy(sourceIPs, network.SourceVpces)), nil
+}
+
+// presignSessionPolicy builds the inline session policy of a network-bound session. The
+// tenant role still scopes access to the tenant prefix; the session policy only narrows
+// it to the object reads and writes presigned URLs perform, from the given networks.
+// Requests through a VPC endpoint carry no public aws:SourceIp, hence the separate statement.
+func presignSessionPolicy(sourceIPs, sourceVpces []string) string {
+	type statement struct {
+		Effect    string                         `json:"Effect"`
+		Action    []string                       `json:"Action"`
+		Resource  string                         `json:"Resource"`
+		Condition map[string]map[string][]string `json:"Condition"`
+	}
+	actions := []string{"s3:PutObject", "s3:GetObject"}
+
+	var statements []statement
+	if len(sourceIPs) > 0 {
+		statements = append(statements, statement{
+			Effect:    "Allow",
+			Action:    actions,
+			Resource:  "*",
+			Condition: map[string]map[string][]string{"IpAddress": {"aws:SourceIp": sourceIPs}},
+		})
+	}
+	if len(sourceVpces) > 0 {
+		statements = append(statements, statement{
+			Effect:    "Allow",
+			Action:    actions,
+			Resource:  "*",
+			Condition: map[string]map[string][]string{"StringEquals": {"aws:SourceVpce": sourceVpces}},
+		})
+	}
+
+	// Marshalling strings and string slices cannot fail
+	policy, _ := json.Marshal(map[string]any{"Version": "2012-10-17", "Statement": statements})
+	return string(policy)
+}
+
+// parsePrefix parses a CIDR range or a single address
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
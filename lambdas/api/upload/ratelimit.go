@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/go-chi/httprate"
+)
+
+// rateLimitCounterTimeout bounds each counter call; httprate gives the counter no context
+const rateLimitCounterTimeout = time.Second
+
+// sustainedRateLimitHeaders report the sustained tier next to the burst tier's X-RateLimit-* headers
+var sustainedRateLimitHeaders = httprate.ResponseHeaders{
+	Limit:      "X-RateLimit-Sustained-Limit",
+	Remaining:  "X-RateLimit-Sustained-Remaining",
+	Reset:      "X-RateLimit-Sustained-Reset",
+	RetryAfter: "Retry-After",
+}
+
+// RateLimitCounter is an httprate.LimitCounter that keeps window counts in DynamoDB, so a
+// limit holds across all Lambda instances instead of per instance. Items are keyed by
+// limit key and window start and expire through TTL two windows later. The counter fails
+// open: when DynamoDB cannot be reached, requests are counted as zero and let through.
+// A nil *RateLimitCounter is not a valid LimitCounter; use the local counter instead.
+type RateLimitCounter struct {
+	table        string
+	windowLength time.Duration
+	dynamoClient *dynamodb.Client
+}
+
+// NewRateLimitCounter creates a counter for the table; it returns nil when table is empty.
+// The client is bound with SetClient once the AWS configuration is loaded.
+func NewRateLimitCounter(table string) *RateLimitCounter {
+	if table == "" {
+		return nil
+	}
+	return &RateLimitCounter{table: table}
+}
+
+// SetClient binds the DynamoDB client; requests arriving before it are counted as zero
+func (c *RateLimitCounter) SetClient(client *dynamodb.Client) {
+	if c == nil {
+		return
+	}
+	c.dynamoClient = client
+}
+
+// Config records the window length, which sets the items' expiry
+func (c *RateLimitCounter) Config(requestLimit int, windowLength time.Duration) {
+	c.windowLength = windowLength
+}
+
+// Increment counts one request in the window
+func (c *RateLimitCounter) Increment(key string, currentWindow time.Time) error {
+	return c.IncrementBy(key, currentWindow, 1)
+}
+
+// IncrementBy counts amount requests in the window
+func (c *RateLimitCounter) IncrementBy(key string, currentWindow time.Time, amount int) error {
+	if c.dynamoClient == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rateLimitCounterTimeout)
+	defer cancel()
+
+	_, err := c.dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(c.table),
+		Key:              rateLimitItemKey(key, currentWindow),
+		UpdateExpression: aws.String("ADD request_count :amount SET expires_at = :expires"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":amount":  &types.AttributeValueMemberN{Value: strconv.Itoa(amount)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(currentWindow.Add(2*c.windowLength).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to count rate limited request for %s, not counted: %v", key, err)
+	}
+	return nil
+}
+
+// Get returns the counts of the current and previous window
+func (c *RateLimitCounter) Get(key string, currentWindow, previousWindow time.Time) (int, int, error) {
+	if c.dynamoClient == nil {
+		return 0, 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rateLimitCounterTimeout)
+	defer cancel()
+
+	return c.count(ctx, key, currentWindow), c.count(ctx, key, previousWindow), nil
+}
+
+// count reads one window's count, treating missing items and errors as zero
+func (c *RateLimitCounter) count(ctx context.Context, key string, window time.Time) int {
+	output, err := c.dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(c.table),
+		Key:                  rateLimitItemKey(key, window),
+		ProjectionExpression: aws.String("request_count"),
+	})
+	if err != nil {
+		log.Printf("Failed to read rate limit count for %s, treating as zero: %v", key, err)
+		return 0
+	}
+	value, ok := output.Item["request_count"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	count, err := strconv.Atoi(value.Value)
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// rateLimitItemKey returns the table key of a limit key's window
+func rateLimitItemKey(key string, window time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"limit_key": &types.AttributeValueMemberS{Value: key + "#" + strconv.FormatInt(window.Unix(), 10)},
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ReceiptSigningAlgorithm is the KMS algorithm receipts are signed with
+const ReceiptSigningAlgorithm = kmstypes.SigningAlgorithmSpecEcdsaSha256
+
+// ErrReceiptsDisabled is returned when no receipt signing key is configured
+var ErrReceiptsDisabled = errors.New("upload receipts are not enabled")
+
+// ReceiptPayload is what a receipt attests: which object a tenant stored, with which
+// content, and when. UploadedAt is the object's S3 Last-Modified time, so receipts
+// re-issued later attest the same upload and only differ in IssuedAt.
+type ReceiptPayload struct {
+	TenantID          string `json:"tenantId"`
+	ObjectKey         string `json:"objectKey"`
+	Size              int64  `json:"size"`
+	ETag              string `json:"eTag"`
+	Checksum          string `json:"checksum,omitempty"`          // Base64 checksum S3 stored with the object, if any
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"` // e.g. "SHA256" or "CRC32"
+	UploadedAt        string `json:"uploadedAt"`                  // RFC 3339
+	IssuedAt          string `json:"issuedAt"`                    // RFC 3339
+}
+
+// ReceiptSigner signs receipts with an asymmetric KMS key. The private key never leaves
+// KMS; anyone holding the public key (aws kms get-public-key) can verify a receipt.
+// A nil *ReceiptSigner is valid and means receipts are disabled.
+type ReceiptSigner struct {
+	kmsClient *kms.Client
+	keyID     string
+}
+
+// NewReceiptSigner creates a signer for the given KMS key; it returns nil when keyID is empty
+func NewReceiptSigner(cfg aws.Config, keyID string) *ReceiptSigner {
+	if keyID == "" {
+		return nil
+	}
+	return &ReceiptSigner{kmsClient: kms.NewFromConfig(cfg), keyID: keyID}
+}
+
+// Sign serializes the payload and signs the exact bytes. The serialized payload is
+// returned alongside the signature, so verifiers never have to re-create it.
+func (r *ReceiptSigner) Sign(ctx context.Context, payload ReceiptPayload) (*UploadReceipt, error) {
+	if r == nil {
+		return nil, ErrReceiptsDisabled
+	}
+
+	// Marshalling a struct of strings and integers cannot fail
+	encoded, _ := json.Marshal(payload)
+	signResp, err := r.kmsClient.Sign(ctx, &kms.SignInput{
+		KeyId:            aws.String(r.keyID),
+		Message:          encoded,
+		MessageType:      kmstypes.MessageTypeRaw,
+		SigningAlgorithm: ReceiptSigningAlgorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign receipt: %w", err)
+	}
+
+	return &UploadReceipt{
+		Receipt:   payload,
+		Payload:   base64.StdEncoding.EncodeToString(encoded),
+		Signature: base64.StdEncoding.EncodeToString(signResp.Signature),
+		KeyID:     aws.ToString(signResp.KeyId),
+		Algorithm: string(ReceiptSigningAlgorithm),
+	}, nil
+}
+
+// IssueReceipt signs a receipt for a stored tenant object from its current S3 metadata
+func (s *UploadService) IssueReceipt(ctx context.Context, tenantID, objectKey string) (*UploadReceipt, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if s.receipts == nil {
+		return nil, ErrReceiptsDisabled
+	}
+	if err := validateLiveObjectKey(tenantID, objectKey); err != nil {
+		return nil, err
+	}
+
+	head, err := s.s3Clients.Get(tenantID).HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucketFor(tenantID)),
+		Key:          aws.String(objectKey),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		if isMissingObject(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to read object metadata: %w", err)
+	}
+
+	payload := ReceiptPayload{
+		TenantID:   tenantID,
+		ObjectKey:  objectKey,
+		Size:       aws.ToInt64(head.ContentLength),
+		ETag:       aws.ToString(head.ETag),
+		UploadedAt: aws.ToTime(head.LastModified).UTC().Format(time.RFC3339),
+		IssuedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+	for algorithm, checksum := range map[string]*string{
+		"SHA256":    head.ChecksumSHA256,
+		"SHA1":      head.ChecksumSHA1,
+		"CRC32C":    head.ChecksumCRC32C,
+		"CRC32":     head.ChecksumCRC32,
+		"CRC64NVME": head.ChecksumCRC64NVME,
+	} {
+		// S3 stores at most one checksum per object
+		if checksum != nil {
+			payload.Checksum, payload.ChecksumAlgorithm = *checksum, algorithm
+		}
+	}
+
+	return s.receipts.Sign(ctx, payload)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxRecordBytes is the largest single NDJSON record accepted
+	MaxRecordBytes = 256 * 1024
+
+	// MaxRecordsPerRequest caps the number of records in one bulk upload
+	MaxRecordsPerRequest = 10000
+
+	// RecordBatchMaxRecords is the number of records after which a batch object is written
+	RecordBatchMaxRecords = 1000
+
+	// RecordBatchMaxBytes is the batch object size after which a new batch is started
+	RecordBatchMaxBytes = 1024 * 1024
+
+	// recordsContentType is the content type of batch objects
+	recordsContentType = "application/x-ndjson"
+)
+
+// ErrTooManyRecords is returned when a bulk upload holds more than MaxRecordsPerRequest records
+var ErrTooManyRecords = fmt.Errorf("request exceeds %d records", MaxRecordsPerRequest)
+
+// generateS3KeyForRecords creates a unique S3 key for a record batch with .ndjson extension
+func generateS3KeyForRecords(tenantID string) string {
+	// Generate a timestamp-based path (YYYY/MM/DD)
+	now := time.Now().UTC()
+	datePath := fmt.Sprintf("%d/%02d/%02d", now.Year(), now.Month(), now.Day())
+
+	// Include tenant ID as prefix in the path: <tenant>/YYYY/MM/DD/<guid>.ndjson
+	return fmt.Sprintf("%s/%s/%s.ndjson", tenantID, datePath, uuid.New().String())
+}
+
+// validateRecord checks that one NDJSON line holds a single JSON object
+func validateRecord(line []byte) string {
+	if len(line) > MaxRecordBytes {
+		return fmt.Sprintf("record exceeds %d bytes", MaxRecordBytes)
+	}
+	if !json.Valid(line) {
+		return "invalid JSON"
+	}
+	if line[0] != '{' {
+		return "record must be a JSON object"
+	}
+	return ""
+}
+
+// recordBatch collects accepted records until it is flushed to one object
+type recordBatch struct {
+	body    bytes.Buffer
+	digest  contentDigest // Digests of body, computed as records are added
+	results []int         // Indexes into the response results of the records in this batch
+}
+
+// UploadRecords splits an NDJSON body into records, validates each, and stores the valid
+// ones in batch objects of at most RecordBatchMaxRecords records / RecordBatchMaxBytes.
+// Every non-blank line gets a result, so producers can resend exactly what was rejected.
+// Storage failures reject the records of the affected batch; an error is only returned
+// when nothing at all could be stored.
+func (s *UploadService) UploadRecords(ctx context.Context, tenantID string, body []byte) (*UploadRecordsResponse, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+
+	// Enforce the record limit before anything is stored
+	lines := bytes.Split(body, []byte("\n"))
+	records := 0
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) > 0 {
+			records++
+		}
+	}
+	if records > MaxRecordsPerRequest {
+		return nil, ErrTooManyRecords
+	}
+
+	resp := &UploadRecordsResponse{ObjectKeys: []string{}, Results: make([]RecordResult, 0, records)}
+	tenantS3Client := s.s3Clients.Get(tenantID)
+
+	var batch recordBatch
+	var storeErr error
+	flush := func() {
+		if len(batch.results) == 0 {
+			return
+		}
+		key := generateS3KeyForRecords(tenantID)
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucketFor(tenantID)),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(batch.body.Bytes()),
+			ContentType: aws.String(recordsContentType),
+		}
+		s.encryption.ApplyPutObject(input, tenantID)
+		batch.digest.ApplyPutObject(input)
+
+		_, err := tenantS3Client.PutObject(ctx, input)
+		for _, i := range batch.results {
+			if err != nil {
+				resp.Results[i].Status = RecordRejected
+				resp.Results[i].Error = "failed to store record batch"
+				continue
+			}
+			resp.Results[i].Status = RecordAccepted
+			resp.Results[i].ObjectKey = key
+		}
+		if err != nil {
+			log.Printf("Failed to store record batch of %d records for tenant %s: %v", len(batch.results), tenantID, err)
+			storeErr = err
+		} else {
+			resp.ObjectKeys = append(resp.ObjectKeys, key)
+		}
+		batch = recordBatch{}
+	}
+
+	for number, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		result := RecordResult{Line: number + 1}
+		if reason := validateRecord(line); reason != "" {
+			result.Status = RecordRejected
+			result.Error = reason
+			resp.Results = append(resp.Results, result)
+			continue
+		}
+
+		// Start a new batch when this record would push the current one over its size
+		if batch.body.Len()+len(line)+1 > RecordBatchMaxBytes {
+			flush()
+		}
+		resp.Results = append(resp.Results, result)
+		batch.results = append(batch.results, len(resp.Results)-1)
+		batch.body.Write(line)
+		batch.body.WriteByte('\n')
+		batch.digest.Write(line)
+		batch.digest.Write([]byte{'\n'})
+		if len(batch.results) >= RecordBatchMaxRecords {
+			flush()
+		}
+	}
+	flush()
+
+	for _, result := range resp.Results {
+		if result.Status == RecordAccepted {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+	if storeErr != nil && resp.Accepted == 0 {
+		return nil, fmt.Errorf("failed to store records: %w", storeErr)
+	}
+	return resp, nil
+}
@@ -0,0 +1,213 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types of the supported body encodings
+const (
+	MediaTypeJSON    = "application/json"
+	MediaTypeCBOR    = "application/cbor"
+	MediaTypeMsgPack = "application/msgpack"
+)
+
+// ErrUnsupportedMediaType is returned by Decode for request bodies in an unknown encoding
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// Codec encodes and decodes request and response bodies in one media type. All codecs
+// use the `json` struct tags, so the API models need no per-encoding tags.
+type Codec interface {
+	MediaType() string
+	Marshal(v any, pretty bool) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) MediaType() string { return MediaTypeJSON }
+
+func (jsonCodec) Marshal(v any, pretty bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if pretty {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return decodeJSON(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) MediaType() string { return MediaTypeCBOR }
+
+func (cborCodec) Marshal(v any, _ bool) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	decode := cbor.Unmarshal
+	if Strict {
+		decode = strictCBOR.Unmarshal
+	}
+	if err := decode(data, v); err != nil {
+		return &BodyError{Err: err}
+	}
+	return nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) MediaType() string { return MediaTypeMsgPack }
+
+func (msgpackCodec) Marshal(v any, _ bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	// The decoder allocates untyped arrays ([]any) at the length the body claims, which
+	// five bytes can set to billions. Skipping allocates nothing and fails at the first
+	// element the body does not contain, so afterwards every claimed length is backed by data.
+	if err := msgpack.NewDecoder(bytes.NewReader(data)).Skip(); err != nil {
+		return &BodyError{Err: err}
+	}
+
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	decoder.DisallowUnknownFields(Strict)
+	if err := decoder.Decode(v); err != nil {
+		return &BodyError{Err: err}
+	}
+	return nil
+}
+
+// codecs lists the supported encodings in order of preference; JSON is the default
+var codecs = []Codec{jsonCodec{}, cborCodec{}, msgpackCodec{}}
+
+// codecAliases maps alternative media type spellings seen in the wild
+var codecAliases = map[string]string{
+	"application/x-msgpack":   MediaTypeMsgPack,
+	"application/vnd.msgpack": MediaTypeMsgPack,
+}
+
+// codecFor returns the codec for a media type (parameters allowed), or nil
+func codecFor(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if alias, ok := codecAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	for _, codec := range codecs {
+		if codec.MediaType() == mediaType {
+			return codec
+		}
+	}
+	return nil
+}
+
+// requestCodec returns the codec for the request body. A missing Content-Type is
+// treated as JSON, which is what every client sent before other encodings existed.
+func requestCodec(r *http.Request) Codec {
+	contentType := strings.TrimSpace(r.Header.Get("Content-Type"))
+	if contentType == "" {
+		return jsonCodec{}
+	}
+	return codecFor(contentType)
+}
+
+// responseCodec picks the codec for the response from the Accept header, preferring
+// JSON on ties. It returns nil when the client accepts none of them.
+func responseCodec(r *http.Request) Codec {
+	var best Codec
+	bestQ := 0.0
+	for _, codec := range codecs {
+		q := acceptQuality(r, codec.MediaType())
+		for alias, target := range codecAliases {
+			if target == codec.MediaType() {
+				q = max(q, acceptQuality(r, alias))
+			}
+		}
+		if q > bestQ {
+			best, bestQ = codec, q
+		}
+	}
+	return best
+}
+
+// Decode reads the request body into v using the encoding named by Content-Type.
+// It returns ErrUnsupportedMediaType (wrapped) for encodings it does not know.
+func Decode(r *http.Request, v any) error {
+	codec := requestCodec(r)
+	if codec == nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedMediaType, r.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// DecodeError writes the error response for a failed Decode: 415 for unknown encodings,
+// otherwise 400 with the given message, followed by what was wrong with the body and where
+func DecodeError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, ErrUnsupportedMediaType) {
+		Error(w, r, http.StatusUnsupportedMediaType, "Content-Type must be one of "+supportedMediaTypes())
+		return
+	}
+	var bodyErr *BodyError
+	if errors.As(err, &bodyErr) {
+		message += ": " + bodyErr.Error()
+	}
+	Error(w, r, http.StatusBadRequest, message)
+}
+
+// Codecs is middleware for routes that exchange encoded bodies. It rejects request bodies
+// in unknown encodings with 415 and clients that accept none of the encodings with 406
+// before the handler runs, and marks responses as varying by Accept for caches.
+func Codecs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if r.ContentLength != 0 && requestCodec(r) == nil {
+			Error(w, r, http.StatusUnsupportedMediaType, "Content-Type must be one of "+supportedMediaTypes())
+			return
+		}
+		if responseCodec(r) == nil {
+			Error(w, r, http.StatusNotAcceptable, "Accept must allow one of "+supportedMediaTypes())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// supportedMediaTypes lists the codec media types for error messages
+func supportedMediaTypes() string {
+	types := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		types = append(types, codec.MediaType())
+	}
+	return strings.Join(types, ", ")
+}
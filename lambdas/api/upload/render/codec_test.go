@@ -0,0 +1,127 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+// fuzzBody is shaped like the control-plane request bodies: strings, numbers, a flag and
+// a list of nested objects
+type fuzzBody struct {
+	UploadID  string     `json:"uploadId"`
+	Size      int64      `json:"size"`
+	Inline    bool       `json:"inline,omitempty"`
+	PartETags []fuzzPart `json:"partETags"`
+}
+
+type fuzzPart struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"eTag"`
+}
+
+// FuzzCodecRoundTrip checks that every codec decodes what it encoded
+func FuzzCodecRoundTrip(f *testing.F) {
+	f.Add("2~abc", int64(1<<20), true, 1, `"9b2cf535f27731c974343645a3985328"`)
+	f.Add("", int64(-1), false, 0, "")
+	f.Add("ünïcødé ✓", int64(1<<62), false, 10000, "\x00")
+
+	f.Fuzz(func(t *testing.T, uploadID string, size int64, inline bool, partNumber int, eTag string) {
+		// Response values are valid UTF-8 Go strings; JSON replaces invalid bytes and
+		// CBOR rejects them on decode, so only valid text is expected to round-trip
+		if !utf8.ValidString(uploadID) || !utf8.ValidString(eTag) {
+			t.Skip()
+		}
+		in := fuzzBody{
+			UploadID:  uploadID,
+			Size:      size,
+			Inline:    inline,
+			PartETags: []fuzzPart{{PartNumber: partNumber, ETag: eTag}},
+		}
+		for _, codec := range codecs {
+			data, err := codec.Marshal(in, false)
+			if err != nil {
+				t.Fatalf("%s: Marshal: %v", codec.MediaType(), err)
+			}
+			var out fuzzBody
+			if err := codec.Unmarshal(data, &out); err != nil {
+				t.Fatalf("%s: Unmarshal of %q: %v", codec.MediaType(), data, err)
+			}
+			if !reflect.DeepEqual(in, out) {
+				t.Fatalf("%s: round trip = %+v, want %+v", codec.MediaType(), out, in)
+			}
+		}
+	})
+}
+
+// fuzzDecode decodes arbitrary bytes with the codec. It must not panic, failures must be
+// reported as a *BodyError, and whatever decodes must survive another round trip.
+func fuzzDecode(t *testing.T, codec Codec, data []byte) {
+	var generic any
+	if err := codec.Unmarshal(data, &generic); err != nil {
+		var bodyErr *BodyError
+		if !errors.As(err, &bodyErr) {
+			t.Fatalf("Unmarshal into any: %T is not a *BodyError: %v", err, err)
+		}
+	}
+
+	var body fuzzBody
+	if err := codec.Unmarshal(data, &body); err != nil {
+		var bodyErr *BodyError
+		if !errors.As(err, &bodyErr) {
+			t.Fatalf("Unmarshal: %T is not a *BodyError: %v", err, err)
+		}
+		return
+	}
+	if !utf8.ValidString(body.UploadID) {
+		return // binary strings decode, but are not valid text to encode again
+	}
+	for _, part := range body.PartETags {
+		if !utf8.ValidString(part.ETag) {
+			return
+		}
+	}
+	encoded, err := codec.Marshal(body, false)
+	if err != nil {
+		t.Fatalf("Marshal of decoded %+v: %v", body, err)
+	}
+	var again fuzzBody
+	if err := codec.Unmarshal(encoded, &again); err != nil {
+		t.Fatalf("Unmarshal of re-encoded %+v: %v", body, err)
+	}
+	if !reflect.DeepEqual(body, again) {
+		t.Fatalf("re-encoded body decodes to %+v, want %+v", again, body)
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add([]byte{0xa1, 0x68, 'u', 'p', 'l', 'o', 'a', 'd', 'I', 'd', 0x63, 'a', 'b', 'c'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, cborCodec{}, data)
+	})
+}
+
+func FuzzDecodeMsgPack(f *testing.F) {
+	f.Add([]byte{0x81, 0xa8, 'u', 'p', 'l', 'o', 'a', 'd', 'I', 'd', 0xa3, 'a', 'b', 'c'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, msgpackCodec{}, data)
+	})
+}
+
+func FuzzDecodeJSON(f *testing.F) {
+	f.Add([]byte(`{"uploadId": "abc", "partETags": [{"partNumber": 1, "eTag": "\"e1\""}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, jsonCodec{}, data)
+
+		// Errors that carry a position point into the body
+		var body fuzzBody
+		var bodyErr *BodyError
+		if err := decodeJSON(data, &body); errors.As(err, &bodyErr) && bodyErr.Line != 0 {
+			if bodyErr.Line > bytes.Count(data, []byte("\n"))+1 || bodyErr.Column < 1 || bodyErr.Column > len(data)+1 {
+				t.Fatalf("error position line %d, column %d is outside the %d byte body", bodyErr.Line, bodyErr.Column, len(data))
+			}
+		}
+	})
+}
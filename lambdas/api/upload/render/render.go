@@ -0,0 +1,154 @@
+// Package render writes the upload API's HTTP responses and decodes its request bodies.
+// Bodies are JSON by default, or CBOR / MessagePack when negotiated through Content-Type
+// and Accept. Success bodies are the typed response structs; errors use a single envelope
+//
+//	{"error": {"code": "not_found", "message": "Object not found"}}
+//
+// so clients can branch on a stable code instead of parsing messages. Handlers should
+// go through this package rather than calling http.Error or encoding bodies themselves.
+package render
+
+import (
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeText = "text/plain; charset=utf-8"
+
+	// PrettyParam is the query parameter that asks for indented JSON (?pretty or ?pretty=true)
+	PrettyParam = "pretty"
+)
+
+// ErrorBody describes a failed request
+type ErrorBody struct {
+	Code    string `json:"code"`    // Stable snake_case code derived from the status, e.g. "not_found"
+	Message string `json:"message"` // Human-readable description
+}
+
+// ErrorEnvelope is the body of every error response
+type ErrorEnvelope struct {
+	Error ErrorBody `json:"error"`
+}
+
+// Respond writes v with the given status in the encoding the Accept header prefers
+// (JSON, CBOR or MessagePack, JSON by default). Clients that accept none of them get
+// 406 Not Acceptable instead.
+func Respond(w http.ResponseWriter, r *http.Request, status int, v any) {
+	codec := responseCodec(r)
+	if codec == nil {
+		Error(w, r, http.StatusNotAcceptable, "Accept must allow one of "+supportedMediaTypes())
+		return
+	}
+	write(w, r, codec, status, v)
+}
+
+// NoContent writes an empty 204 response
+func NoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Error writes an error response with a code derived from the status. The envelope is
+// encoded like a regular response, or sent as the bare message in text/plain for clients
+// that accept none of the encodings but do accept text.
+func Error(w http.ResponseWriter, r *http.Request, status int, message string) {
+	codec := responseCodec(r)
+	if codec == nil && acceptQuality(r, "text/plain") > 0 {
+		h := w.Header()
+		h.Set("Content-Type", contentTypeText)
+		h.Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(message + "\n"))
+		return
+	}
+	if codec == nil {
+		codec = jsonCodec{}
+	}
+	write(w, r, codec, status, ErrorEnvelope{Error: ErrorBody{Code: ErrorCode(status), Message: message}})
+}
+
+// ErrorCode converts a status to its snake_case code, e.g. 429 -> "too_many_requests"
+func ErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "http_" + strconv.Itoa(status)
+	}
+	text = strings.NewReplacer("-", " ", "'", "").Replace(strings.ToLower(text))
+	return strings.Join(strings.Fields(text), "_")
+}
+
+// write encodes v with codec, indenting JSON when the request asks for pretty output
+func write(w http.ResponseWriter, r *http.Request, codec Codec, status int, v any) {
+	body, err := codec.Marshal(v, wantsPretty(r))
+	if err != nil {
+		log.Printf("Failed to encode %s response: %v", codec.MediaType(), err)
+		status = http.StatusInternalServerError
+		body, _ = codec.Marshal(ErrorEnvelope{Error: ErrorBody{
+			Code:    ErrorCode(status),
+			Message: "Failed to encode response",
+		}}, false)
+	}
+
+	w.Header().Set("Content-Type", codec.MediaType())
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// wantsPretty reports whether the pretty query parameter is present and not false
+func wantsPretty(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	values, ok := r.URL.Query()[PrettyParam]
+	if !ok {
+		return false
+	}
+	if len(values) == 0 || values[0] == "" {
+		return true
+	}
+	pretty, err := strconv.ParseBool(values[0])
+	return err == nil && pretty
+}
+
+// acceptQuality returns the quality the request's Accept header gives mediaType, from
+// the most specific matching entry, so "application/json;q=0, */*" rejects JSON.
+// A missing header accepts everything; entries that cannot be parsed are ignored.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	if r == nil {
+		return 1
+	}
+	header := strings.TrimSpace(r.Header.Get("Accept"))
+	if header == "" {
+		return 1
+	}
+
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	best, quality := 0, 0.0
+	for _, entry := range strings.Split(header, ",") {
+		accepted, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		specificity := 0
+		switch accepted {
+		case mediaType:
+			specificity = 3
+		case mainType + "/*":
+			specificity = 2
+		case "*/*":
+			specificity = 1
+		}
+		if specificity <= best {
+			continue
+		}
+		best = specificity
+		quality = 1
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+	}
+	return quality
+}
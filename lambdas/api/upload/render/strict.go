@@ -0,0 +1,206 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Strict makes Decode reject request bodies with fields the target struct does not have,
+// including fields whose name only matches when ignoring case, so client typos (e.g.
+// "partsize" for "partSize") fail loudly instead of leaving the field zero. It applies to
+// every encoding. Set it once at init; it is on unless a deployment needs time to fix
+// clients that send extra fields.
+var Strict = true
+
+// strictCBOR decodes CBOR like cbor.Unmarshal but rejects unknown and miscased fields
+var strictCBOR, _ = cbor.DecOptions{
+	ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	FieldNameMatching: cbor.FieldNameMatchingCaseSensitive,
+}.DecMode()
+
+// BodyError describes why a request body could not be decoded. Line and Column locate the
+// problem in JSON bodies; they are zero for the binary encodings.
+type BodyError struct {
+	Line   int // 1-based
+	Column int // 1-based, in bytes
+	Err    error
+}
+
+func (e *BodyError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
+// decodeJSON decodes a single JSON value, reporting errors with their position
+func decodeJSON(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if Strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		if err == io.EOF {
+			return &BodyError{Err: errors.New("body is empty")}
+		}
+		return jsonBodyError(data, decoder.InputOffset(), err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return jsonBodyError(data, decoder.InputOffset(), errors.New("unexpected data after the JSON value"))
+	}
+	if Strict {
+		// encoding/json matches field names case-insensitively, so "partsize" would still
+		// fill partSize; strict mode wants the exact name
+		var raw any
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return jsonBodyError(data, 0, err)
+		}
+		if name, want, ok := miscasedField(raw, reflect.TypeOf(v)); ok {
+			offset := int64(bytes.Index(data, []byte(strconv.Quote(name)))) + 1
+			return jsonBodyError(data, offset, fmt.Errorf("unknown field %q (did you mean %q?)", name, want))
+		}
+	}
+	return nil
+}
+
+// miscasedField finds an object key in raw that only matches a field of t when ignoring
+// case, returning it with the field's exact name
+func miscasedField(raw any, t reflect.Type) (name, want string, found bool) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil {
+		return "", "", false
+	}
+	switch value := raw.(type) {
+	case map[string]any:
+		switch t.Kind() {
+		case reflect.Map:
+			for _, item := range value {
+				if name, want, found = miscasedField(item, t.Elem()); found {
+					return name, want, true
+				}
+			}
+		case reflect.Struct:
+			for key, item := range value {
+				field, exact := structField(t, key)
+				if field == nil {
+					continue
+				}
+				if !exact {
+					return key, jsonName(*field), true
+				}
+				if name, want, found = miscasedField(item, field.Type); found {
+					return name, want, true
+				}
+			}
+		}
+	case []any:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, item := range value {
+				if name, want, found = miscasedField(item, t.Elem()); found {
+					return name, want, true
+				}
+			}
+		}
+	}
+	return "", "", false
+}
+
+// structField returns the field of t that the JSON key decodes into, and whether the key
+// spells its name exactly
+func structField(t reflect.Type, key string) (*reflect.StructField, bool) {
+	var folded *reflect.StructField
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name := jsonName(field)
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == key {
+			return &field, true
+		}
+		if folded == nil && strings.EqualFold(name, key) {
+			folded = &field
+		}
+	}
+	return folded, false
+}
+
+// jsonName returns the name a struct field has in JSON
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// jsonBodyError locates err in data. offset is where the decoder stopped, used when the
+// error carries no position of its own.
+func jsonBodyError(data []byte, offset int64, err error) *BodyError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+		err = errors.New(syntaxErr.Error())
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		err = fmt.Errorf("field %q must be %s", typeErr.Field, jsonKind(typeErr.Type))
+	default:
+		// Unknown fields are only reported by name, after the whole value was read
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if i := bytes.Index(data, []byte(name)); i >= 0 {
+				offset = int64(i) + 1
+			}
+			if unquoted, uerr := strconv.Unquote(name); uerr == nil {
+				err = fmt.Errorf("unknown field %q", unquoted)
+			}
+		}
+	}
+
+	line, column := 1, 1
+	for _, b := range data[:min(max(offset-1, 0), int64(len(data)))] {
+		if b == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return &BodyError{Line: line, Column: column, Err: err}
+}
+
+// jsonKind names the JSON type a Go type is decoded from
+func jsonKind(t reflect.Type) string {
+	if t == nil {
+		return "a different type"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// DefaultReplicationWaitTimeout is how long complete waits for replication when asked to
+	DefaultReplicationWaitTimeout = 20 * time.Second
+
+	// MaxReplicationWaitTimeout keeps the wait, plus the completion itself, within the
+	// 29 second API Gateway integration timeout
+	MaxReplicationWaitTimeout = 25 * time.Second
+
+	// replicationPollInterval is the delay between replication status checks
+	replicationPollInterval = 1 * time.Second
+
+	// Replication states reported to clients
+	ReplicationPending   = "PENDING"
+	ReplicationCompleted = "COMPLETED"
+	ReplicationFailed    = "FAILED"
+)
+
+// ErrReplicationNotConfigured is returned when waiting for the replication of an object that
+// no replication rule applies to
+var ErrReplicationNotConfigured = errors.New("object is not replicated")
+
+// ReplicationStatus reads the cross-region replication status of a tenant object: PENDING,
+// COMPLETED or FAILED, and "" when no replication rule applies to it. With several
+// destinations, S3 only reports COMPLETED once every replica is written.
+func (s *UploadService) ReplicationStatus(ctx context.Context, tenantID, objectKey string) (string, error) {
+	if err := validateLiveObjectKey(tenantID, objectKey); err != nil {
+		return "", err
+	}
+
+	head, err := s.s3Clients.Get(tenantID).HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		if isMissingObject(err) {
+			return "", ErrObjectNotFound
+		}
+		return "", fmt.Errorf("failed to read replication status: %w", err)
+	}
+	return normalizeReplicationStatus(head.ReplicationStatus), nil
+}
+
+// normalizeReplicationStatus maps the legacy COMPLETE status some S3 responses still use
+// onto COMPLETED
+func normalizeReplicationStatus(status types.ReplicationStatus) string {
+	if status == types.ReplicationStatusComplete {
+		return ReplicationCompleted
+	}
+	return string(status)
+}
+
+// WaitForReplication polls the replication status of a tenant object until it is COMPLETED
+// or FAILED, or the wait timeout elapses, and returns the last status seen. S3 sets PENDING
+// as soon as the object is written, so an empty status means the bucket does not replicate it.
+func (s *UploadService) WaitForReplication(ctx context.Context, tenantID, objectKey string) (string, error) {
+	deadline := time.Now().Add(s.replWait)
+	for {
+		status, err := s.ReplicationStatus(ctx, tenantID, objectKey)
+		if err != nil {
+			return "", err
+		}
+		switch status {
+		case "":
+			return "", ErrReplicationNotConfigured
+		case ReplicationCompleted, ReplicationFailed:
+			return status, nil
+		}
+
+		if time.Now().Add(replicationPollInterval).After(deadline) {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return status, nil
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
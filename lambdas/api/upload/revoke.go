@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ErrUploadNotFound is returned when a multipart upload no longer exists (completed or aborted)
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// RevokeUploadUrls revokes the presigned URLs of an in-progress multipart upload, e.g. when a
+// device holding them is reported stolen, and restarts the upload under a new object key.
+//
+// Part URLs are bound to their object key and upload ID, so aborting the upload makes every
+// outstanding URL fail, including ones already refreshed. S3 cannot copy the parts of an
+// unfinished upload, so the replacement upload starts empty and the client uploads all parts
+// again. The new key has a fresh random segment, so URLs for the old key cannot be guessed
+// into working for the new upload.
+//
+// The old upload is aborted first: if starting the replacement fails, the URLs are still revoked
+// and the client can initiate a new upload itself.
+func (s *UploadService) RevokeUploadUrls(ctx context.Context, tenantID string, req *RevokeUploadRequest) (*InitiateUploadResponse, error) {
+	if req.UploadID == "" {
+		return nil, fmt.Errorf("upload ID cannot be empty")
+	}
+	if req.ObjectKey == "" {
+		return nil, fmt.Errorf("object key cannot be empty")
+	}
+	if err := validateTenantObjectKey(tenantID, req.ObjectKey); err != nil {
+		return nil, err
+	}
+	initiate := &InitiateUploadRequest{Size: req.Size, PartSize: req.PartSize, URLDelivery: req.URLDelivery}
+	if err := validateInitiateRequest(tenantID, initiate); err != nil {
+		return nil, err
+	}
+
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
+
+	_, err := tenantS3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketFor(tenantID)),
+		Key:      aws.String(req.ObjectKey),
+		UploadId: aws.String(req.UploadID),
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchUpload) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, req.UploadID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+
+	username, _ := GetUsername(ctx)
+	log.Printf("AUDIT upload urls revoked: user=%s tenant=%s key=%s upload=%s%s",
+		username, tenantID, req.ObjectKey, req.UploadID, clientFields(ctx))
+
+	resp, err := s.InitiateMultipartUpload(ctx, tenantID, initiate)
+	if err != nil {
+		return nil, fmt.Errorf("upload %s revoked, but its replacement could not be started: %w", req.UploadID, err)
+	}
+	log.Printf("Upload %s replaced by %s at %s", req.UploadID, resp.UploadID, resp.ObjectKey)
+	return resp, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// CredentialValidity is a key type for storing the required credential lifetime in context
+type CredentialValidity string
+
+// ContextCredentialValidityKey is the key used to store the minimum remaining lifetime
+// that tenant credentials must have for the current S3 call
+const ContextCredentialValidityKey CredentialValidity = "credential_validity"
+
+// WithCredentialValidity sets how long the tenant credentials used by S3 calls made with
+// ctx must remain valid. Presigning uses this so the URLs never outlive their credentials.
+func WithCredentialValidity(ctx context.Context, validity time.Duration) context.Context {
+	return context.WithValue(ctx, ContextCredentialValidityKey, validity)
+}
+
+// getCredentialValidity retrieves the required credential lifetime, defaulting to MinCredentialValidity
+func getCredentialValidity(ctx context.Context) time.Duration {
+	if validity, ok := ctx.Value(ContextCredentialValidityKey).(time.Duration); ok {
+		return validity
+	}
+	return MinCredentialValidity
+}
+
+// tenantCredentialsProvider resolves credentials for one tenant from the shared credential cache.
+// It is deliberately not wrapped in aws.CredentialsCache: the tenant cache already avoids STS
+// calls, and each call may require a different minimum validity.
+type tenantCredentialsProvider struct {
+	cache    *TenantCredentialCache
+	tenantID string
+}
+
+// Retrieve implements aws.CredentialsProvider
+func (p *tenantCredentialsProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	return p.cache.Get(ctx, p.tenantID, getCredentialValidity(ctx))
+}
+
+// TenantS3Clients caches one S3 client per tenant within a Lambda instance so HTTP
+// connections and TLS sessions are reused across requests. Clients never hold
+// credentials themselves; they pull them from the TenantCredentialCache on every call.
+type TenantS3Clients struct {
+	awsConfig   aws.Config
+	credentials *TenantCredentialCache
+
+	mu      sync.Mutex
+	clients map[string]*s3.Client
+}
+
+// NewTenantS3Clients creates an empty per-tenant S3 client cache
+func NewTenantS3Clients(cfg aws.Config, credentials *TenantCredentialCache) *TenantS3Clients {
+	return &TenantS3Clients{
+		awsConfig:   cfg,
+		credentials: credentials,
+		clients:     make(map[string]*s3.Client),
+	}
+}
+
+// Get returns the S3 client for the tenant, creating it on first use
+func (c *TenantS3Clients) Get(tenantID string) *s3.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[tenantID]; ok {
+		return client
+	}
+
+	// All tenant clients share the HTTP client from awsConfig, so the connection pool is shared too
+	client := s3.NewFromConfig(c.awsConfig, func(o *s3.Options) {
+		o.Credentials = &tenantCredentialsProvider{cache: c.credentials, tenantID: tenantID}
+	})
+	c.clients[tenantID] = client
+	return client
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// SandboxHeader marks responses to sandbox tenants, so integrators can tell test traffic
+// from production at a glance
+const SandboxHeader = "X-Upload-Sandbox"
+
+// SandboxConfig routes the objects of sandbox tenants to a separate bucket, whose lifecycle
+// rule expires everything after a short retention. Keys keep the tenant prefix there, so the
+// tenant role's prefix conditions apply unchanged. A nil *SandboxConfig sandboxes nobody.
+type SandboxConfig struct {
+	Bucket  string   // Sandbox bucket name
+	Tenants []string // Sandboxed tenants; "*" for all
+}
+
+// LoadSandboxConfig reads SANDBOX_TENANTS, a comma-separated list of tenants ("*" for all),
+// and SANDBOX_BUCKET. It returns nil when no tenant is sandboxed.
+func LoadSandboxConfig() (*SandboxConfig, error) {
+	tenants := envList("SANDBOX_TENANTS")
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+	bucket := strings.TrimSpace(os.Getenv("SANDBOX_BUCKET"))
+	if bucket == "" {
+		return nil, fmt.Errorf("SANDBOX_TENANTS requires SANDBOX_BUCKET")
+	}
+	return &SandboxConfig{Bucket: bucket, Tenants: tenants}, nil
+}
+
+// Includes reports whether the tenant is sandboxed
+func (c *SandboxConfig) Includes(tenantID string) bool {
+	if c == nil {
+		return false
+	}
+	return slices.Contains(c.Tenants, "*") || slices.Contains(c.Tenants, tenantID)
+}
+
+// SandboxWatermark marks the responses of sandboxed tenants with SandboxHeader. It must run
+// after the tenant is established.
+func SandboxWatermark(sandbox *SandboxConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tenantID, ok := GetTenantID(r.Context()); ok && sandbox.Includes(tenantID) {
+				w.Header().Set(SandboxHeader, "true")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
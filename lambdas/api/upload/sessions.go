@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// MinTenantSessionDuration and MaxTenantSessionDuration bound a tenant's assumed-role
+	// session to what STS issues; the maximum must not exceed the TenantAccessRole's
+	// MaxSessionDuration
+	MinTenantSessionDuration = 15 * time.Minute
+	MaxTenantSessionDuration = 12 * time.Hour
+)
+
+// SessionSettings are a tenant's service-level durations
+type SessionSettings struct {
+	MinTokenValidity time.Duration // Token lifetime left that simple uploads require
+	Session          time.Duration // Assumed-role session length; presigned URLs cannot outlive it
+	DefaultPresign   time.Duration // Presigned URL lifetime when the token's expiry is unknown
+}
+
+// DefaultSessionSettings apply to tenants without configured settings
+var DefaultSessionSettings = SessionSettings{
+	MinTokenValidity: MinSessionDuration * time.Second,
+	Session:          LongSessionDuration * time.Second,
+	DefaultPresign:   DefaultPresignedURLDuration,
+}
+
+// MaxCredentialValidity is the longest remaining lifetime the tenant's credentials can be
+// required to have, leaving the presigned URL buffer before the session ends
+func (s SessionSettings) MaxCredentialValidity() time.Duration {
+	return s.Session - PresignedURLBuffer
+}
+
+// RefreshThreshold is the remaining lifetime below which an active tenant's credentials are
+// renewed, so presigned URLs with the default duration never need an STS call on the hot path
+func (s SessionSettings) RefreshThreshold() time.Duration {
+	return s.DefaultPresign + PresignedURLBuffer
+}
+
+// validate checks the settings against STS limits and against each other
+func (s SessionSettings) validate() error {
+	if s.Session < MinTenantSessionDuration || s.Session > MaxTenantSessionDuration {
+		return fmt.Errorf("session must be between %s and %s", MinTenantSessionDuration, MaxTenantSessionDuration)
+	}
+	if s.DefaultPresign < MinPresignedURLDuration || s.DefaultPresign > s.MaxCredentialValidity() {
+		return fmt.Errorf("default_presign must be between %s and the session minus %s", MinPresignedURLDuration, PresignedURLBuffer)
+	}
+	if s.MinTokenValidity < 0 || s.MinTokenValidity > s.Session {
+		return fmt.Errorf("min_token_validity must be between 0 and the session")
+	}
+	return nil
+}
+
+// sessionSettingsEntry is the JSON form of SessionSettings, with Go duration strings
+// ("15m", "8h"); fields left empty keep the base value
+type sessionSettingsEntry struct {
+	MinTokenValidity string `json:"min_token_validity"`
+	Session          string `json:"session"`
+	DefaultPresign   string `json:"default_presign"`
+}
+
+// apply overrides the base settings with the entry's durations
+func (e sessionSettingsEntry) apply(base SessionSettings) (SessionSettings, error) {
+	settings := base
+	for _, field := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"min_token_validity", e.MinTokenValidity, &settings.MinTokenValidity},
+		{"session", e.Session, &settings.Session},
+		{"default_presign", e.DefaultPresign, &settings.DefaultPresign},
+	} {
+		if field.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(field.value)
+		if err != nil {
+			return SessionSettings{}, fmt.Errorf("%s: %w", field.name, err)
+		}
+		*field.target = duration
+	}
+	return settings, settings.validate()
+}
+
+// SessionConfig holds the default session settings and per-tenant overrides. A nil
+// *SessionConfig is valid and applies DefaultSessionSettings to every tenant.
+type SessionConfig struct {
+	Default SessionSettings
+	Tenants map[string]SessionSettings
+}
+
+// LoadSessionConfig reads TENANT_SESSION_SETTINGS, a JSON object mapping tenants (or "*"
+// for the default) to session settings, e.g. {"premium": {"session": "12h", "default_presign": "10h"}}.
+// Fields left out keep the default's value. It returns nil when the variable is unset.
+func LoadSessionConfig() (*SessionConfig, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_SESSION_SETTINGS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var entries map[string]sessionSettingsEntry
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("TENANT_SESSION_SETTINGS is not a valid JSON object: %w", err)
+	}
+	config := &SessionConfig{Default: DefaultSessionSettings, Tenants: map[string]SessionSettings{}}
+	if entry, ok := entries["*"]; ok {
+		settings, err := entry.apply(DefaultSessionSettings)
+		if err != nil {
+			return nil, fmt.Errorf("TENANT_SESSION_SETTINGS default: %w", err)
+		}
+		config.Default = settings
+	}
+	for tenant, entry := range entries {
+		if tenant == "*" {
+			continue
+		}
+		settings, err := entry.apply(config.Default)
+		if err != nil {
+			return nil, fmt.Errorf("TENANT_SESSION_SETTINGS tenant %s: %w", tenant, err)
+		}
+		config.Tenants[tenant] = settings
+	}
+	return config, nil
+}
+
+// For returns the session settings of a tenant
+func (c *SessionConfig) For(tenantID string) SessionSettings {
+	if c == nil {
+		return DefaultSessionSettings
+	}
+	if settings, ok := c.Tenants[tenantID]; ok {
+		return settings
+	}
+	return c.Default
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+)
+
+// STSAssumer is the part of the STS API the service uses; *sts.Client and *FailoverSTSClient
+// implement it
+type STSAssumer interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+}
+
+// STSEndpointConfig selects the regional STS endpoints AssumeRole calls go to
+type STSEndpointConfig struct {
+	Region         string // Primary STS region; empty uses the Lambda's region
+	FailoverRegion string // Region tried when the primary fails; empty disables failover
+}
+
+// LoadSTSEndpointConfig reads STS_REGION and STS_FAILOVER_REGION
+func LoadSTSEndpointConfig() (STSEndpointConfig, error) {
+	cfg := STSEndpointConfig{
+		Region:         strings.TrimSpace(os.Getenv("STS_REGION")),
+		FailoverRegion: strings.TrimSpace(os.Getenv("STS_FAILOVER_REGION")),
+	}
+	if cfg.FailoverRegion != "" && cfg.FailoverRegion == cfg.Region {
+		return cfg, fmt.Errorf("STS_FAILOVER_REGION must differ from STS_REGION")
+	}
+	return cfg, nil
+}
+
+// stsEndpoint is one regional STS endpoint
+type stsEndpoint struct {
+	region  string
+	client  *sts.Client
+	breaker *CircuitBreaker // Skips the endpoint while it keeps failing; nil never skips
+}
+
+// FailoverSTSClient calls the primary regional STS endpoint and, when it fails with an error
+// another region could avoid (throttling, server errors, timeouts, a disabled region), the
+// failover endpoint. Credentials from either region are equally valid everywhere. While the
+// primary's circuit breaker is open, calls go straight to the failover endpoint. Every call
+// records which endpoint served it as the AssumeRoleServed metric.
+type FailoverSTSClient struct {
+	primary  stsEndpoint
+	failover *stsEndpoint // nil without failover
+}
+
+// NewFailoverSTSClient creates the STS client for the configured endpoints; breaker applies
+// to the primary endpoint when failover is enabled
+func NewFailoverSTSClient(cfg aws.Config, endpoints STSEndpointConfig, breaker CircuitBreakerConfig) *FailoverSTSClient {
+	regional := func(region string) stsEndpoint {
+		if region == "" {
+			region = cfg.Region
+		}
+		client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+			o.Region = region
+		})
+		return stsEndpoint{region: region, client: client}
+	}
+
+	c := &FailoverSTSClient{primary: regional(endpoints.Region)}
+	if endpoints.FailoverRegion != "" {
+		failover := regional(endpoints.FailoverRegion)
+		c.failover = &failover
+		c.primary.breaker = NewCircuitBreaker("sts-"+c.primary.region, breaker)
+	}
+	return c
+}
+
+// AssumeRole implements STSAssumer
+func (c *FailoverSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	// Only endpoints with a failover have a breaker, so an open one always leaves the failover
+	primaryErr := c.primary.breaker.Allow()
+	if primaryErr == nil {
+		start := time.Now()
+		output, err := c.primary.client.AssumeRole(ctx, params, optFns...)
+		c.primary.breaker.Record(failoverError(err))
+		recordAssumeRole(c.primary.region, false, err, time.Since(start))
+		if err == nil || c.failover == nil || !isFailoverError(err) {
+			return output, err
+		}
+		primaryErr = err
+	}
+
+	log.Printf("STS endpoint %s unavailable, failing over to %s: %v", c.primary.region, c.failover.region, primaryErr)
+	start := time.Now()
+	output, err := c.failover.client.AssumeRole(ctx, params, optFns...)
+	recordAssumeRole(c.failover.region, true, err, time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("STS failover to %s: %w", c.failover.region, err)
+	}
+	return output, nil
+}
+
+// failoverError returns err when it counts against the endpoint, so errors caused by the
+// request itself (e.g. an access denied) do not open the endpoint's breaker
+func failoverError(err error) error {
+	if err != nil && isFailoverError(err) {
+		return err
+	}
+	return nil
+}
+
+// isFailoverError reports whether another region might succeed where err occurred:
+// everything except client errors other than throttling and a disabled STS region
+func isFailoverError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		// Timeouts and connection failures
+		return true
+	}
+	switch apiErr.ErrorCode() {
+	case "Throttling", "ThrottlingException", "RegionDisabledException":
+		return true
+	}
+	return apiErr.ErrorFault() != smithy.FaultClient
+}
+
+// recordAssumeRole records which endpoint served an AssumeRole call and how long it took
+func recordAssumeRole(region string, failover bool, err error, latency time.Duration) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	dimensions := map[string]string{"Region": region, "Failover": fmt.Sprint(failover), "Outcome": outcome}
+	emitMetric("AssumeRoleServed", "Count", 1, dimensions)
+	emitMetric("AssumeRoleLatency", "Milliseconds", float64(latency.Milliseconds()), map[string]string{"Region": region})
+}
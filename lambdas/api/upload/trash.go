@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// TrashPrefix is the folder under a tenant's prefix that holds deleted objects:
+	// <tenant>/.trash/<rest of the original key>
+	TrashPrefix = ".trash"
+
+	// trashTagging marks trashed objects; the bucket lifecycle rule purges them after the
+	// retention window, counted from the move into the trash
+	trashTagging = "purpose=trash"
+
+	// DefaultTrashRetentionDays is how long deleted objects can be restored
+	DefaultTrashRetentionDays = 30
+
+	// maxCopyParts is S3's part limit, which also applies to multipart copies
+	maxCopyParts = 10000
+
+	// copyConcurrency is how many parts of a large object are copied at once
+	copyConcurrency = 16
+
+	// Object states reported by the delete and restore endpoints
+	ObjectTrashed  = "trashed"
+	ObjectRestored = "restored"
+)
+
+// CopyObject copies objects of up to 5 GiB; larger ones are copied part by part with
+// UploadPartCopy. Variables so tests can exercise the multipart path with small objects.
+var (
+	maxCopyObjectSize int64 = 5 << 30
+	copyPartSize      int64 = 512 << 20
+)
+
+var (
+	// ErrObjectExists is returned when restoring over an object that exists again
+	ErrObjectExists = errors.New("object already exists")
+
+	// ErrTrashedObjectKey is returned when a key inside the trash is addressed directly
+	ErrTrashedObjectKey = errors.New("object key is inside the trash")
+)
+
+// trashKey maps a tenant object key to its key in the tenant's trash
+func trashKey(tenantID, objectKey string) string {
+	return tenantID + "/" + TrashPrefix + "/" + strings.TrimPrefix(objectKey, tenantID+"/")
+}
+
+// validateLiveObjectKey checks a client-supplied key of a (possibly deleted) tenant object
+func validateLiveObjectKey(tenantID, objectKey string) error {
+	if err := validateTenantObjectKey(tenantID, objectKey); err != nil {
+		return err
+	}
+	if strings.HasPrefix(objectKey, tenantID+"/"+TrashPrefix+"/") {
+		return fmt.Errorf("%w: %s", ErrTrashedObjectKey, objectKey)
+	}
+	return nil
+}
+
+// DeleteObject soft-deletes a tenant object by moving it into the tenant's trash, from
+// where RestoreObject can bring it back until the lifecycle rule purges it. Deleting the
+// same key again replaces the earlier trashed copy.
+func (s *UploadService) DeleteObject(ctx context.Context, tenantID, objectKey string) (*ObjectTrashResponse, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if err := validateLiveObjectKey(tenantID, objectKey); err != nil {
+		return nil, err
+	}
+
+	tenantS3Client := s.s3Clients.Get(tenantID)
+	trashed := trashKey(tenantID, objectKey)
+
+	if err := s.copyObject(ctx, tenantS3Client, tenantID, objectKey, trashed, trashTagging); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to move object to trash: %w", err)
+	}
+
+	// The trashed copy exists, so a failure here leaves a restorable duplicate, never a loss
+	if _, err := tenantS3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(objectKey),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to delete object: %w", err)
+	}
+
+	log.Printf("Object trashed: tenant=%s key=%s trash_key=%s", tenantID, objectKey, trashed)
+	return &ObjectTrashResponse{
+		ObjectKey:  objectKey,
+		TrashKey:   trashed,
+		Status:     ObjectTrashed,
+		PurgeAfter: time.Now().AddDate(0, 0, s.trashDays).Unix(),
+	}, nil
+}
+
+// RestoreObject moves a trashed object back to its original key. It refuses with
+// ErrObjectExists when a new object was stored under that key in the meantime.
+func (s *UploadService) RestoreObject(ctx context.Context, tenantID, objectKey string) (*ObjectTrashResponse, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+	if err := validateLiveObjectKey(tenantID, objectKey); err != nil {
+		return nil, err
+	}
+
+	tenantS3Client := s.s3Clients.Get(tenantID)
+	trashed := trashKey(tenantID, objectKey)
+
+	_, err := tenantS3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(objectKey),
+	})
+	if err == nil {
+		return nil, ErrObjectExists
+	}
+	if !isMissingObject(err) {
+		return nil, fmt.Errorf("failed to check object: %w", err)
+	}
+
+	// Replacing the tagging with an empty set drops the trash tag
+	if err := s.copyObject(ctx, tenantS3Client, tenantID, trashed, objectKey, ""); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to restore object: %w", err)
+	}
+
+	// A leftover trashed copy is harmless; the lifecycle rule removes it eventually
+	if _, err := tenantS3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(trashed),
+	}); err != nil {
+		log.Printf("Failed to remove restored object from trash: tenant=%s trash_key=%s: %v", tenantID, trashed, err)
+	}
+
+	log.Printf("Object restored: tenant=%s key=%s", tenantID, objectKey)
+	return &ObjectTrashResponse{
+		ObjectKey: objectKey,
+		TrashKey:  trashed,
+		Status:    ObjectRestored,
+	}, nil
+}
+
+// copyObject copies a tenant object to another key in the tenant's bucket, keeping its
+// content headers and metadata and replacing its tags. It returns ErrObjectNotFound when
+// the source does not exist.
+func (s *UploadService) copyObject(ctx context.Context, client *s3.Client, tenantID, sourceKey, destKey, tagging string) error {
+	bucket := s.bucketFor(tenantID)
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(sourceKey),
+	})
+	if err != nil {
+		if isMissingObject(err) {
+			return ErrObjectNotFound
+		}
+		return fmt.Errorf("failed to check object: %w", err)
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	if size > maxCopyObjectSize {
+		return s.copyObjectMultipart(ctx, client, tenantID, sourceKey, destKey, tagging, head)
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:           aws.String(bucket),
+		Key:              aws.String(destKey),
+		CopySource:       aws.String(copySource(bucket, sourceKey)),
+		TaggingDirective: types.TaggingDirectiveReplace,
+		Tagging:          aws.String(tagging),
+	}
+	s.encryption.ApplyCopyObject(input, tenantID)
+	if _, err := client.CopyObject(ctx, input); err != nil {
+		if isMissingObject(err) {
+			return ErrObjectNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// copyObjectMultipart copies an object too large for CopyObject in parts, several at a
+// time. The parts are copied only while the source keeps the ETag it had when headed, so
+// an object replaced mid-copy fails the copy instead of mixing two versions. A failed copy
+// is aborted, leaving the destination untouched.
+func (s *UploadService) copyObjectMultipart(ctx context.Context, client *s3.Client, tenantID, sourceKey, destKey, tagging string, head *s3.HeadObjectOutput) error {
+	bucket := s.bucketFor(tenantID)
+	size := aws.ToInt64(head.ContentLength)
+
+	// Multipart uploads are not copied as such; the destination gets the source's headers
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(destKey),
+		Tagging:            aws.String(tagging),
+		ContentType:        head.ContentType,
+		ContentEncoding:    head.ContentEncoding,
+		ContentDisposition: head.ContentDisposition,
+		ContentLanguage:    head.ContentLanguage,
+		CacheControl:       head.CacheControl,
+		Metadata:           head.Metadata,
+	}
+	s.encryption.ApplyCreateMultipartUpload(createInput, tenantID)
+	createResp, err := client.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return fmt.Errorf("failed to create multipart copy: %w", err)
+	}
+	abortCopy := func() {
+		_, _ = client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(destKey),
+			UploadId: createResp.UploadId,
+		})
+	}
+
+	// Parts grow beyond copyPartSize when the object would otherwise need too many
+	partSize := max(copyPartSize, (size+maxCopyParts-1)/maxCopyParts)
+	numParts := int((size + partSize - 1) / partSize)
+	parts := make([]types.CompletedPart, numParts)
+
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	slots := make(chan struct{}, copyConcurrency)
+	for i := range parts {
+		select {
+		case slots <- struct{}{}:
+		case <-copyCtx.Done():
+		}
+		if copyCtx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := int64(i) * partSize
+			end := min(start+partSize, size) - 1
+			resp, err := client.UploadPartCopy(copyCtx, &s3.UploadPartCopyInput{
+				Bucket:            aws.String(bucket),
+				Key:               aws.String(destKey),
+				UploadId:          createResp.UploadId,
+				PartNumber:        aws.Int32(int32(i + 1)),
+				CopySource:        aws.String(copySource(bucket, sourceKey)),
+				CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+				CopySourceIfMatch: head.ETag,
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("failed to copy part %d: %w", i+1, err)
+					cancel()
+				})
+				return
+			}
+			parts[i] = types.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: aws.Int32(int32(i + 1))}
+		}(i)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		abortCopy()
+		return firstErr
+	}
+
+	if _, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(destKey),
+		UploadId:        createResp.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		abortCopy()
+		return fmt.Errorf("failed to complete multipart copy: %w", err)
+	}
+	log.Printf("Object copied in %d parts: tenant=%s key=%s dest=%s bytes=%d", numParts, tenantID, sourceKey, destKey, size)
+	return nil
+}
+
+// isMissingObject reports whether an S3 error means the object does not exist. HeadObject
+// has no body, so its miss is only visible as a 404 status.
+func isMissingObject(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == 404
+}
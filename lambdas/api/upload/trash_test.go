@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useSmallCopyLimit lowers the CopyObject limit to 16 bytes, in the service and the stub,
+// and copies larger objects in 8 byte parts
+func useSmallCopyLimit(t *testing.T, stub *awsStub) {
+	oldLimit, oldPartSize := maxCopyObjectSize, copyPartSize
+	maxCopyObjectSize, copyPartSize, stub.copyLimit = 16, 8, 16
+	t.Cleanup(func() { maxCopyObjectSize, copyPartSize = oldLimit, oldPartSize })
+}
+
+// countCalls counts the S3 calls of an operation
+func countCalls(calls []string, operation string) int {
+	n := 0
+	for _, call := range calls {
+		if strings.HasPrefix(call, operation+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// trashedObjectHeader is how the stored test objects are described
+func trashedObjectHeader() http.Header {
+	return http.Header{
+		"Content-Type":        {"image/jpeg"},
+		"Content-Disposition": {`attachment; filename="cat.jpg"`},
+		"X-Amz-Meta-Origin":   {"camera"},
+	}
+}
+
+func TestDeleteAndRestoreObject(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		operation string // How the object is copied
+		calls     int
+	}{
+		{name: "copied at once", size: 16, operation: "CopyObject", calls: 1},
+		{name: "copied in parts", size: 40, operation: "UploadPartCopy", calls: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, stub := newStubbedUploadService(t, UploadServiceOptions{TrashRetentionDays: DefaultTrashRetentionDays})
+			useSmallCopyLimit(t, stub)
+			ctx := contractContext()
+
+			const key = "tenant-a/photos/cat.jpg"
+			content := bytes.Repeat([]byte("0123456789"), 4)[:tt.size]
+			stub.putObject("test-bucket", key, content, trashedObjectHeader())
+
+			trashed, err := service.DeleteObject(ctx, "tenant-a", key)
+			if err != nil {
+				t.Fatalf("DeleteObject: %v", err)
+			}
+			if trashed.TrashKey != "tenant-a/.trash/photos/cat.jpg" || trashed.Status != ObjectTrashed {
+				t.Fatalf("DeleteObject = %+v", trashed)
+			}
+			if got := countCalls(stub.calls(), tt.operation); got != tt.calls {
+				t.Fatalf("%d %s calls, want %d: %v", got, tt.operation, tt.calls, stub.calls())
+			}
+			if _, ok := stub.object("test-bucket", key); ok {
+				t.Fatal("deleted object is still in place")
+			}
+			if body, _ := stub.object("test-bucket", trashed.TrashKey); !bytes.Equal(body, content) {
+				t.Fatalf("trashed copy = %q, want %q", body, content)
+			}
+			header := stub.objectHeader("test-bucket", trashed.TrashKey)
+			for name, values := range trashedObjectHeader() {
+				if !slices.Equal(header[name], values) {
+					t.Errorf("trashed copy %s = %q, want %q", name, header[name], values)
+				}
+			}
+			if tagging := header.Get("X-Amz-Tagging"); tagging != trashTagging {
+				t.Errorf("trashed copy tagging = %q, want %q", tagging, trashTagging)
+			}
+
+			restored, err := service.RestoreObject(ctx, "tenant-a", key)
+			if err != nil {
+				t.Fatalf("RestoreObject: %v", err)
+			}
+			if restored.Status != ObjectRestored {
+				t.Fatalf("RestoreObject = %+v", restored)
+			}
+			if body, _ := stub.object("test-bucket", key); !bytes.Equal(body, content) {
+				t.Fatalf("restored object = %q, want %q", body, content)
+			}
+			if tagging := stub.objectHeader("test-bucket", key).Get("X-Amz-Tagging"); tagging != "" {
+				t.Errorf("restored object tagging = %q, want none", tagging)
+			}
+			if _, ok := stub.object("test-bucket", trashed.TrashKey); ok {
+				t.Fatal("restored object is still in the trash")
+			}
+			if stub.uploadCount() != 0 {
+				t.Fatalf("%d multipart copies left behind", stub.uploadCount())
+			}
+		})
+	}
+}
+
+func TestDeleteObjectMultipartCopyFailure(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	useSmallCopyLimit(t, stub)
+	stub.failOperation = "UploadPartCopy"
+
+	const key = "tenant-a/photos/cat.jpg"
+	stub.putObject("test-bucket", key, bytes.Repeat([]byte("x"), 40), trashedObjectHeader())
+
+	if _, err := service.DeleteObject(contractContext(), "tenant-a", key); err == nil {
+		t.Fatal("DeleteObject succeeded although no part could be copied")
+	}
+	if _, ok := stub.object("test-bucket", key); !ok {
+		t.Fatal("object was deleted although its trashed copy failed")
+	}
+	if _, ok := stub.object("test-bucket", trashKey("tenant-a", key)); ok {
+		t.Fatal("a failed copy left a trashed object")
+	}
+	if countCalls(stub.calls(), "AbortMultipartUpload") != 1 || stub.uploadCount() != 0 {
+		t.Fatalf("failed multipart copy was not aborted: %v", stub.calls())
+	}
+}
+
+func TestDeleteObjectMissing(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+
+	if _, err := service.DeleteObject(contractContext(), "tenant-a", "tenant-a/photos/none.jpg"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("DeleteObject error = %v, want ErrObjectNotFound", err)
+	}
+	if _, err := service.RestoreObject(contractContext(), "tenant-a", "tenant-a/photos/none.jpg"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("RestoreObject error = %v, want ErrObjectNotFound", err)
+	}
+	if got := countCalls(stub.calls(), "DeleteObject"); got != 0 {
+		t.Fatalf("%d DeleteObject calls for a missing object", got)
+	}
+}
@@ -1,25 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"os"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/google/uuid"
-
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
 )
 
 const (
-	// MinSessionDuration is the minimum duration for AWS STS AssumeRole (15 minutes)
+	// MinSessionDuration is the default token lifetime simple uploads require (15 minutes);
+	// tenants can override it with TENANT_SESSION_SETTINGS
 	MinSessionDuration = 900 // seconds
 	
-	// LongSessionDuration is the duration for operations requiring presigned URLs (3 hours)
+	// LongSessionDuration is the default assumed-role session length, long enough for
+	// operations requiring presigned URLs (3 hours)
 	LongSessionDuration = 10800 // seconds
 	
 	// PresignedURLBuffer is the time buffer before token expiration (5 minutes)
@@ -28,16 +35,65 @@ const (
 	// MinPresignedURLDuration is the minimum duration for presigned URLs
 	MinPresignedURLDuration = 5 * time.Minute
 	
-	// DefaultPresignedURLDuration is the default duration for presigned URLs when no token expiration
+	// MinExpiryWarningLead and ExpiryWarningDivisor place an upload's warnAt: a fraction
+	// (1/ExpiryWarningDivisor) of the URL lifetime before expiry, but no later than
+	// MinExpiryWarningLead before it
+	MinExpiryWarningLead = 5 * time.Minute
+	ExpiryWarningDivisor = 5
+
+	// DefaultPresignedURLDuration is the default duration for presigned URLs when no token expiration;
+	// tenants can override it with TENANT_SESSION_SETTINGS
 	DefaultPresignedURLDuration = 2 * time.Hour
+
+	// SimpleUploadURLDuration is the lifetime of the presigned PUT for redirect-style simple uploads
+	SimpleUploadURLDuration = 15 * time.Minute
+
+	// simpleUploadContentType is the content type of simple uploads
+	simpleUploadContentType = "application/json"
+
+	// MaxInlinePresignedUrls is the part count above which presigned URLs are always delivered
+	// via an S3 object, since larger maps risk exceeding the 6 MB Lambda response limit
+	MaxInlinePresignedUrls = 1000
+
+	// MaxUploadParts is S3's limit on the parts of a multipart upload, and so on the URLs one
+	// initiate or refresh presigns
+	MaxUploadParts = 10000
+
+	// PresignedUrlsPrefix is the folder under the tenant prefix holding delivered URL maps
+	PresignedUrlsPrefix = ".presigned-urls"
+
+	// PresignedUrlsTagging marks URL map objects so a bucket lifecycle rule can expire them
+	PresignedUrlsTagging = "purpose=presigned-urls"
+)
+
+var (
+	// ErrForeignObjectKey is returned when a client-supplied object key is outside the caller's tenant prefix
+	ErrForeignObjectKey = errors.New("object key does not belong to tenant")
+
+	// ErrInvalidUploadRequest is returned for initiate and refresh requests S3 could not honor
+	ErrInvalidUploadRequest = errors.New("invalid upload request")
 )
 
 // UploadService handles file uploads to S3 with tenant isolation
 type UploadService struct {
-	stsClient  *sts.Client
-	bucketName string     // Single shared bucket for all tenants
-	roleArn    string     // ARN of the role to assume for tenant access
-	awsConfig  aws.Config // Base AWS config for creating new clients
+	s3Clients   *TenantS3Clients    // Per-tenant S3 clients backed by cached assumed-role credentials
+	bucketName  string              // Single shared bucket for all tenants
+	completions *CompletionStore    // Pending completions for the retry worker; nil when disabled
+	encryption  *ObjectEncryption   // SSE-KMS with a tenant encryption context; nil when disabled
+	trashDays   int                 // Days deleted objects stay restorable in the tenant's trash
+	receipts    *ReceiptSigner      // Signs upload receipts; nil when disabled
+	hints       *UploadHintConfig   // Part upload throttling hints; nil omits them
+	bindings    *PresignBindings    // Per-tenant network binding of presigned URLs; nil leaves them unbound
+	replWait    time.Duration       // Longest wait for cross-region replication on complete
+	accessPts   map[string]string   // Tenant -> S3 Access Point ARN used instead of the bucket
+	content     *ContentPolicies    // How objects are served to browsers; nil serves them as stored
+	mrapArns    map[string]string   // Tenant -> Multi-Region Access Point ARN for SigV4a presigned PUTs
+	aggregate   *RecordAggregator   // Buffers simple uploads of aggregating tenants; nil writes each one
+	sessions    *SessionConfig      // Per-tenant session and presign durations; nil applies the defaults
+	delegates   []string            // Tenants that may receive delegated credentials; "*" for all
+	delegateTTL time.Duration       // Lifetime of delegated credentials, capped by the token and session
+	sandbox     *SandboxConfig      // Tenants whose objects go to the short-lived sandbox bucket
+	presigning  *ConcurrencyLimiter // Bounds the presigned URLs generated at once; nil is unbounded
 }
 
 // generateS3Key creates a unique S3 key with tenant prefix and date-based organization
@@ -66,21 +122,64 @@ func generateS3KeyForMultipart(tenantID string) string {
 	return fmt.Sprintf("%s/%s/%s.raw", tenantID, datePath, fileID)
 }
 
+// UploadServiceOptions holds optional behavior of the upload service, validated at init
+type UploadServiceOptions struct {
+	RequireSourceIdentity  bool                 // Refuse to assume the tenant role for requests without a username
+	STSBreaker             CircuitBreakerConfig // Circuit breaker around AssumeRole
+	STSEndpoints           STSEndpointConfig    // Regional STS endpoints and failover
+	CompletionPendingTable string               // DynamoDB table for the completion retry worker; empty disables
+	SSEKMSKeyID            string               // KMS key for SSE-KMS with a tenant encryption context; empty disables
+	TrashRetentionDays     int                  // Days deleted objects stay restorable (must match the bucket lifecycle rule)
+	ReceiptSigningKeyID    string               // Asymmetric KMS key for signed upload receipts; empty disables
+	UploadHints            *UploadHintConfig    // Tier and load based throttling hints for initiate responses
+	PresignBindings        *PresignBindings     // Networks restricted tenants' presigned URLs are bound to
+	ReplicationWaitTimeout time.Duration        // Longest wait for cross-region replication when complete is asked to wait
+	TenantAccessPoints     map[string]string    // Tenant -> S3 Access Point ARN for presigning and server-side calls
+	ContentPolicies        *ContentPolicies     // Forced attachments and unsafe content-type rewriting on downloads
+	TenantMRAPs            map[string]string    // Tenant -> Multi-Region Access Point ARN for presigned single-object PUTs
+	Aggregation            *AggregationConfig   // Tenants whose simple uploads are buffered into shared objects
+	SessionSettings        *SessionConfig       // Per-tenant session length, presign default and minimum token validity
+	DelegationTenants      []string             // Tenants whose clients may receive write-only AWS credentials
+	DelegationDuration     time.Duration        // Lifetime of delegated credentials
+	Sandbox                *SandboxConfig       // Tenants whose objects go to the sandbox bucket instead
+	Concurrency            ConcurrencyConfig    // Per-instance limits on presigning and AssumeRole
+}
+
 // NewUploadService creates a new upload service
-func NewUploadService(cfg aws.Config, bucketName string) *UploadService {
-	stsClient := sts.NewFromConfig(cfg)
+func NewUploadService(cfg aws.Config, bucketName string, opts UploadServiceOptions) *UploadService {
+	stsClient := NewFailoverSTSClient(cfg, opts.STSEndpoints, opts.STSBreaker)
 	roleArn := os.Getenv("TENANT_ACCESS_ROLE_ARN")
 	if roleArn == "" {
 		// This will be set in the CloudFormation template
 		panic("TENANT_ACCESS_ROLE_ARN environment variable not set")
 	}
 
-	return &UploadService{
-		stsClient:  stsClient,
+	// Cache tenant credentials and keep them warm for active tenants
+	credentials := NewTenantCredentialCache(stsClient, roleArn, opts)
+	go credentials.RunRefresher(context.Background())
+
+	service := &UploadService{
+		s3Clients:  NewTenantS3Clients(cfg, credentials),
 		bucketName: bucketName,
-		roleArn:    roleArn,
-		awsConfig:  cfg,
-	}
+		encryption: NewObjectEncryption(opts.SSEKMSKeyID),
+		trashDays:  opts.TrashRetentionDays,
+		receipts:   NewReceiptSigner(cfg, opts.ReceiptSigningKeyID),
+		hints:      opts.UploadHints,
+		bindings:   opts.PresignBindings,
+		replWait:   opts.ReplicationWaitTimeout,
+		accessPts:  opts.TenantAccessPoints,
+		content:    opts.ContentPolicies,
+		mrapArns:   opts.TenantMRAPs,
+		sessions:   opts.SessionSettings,
+		sandbox:    opts.Sandbox,
+		presigning: NewConcurrencyLimiter("presign", opts.Concurrency.PresignLimit, opts.Concurrency.QueueTimeout),
+	}
+	if opts.CompletionPendingTable != "" {
+		service.completions = NewCompletionStore(cfg, opts.CompletionPendingTable)
+	}
+	service.aggregate = NewRecordAggregator(service, opts.Aggregation)
+	service.delegates, service.delegateTTL = opts.DelegationTenants, opts.DelegationDuration
+	return service
 }
 
 // UploadFile uploads a file to the shared S3 bucket with tenant-prefixed path
@@ -93,41 +192,33 @@ func (s *UploadService) UploadFile(ctx context.Context, tenantID string, content
 	// Check if token has enough time left for minimum session duration
 	if tokenExp, ok := GetTokenExpiration(ctx); ok {
 		timeUntilExpiry := time.Unix(tokenExp, 0).Sub(time.Now())
-		minDurationRequired := time.Duration(MinSessionDuration) * time.Second
+		minDurationRequired := s.sessions.For(tenantID).MinTokenValidity
 		if timeUntilExpiry < minDurationRequired {
-			return "", fmt.Errorf("token expires too soon for upload operation (needs at least %v, has %v)", minDurationRequired, timeUntilExpiry)
+			return "", fmt.Errorf("%w for upload operation (needs at least %v, has %v)", ErrTokenExpiresTooSoon, minDurationRequired, timeUntilExpiry)
 		}
 	}
 
 	// Generate the S3 key
 	key := generateS3Key(tenantID)
 
-	// Get tenant-scoped credentials
-	tenantCreds, err := AssumeRoleForTenant(ctx, s.stsClient, s.roleArn, tenantID, MinSessionDuration)
-	if err != nil {
-		return "", err
-	}
-
-	// Create a new S3 client with the assumed role credentials
-	tenantS3Client := s3.NewFromConfig(s.awsConfig, func(o *s3.Options) {
-		o.Credentials = aws.NewCredentialsCache(
-			aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return tenantCreds, nil
-			}),
-		)
-	})
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
 
 	// Create the S3 PutObject input
 	input := &s3.PutObjectInput{
-		Bucket: aws.String(s.bucketName),
+		Bucket: aws.String(s.bucketFor(tenantID)),
 		Key:    aws.String(key),
 		Body:   strings.NewReader(string(content)),
 		// Add content type for JSON
 		ContentType: aws.String("application/json"),
 	}
+	s.encryption.ApplyPutObject(input, tenantID)
+	var digest contentDigest
+	digest.Write(content)
+	digest.ApplyPutObject(input)
 
 	// Upload the file to S3 using tenant-scoped credentials
-	_, err = tenantS3Client.PutObject(ctx, input)
+	_, err := tenantS3Client.PutObject(ctx, input)
 	if err != nil {
 		return "", fmt.Errorf("failed to upload file: %w", err)
 	}
@@ -136,22 +227,97 @@ func (s *UploadService) UploadFile(ctx context.Context, tenantID string, content
 	return key, nil
 }
 
+// AggregateUpload buffers a simple upload of an aggregating tenant and returns the key of
+// the NDJSON object it will be written to, as one line among other uploads
+func (s *UploadService) AggregateUpload(ctx context.Context, tenantID string, content []byte) (string, error) {
+	if tenantID == "" {
+		return "", fmt.Errorf("tenant ID cannot be empty")
+	}
+	return s.aggregate.Append(ctx, tenantID, content)
+}
+
+// AggregatesUploads reports whether the tenant's simple uploads are buffered
+func (s *UploadService) AggregatesUploads(tenantID string) bool {
+	return s.aggregate.Enabled(tenantID)
+}
+
+// FlushAggregates writes buffered simple uploads: the expired buffers, or all of them
+// when the instance shuts down
+func (s *UploadService) FlushAggregates(ctx context.Context, all bool) {
+	if all {
+		s.aggregate.FlushAll(ctx)
+		return
+	}
+	s.aggregate.FlushExpired(ctx)
+}
+
+// PresignSimpleUpload reserves a key for a simple JSON upload and presigns a PUT for it,
+// returning what the client must send. The body never passes through the Lambda, so it
+// is not validated as JSON here.
+func (s *UploadService) PresignSimpleUpload(ctx context.Context, tenantID string) (*UploadRedirectResponse, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID cannot be empty")
+	}
+
+	key := generateS3Key(tenantID)
+	uploadURL, err := s.PresignPutObject(ctx, tenantID, key, simpleUploadContentType, SimpleUploadURLDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encryption headers are signed into the URL along with the content type
+	headers := map[string]string{"Content-Type": simpleUploadContentType}
+	for name, value := range s.encryption.PutHeaders(tenantID) {
+		headers[name] = value
+	}
+
+	return &UploadRedirectResponse{
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   headers,
+		FilePath:  key,
+		TenantID:  tenantID,
+		ExpiresAt: time.Now().Add(SimpleUploadURLDuration).Unix(),
+	}, nil
+}
+
 // validateInitiateRequest validates the initiate multipart upload request
 func validateInitiateRequest(tenantID string, req *InitiateUploadRequest) error {
 	if tenantID == "" {
 		return fmt.Errorf("tenant ID cannot be empty")
 	}
 	if req.Size <= 0 {
-		return fmt.Errorf("size must be greater than zero")
+		return fmt.Errorf("%w: size must be greater than zero", ErrInvalidUploadRequest)
 	}
 	if req.PartSize <= 0 {
-		return fmt.Errorf("part size must be greater than zero")
+		return fmt.Errorf("%w: part size must be greater than zero", ErrInvalidUploadRequest)
+	}
+	// Checked before any capacity is taken: the presign limiter clamps larger requests to
+	// its whole capacity, so one oversized request would otherwise block every other
+	if parts := uploadPartCount(req.Size, req.PartSize); parts > MaxUploadParts {
+		return fmt.Errorf("%w: %d parts exceed the limit of %d; use larger parts", ErrInvalidUploadRequest, parts, MaxUploadParts)
+	}
+	switch req.URLDelivery {
+	case "", URLDeliveryInline, URLDeliveryObject:
+	default:
+		return fmt.Errorf("%w: url delivery must be %q or %q", ErrInvalidUploadRequest, URLDeliveryInline, URLDeliveryObject)
 	}
 	return nil
 }
 
-// calculatePresignExpiration determines the expiration time for presigned URLs based on token expiration
-func calculatePresignExpiration(ctx context.Context) time.Duration {
+// uploadPartCount returns how many parts of partSize an upload of size bytes needs,
+// without the overflow of rounding up by addition
+func uploadPartCount(size, partSize int64) int64 {
+	parts := size / partSize
+	if size%partSize != 0 {
+		parts++
+	}
+	return parts
+}
+
+// calculatePresignExpiration determines the expiration time for presigned URLs based on token
+// expiration, within the tenant's session
+func calculatePresignExpiration(ctx context.Context, settings SessionSettings) time.Duration {
 	if tokenExp, ok := GetTokenExpiration(ctx); ok {
 		// Token expiration is Unix timestamp in seconds
 		timeUntilExpiry := time.Unix(tokenExp, 0).Sub(time.Now())
@@ -162,13 +328,46 @@ func calculatePresignExpiration(ctx context.Context) time.Duration {
 				// Minimum 5 minutes
 				return MinPresignedURLDuration
 			}
-			return presignExpiration
+			// URLs cannot outlive the credentials that sign them
+			return min(presignExpiration, settings.MaxCredentialValidity())
 		}
 		// Token already expired, use minimal duration
 		return MinPresignedURLDuration
 	}
-	// No token expiration in context, default to 2 hours
-	return DefaultPresignedURLDuration
+	// No token expiration in context, use the tenant's default (2 hours unless configured)
+	return settings.DefaultPresign
+}
+
+// UploadDeadline is when an upload's presigned URLs stop working and when the client should
+// refresh them
+type UploadDeadline struct {
+	ExpiresAt time.Time
+	WarnAt    time.Time
+}
+
+// presignDeadline resolves the credentials that will sign URLs valid for presignExpiration,
+// assuming the role again if the cached ones would not cover them, and derives the deadline.
+// The URLs expire with whichever ends first: their own lifetime or the signing credentials,
+// which only end earlier when STS is unavailable and older credentials are served.
+func (s *UploadService) presignDeadline(ctx context.Context, tenantID string, presignExpiration time.Duration) (UploadDeadline, error) {
+	now := time.Now()
+	creds, err := s.s3Clients.credentials.Get(ctx, tenantID, presignExpiration)
+	if err != nil {
+		return UploadDeadline{}, err
+	}
+	expiresAt := now.Add(presignExpiration)
+	if creds.CanExpire && creds.Expires.Before(expiresAt) {
+		expiresAt = creds.Expires
+	}
+
+	// Warn a fifth of the way before the end, but at least MinExpiryWarningLead, so long
+	// uploads get time proportional to their progress to refresh
+	lead := max(expiresAt.Sub(now)/ExpiryWarningDivisor, MinExpiryWarningLead)
+	warnAt := expiresAt.Add(-lead)
+	if warnAt.Before(now) {
+		warnAt = now
+	}
+	return UploadDeadline{ExpiresAt: expiresAt, WarnAt: warnAt}, nil
 }
 
 // generatePresignedUrls creates presigned URLs for all parts of a multipart upload
@@ -196,6 +395,55 @@ func (s *UploadService) generatePresignedUrls(ctx context.Context, presignClient
 	return presignedUrls, nil
 }
 
+// presignedUrlsKey derives the tenant-scoped key of the URL map object for a multipart upload
+func presignedUrlsKey(tenantID, objectKey string) string {
+	fileName := strings.TrimSuffix(path.Base(objectKey), path.Ext(objectKey))
+	return fmt.Sprintf("%s/%s/%s.json", tenantID, PresignedUrlsPrefix, fileName)
+}
+
+// storePresignedUrls writes the URL map to a short-lived S3 object under the tenant prefix
+// and returns a presigned GET URL for fetching it
+func (s *UploadService) storePresignedUrls(ctx context.Context, tenantS3Client *s3.Client, presignClient *s3.PresignClient, tenantID, objectKey string, presignedUrls map[int]string, expiration time.Duration) (string, error) {
+	body, err := json.Marshal(presignedUrls)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode presigned URLs: %w", err)
+	}
+
+	key := presignedUrlsKey(tenantID, objectKey)
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucketFor(tenantID)),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		// Tagged so the bucket lifecycle rule removes it once the URLs are useless
+		Tagging: aws.String(PresignedUrlsTagging),
+	}
+	s.encryption.ApplyPutObject(input, tenantID)
+	_, err = tenantS3Client.PutObject(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to store presigned URLs: %w", err)
+	}
+
+	// The URL map is bound to the same networks as the part URLs it holds
+	presignCtx, err := s.bindings.Bind(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketFor(tenantID)),
+		Key:    aws.String(key),
+	}
+	s.content.For(tenantID).ApplyGetObject(getInput, "application/json")
+	getReq, err := presignClient.PresignGetObject(presignCtx, getInput, func(opts *s3.PresignOptions) {
+		opts.Expires = expiration
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to presign presigned URLs object: %w", err)
+	}
+
+	return getReq.URL, nil
+}
+
 // InitiateMultipartUpload starts a new multipart upload and returns presigned URLs
 func (s *UploadService) InitiateMultipartUpload(ctx context.Context, tenantID string, req *InitiateUploadRequest) (*InitiateUploadResponse, error) {
 	// Validate inputs
@@ -206,59 +454,107 @@ func (s *UploadService) InitiateMultipartUpload(ctx context.Context, tenantID st
 	// Generate an S3 key with date-based organization and .raw extension
 	objectKey := generateS3KeyForMultipart(tenantID)
 
-	// Get tenant-scoped credentials
-	tenantCreds, err := AssumeRoleForTenant(ctx, s.stsClient, s.roleArn, tenantID, LongSessionDuration)
+	// Calculate presigned URL expiration based on token expiration
+	presignExpiration := calculatePresignExpiration(ctx, s.sessions.For(tenantID))
+
+	// Require tenant credentials that outlive the presigned URLs
+	ctx = WithCredentialValidity(ctx, presignExpiration)
+
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
+
+	// Create presigned client
+	presignClient := s3.NewPresignClient(tenantS3Client)
+
+	// Sign the part URLs with the tenant's network-bound session, if it has one
+	presignCtx, err := s.bindings.Bind(ctx, tenantID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a new S3 client with the assumed role credentials
-	tenantS3Client := s3.NewFromConfig(s.awsConfig, func(o *s3.Options) {
-		o.Credentials = aws.NewCredentialsCache(
-			aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return tenantCreds, nil
-			}),
-		)
-	})
+	// Resolve the signing credentials before starting the upload, so the deadline reported
+	// to the client is the one the URLs will actually have
+	deadline, err := s.presignDeadline(presignCtx, tenantID, presignExpiration)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create presigned client
-	presignClient := s3.NewPresignClient(tenantS3Client)
+	// Wait for capacity to sign every part before starting the upload, so a rejected request
+	// leaves no upload behind; the URLs are held until the response is built
+	numParts := int(uploadPartCount(req.Size, req.PartSize))
+	release, err := s.presigning.Acquire(ctx, int64(numParts)+1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// Initiate multipart upload
-	createResp, err := tenantS3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-		Bucket:      aws.String(s.bucketName),
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucketFor(tenantID)),
 		Key:         aws.String(objectKey),
 		ContentType: aws.String("application/octet-stream"),
-	})
+	}
+	s.encryption.ApplyCreateMultipartUpload(createInput, tenantID)
+	createResp, err := tenantS3Client.CreateMultipartUpload(ctx, createInput)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create multipart upload: %w", err)
 	}
 
-	// Calculate the number of parts
-	numParts := int((req.Size + req.PartSize - 1) / req.PartSize)
-
-	// Calculate presigned URL expiration based on token expiration
-	presignExpiration := calculatePresignExpiration(ctx)
-
-	// Generate presigned URLs for each part
-	presignedUrls, err := s.generatePresignedUrls(ctx, presignClient, s.bucketName, objectKey, *createResp.UploadId, numParts, presignExpiration)
-	if err != nil {
-		// DEMOWARE DECISION: Abort on presigned URL failure
-		// In production, consider returning partial success (UploadID + ObjectKey)
-		// and letting client retry via /upload/refresh endpoint
+	// DEMOWARE DECISION: Abort on presigned URL failure
+	// In production, consider returning partial success (UploadID + ObjectKey)
+	// and letting client retry via /upload/refresh endpoint
+	abortUpload := func() {
 		_, _ = tenantS3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
-			Bucket:   aws.String(s.bucketName),
+			Bucket:   aws.String(s.bucketFor(tenantID)),
 			Key:      aws.String(objectKey),
 			UploadId: createResp.UploadId,
 		})
+	}
+
+	// Generate presigned URLs for each part
+	presignedUrls, err := s.generatePresignedUrls(presignCtx, presignClient, s.bucketFor(tenantID), objectKey, *createResp.UploadId, numParts, presignExpiration)
+	if err != nil {
+		abortUpload()
 		return nil, fmt.Errorf("failed to generate presigned URLs: %w", err)
 	}
 
-	return &InitiateUploadResponse{
-		PresignedUrls: presignedUrls,
-		UploadID:      *createResp.UploadId,
-		ObjectKey:     objectKey,
-	}, nil
+	resp := &InitiateUploadResponse{
+		UploadID:  *createResp.UploadId,
+		ObjectKey: objectKey,
+		Hints:     s.hints.For(tenantID),
+		ExpiresAt: deadline.ExpiresAt.Unix(),
+		WarnAt:    deadline.WarnAt.Unix(),
+	}
+
+	// Large URL maps are delivered through S3 to keep the API response small
+	if req.URLDelivery == URLDeliveryObject || numParts > MaxInlinePresignedUrls {
+		location, err := s.storePresignedUrls(ctx, tenantS3Client, presignClient, tenantID, objectKey, presignedUrls, presignExpiration)
+		if err != nil {
+			abortUpload()
+			return nil, err
+		}
+		resp.PresignedUrlsLocation = location
+	} else {
+		resp.PresignedUrls = presignedUrls
+	}
+
+	log.Printf("Upload %s initiated: tenant=%s key=%s parts=%d urls_expire=%s",
+		resp.UploadID, tenantID, objectKey, numParts, deadline.ExpiresAt.UTC().Format(time.RFC3339))
+	return resp, nil
+}
+
+// validateTenantObjectKey ensures a client-supplied object key is canonical and lives under
+// the tenant's prefix. Control operations trust the client to echo back the object key, so
+// without this check a client that learned another tenant's uploadId and key could operate
+// on that upload, or smuggle traversal sequences into the key.
+func validateTenantObjectKey(tenantID, objectKey string) error {
+	if err := keyutil.RequireCanonical(objectKey); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(objectKey, tenantID+"/") {
+		return fmt.Errorf("%w: %s", ErrForeignObjectKey, objectKey)
+	}
+	return nil
 }
 
 // validateCompleteRequest validates the complete multipart upload request
@@ -275,7 +571,7 @@ func validateCompleteRequest(tenantID string, req *CompleteUploadRequest) error
 	if req.ObjectKey == "" {
 		return fmt.Errorf("object key cannot be empty")
 	}
-	return nil
+	return validateTenantObjectKey(tenantID, req.ObjectKey)
 }
 
 // convertPartETags converts part ETags to AWS SDK format
@@ -301,41 +597,52 @@ func (s *UploadService) CompleteMultipartUpload(ctx context.Context, tenantID st
 	// For demo, we'll need to pass the object key in the request or store it in a database
 	// For now, we'll extract it from the first part's presigned URL or require it in the request
 
-	// Get tenant-scoped credentials
-	tenantCreds, err := AssumeRoleForTenant(ctx, s.stsClient, s.roleArn, tenantID, MinSessionDuration)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create a new S3 client with the assumed role credentials
-	tenantS3Client := s3.NewFromConfig(s.awsConfig, func(o *s3.Options) {
-		o.Credentials = aws.NewCredentialsCache(
-			aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return tenantCreds, nil
-			}),
-		)
-	})
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
 
 	// Convert part ETags to the AWS SDK format
 	completedParts := convertPartETags(req.PartETags)
 
+	// Record the completion first so the retry worker can finish it if this attempt is cut short
+	if s.completions != nil {
+		if err := s.completions.Put(ctx, tenantID, s.bucketFor(tenantID), TenantSessionFromContext(ctx, tenantID), req); err != nil {
+			log.Printf("Completion of upload %s will not be retried on failure: %v", req.UploadID, err)
+		}
+	}
+
 	// Complete the multipart upload
 	completeResp, err := tenantS3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   aws.String(s.bucketName),
+		Bucket:   aws.String(s.bucketFor(tenantID)),
 		Key:      aws.String(req.ObjectKey),
 		UploadId: aws.String(req.UploadID),
 		MultipartUpload: &types.CompletedMultipartUpload{
 			Parts: completedParts,
 		},
 	})
+	if s.completions != nil {
+		if err != nil && isRetryableCompletionError(err) {
+			log.Printf("Completion of upload %s left for the retry worker: %v", req.UploadID, err)
+		} else if delErr := s.completions.Delete(context.WithoutCancel(ctx), req.UploadID); delErr != nil {
+			// The worker will find the upload already completed (or invalid) and drop the record
+			log.Printf("Upload %s: %v", req.UploadID, delErr)
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to complete multipart upload: %w", err)
 	}
 
-	return &CompleteUploadResponse{
+	resp := &CompleteUploadResponse{
 		ObjectKey: req.ObjectKey,
 		Location:  *completeResp.Location,
-	}, nil
+	}
+
+	// The upload is complete either way; a missing receipt can be re-issued later
+	if s.receipts != nil {
+		if resp.Receipt, err = s.IssueReceipt(ctx, tenantID, req.ObjectKey); err != nil {
+			log.Printf("Receipt for %s not issued: %v", req.ObjectKey, err)
+		}
+	}
+	return resp, nil
 }
 
 // AbortMultipartUpload cancels an in-progress multipart upload
@@ -347,32 +654,20 @@ func (s *UploadService) AbortMultipartUpload(ctx context.Context, tenantID strin
 	if req.UploadID == "" {
 		return fmt.Errorf("upload ID cannot be empty")
 	}
-
-	// Get tenant-scoped credentials
-	tenantCreds, err := AssumeRoleForTenant(ctx, s.stsClient, s.roleArn, tenantID, MinSessionDuration)
-	if err != nil {
+	if req.ObjectKey == "" {
+		return fmt.Errorf("object key cannot be empty")
+	}
+	if err := validateTenantObjectKey(tenantID, req.ObjectKey); err != nil {
 		return err
 	}
 
-	// Create a new S3 client with the assumed role credentials
-	tenantS3Client := s3.NewFromConfig(s.awsConfig, func(o *s3.Options) {
-		o.Credentials = aws.NewCredentialsCache(
-			aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return tenantCreds, nil
-			}),
-		)
-	})
-
-	// Use object key from request
-	objectKey := req.ObjectKey
-	if objectKey == "" {
-		return fmt.Errorf("object key cannot be empty")
-	}
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
 
 	// Abort the multipart upload
-	_, err = tenantS3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
-		Bucket:   aws.String(s.bucketName),
-		Key:      aws.String(objectKey),
+	_, err := tenantS3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucketFor(tenantID)),
+		Key:      aws.String(req.ObjectKey),
 		UploadId: aws.String(req.UploadID),
 	})
 	if err != nil {
@@ -393,45 +688,65 @@ func validateRefreshRequest(tenantID string, req *RefreshUploadRequest) error {
 	if len(req.PartNumbers) == 0 {
 		return fmt.Errorf("part numbers cannot be empty")
 	}
+	if len(req.PartNumbers) > MaxUploadParts {
+		return fmt.Errorf("%w: %d part numbers exceed the limit of %d", ErrInvalidUploadRequest, len(req.PartNumbers), MaxUploadParts)
+	}
+	for _, partNumber := range req.PartNumbers {
+		if partNumber < 1 || partNumber > MaxUploadParts {
+			return fmt.Errorf("%w: part number %d is outside 1..%d", ErrInvalidUploadRequest, partNumber, MaxUploadParts)
+		}
+	}
 	if req.ObjectKey == "" {
 		return fmt.Errorf("object key cannot be empty")
 	}
-	return nil
+	return validateTenantObjectKey(tenantID, req.ObjectKey)
 }
 
-// RefreshPresignedUrls refreshes presigned URLs for specified parts
+// RefreshPresignedUrls refreshes presigned URLs for specified parts. A refresh with a newer
+// token extends the session: when the cached credentials would expire before URLs valid for
+// the new token's lifetime, the role is assumed again for a full session and the cache entry
+// replaced, so the returned deadline follows the token rather than the original session.
 func (s *UploadService) RefreshPresignedUrls(ctx context.Context, tenantID string, req *RefreshUploadRequest) (*RefreshUploadResponse, error) {
 	// Validate inputs
 	if err := validateRefreshRequest(tenantID, req); err != nil {
 		return nil, err
 	}
 
-	// Get tenant-scoped credentials
-	tenantCreds, err := AssumeRoleForTenant(ctx, s.stsClient, s.roleArn, tenantID, LongSessionDuration)
-	if err != nil {
-		return nil, err
-	}
+	// Calculate presigned URL expiration based on token expiration
+	presignExpiration := calculatePresignExpiration(ctx, s.sessions.For(tenantID))
 
-	// Create a new S3 client with the assumed role credentials
-	tenantS3Client := s3.NewFromConfig(s.awsConfig, func(o *s3.Options) {
-		o.Credentials = aws.NewCredentialsCache(
-			aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
-				return tenantCreds, nil
-			}),
-		)
-	})
+	// Require tenant credentials that outlive the presigned URLs
+	ctx = WithCredentialValidity(ctx, presignExpiration)
+
+	// Get the cached tenant-scoped S3 client (credentials are resolved per call)
+	tenantS3Client := s.s3Clients.Get(tenantID)
 
 	// Create presigned client
 	presignClient := s3.NewPresignClient(tenantS3Client)
 
-	// Calculate presigned URL expiration based on token expiration
-	presignExpiration := calculatePresignExpiration(ctx)
+	// Sign the part URLs with the tenant's network-bound session, if it has one
+	ctx, err := s.bindings.Bind(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the session credentials up front, re-assuming the role if they would not cover
+	// the new URLs; the presign calls below then reuse them from the cache
+	deadline, err := s.presignDeadline(ctx, tenantID, presignExpiration)
+	if err != nil {
+		return nil, err
+	}
 
 	// Generate refreshed presigned URLs for requested parts
+	release, err := s.presigning.Acquire(ctx, int64(len(req.PartNumbers)))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	presignedUrls := make(map[int]string)
 	for _, partNum := range req.PartNumbers {
 		uploadPartReq := &s3.UploadPartInput{
-			Bucket:     aws.String(s.bucketName),
+			Bucket:     aws.String(s.bucketFor(tenantID)),
 			Key:        aws.String(req.ObjectKey),
 			PartNumber: aws.Int32(int32(partNum)),
 			UploadId:   aws.String(req.UploadID),
@@ -447,7 +762,11 @@ func (s *UploadService) RefreshPresignedUrls(ctx context.Context, tenantID strin
 		presignedUrls[partNum] = presignReq.URL
 	}
 
+	log.Printf("Upload %s refreshed: tenant=%s parts=%v urls_expire=%s",
+		req.UploadID, tenantID, req.PartNumbers, deadline.ExpiresAt.UTC().Format(time.RFC3339))
 	return &RefreshUploadResponse{
 		PresignedUrls: presignedUrls,
+		ExpiresAt:     deadline.ExpiresAt.Unix(),
+		WarnAt:        deadline.WarnAt.Unix(),
 	}, nil
 }
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stefando/uploadDemoAWS/lambda/upload/keyutil"
+)
+
+func TestCalculatePresignExpiration(t *testing.T) {
+	settings := DefaultSessionSettings
+	tests := []struct {
+		name  string
+		token time.Duration // Remaining token lifetime; 0 leaves the expiration out of the context
+		want  time.Duration
+	}{
+		{name: "no token", want: settings.DefaultPresign},
+		{name: "follows the token", token: 45 * time.Minute, want: 40 * time.Minute},
+		{name: "capped by the session", token: 24 * time.Hour, want: settings.MaxCredentialValidity()},
+		{name: "token about to expire", token: 6 * time.Minute, want: MinPresignedURLDuration},
+		{name: "expired token", token: -time.Minute, want: MinPresignedURLDuration},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != 0 {
+				ctx = WithTokenExpiration(ctx, time.Now().Add(tt.token).Unix())
+			}
+			// Token expirations have second precision
+			got := calculatePresignExpiration(ctx, settings)
+			if got < tt.want-time.Second || got > tt.want+time.Second {
+				t.Fatalf("calculatePresignExpiration = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzCompleteUploadRequest decodes arbitrary complete bodies like handleCompleteUpload does.
+// Whatever validation accepts must name an upload, its parts and a canonical key in the
+// caller's prefix.
+func FuzzCompleteUploadRequest(f *testing.F) {
+	f.Add(uint8(0), []byte(`{"uploadId": "2~abc", "objectKey": "tenant-a/2026/10/18/file.bin", "partETags": [{"partNumber": 1, "eTag": "\"e1\""}]}`))
+	f.Add(uint8(0), []byte(`{"uploadId": "2~abc", "objectKey": "tenant-a/../tenant-b/file.bin", "partETags": [{"partNumber": 1, "eTag": "x"}]}`))
+	f.Add(uint8(0), []byte(`{"uploadId": "2~abc", "objectKey": "tenant-a//file.bin", "partETags": []}`))
+
+	f.Fuzz(func(t *testing.T, codec uint8, body []byte) {
+		var req CompleteUploadRequest
+		if err := decodeBody(codec, body, &req); err != nil {
+			return
+		}
+		if err := validateCompleteRequest("tenant-a", &req); err != nil {
+			return
+		}
+		if req.UploadID == "" || len(req.PartETags) == 0 {
+			t.Fatalf("accepted a request without upload ID or parts: %+v", req)
+		}
+		if err := keyutil.RequireCanonical(req.ObjectKey); err != nil {
+			t.Fatalf("accepted non-canonical key %q: %v", req.ObjectKey, err)
+		}
+		if !strings.HasPrefix(req.ObjectKey, "tenant-a/") {
+			t.Fatalf("accepted key %q outside the tenant prefix", req.ObjectKey)
+		}
+	})
+}
+
+// contractContext is the request context the middleware builds for tom of tenant-a, whose
+// token is valid for another 30 minutes
+func contractContext() context.Context {
+	ctx := WithTenantID(context.Background(), "tenant-a")
+	ctx = WithUsername(ctx, "tom")
+	return WithTokenExpiration(ctx, time.Now().Add(30*time.Minute).Unix())
+}
+
+// uploadPart PUTs data to a presigned part URL the way a client does and returns the ETag
+func uploadPart(t *testing.T, presignedURL, data string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, presignedURL, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("part upload: status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Header.Get("ETag")
+}
+
+// checkPresignedURL fails unless a part URL is signed by the tenant session for the upload
+func checkPresignedURL(t *testing.T, presignedURL, objectKey, uploadID string, partNumber int) {
+	t.Helper()
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/test-bucket/"+objectKey || query.Get("uploadId") != uploadID || query.Get("partNumber") != strconv.Itoa(partNumber) {
+		t.Fatalf("part %d URL %s does not address the upload", partNumber, presignedURL)
+	}
+	if !strings.HasPrefix(query.Get("X-Amz-Credential"), stubSessionKeyID+"/") || query.Get("X-Amz-Security-Token") != "session-token" {
+		t.Fatalf("part %d URL %s is not signed by the tenant session", partNumber, presignedURL)
+	}
+}
+
+func TestMultipartUploadContract(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	ctx := contractContext()
+
+	initiated, err := service.InitiateMultipartUpload(ctx, "tenant-a", &InitiateUploadRequest{Size: 12 << 20, PartSize: 5 << 20})
+	if err != nil {
+		t.Fatalf("InitiateMultipartUpload: %v", err)
+	}
+	if !strings.HasPrefix(initiated.ObjectKey, "tenant-a/") || initiated.UploadID == "" {
+		t.Fatalf("initiated upload %q of %q, want one under the tenant prefix", initiated.UploadID, initiated.ObjectKey)
+	}
+	if len(initiated.PresignedUrls) != 3 {
+		t.Fatalf("got %d part URLs for 12 MiB in 5 MiB parts, want 3", len(initiated.PresignedUrls))
+	}
+	if now := time.Now().Unix(); initiated.WarnAt <= now || initiated.ExpiresAt <= initiated.WarnAt {
+		t.Fatalf("deadline warnAt=%d expiresAt=%d, want both ahead (now %d)", initiated.WarnAt, initiated.ExpiresAt, now)
+	}
+
+	// The role is assumed for the tenant, tagged with who asked
+	roles := stub.assumedRoles()
+	if len(roles) == 0 {
+		t.Fatal("no AssumeRole call")
+	}
+	tags := make(map[string]string)
+	for i := 1; roles[0].Has(fmt.Sprintf("Tags.member.%d.Key", i)); i++ {
+		tags[roles[0].Get(fmt.Sprintf("Tags.member.%d.Key", i))] = roles[0].Get(fmt.Sprintf("Tags.member.%d.Value", i))
+	}
+	if tags["tenant_id"] != "tenant-a" || tags["username"] != "tom" {
+		t.Fatalf("session tags = %v, want tenant_id tenant-a and username tom", tags)
+	}
+
+	// Parts go straight to S3 through the presigned URLs
+	var parts []PartTag
+	for number := 1; number <= 3; number++ {
+		checkPresignedURL(t, initiated.PresignedUrls[number], initiated.ObjectKey, initiated.UploadID, number)
+		parts = append(parts, PartTag{PartNumber: number, ETag: uploadPart(t, initiated.PresignedUrls[number], fmt.Sprintf("part %d", number))})
+	}
+
+	completed, err := service.CompleteMultipartUpload(ctx, "tenant-a", &CompleteUploadRequest{
+		UploadID:  initiated.UploadID,
+		ObjectKey: initiated.ObjectKey,
+		PartETags: parts,
+	})
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload: %v", err)
+	}
+	if completed.ObjectKey != initiated.ObjectKey || !strings.HasSuffix(completed.Location, "/test-bucket/"+initiated.ObjectKey) {
+		t.Fatalf("completed %+v, want the initiated object", completed)
+	}
+	if _, ok := stub.object("test-bucket", initiated.ObjectKey); !ok {
+		t.Fatal("completed object is not in the bucket")
+	}
+	if _, ok := stub.upload(initiated.UploadID); ok {
+		t.Fatal("upload is still in progress after completion")
+	}
+}
+
+func TestCompleteMultipartUploadContractRejectsWrongParts(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	ctx := contractContext()
+
+	initiated, err := service.InitiateMultipartUpload(ctx, "tenant-a", &InitiateUploadRequest{Size: 10, PartSize: 5})
+	if err != nil {
+		t.Fatalf("InitiateMultipartUpload: %v", err)
+	}
+	first := uploadPart(t, initiated.PresignedUrls[1], "hello")
+	second := uploadPart(t, initiated.PresignedUrls[2], "world")
+
+	tests := []struct {
+		name  string
+		parts []PartTag
+	}{
+		{name: "wrong ETag", parts: []PartTag{{PartNumber: 1, ETag: first}, {PartNumber: 2, ETag: `"0123"`}}},
+		{name: "part never uploaded", parts: []PartTag{{PartNumber: 1, ETag: first}, {PartNumber: 3, ETag: second}}},
+		{name: "descending parts", parts: []PartTag{{PartNumber: 2, ETag: second}, {PartNumber: 1, ETag: first}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.CompleteMultipartUpload(ctx, "tenant-a", &CompleteUploadRequest{
+				UploadID:  initiated.UploadID,
+				ObjectKey: initiated.ObjectKey,
+				PartETags: tt.parts,
+			})
+			if err == nil {
+				t.Fatal("CompleteMultipartUpload accepted the parts")
+			}
+			if _, ok := stub.upload(initiated.UploadID); !ok {
+				t.Fatal("a rejected completion ended the upload")
+			}
+		})
+	}
+
+	// Another tenant's key is refused before S3 is asked
+	calls := len(stub.calls())
+	_, err = service.CompleteMultipartUpload(ctx, "tenant-b", &CompleteUploadRequest{
+		UploadID:  initiated.UploadID,
+		ObjectKey: initiated.ObjectKey,
+		PartETags: []PartTag{{PartNumber: 1, ETag: first}, {PartNumber: 2, ETag: second}},
+	})
+	if !errors.Is(err, ErrForeignObjectKey) {
+		t.Fatalf("completing tenant-a's upload as tenant-b: error = %v, want ErrForeignObjectKey", err)
+	}
+	if len(stub.calls()) != calls {
+		t.Fatalf("S3 was called for a foreign key: %v", stub.calls()[calls:])
+	}
+}
+
+func TestAbortMultipartUploadContract(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	ctx := contractContext()
+
+	initiated, err := service.InitiateMultipartUpload(ctx, "tenant-a", &InitiateUploadRequest{Size: 10, PartSize: 5})
+	if err != nil {
+		t.Fatalf("InitiateMultipartUpload: %v", err)
+	}
+	eTag := uploadPart(t, initiated.PresignedUrls[1], "hello")
+
+	abort := &AbortUploadRequest{UploadID: initiated.UploadID, ObjectKey: initiated.ObjectKey}
+	if err := service.AbortMultipartUpload(ctx, "tenant-a", abort); err != nil {
+		t.Fatalf("AbortMultipartUpload: %v", err)
+	}
+	if _, ok := stub.upload(initiated.UploadID); ok {
+		t.Fatal("upload is still in progress after the abort")
+	}
+
+	// S3 reports the upload gone to a second abort and to a late completion
+	if err := service.AbortMultipartUpload(ctx, "tenant-a", abort); err == nil || !strings.Contains(err.Error(), "NoSuchUpload") {
+		t.Fatalf("second abort: error = %v, want NoSuchUpload", err)
+	}
+	_, err = service.CompleteMultipartUpload(ctx, "tenant-a", &CompleteUploadRequest{
+		UploadID:  initiated.UploadID,
+		ObjectKey: initiated.ObjectKey,
+		PartETags: []PartTag{{PartNumber: 1, ETag: eTag}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "NoSuchUpload") {
+		t.Fatalf("completing an aborted upload: error = %v, want NoSuchUpload", err)
+	}
+}
+
+func TestRefreshPresignedUrlsContract(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	ctx := contractContext()
+
+	initiated, err := service.InitiateMultipartUpload(ctx, "tenant-a", &InitiateUploadRequest{Size: 15, PartSize: 5})
+	if err != nil {
+		t.Fatalf("InitiateMultipartUpload: %v", err)
+	}
+	calls := len(stub.calls())
+
+	refreshed, err := service.RefreshPresignedUrls(ctx, "tenant-a", &RefreshUploadRequest{
+		UploadID:    initiated.UploadID,
+		ObjectKey:   initiated.ObjectKey,
+		PartNumbers: []int{2, 3},
+	})
+	if err != nil {
+		t.Fatalf("RefreshPresignedUrls: %v", err)
+	}
+	if len(refreshed.PresignedUrls) != 2 {
+		t.Fatalf("refreshed %d URLs, want parts 2 and 3", len(refreshed.PresignedUrls))
+	}
+	if now := time.Now().Unix(); refreshed.WarnAt <= now || refreshed.ExpiresAt <= refreshed.WarnAt {
+		t.Fatalf("deadline warnAt=%d expiresAt=%d, want both ahead (now %d)", refreshed.WarnAt, refreshed.ExpiresAt, now)
+	}
+	// Presigning happens locally; S3 only sees the parts uploaded through the URLs
+	if len(stub.calls()) != calls {
+		t.Fatalf("refresh called S3: %v", stub.calls()[calls:])
+	}
+
+	for number, presignedURL := range refreshed.PresignedUrls {
+		checkPresignedURL(t, presignedURL, initiated.ObjectKey, initiated.UploadID, number)
+		uploadPart(t, presignedURL, "refreshed")
+	}
+	parts, _ := stub.upload(initiated.UploadID)
+	if len(parts) != 2 || parts[2] == "" || parts[3] == "" {
+		t.Fatalf("uploaded parts = %v, want 2 and 3", parts)
+	}
+}
+
+func TestInitiateMultipartUploadContractObjectDelivery(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{})
+	ctx := contractContext()
+
+	initiated, err := service.InitiateMultipartUpload(ctx, "tenant-a", &InitiateUploadRequest{Size: 10, PartSize: 5, URLDelivery: URLDeliveryObject})
+	if err != nil {
+		t.Fatalf("InitiateMultipartUpload: %v", err)
+	}
+	if initiated.PresignedUrls != nil || initiated.PresignedUrlsLocation == "" {
+		t.Fatalf("object delivery returned %+v, want only a location", initiated)
+	}
+	stored, ok := stub.object("test-bucket", presignedUrlsKey("tenant-a", initiated.ObjectKey))
+	if !ok {
+		t.Fatal("URL map was not stored under the tenant prefix")
+	}
+
+	// The location is a presigned GET of the stored map
+	resp, err := http.Get(initiated.PresignedUrlsLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	fetched, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(fetched, stored) {
+		t.Fatalf("GET location: status %d, body %q; want the stored map %q", resp.StatusCode, fetched, stored)
+	}
+	var presignedUrls map[int]string
+	if err := json.Unmarshal(fetched, &presignedUrls); err != nil || len(presignedUrls) != 2 {
+		t.Fatalf("URL map %q: %v, want two parts", fetched, err)
+	}
+	checkPresignedURL(t, presignedUrls[1], initiated.ObjectKey, initiated.UploadID, 1)
+}
+
+func TestInitiateMultipartUploadRejectsTooManyParts(t *testing.T) {
+	service, stub := newStubbedUploadService(t, UploadServiceOptions{
+		Concurrency: ConcurrencyConfig{PresignLimit: 1, QueueTimeout: 10 * time.Millisecond},
+	})
+
+	// With the presign capacity taken, a request that reached Acquire would time out
+	release, err := service.presigning.Acquire(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	tests := []struct {
+		name string
+		req  InitiateUploadRequest
+	}{
+		{name: "10,001 parts", req: InitiateUploadRequest{Size: MaxUploadParts + 1, PartSize: 1}},
+		{name: "size near the int64 limit", req: InitiateUploadRequest{Size: math.MaxInt64, PartSize: 5 << 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := service.InitiateMultipartUpload(contractContext(), "tenant-a", &tt.req)
+			if !errors.Is(err, ErrInvalidUploadRequest) {
+				t.Fatalf("InitiateMultipartUpload error = %v, want ErrInvalidUploadRequest", err)
+			}
+		})
+	}
+	if len(stub.calls()) != 0 || len(stub.assumedRoles()) != 0 {
+		t.Fatalf("rejected initiates reached AWS: %v", stub.calls())
+	}
+
+	// Exactly the limit is fine
+	if err := validateInitiateRequest("tenant-a", &InitiateUploadRequest{Size: MaxUploadParts, PartSize: 1}); err != nil {
+		t.Fatalf("validateInitiateRequest of %d parts: %v", MaxUploadParts, err)
+	}
+}
+
+func TestValidateRefreshRequestPartNumbers(t *testing.T) {
+	tooMany := make([]int, MaxUploadParts+1)
+	for i := range tooMany {
+		tooMany[i] = i%MaxUploadParts + 1
+	}
+	tests := []struct {
+		name        string
+		partNumbers []int
+		wantErr     bool
+	}{
+		{name: "first and last part", partNumbers: []int{1, MaxUploadParts}},
+		{name: "part zero", partNumbers: []int{0}, wantErr: true},
+		{name: "negative part", partNumbers: []int{2, -1}, wantErr: true},
+		{name: "past the last part", partNumbers: []int{MaxUploadParts + 1}, wantErr: true},
+		{name: "too many parts", partNumbers: tooMany, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRefreshRequest("tenant-a", &RefreshUploadRequest{
+				UploadID:    "2~abc",
+				ObjectKey:   "tenant-a/2026/10/18/file.raw",
+				PartNumbers: tt.partNumbers,
+			})
+			if tt.wantErr != errors.Is(err, ErrInvalidUploadRequest) || !tt.wantErr && err != nil {
+				t.Fatalf("validateRefreshRequest error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
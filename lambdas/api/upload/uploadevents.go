@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Statuses of an upload timeline
+const (
+	UploadStatusInProgress = "in_progress"
+	UploadStatusCompleting = "completing"
+	UploadStatusCompleted  = "completed"
+)
+
+// UploadEvents reconstructs the timeline of a multipart upload for support, from what S3 and
+// the pending completion store know about it: when it was initiated, when each part last
+// arrived, whether a completion is pending or being retried, and when the object appeared.
+//
+// Issuing and refreshing presigned URLs leaves no state behind, so those steps appear only in
+// the function's logs, under the upload ID. S3 keeps no trace of aborted or expired uploads,
+// which are reported as ErrUploadNotFound like uploads that never existed.
+func (s *UploadService) UploadEvents(ctx context.Context, tenantID, uploadID, objectKey string) (*UploadEventsResponse, error) {
+	if uploadID == "" {
+		return nil, fmt.Errorf("upload ID cannot be empty")
+	}
+	if objectKey == "" {
+		return nil, fmt.Errorf("object key cannot be empty")
+	}
+	if err := validateTenantObjectKey(tenantID, objectKey); err != nil {
+		return nil, err
+	}
+
+	resp := &UploadEventsResponse{UploadID: uploadID, ObjectKey: objectKey, Events: []UploadEvent{}}
+
+	// The pending record is written with the tenant that started the completion; another
+	// tenant's record under a guessed upload ID is ignored
+	var pending *PendingCompletion
+	if s.completions != nil {
+		var err error
+		if pending, err = s.completions.Get(ctx, uploadID); err != nil {
+			return nil, err
+		}
+		if pending != nil && pending.TenantID != tenantID {
+			pending = nil
+		}
+	}
+
+	tenantS3Client := s.s3Clients.Get(tenantID)
+	bucket := s.bucketFor(tenantID)
+
+	initiated, err := findMultipartUpload(ctx, tenantS3Client, bucket, objectKey, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if initiated != nil {
+		resp.Status = UploadStatusInProgress
+		resp.Events = append(resp.Events, UploadEvent{Type: UploadEventInitiated, Time: formatEventTime(*initiated)})
+
+		paginator := s3.NewListPartsPaginator(tenantS3Client, &s3.ListPartsInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(objectKey),
+			UploadId: aws.String(uploadID),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			var noSuchUpload *types.NoSuchUpload
+			if errors.As(err, &noSuchUpload) {
+				// Completed or aborted since it was listed; the object check below tells which
+				initiated = nil
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to list upload parts: %w", err)
+			}
+			for _, part := range page.Parts {
+				resp.Events = append(resp.Events, UploadEvent{
+					Type:       UploadEventPartUploaded,
+					Time:       formatEventTime(aws.ToTime(part.LastModified)),
+					PartNumber: int(aws.ToInt32(part.PartNumber)),
+					Size:       aws.ToInt64(part.Size),
+					ETag:       aws.ToString(part.ETag),
+				})
+			}
+		}
+	}
+
+	if initiated == nil {
+		// Keys are unique per upload, so an object under the key is this upload's result
+		head, err := tenantS3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(objectKey),
+		})
+		switch {
+		case err == nil:
+			resp.Status = UploadStatusCompleted
+			resp.Events = append(resp.Events, UploadEvent{
+				Type: UploadEventCompleted,
+				Time: formatEventTime(aws.ToTime(head.LastModified)),
+				Size: aws.ToInt64(head.ContentLength),
+				ETag: aws.ToString(head.ETag),
+			})
+		case !isMissingObject(err):
+			return nil, fmt.Errorf("failed to check object: %w", err)
+		case pending == nil:
+			return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, uploadID)
+		}
+	}
+
+	if pending != nil {
+		if resp.Status != UploadStatusCompleted {
+			resp.Status = UploadStatusCompleting
+		}
+		resp.Events = append(resp.Events, UploadEvent{
+			Type:     UploadEventCompletionPending,
+			Time:     formatEventTime(pending.CreatedAt),
+			Attempts: pending.Attempts,
+		})
+	}
+
+	// RFC 3339 UTC timestamps sort chronologically as strings
+	slices.SortStableFunc(resp.Events, func(a, b UploadEvent) int {
+		switch {
+		case a.Time < b.Time:
+			return -1
+		case a.Time > b.Time:
+			return 1
+		}
+		return 0
+	})
+	return resp, nil
+}
+
+// findMultipartUpload returns when an in-progress multipart upload was initiated, or nil
+// when S3 no longer lists it
+func findMultipartUpload(ctx context.Context, client *s3.Client, bucket, objectKey, uploadID string) (*time.Time, error) {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(objectKey),
+	}
+	for {
+		output, err := client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range output.Uploads {
+			if aws.ToString(upload.Key) == objectKey && aws.ToString(upload.UploadId) == uploadID {
+				return upload.Initiated, nil
+			}
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			return nil, nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// formatEventTime formats a timeline timestamp
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+// Build stamp, set at link time, e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// The commit falls back to the VCS revision Go records in the binary.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+const (
+	// VersionHeader reports the build serving a response as <version>+<commit>
+	VersionHeader = "X-Service-Version"
+
+	// FunctionVersionHeader reports the published Lambda version serving a response, which
+	// tells the canary and the stable version apart while an alias shifts traffic
+	FunctionVersionHeader = "X-Function-Version"
+)
+
+// BuildInfo identifies the running code, as returned by /health
+type BuildInfo struct {
+	Status          string `json:"status"`
+	Version         string `json:"version"`
+	Commit          string `json:"commit,omitempty"`
+	BuildTime       string `json:"buildTime,omitempty"`
+	FunctionVersion string `json:"functionVersion,omitempty"` // Lambda version, "$LATEST" when unpublished
+}
+
+// String formats the build as <version>+<commit>
+func (b BuildInfo) String() string {
+	if b.Commit == "" {
+		return b.Version
+	}
+	return b.Version + "+" + b.Commit
+}
+
+// currentBuild returns the build stamp of this binary, resolved once
+var currentBuild = sync.OnceValue(func() BuildInfo {
+	build := BuildInfo{
+		Status:          "OK",
+		Version:         version,
+		Commit:          commit,
+		BuildTime:       buildTime,
+		FunctionVersion: os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && build.Commit == "" {
+				build.Commit = setting.Value[:min(len(setting.Value), 12)]
+			}
+		}
+	}
+	return build
+})
+
+// VersionHeaders marks every response with the build and Lambda version serving it
+func VersionHeaders(next http.Handler) http.Handler {
+	build := currentBuild()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VersionHeader, build.String())
+		if build.FunctionVersion != "" {
+			w.Header().Set(FunctionVersionHeader, build.FunctionVersion)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
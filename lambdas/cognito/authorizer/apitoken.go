@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+)
+
+const (
+	// APITokenPrefix starts the tenant API tokens minted by the upload API:
+	// "udt_<token ID>_<secret>"
+	APITokenPrefix = "udt_"
+
+	// APITokenPrincipalPrefix marks API tokens in the username passed to the API
+	APITokenPrincipalPrefix = "token:"
+
+	// APITokenMaxValidity caps the token expiration passed to the API, which bounds the
+	// lifetime of the presigned URLs and session credentials issued for the request
+	APITokenMaxValidity = time.Hour
+)
+
+// apiTokenStore looks API tokens up in the table shared with the upload API
+type apiTokenStore struct {
+	tableName string
+
+	clientOnce sync.Once
+	client     *dynamodb.Client
+	clientErr  error
+}
+
+// apiTokens holds the API token store; nil when API_TOKENS_TABLE is unset, which disables
+// API tokens
+var apiTokens *apiTokenStore
+
+// loadAPITokenStore configures API token validation from API_TOKENS_TABLE
+func loadAPITokenStore() *apiTokenStore {
+	tableName := strings.TrimSpace(os.Getenv("API_TOKENS_TABLE"))
+	if tableName == "" {
+		return nil
+	}
+	return &apiTokenStore{tableName: tableName}
+}
+
+// APITokenGrant is what a valid API token may do, passed to the API in the authorizer context
+type APITokenGrant struct {
+	TokenID    string
+	Operations []string
+	Containers []string // Empty allows the tenant's whole prefix
+}
+
+// isAPIToken reports whether a bearer token is an API token rather than a JWT
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// validateAPIToken checks an API token against its stored hash and expiry and maps it to
+// its tenant and a token principal without admin rights
+func validateAPIToken(ctx context.Context, token string) (*tokenauth.TokenInfo, *APITokenGrant, error) {
+	if apiTokens == nil {
+		return nil, nil, fmt.Errorf("API tokens are not enabled")
+	}
+	// Token IDs are hex, so the first separator after the prefix ends the ID
+	tokenID, _, found := strings.Cut(strings.TrimPrefix(token, APITokenPrefix), "_")
+	if !found || tokenID == "" {
+		return nil, nil, fmt.Errorf("malformed API token")
+	}
+
+	apiTokens.clientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			apiTokens.clientErr = fmt.Errorf("failed to load AWS config: %w", err)
+			return
+		}
+		apiTokens.client = dynamodb.NewFromConfig(cfg)
+	})
+	if apiTokens.clientErr != nil {
+		return nil, nil, apiTokens.clientErr
+	}
+
+	output, err := apiTokens.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(apiTokens.tableName),
+		Key: map[string]types.AttributeValue{
+			"token_id": &types.AttributeValueMemberS{Value: tokenID},
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up API token %s: %w", tokenID, err)
+	}
+	if output.Item == nil {
+		return nil, nil, fmt.Errorf("unknown or revoked API token %s", tokenID)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	storedHash, _ := output.Item["token_hash"].(*types.AttributeValueMemberS)
+	if storedHash == nil || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(storedHash.Value)) != 1 {
+		return nil, nil, fmt.Errorf("API token %s secret mismatch", tokenID)
+	}
+
+	// Expired items linger until DynamoDB's TTL deletes them
+	var expiresAt int64
+	if n, ok := output.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, _ = strconv.ParseInt(n.Value, 10, 64)
+	}
+	now := time.Now()
+	if expiresAt <= now.Unix() {
+		return nil, nil, fmt.Errorf("API token %s expired", tokenID)
+	}
+
+	tenantID, _ := output.Item["tenant_id"].(*types.AttributeValueMemberS)
+	name, _ := output.Item["name"].(*types.AttributeValueMemberS)
+	operations, _ := output.Item["operations"].(*types.AttributeValueMemberSS)
+	if tenantID == nil || tenantID.Value == "" || name == nil || operations == nil {
+		return nil, nil, fmt.Errorf("API token %s record is incomplete", tokenID)
+	}
+	grant := &APITokenGrant{TokenID: tokenID, Operations: operations.Value}
+	if containers, ok := output.Item["containers"].(*types.AttributeValueMemberSS); ok {
+		grant.Containers = containers.Value
+	}
+
+	return &tokenauth.TokenInfo{
+		TenantID:   tenantID.Value,
+		Username:   APITokenPrincipalPrefix + name.Value,
+		Expiration: min(now.Add(APITokenMaxValidity).Unix(), expiresAt),
+	}, grant, nil
+}
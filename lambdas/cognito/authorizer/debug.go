@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+)
+
+// debugTokenPath is served by this function as a regular API route next to the authorizer
+const debugTokenPath = "/admin/debug/token"
+
+// DebugTokenRequest is the body of POST /admin/debug/token
+type DebugTokenRequest struct {
+	Token string `json:"token"` // Access or ID token, with or without the "Bearer " prefix
+}
+
+// DebugTokenResponse explains how the authorizer sees a token. Claims are included even
+// when verification fails, decoded without verification, so the cause of a 401 is visible.
+type DebugTokenResponse struct {
+	Valid          bool            `json:"valid"`
+	Error          string          `json:"error,omitempty"`
+	Issuer         string          `json:"issuer,omitempty"`
+	IssuerType     string          `json:"issuer_type,omitempty"` // cognito, external or untrusted
+	JWKSURI        string          `json:"jwks_uri,omitempty"`    // Key set the signature is checked against
+	KeyID          string          `json:"key_id,omitempty"`      // kid of the token header
+	Algorithm      string          `json:"algorithm,omitempty"`   // alg of the token header
+	KeyMatched     bool            `json:"key_matched"`           // The key set had a key for kid that verified the signature
+	Claims         map[string]any  `json:"claims,omitempty"`
+	ClaimsVerified bool            `json:"claims_verified"`
+	ExpiresAt      string          `json:"expires_at,omitempty"` // RFC 3339
+	Expired        bool            `json:"expired"`
+	Result         *DebugTokenInfo `json:"result,omitempty"` // What the authorizer passes on; set when valid
+}
+
+// DebugTokenInfo is the validated token information as the authorizer context carries it
+type DebugTokenInfo struct {
+	TenantID     string   `json:"tenant_id"`
+	Username     string   `json:"username"`
+	Expiration   int64    `json:"token_expiration"`
+	Scope        string   `json:"scope"`
+	Admin        bool     `json:"admin"`
+	IPRestricted bool     `json:"ip_restricted"`            // The tenant has a source IP allow-list
+	ActAsTenants []string `json:"act_as_tenants,omitempty"` // Only for admin tokens
+}
+
+// decodeTokenSegment decodes a base64url JWT segment into a JSON object without verification
+func decodeTokenSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// DebugToken runs a token through the authorizer's validator and reports each step: the issuer and
+// whether it is trusted, the key set and key ID used for the signature, the claims and
+// the resulting token information. It never fails; problems are reported in Error.
+func DebugToken(ctx context.Context, tokenStr string) *DebugTokenResponse {
+	result := &DebugTokenResponse{}
+	tokenStr = stripBearerPrefix(strings.TrimSpace(tokenStr))
+
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) == 3 {
+		var header struct {
+			KeyID     string `json:"kid"`
+			Algorithm string `json:"alg"`
+		}
+		if decodeTokenSegment(parts[0], &header) == nil {
+			result.KeyID, result.Algorithm = header.KeyID, header.Algorithm
+		}
+		if decodeTokenSegment(parts[1], &result.Claims) == nil {
+			if exp, ok := result.Claims["exp"].(float64); ok {
+				expiresAt := time.Unix(int64(exp), 0).UTC()
+				result.ExpiresAt = expiresAt.Format(time.RFC3339)
+				result.Expired = time.Now().After(expiresAt)
+			}
+		}
+	}
+
+	if issuer, err := tokenauth.ExtractIssuer(tokenStr); err == nil {
+		result.Issuer = issuer
+		result.IssuerType = validator.IssuerType(issuer)
+		if result.IssuerType != tokenauth.IssuerUntrusted {
+			if keys, err := validator.Keys.Keys(ctx, issuer); err == nil {
+				result.JWKSURI = keys.JWKSURI
+			}
+		}
+	}
+
+	tokenInfo, err := validator.Validate(ctx, tokenStr)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// go-oidc only accepts a signature verified by a key of the issuer's set with the
+	// header's kid (or any key when the token has none), so a valid token identifies its key
+	result.Valid = true
+	result.KeyMatched = true
+	result.ClaimsVerified = true
+	result.Result = &DebugTokenInfo{
+		TenantID:     tokenInfo.TenantID,
+		Username:     tokenInfo.Username,
+		Expiration:   tokenInfo.Expiration,
+		Scope:        tokenInfo.Scope,
+		Admin:        tokenInfo.Admin,
+		IPRestricted: len(tenantIPAllowLists[tokenInfo.TenantID]) > 0,
+	}
+	if tokenInfo.Admin {
+		result.Result.ActAsTenants = actAsAllowList()
+	}
+	return result
+}
+
+// debugResponse builds a JSON API Gateway proxy response
+func debugResponse(status int, body any) events.APIGatewayProxyResponse {
+	payload, _ := json.Marshal(body)
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}
+}
+
+// handleDebugToken serves POST /admin/debug/token for callers with the admin scope.
+// The route itself is protected by this authorizer, which passes the caller's scope on.
+func handleDebugToken(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.HTTPMethod != http.MethodPost {
+		return debugResponse(http.StatusMethodNotAllowed, map[string]string{"error": "Method not allowed"}), nil
+	}
+	scope, _ := request.RequestContext.Authorizer["scope"].(string)
+	if !tokenauth.HasAdminScope(scope) {
+		return debugResponse(http.StatusForbidden, map[string]string{"error": "Admin scope required"}), nil
+	}
+
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return debugResponse(http.StatusBadRequest, map[string]string{"error": "Invalid request body"}), nil
+		}
+		body = string(decoded)
+	}
+	var debugRequest DebugTokenRequest
+	if err := json.Unmarshal([]byte(body), &debugRequest); err != nil || strings.TrimSpace(debugRequest.Token) == "" {
+		return debugResponse(http.StatusBadRequest, map[string]string{"error": "Request body must be {\"token\": \"<jwt>\"}"}), nil
+	}
+
+	caller, _ := request.RequestContext.Authorizer["username"].(string)
+	result := DebugToken(ctx, debugRequest.Token)
+	log.Printf("AUDIT token debug: caller=%s issuer=%s valid=%v", caller, result.Issuer, result.Valid)
+	return debugResponse(http.StatusOK, result), nil
+}
+
+// dispatch routes an invocation by its payload: API Gateway invokes this function as the
+// REQUEST authorizer of REST APIs and of WebSocket $connect routes and, for the admin debug
+// route, as a Lambda proxy integration
+func dispatch(ctx context.Context, payload json.RawMessage) (any, error) {
+	var probe struct {
+		Type           string `json:"type"`
+		MethodArn      string `json:"methodArn"`
+		RequestContext struct {
+			RouteKey  string `json:"routeKey"`
+			EventType string `json:"eventType"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, err
+	}
+	if probe.MethodArn != "" && isWebSocketConnect(probe.RequestContext.RouteKey, probe.RequestContext.EventType) {
+		var event WebSocketConnectAuthorizerRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return handleWebSocketConnect(ctx, event)
+	}
+	if probe.Type == "REQUEST" || probe.MethodArn != "" {
+		var event events.APIGatewayCustomAuthorizerRequestTypeRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return handler(ctx, event)
+	}
+
+	var request events.APIGatewayProxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	if request.Resource != debugTokenPath {
+		return debugResponse(http.StatusNotFound, map[string]string{"error": "Not found"}), nil
+	}
+	return handleDebugToken(ctx, request)
+}
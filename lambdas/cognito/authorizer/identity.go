@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Identity source modes: where the authorizer reads the caller's credential from
+const (
+	IdentitySourceHeader = "header" // A request header, "Authorization" by default
+	IdentitySourceQuery  = "query"  // A query string parameter, "token" by default
+	IdentitySourceCookie = "cookie" // A cookie, "access_token" by default
+)
+
+// defaultIdentityNames names the credential's header, parameter or cookie for each mode
+var defaultIdentityNames = map[string]string{
+	IdentitySourceHeader: "Authorization",
+	IdentitySourceQuery:  "token",
+	IdentitySourceCookie: "access_token",
+}
+
+// IdentitySource locates the credential in a request. It must name the same header,
+// parameter or cookie as the identity sources configured on the API Gateway authorizer,
+// which key the authorizer result cache.
+type IdentitySource struct {
+	Mode string
+	Name string
+}
+
+// String formats the identity source as configured, e.g. "query:token"
+func (s IdentitySource) String() string {
+	return s.Mode + ":" + s.Name
+}
+
+// identitySource holds the configured identity source
+var identitySource = IdentitySource{Mode: IdentitySourceHeader, Name: defaultIdentityNames[IdentitySourceHeader]}
+
+// loadIdentitySource parses IDENTITY_SOURCE, "<mode>" or "<mode>:<name>" with mode header,
+// query or cookie. Unset reads the Authorization header. Browsers cannot set headers on
+// WebSocket handshakes, so WebSocket deployments pass the token as a query parameter.
+func loadIdentitySource() (IdentitySource, error) {
+	raw := strings.TrimSpace(os.Getenv("IDENTITY_SOURCE"))
+	if raw == "" {
+		return identitySource, nil
+	}
+	mode, name, _ := strings.Cut(raw, ":")
+	mode, name = strings.ToLower(strings.TrimSpace(mode)), strings.TrimSpace(name)
+	defaultName, ok := defaultIdentityNames[mode]
+	if !ok {
+		return IdentitySource{}, fmt.Errorf("IDENTITY_SOURCE mode must be header, query or cookie, got %q", mode)
+	}
+	if name == "" {
+		name = defaultName
+	}
+	return IdentitySource{Mode: mode, Name: name}, nil
+}
+
+// Credential returns the credential the request carries in the identity source
+func (s IdentitySource) Credential(headers, queryParameters map[string]string) (string, bool) {
+	var value string
+	switch s.Mode {
+	case IdentitySourceHeader:
+		value = headerValue(headers, s.Name)
+	case IdentitySourceQuery:
+		value = queryParameters[s.Name]
+	case IdentitySourceCookie:
+		cookies, err := http.ParseCookie(headerValue(headers, "Cookie"))
+		if err != nil {
+			return "", false
+		}
+		for _, cookie := range cookies {
+			if cookie.Name == s.Name {
+				value = cookie.Value
+				break
+			}
+		}
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+// policyResource widens a method ARN to every method and path of its API stage, e.g.
+// "arn:aws:execute-api:eu-west-1:123456789012:abc123/prod/GET/upload/initiate" becomes
+// "arn:aws:execute-api:eu-west-1:123456789012:abc123/prod/*". API Gateway caches the policy
+// per identity, not per route, so a policy naming the first route called would deny the
+// caller's other routes until the cache entry expired. WebSocket route ARNs
+// (".../prod/$connect") are widened the same way.
+func policyResource(methodArn string) string {
+	parts := strings.SplitN(methodArn, ":", 6)
+	if len(parts) != 6 {
+		return methodArn
+	}
+	apiID, rest, found := strings.Cut(parts[5], "/")
+	stage, _, _ := strings.Cut(rest, "/")
+	if !found || apiID == "" || stage == "" {
+		return methodArn
+	}
+	parts[5] = apiID + "/" + stage + "/*"
+	return strings.Join(parts, ":")
+}
+
+// allowResource returns the resource of an Allow policy. Service-signed requests and callers
+// presenting a tenant-bound client certificate get the called route only: the result cache
+// is keyed on the Authorization header and source IP, which covers neither the signed
+// method, path and query nor the certificate, so a stage-wide cached Allow would let a
+// replayed header reach every route without the signature or certificate being checked.
+// A service signature is unique per request, so service callers never hit another route's
+// entry; a cert-bound caller reusing its token on another route within the cache TTL is
+// refused by API Gateway until the entry expires.
+func allowResource(methodArn string, serviceSigned, certBound bool) string {
+	if serviceSigned || certBound {
+		return methodArn
+	}
+	return policyResource(methodArn)
+}
+
+// requestCredential reads the credential of a REST REQUEST authorizer event
+func requestCredential(event events.APIGatewayCustomAuthorizerRequestTypeRequest) (string, bool) {
+	return identitySource.Credential(event.Headers, event.QueryStringParameters)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// tenantIPAllowLists holds each restricted tenant's allowed source ranges, from
+// TENANT_IP_ALLOWLISTS. Tenants without an entry may call from anywhere.
+var tenantIPAllowLists map[string][]netip.Prefix
+
+// loadTenantIPAllowLists parses TENANT_IP_ALLOWLISTS, a JSON object mapping tenants to
+// CIDR ranges, e.g. {"acme": ["203.0.113.0/24", "2001:db8::/32"]}. A bare address is
+// treated as a single-host range.
+func loadTenantIPAllowLists() (map[string][]netip.Prefix, error) {
+	raw := strings.TrimSpace(os.Getenv("TENANT_IP_ALLOWLISTS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var config map[string][]string
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, fmt.Errorf("TENANT_IP_ALLOWLISTS is not a valid JSON object: %w", err)
+	}
+
+	allowLists := make(map[string][]netip.Prefix, len(config))
+	for tenant, ranges := range config {
+		if len(ranges) == 0 {
+			return nil, fmt.Errorf("TENANT_IP_ALLOWLISTS has no ranges for tenant %s", tenant)
+		}
+		for _, cidr := range ranges {
+			prefix, err := parsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("TENANT_IP_ALLOWLISTS tenant %s: %w", tenant, err)
+			}
+			allowLists[tenant] = append(allowLists[tenant], prefix)
+		}
+	}
+	return allowLists, nil
+}
+
+// parsePrefix parses a CIDR range or a single address
+func parsePrefix(cidr string) (netip.Prefix, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// sourceIPAllowed reports whether the tenant may call from sourceIP. The source IP comes
+// from the API Gateway request context, not from client-supplied headers.
+func sourceIPAllowed(tenantID, sourceIP string) bool {
+	allowList, restricted := tenantIPAllowLists[tenantID]
+	if !restricted {
+		return true
+	}
+	addr, err := netip.ParseAddr(sourceIP)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range allowList {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,122 +2,53 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
 	"log"
+	"os"
 	"strings"
 )
 
-// No global variables needed
+// validator verifies bearer tokens against the trusted issuers
+var validator *tokenauth.Validator
 
-// TokenInfo contains the validated token information
-type TokenInfo struct {
-	TenantID   string
-	Username   string
-	Expiration int64 // Unix timestamp
-}
-
-// extractIssuerFromToken extracts the issuer claim from a JWT token without verification.
-// This is safe because we immediately verify the token with the extracted issuer's keys.
-// We need this because the OIDC library requires knowing the issuer URL to fetch the public keys,
-// but the issuer is inside the token itself.
-func extractIssuerFromToken(tokenStr string) (string, error) {
-	// JWT format: header.payload.signature
-	parts := strings.Split(tokenStr, ".")
-	if len(parts) != 3 {
-		return "", fmt.Errorf("invalid token format: expected 3 parts, got %d", len(parts))
-	}
-	
-	// Decode the payload (base64url without padding)
-	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+// init loads the external IdP configuration; an invalid configuration fails the cold start
+func init() {
+	externalIssuers, err := tokenauth.LoadExternalIssuers()
 	if err != nil {
-		return "", fmt.Errorf("failed to decode token payload: %w", err)
+		log.Fatalf("Invalid external IdP configuration: %v", err)
 	}
-	
-	// Parse just enough to get the issuer
-	var claims map[string]interface{}
-	if err := json.Unmarshal(payload, &claims); err != nil {
-		return "", fmt.Errorf("failed to parse token claims: %w", err)
+	validator = tokenauth.NewValidator(os.Getenv("REGION"), externalIssuers)
+	if identitySource, err = loadIdentitySource(); err != nil {
+		log.Fatalf("Invalid identity source: %v", err)
 	}
-	
-	issuer, ok := claims["iss"].(string)
-	if !ok || issuer == "" {
-		return "", fmt.Errorf("missing or invalid issuer claim")
+	log.Printf("🎟️  Identity source: %s", identitySource)
+	serviceKeys = loadServiceKeyStore()
+	apiTokens = loadAPITokenStore()
+	if certTenants, err = loadCertTenants(); err != nil {
+		log.Fatalf("Invalid client certificate bindings: %v", err)
 	}
-	
-	return issuer, nil
-}
-
-func ValidateToken(ctx context.Context, tokenStr string) (*TokenInfo, error) {
-	// Extract issuer from the token to know which Cognito User Pool to verify against
-	issuer, err := extractIssuerFromToken(tokenStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract issuer: %w", err)
+	if tenantIPAllowLists, err = loadTenantIPAllowLists(); err != nil {
+		log.Fatalf("Invalid tenant IP allow-lists: %v", err)
 	}
-	
-	log.Printf("🔍 Token issuer: %s", issuer)
-	
-	// Connect to the issuer's OIDC endpoint to get the public keys
-	provider, err := oidc.NewProvider(ctx, issuer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create OIDC provider for issuer %s: %w", issuer, err)
-	}
-
-	// For access tokens, skip audience check as they don't have 'aud' claim
-	verifier := provider.Verifier(&oidc.Config{
-		SkipClientIDCheck: true, // Access tokens don't have audience claim
-	})
-
-	// Verify the token signature, expiry, and issuer
-	idToken, err := verifier.Verify(ctx, tokenStr)
-	if err != nil {
-		return nil, fmt.Errorf("token verification failed: %w", err)
-	}
-
-	// Extract claims from the verified token
-	var claims map[string]interface{}
-	if err := idToken.Claims(&claims); err != nil {
-		return nil, fmt.Errorf("failed to decode claims: %w", err)
-	}
-
-	// Extract tenant_id - this is our custom claim added by the pre-token Lambda
-	tenant, _ := claims["tenant_id"].(string)
-	if tenant == "" {
-		return nil, fmt.Errorf("missing tenant_id claim")
+	for issuer, external := range externalIssuers {
+		log.Printf("🔗 External IdP configured: issuer=%s, tenant=%s, group tenants=%d",
+			issuer, external.TenantID, len(external.GroupTenants))
 	}
-
-	// Extract username (Cognito uses the "username" claim in access tokens)
-	username, _ := claims["username"].(string)
-	
-	// Extract the expiration (standard claim "exp")
-	exp, _ := claims["exp"].(float64)
-	expiration := int64(exp)
-
-	log.Printf("✅ Token validated: tenant=%s, user=%s, exp=%d", 
-		tenant, username, expiration)
-	
-	return &TokenInfo{
-		TenantID:   tenant,
-		Username:   username,
-		Expiration: expiration,
-	}, nil
 }
 
-// extractAuthorizationHeader retrieves the authorization header from the request
-func extractAuthorizationHeader(headers map[string]string) (string, bool) {
-	// Try standard capitalization first
-	if authHeader, exists := headers["Authorization"]; exists {
-		return authHeader, true
-	}
-	// Try lowercase as fallback
-	if authHeader, exists := headers["authorization"]; exists {
-		return authHeader, true
+// actAsAllowList returns the tenants admins may act on behalf of, from the comma-separated
+// ADMIN_ACT_AS_TENANTS environment variable ("*" allows any tenant, unset allows none)
+func actAsAllowList() []string {
+	var tenants []string
+	for _, tenant := range strings.Split(os.Getenv("ADMIN_ACT_AS_TENANTS"), ",") {
+		if tenant = strings.TrimSpace(tenant); tenant != "" {
+			tenants = append(tenants, tenant)
+		}
 	}
-	return "", false
+	return tenants
 }
 
 // stripBearerPrefix removes the "Bearer " prefix from a token if present
@@ -132,8 +63,10 @@ func stripBearerPrefix(token string) string {
 	return token
 }
 
-// createAuthorizerResponse creates a standardized authorizer response
-func createAuthorizerResponse(principalID string, allow bool, methodArn string, context map[string]interface{}) events.APIGatewayCustomAuthorizerResponse {
+// createAuthorizerResponse creates a standardized authorizer response for the policy resource,
+// which is usually the whole stage (see policyResource and allowResource). The principal is
+// the caller's tenant, never anything specific to the route that was called.
+func createAuthorizerResponse(principalID string, allow bool, resource string, context map[string]interface{}) events.APIGatewayCustomAuthorizerResponse {
 	effect := "Allow"
 	if !allow {
 		effect = "Deny"
@@ -141,7 +74,7 @@ func createAuthorizerResponse(principalID string, allow bool, methodArn string,
 	
 	response := events.APIGatewayCustomAuthorizerResponse{
 		PrincipalID:    principalID,
-		PolicyDocument: generatePolicy(effect, methodArn),
+		PolicyDocument: generatePolicy(effect, resource),
 	}
 	
 	if context != nil {
@@ -159,31 +92,59 @@ func handler(ctx context.Context, event events.APIGatewayCustomAuthorizerRequest
 	// Log all available headers for debugging
 	log.Printf("📋 All Headers: %+v", event.Headers)
 
-	// Extract Authorization header from REQUEST event
-	authHeader, exists := extractAuthorizationHeader(event.Headers)
-	log.Printf("🎟️  Authorization Header Present: %v (looking for: Authorization or authorization)", exists)
+	// Extract the credential from the configured identity source (the Authorization header by default)
+	authHeader, exists := requestCredential(event)
+	log.Printf("🎟️  Credential Present: %v (looking for: %s)", exists, identitySource)
 	if !exists {
-		log.Printf("❌ AUTHORIZATION FAILED: No Authorization header found")
-		return createAuthorizerResponse("unauthorized", false, event.MethodArn, nil), nil
-	}
+		log.Printf("❌ AUTHORIZATION FAILED: No credential found in %s", identitySource)
+		return createAuthorizerResponse("unauthorized", false, policyResource(event.MethodArn), nil), nil
+	}
+
+	var tokenInfo *tokenauth.TokenInfo
+	var grant *APITokenGrant
+	var err error
+	serviceSigned := isServiceAuthorization(authHeader)
+	if serviceSigned {
+		// Backend services sign requests with a shared HMAC key instead of presenting a token
+		log.Printf("🔑 Service request signed with key %s", headerValue(event.Headers, ServiceKeyIDHeader))
+		tokenInfo, err = validateServiceRequest(ctx, event, authHeader)
+	} else if token := stripBearerPrefix(authHeader); isAPIToken(token) {
+		// Tenant API tokens are opaque and looked up by ID; the secret is never logged
+		tokenInfo, grant, err = validateAPIToken(ctx, token)
+	} else {
+		token := authHeader
+		log.Printf("🔍 Raw token received (length: %d): %s", len(token), token)
 
-	token := authHeader
-	log.Printf("🔍 Raw token received (length: %d): %s", len(token), token)
+		// Handle the case-insensitive stripping of the "Bearer " prefix
+		token = stripBearerPrefix(token)
 
-	// Handle the case-insensitive stripping of the "Bearer " prefix
-	token = stripBearerPrefix(token)
+		log.Printf("🔍 Token after stripping (length: %d)", len(token))
+		if len(token) > 80 {
+			log.Printf("🔍 First 80 chars: %s", token[:80])
+		} else {
+			log.Printf("🔍 Full token: %s", token)
+		}
 
-	log.Printf("🔍 Token after stripping (length: %d)", len(token))
-	if len(token) > 80 {
-		log.Printf("🔍 First 80 chars: %s", token[:80])
-	} else {
-		log.Printf("🔍 Full token: %s", token)
+		tokenInfo, err = validator.Validate(ctx, token)
 	}
-
-	tokenInfo, err := ValidateToken(ctx, token)
 	if err != nil {
 		log.Printf("❌ AUTHORIZATION FAILED: %v", err)
-		return createAuthorizerResponse("unauthorized", false, event.MethodArn, nil), nil
+		return createAuthorizerResponse("unauthorized", false, policyResource(event.MethodArn), nil), nil
+	}
+
+	// Certificates bound to a tenant may only carry tokens of that tenant
+	clientCert := event.RequestContext.Identity.ClientCert
+	if err := checkClientCert(clientCert, tokenInfo.TenantID); err != nil {
+		log.Printf("❌ AUTHORIZATION FAILED: %v", err)
+		return createAuthorizerResponse("unauthorized", false, policyResource(event.MethodArn), nil), nil
+	}
+
+	// Tenants with registered ranges may only call from inside them
+	sourceIP := event.RequestContext.Identity.SourceIP
+	if !sourceIPAllowed(tokenInfo.TenantID, sourceIP) {
+		log.Printf("AUDIT ip allow-list violation: tenant=%s user=%s ip=%s %s %s",
+			tokenInfo.TenantID, tokenInfo.Username, sourceIP, event.HTTPMethod, event.Path)
+		return createAuthorizerResponse("unauthorized", false, policyResource(event.MethodArn), nil), nil
 	}
 
 	log.Printf("✅ AUTHORIZATION SUCCESSFUL: tenant=%s, user=%s, exp=%d", 
@@ -194,9 +155,25 @@ func handler(ctx context.Context, event events.APIGatewayCustomAuthorizerRequest
 		"tenant_id":        tokenInfo.TenantID,
 		"username":         tokenInfo.Username,
 		"token_expiration": fmt.Sprintf("%d", tokenInfo.Expiration), // Must be string in context
+		"scope":            tokenInfo.Scope,
+	}
+	addClientCertContext(authContext, clientCert)
+	if grant != nil {
+		authContext["api_token_id"] = grant.TokenID
+		authContext["api_token_operations"] = strings.Join(grant.Operations, ",")
+		authContext["api_token_containers"] = strings.Join(grant.Containers, ",")
+	}
+
+	// The authorizer result is cached per Authorization header, so the X-Act-As-Tenant header
+	// itself is checked by the upload Lambda against this validated allow-list
+	if tokenInfo.Admin {
+		if allowList := actAsAllowList(); len(allowList) > 0 {
+			authContext["act_as_tenants"] = strings.Join(allowList, ",")
+			log.Printf("🛡️  Admin token: may act as tenants %v", allowList)
+		}
 	}
 	
-	return createAuthorizerResponse(tokenInfo.TenantID, true, event.MethodArn, authContext), nil
+	return createAuthorizerResponse(tokenInfo.TenantID, true, allowResource(event.MethodArn, serviceSigned, isCertBound(clientCert)), authContext), nil
 }
 
 func generatePolicy(effect, resource string) events.APIGatewayCustomAuthorizerPolicy {
@@ -211,5 +188,5 @@ func generatePolicy(effect, resource string) events.APIGatewayCustomAuthorizerPo
 }
 
 func main() {
-	lambda.Start(handler)
+	lambda.Start(dispatch)
 }
\ No newline at end of file
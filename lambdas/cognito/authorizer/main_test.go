@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth/tokenauthtest"
+)
+
+const (
+	testRegion    = "eu-central-1"
+	testMethodArn = "arn:aws:execute-api:eu-central-1:123456789012:abc123/prod/DELETE/objects/tenant-a/cat.jpg"
+	testStageArn  = "arn:aws:execute-api:eu-central-1:123456789012:abc123/prod/*"
+)
+
+// useTestIssuer makes the authorizer trust the issuer as a Cognito user pool of testRegion
+// and returns the pool's issuer URL
+func useTestIssuer(t *testing.T, issuer *tokenauthtest.Issuer) string {
+	previous := validator
+	validator = &tokenauth.Validator{Keys: issuer.Fetcher(), CognitoRegion: testRegion}
+	t.Cleanup(func() { validator = previous })
+	return tokenauthtest.CognitoIssuerURL(testRegion, "eu-central-1_TestPool")
+}
+
+// authorizerEvent is the REQUEST authorizer event for a call with the Authorization header
+func authorizerEvent(authorization string) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+	event := events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		MethodArn:  testMethodArn,
+		HTTPMethod: "DELETE",
+		Path:       "/objects/tenant-a/cat.jpg",
+		Headers:    map[string]string{"Authorization": authorization},
+	}
+	event.RequestContext.Identity.SourceIP = "203.0.113.10"
+	return event
+}
+
+// policyOf returns the effect and resource of an authorizer response's single statement
+func policyOf(t *testing.T, response events.APIGatewayCustomAuthorizerResponse) (string, string) {
+	t.Helper()
+	statements := response.PolicyDocument.Statement
+	if len(statements) != 1 || len(statements[0].Resource) != 1 {
+		t.Fatalf("policy = %+v, want one statement on one resource", response.PolicyDocument)
+	}
+	return statements[0].Effect, statements[0].Resource[0]
+}
+
+func TestHandlerAllowsTokensStageWide(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+	poolURL := useTestIssuer(t, issuer)
+
+	token := issuer.Mint(tokenauthtest.CognitoClaims(poolURL, "tenant-a", "tom", "aws.cognito.signin.user.admin"))
+	response, err := handler(context.Background(), authorizerEvent("Bearer "+token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached result serves the caller's other routes too
+	if effect, resource := policyOf(t, response); effect != "Allow" || resource != testStageArn {
+		t.Fatalf("policy = %s on %s, want Allow on %s", effect, resource, testStageArn)
+	}
+}
+
+func TestHandlerBindsCertBoundCallersToTheRoute(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+	poolURL := useTestIssuer(t, issuer)
+	previous := certTenants
+	certTenants = map[string]string{"CN=acme-ingest,O=Acme": "tenant-a"}
+	t.Cleanup(func() { certTenants = previous })
+
+	token := issuer.Mint(tokenauthtest.CognitoClaims(poolURL, "tenant-a", "tom", "aws.cognito.signin.user.admin"))
+	tests := []struct {
+		name     string
+		subject  string
+		resource string
+	}{
+		// The certificate is not part of the cache key, so its Allow must not reach other routes
+		{name: "bound certificate", subject: "CN=acme-ingest,O=Acme", resource: testMethodArn},
+		{name: "unbound certificate", subject: "CN=someone-else", resource: testStageArn},
+		{name: "no certificate", resource: testStageArn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := authorizerEvent("Bearer " + token)
+			event.RequestContext.Identity.ClientCert.SubjectDN = tt.subject
+			response, err := handler(context.Background(), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if effect, resource := policyOf(t, response); effect != "Allow" || resource != tt.resource {
+				t.Fatalf("policy = %s on %s, want Allow on %s", effect, resource, tt.resource)
+			}
+		})
+	}
+}
+
+func TestHandlerBindsServiceRequestsToTheRoute(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	previous := serviceKeys
+	serviceKeys = &serviceKeyStore{
+		secretID: "test",
+		keys: map[string]*ServiceKey{
+			"ingest-1": {Secret: base64.StdEncoding.EncodeToString(key), TenantID: "tenant-a", Service: "nightly-ingest", key: key},
+		},
+		loadedAt: time.Now(),
+	}
+	t.Cleanup(func() { serviceKeys = previous })
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(serviceStringToSign(timestamp, "ingest-1", "DELETE", "/objects/tenant-a/cat.jpg", "")))
+	event := authorizerEvent(ServiceAuthScheme + " " + hex.EncodeToString(mac.Sum(nil)))
+	event.Headers[ServiceKeyIDHeader] = "ingest-1"
+	event.Headers[ServiceTimestampHeader] = timestamp
+
+	response, err := handler(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A cached Allow for the signed request must not let a replayed header reach other routes
+	if effect, resource := policyOf(t, response); effect != "Allow" || resource != testMethodArn {
+		t.Fatalf("policy = %s on %s, want Allow on %s only", effect, resource, testMethodArn)
+	}
+	if response.PrincipalID != "tenant-a" || response.Context["username"] != ServicePrincipalPrefix+"nightly-ingest" {
+		t.Fatalf("principal %s, context %v", response.PrincipalID, response.Context)
+	}
+
+	// The same signature on another route is refused
+	event.HTTPMethod, event.Path = "POST", "/tokens"
+	response, err = handler(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effect, _ := policyOf(t, response); effect != "Deny" {
+		t.Fatalf("signature replayed on another route: %s", effect)
+	}
+}
+
+func TestAllowResource(t *testing.T) {
+	if got := allowResource(testMethodArn, false, false); got != testStageArn {
+		t.Fatalf("allowResource for a token = %s, want %s", got, testStageArn)
+	}
+	if got := allowResource(testMethodArn, true, false); got != testMethodArn {
+		t.Fatalf("allowResource for a service request = %s, want %s", got, testMethodArn)
+	}
+	if got := allowResource(testMethodArn, false, true); got != testMethodArn {
+		t.Fatalf("allowResource for a cert-bound caller = %s, want %s", got, testMethodArn)
+	}
+}
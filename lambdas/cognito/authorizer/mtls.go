@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// certTenants binds client certificate subject DNs to tenants, from CLIENT_CERT_TENANTS
+var certTenants map[string]string
+
+// loadCertTenants parses CLIENT_CERT_TENANTS, a JSON object mapping certificate subject
+// DNs to tenants, e.g. {"CN=acme-ingest,O=Acme": "acme"}. Unset means no bindings.
+func loadCertTenants() (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv("CLIENT_CERT_TENANTS"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var bindings map[string]string
+	if err := json.Unmarshal([]byte(raw), &bindings); err != nil {
+		return nil, fmt.Errorf("CLIENT_CERT_TENANTS is not a valid JSON object: %w", err)
+	}
+	for subject, tenant := range bindings {
+		if subject == "" || tenant == "" {
+			return nil, fmt.Errorf("CLIENT_CERT_TENANTS has an empty subject or tenant")
+		}
+	}
+	return bindings, nil
+}
+
+// checkClientCert enforces the certificate binding for a validated token. API Gateway has
+// already verified the certificate against the domain's truststore; requests without a
+// certificate (mTLS not enabled) and certificates without a binding are not restricted.
+// The result is cached per identity source, so mTLS deployments must add
+// context.identity.clientCert.serialNumber to the authorizer's identity sources.
+func checkClientCert(cert events.APIGatewayCustomAuthorizerRequestTypeRequestIdentityClientCert, tenantID string) error {
+	if cert.SubjectDN == "" {
+		return nil
+	}
+	bound, ok := certTenants[cert.SubjectDN]
+	if !ok || bound == tenantID {
+		return nil
+	}
+	return fmt.Errorf("client certificate %s is bound to tenant %s, token is for %s", cert.SubjectDN, bound, tenantID)
+}
+
+// isCertBound reports whether the request presented a certificate bound to a tenant
+func isCertBound(cert events.APIGatewayCustomAuthorizerRequestTypeRequestIdentityClientCert) bool {
+	_, ok := certTenants[cert.SubjectDN]
+	return cert.SubjectDN != "" && ok
+}
+
+// addClientCertContext exposes the client certificate in the authorizer context so the
+// upload Lambda can attribute requests to it
+func addClientCertContext(authContext map[string]interface{}, cert events.APIGatewayCustomAuthorizerRequestTypeRequestIdentityClientCert) {
+	if cert.SubjectDN == "" {
+		return
+	}
+	authContext["client_cert_subject"] = cert.SubjectDN
+	authContext["client_cert_issuer"] = cert.IssuerDN
+	authContext["client_cert_serial"] = cert.SerialNumber
+	authContext["client_cert_not_after"] = cert.Validity.NotAfter
+}
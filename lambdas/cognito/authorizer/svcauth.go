@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+)
+
+const (
+	// ServiceAuthScheme prefixes the Authorization header of service requests:
+	// "Authorization: HMAC-SHA256 <hex signature>"
+	ServiceAuthScheme = "HMAC-SHA256"
+
+	// ServiceKeyIDHeader and ServiceTimestampHeader carry the signing key's ID and the
+	// request time in Unix seconds; both are covered by the signature
+	ServiceKeyIDHeader     = "X-Service-Key-Id"
+	ServiceTimestampHeader = "X-Service-Timestamp"
+
+	// ServiceClockSkew is how far a request's timestamp may be from the authorizer's clock.
+	// A signed request can be replayed within it, and for as long afterwards as API Gateway
+	// caches the Allow (up to the result TTL from the first call). Replays only reach the
+	// signed method, path and query: service requests are allowed for that route alone
+	// (see allowResource).
+	ServiceClockSkew = 5 * time.Minute
+
+	// ServiceKeyCacheTTL is how long keys read from Secrets Manager are reused, so rotated
+	// keys take effect within this time
+	ServiceKeyCacheTTL = 5 * time.Minute
+
+	// ServicePrincipalPrefix marks service principals in the username passed to the API
+	ServicePrincipalPrefix = "svc:"
+
+	// minServiceKeyBytes is the shortest accepted HMAC key (the SHA-256 block output size)
+	minServiceKeyBytes = 32
+)
+
+// ServiceKey is one entry of the service auth secret: a shared HMAC key and the tenant and
+// service the requests signed with it act as
+type ServiceKey struct {
+	Secret   string `json:"secret"`    // Base64-encoded key of at least 32 bytes
+	TenantID string `json:"tenant_id"` // Tenant the service's requests are scoped to
+	Service  string `json:"service"`   // Service name, reported as username "svc:<service>"
+
+	key []byte
+}
+
+// serviceKeyStore reads the service keys from a Secrets Manager secret and caches them
+type serviceKeyStore struct {
+	secretID string
+
+	clientOnce sync.Once
+	client     *secretsmanager.Client
+	clientErr  error
+
+	mu       sync.Mutex
+	keys     map[string]*ServiceKey
+	loadedAt time.Time
+}
+
+// serviceKeys holds the service key store; nil when SERVICE_AUTH_SECRET_ID is unset, which
+// disables the HMAC auth mode
+var serviceKeys *serviceKeyStore
+
+// loadServiceKeyStore configures the HMAC auth mode from SERVICE_AUTH_SECRET_ID, the ARN or
+// name of a secret holding a JSON object of key ID -> ServiceKey, e.g.
+// {"ingest-2025-06": {"secret": "<base64>", "tenant_id": "acme", "service": "nightly-ingest"}}.
+// The secret itself is read on the first service request.
+func loadServiceKeyStore() *serviceKeyStore {
+	secretID := strings.TrimSpace(os.Getenv("SERVICE_AUTH_SECRET_ID"))
+	if secretID == "" {
+		return nil
+	}
+	return &serviceKeyStore{secretID: secretID}
+}
+
+// parseServiceKeys decodes and validates the secret's key entries
+func parseServiceKeys(raw string) (map[string]*ServiceKey, error) {
+	var keys map[string]*ServiceKey
+	if err := json.Unmarshal([]byte(raw), &keys); err != nil {
+		return nil, fmt.Errorf("service auth secret is not a valid JSON object: %w", err)
+	}
+	for keyID, entry := range keys {
+		if entry == nil || entry.TenantID == "" || entry.Service == "" {
+			return nil, fmt.Errorf("service key %s needs tenant_id and service", keyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(entry.Secret)
+		if err != nil || len(key) < minServiceKeyBytes {
+			return nil, fmt.Errorf("service key %s: secret must be base64 of at least %d bytes", keyID, minServiceKeyBytes)
+		}
+		entry.key = key
+	}
+	return keys, nil
+}
+
+// key returns the entry for the key ID, re-reading the secret once the cache is stale.
+// Unknown key IDs do not force a re-read, so they cannot be used to flood Secrets Manager.
+func (s *serviceKeyStore) key(ctx context.Context, keyID string) (*ServiceKey, error) {
+	s.clientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			s.clientErr = fmt.Errorf("failed to load AWS config: %w", err)
+			return
+		}
+		s.client = secretsmanager.NewFromConfig(cfg)
+	})
+	if s.clientErr != nil {
+		return nil, s.clientErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys == nil || time.Since(s.loadedAt) > ServiceKeyCacheTTL {
+		output, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(s.secretID),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service auth secret: %w", err)
+		}
+		keys, err := parseServiceKeys(aws.ToString(output.SecretString))
+		if err != nil {
+			return nil, err
+		}
+		s.keys, s.loadedAt = keys, time.Now()
+	}
+
+	entry, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown service key %s", keyID)
+	}
+	return entry, nil
+}
+
+// headerValue looks a header up case-insensitively
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// canonicalQuery encodes the query parameters sorted by name and value
+func canonicalQuery(params map[string][]string) string {
+	var pairs []string
+	for name, values := range params {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// serviceStringToSign builds what a service signs: the scheme, timestamp, key ID, method,
+// path (as routed by API Gateway, without the stage) and canonical query, newline-separated.
+// The body is not covered, since REQUEST authorizers never see it.
+func serviceStringToSign(timestamp, keyID, method, path, query string) string {
+	return strings.Join([]string{ServiceAuthScheme, timestamp, keyID, method, path, query}, "\n")
+}
+
+// isServiceAuthorization reports whether an Authorization header uses the HMAC scheme
+func isServiceAuthorization(authHeader string) bool {
+	return strings.HasPrefix(authHeader, ServiceAuthScheme+" ")
+}
+
+// validateServiceRequest verifies an HMAC-signed service request and maps it to the
+// key's tenant and a service principal without admin rights
+func validateServiceRequest(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest, authHeader string) (*tokenauth.TokenInfo, error) {
+	if serviceKeys == nil {
+		return nil, fmt.Errorf("service auth is not enabled")
+	}
+
+	keyID := headerValue(event.Headers, ServiceKeyIDHeader)
+	timestamp := headerValue(event.Headers, ServiceTimestampHeader)
+	if keyID == "" || timestamp == "" {
+		return nil, fmt.Errorf("service request without %s or %s", ServiceKeyIDHeader, ServiceTimestampHeader)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %q", ServiceTimestampHeader, timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > ServiceClockSkew || skew < -ServiceClockSkew {
+		return nil, fmt.Errorf("service request timestamp %s is outside the allowed clock skew", signedAt.UTC().Format(time.RFC3339))
+	}
+
+	signature, err := hex.DecodeString(strings.TrimSpace(strings.TrimPrefix(authHeader, ServiceAuthScheme+" ")))
+	if err != nil {
+		return nil, fmt.Errorf("service signature is not hex encoded")
+	}
+
+	entry, err := serviceKeys.key(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, entry.key)
+	mac.Write([]byte(serviceStringToSign(timestamp, keyID, event.HTTPMethod, event.Path,
+		canonicalQuery(event.MultiValueQueryStringParameters))))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("service signature mismatch for key %s", keyID)
+	}
+
+	return &tokenauth.TokenInfo{
+		TenantID:   entry.TenantID,
+		Username:   ServicePrincipalPrefix + entry.Service,
+		Expiration: signedAt.Add(ServiceClockSkew).Unix(),
+	}, nil
+}
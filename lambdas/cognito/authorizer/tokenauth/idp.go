@@ -0,0 +1,123 @@
+package tokenauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ExternalIssuer configures an OIDC issuer outside Cognito (Okta, Entra ID, ...) whose
+// tokens are accepted directly. Its claims are mapped onto the same tenant, username and
+// scope fields a Cognito token provides, so the upload Lambda cannot tell them apart.
+type ExternalIssuer struct {
+	Issuer        string              `json:"issuer"`         // Exact "iss" value of the tokens
+	Audience      string              `json:"audience"`       // Required "aud" value; empty skips the check
+	TenantID      string              `json:"tenant_id"`      // Fixed tenant for every token of this issuer
+	GroupsClaim   string              `json:"groups_claim"`   // Claim holding the user's groups (default "groups")
+	GroupTenants  map[string]string   `json:"group_tenants"`  // Group -> tenant, used when TenantID is empty
+	GroupScopes   map[string][]string `json:"group_scopes"`   // Group -> scopes granted, e.g. {"upload-admins": ["admin"]}
+	UsernameClaim string              `json:"username_claim"` // Claim holding the username (default "preferred_username", then "sub")
+}
+
+// LoadExternalIssuers parses EXTERNAL_IDP_CONFIG, a JSON array of ExternalIssuer entries,
+// into a map by issuer. Unset or empty means only Cognito tokens are accepted.
+func LoadExternalIssuers() (map[string]*ExternalIssuer, error) {
+	raw := strings.TrimSpace(os.Getenv("EXTERNAL_IDP_CONFIG"))
+	if raw == "" {
+		return nil, nil
+	}
+
+	var entries []*ExternalIssuer
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("EXTERNAL_IDP_CONFIG is not a valid JSON array: %w", err)
+	}
+
+	issuers := make(map[string]*ExternalIssuer, len(entries))
+	for _, entry := range entries {
+		if entry.Issuer == "" {
+			return nil, fmt.Errorf("EXTERNAL_IDP_CONFIG entry without issuer")
+		}
+		if entry.TenantID == "" && len(entry.GroupTenants) == 0 {
+			return nil, fmt.Errorf("EXTERNAL_IDP_CONFIG issuer %s needs tenant_id or group_tenants", entry.Issuer)
+		}
+		if _, ok := issuers[entry.Issuer]; ok {
+			return nil, fmt.Errorf("EXTERNAL_IDP_CONFIG lists issuer %s twice", entry.Issuer)
+		}
+		if entry.GroupsClaim == "" {
+			entry.GroupsClaim = "groups"
+		}
+		issuers[entry.Issuer] = entry
+	}
+	return issuers, nil
+}
+
+// mapClaims normalizes an external token's claims into a TokenInfo. The tenant comes from
+// the fixed tenant_id or from exactly one mapped group; scopes are only granted through
+// group_scopes, never taken from the external token's own scope claim.
+func (e *ExternalIssuer) mapClaims(claims map[string]interface{}) (*TokenInfo, error) {
+	groups := stringList(claims[e.GroupsClaim])
+
+	tenant := e.TenantID
+	if tenant == "" {
+		for _, group := range groups {
+			mapped, ok := e.GroupTenants[group]
+			if !ok || mapped == tenant {
+				continue
+			}
+			if tenant != "" {
+				return nil, fmt.Errorf("groups map to several tenants (%s, %s)", tenant, mapped)
+			}
+			tenant = mapped
+		}
+	}
+	if tenant == "" {
+		return nil, fmt.Errorf("no group maps to a tenant")
+	}
+
+	var scopes []string
+	for _, group := range groups {
+		for _, scope := range e.GroupScopes[group] {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	scope := strings.Join(scopes, " ")
+
+	username := ""
+	if e.UsernameClaim != "" {
+		username, _ = claims[e.UsernameClaim].(string)
+	} else if username, _ = claims["preferred_username"].(string); username == "" {
+		username, _ = claims["sub"].(string)
+	}
+
+	exp, _ := claims["exp"].(float64)
+
+	return &TokenInfo{
+		TenantID:   tenant,
+		Username:   username,
+		Expiration: int64(exp),
+		Scope:      scope,
+		Admin:      HasAdminScope(scope),
+	}, nil
+}
+
+// stringList reads a claim that IdPs send either as a JSON array or as a
+// space/comma-separated string
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package tokenauth
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// supportedAlgorithms are the signing algorithms go-oidc can verify; advertised algorithms
+// outside this list are ignored, as the library's own provider verifier does
+var supportedAlgorithms = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.EdDSA,
+}
+
+// IssuerKeys are the keys tokens of one issuer are verified against
+type IssuerKeys struct {
+	KeySet     oidc.KeySet
+	JWKSURI    string   // Where the key set is fetched from; empty for static key sets
+	Algorithms []string // Accepted signing algorithms; empty accepts RS256 only
+}
+
+// KeyFetcher returns the verification keys of a trusted issuer. The Validator calls it for
+// every token, so implementations should cache.
+type KeyFetcher interface {
+	Keys(ctx context.Context, issuer string) (*IssuerKeys, error)
+}
+
+// DiscoveryKeyFetcher finds each issuer's JWKS through OIDC discovery. Discovery happens
+// lazily on the first token from each issuer (never at init), and the key set is reused
+// afterwards so warm invocations don't repeat the discovery and JWKS round trips.
+type DiscoveryKeyFetcher struct {
+	mu      sync.Mutex
+	issuers map[string]*IssuerKeys
+}
+
+// NewDiscoveryKeyFetcher creates a DiscoveryKeyFetcher with an empty cache
+func NewDiscoveryKeyFetcher() *DiscoveryKeyFetcher {
+	return &DiscoveryKeyFetcher{issuers: make(map[string]*IssuerKeys)}
+}
+
+// Keys returns the cached keys of the issuer, discovering them on first use. Failed
+// discoveries are not cached so a transient error doesn't stick to the instance.
+func (f *DiscoveryKeyFetcher) Keys(ctx context.Context, issuer string) (*IssuerKeys, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if keys, ok := f.issuers[issuer]; ok {
+		return keys, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		JWKSURI    string   `json:"jwks_uri"`
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, err
+	}
+
+	keys := &IssuerKeys{
+		// The key set outlives this invocation, so it must not inherit its deadline
+		KeySet:  oidc.NewRemoteKeySet(context.WithoutCancel(ctx), metadata.JWKSURI),
+		JWKSURI: metadata.JWKSURI,
+	}
+	for _, algorithm := range metadata.Algorithms {
+		if slices.Contains(supportedAlgorithms, algorithm) {
+			keys.Algorithms = append(keys.Algorithms, algorithm)
+		}
+	}
+	f.issuers[issuer] = keys
+	return keys, nil
+}
@@ -0,0 +1,159 @@
+// Package tokenauthtest provides an in-process OIDC issuer for exercising package tokenauth:
+// an HTTP server with a discovery document and JWKS endpoint, and a minter for tokens
+// signed by its key. Tests either validate against the server through OIDC discovery, or
+// inject the issuer's keys directly with Fetcher to mint tokens for any issuer URL, such as
+// a Cognito user pool's.
+package tokenauthtest
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+)
+
+// DefaultTokenLifetime is the exp of minted tokens that don't set one
+const DefaultTokenLifetime = time.Hour
+
+// Issuer is an OIDC issuer served from an in-process HTTP server
+type Issuer struct {
+	URL   string // Issuer URL, the "iss" of minted tokens and base of the discovery document
+	KeyID string // kid of the signing key in the JWKS and token headers
+
+	key    *rsa.PrivateKey
+	server *httptest.Server
+}
+
+// NewIssuer starts an issuer with a fresh RSA signing key. Close it when done.
+func NewIssuer() *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("tokenauthtest: failed to generate key: %v", err))
+	}
+	issuer := &Issuer{KeyID: "test-key-1", key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                issuer.URL,
+			"jwks_uri":                              issuer.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{oidc.RS256},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, issuer.JWKS())
+	})
+	issuer.server = httptest.NewServer(mux)
+	issuer.URL = issuer.server.URL
+	return issuer
+}
+
+// Close shuts the issuer's server down
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// JWKS returns the issuer's public key set
+func (i *Issuer) JWKS() jose.JSONWebKeySet {
+	return jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &i.key.PublicKey,
+		KeyID:     i.KeyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}}
+}
+
+// Mint signs the claims with the issuer's key. "iss", "iat" and "exp" default to the
+// issuer URL, now and DefaultTokenLifetime from now; set them to override.
+func (i *Issuer) Mint(claims map[string]any) string {
+	return mint(claims, i.URL, i.key, i.KeyID)
+}
+
+// MintWithKey signs the claims with another key under the given kid, for tokens whose
+// signature must not verify
+func (i *Issuer) MintWithKey(claims map[string]any, key *rsa.PrivateKey, keyID string) string {
+	return mint(claims, i.URL, key, keyID)
+}
+
+// CognitoClaims returns the claims of a Cognito access token as the pre-token Lambda
+// shapes them, for the user pool at issuerURL
+func CognitoClaims(issuerURL, tenantID, username, scope string) map[string]any {
+	return map[string]any{
+		"iss":       issuerURL,
+		"sub":       username,
+		"token_use": "access",
+		"tenant_id": tenantID,
+		"username":  username,
+		"scope":     scope,
+	}
+}
+
+// CognitoIssuerURL returns the issuer URL of a Cognito user pool
+func CognitoIssuerURL(region, userPoolID string) string {
+	return fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, userPoolID)
+}
+
+// Fetcher returns a key fetcher that answers every issuer with this issuer's key, without
+// HTTP, so tokens minted with any "iss" verify
+func (i *Issuer) Fetcher() tokenauth.KeyFetcher {
+	return staticFetcher{keys: &tokenauth.IssuerKeys{
+		KeySet:     &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&i.key.PublicKey}},
+		Algorithms: []string{oidc.RS256},
+	}}
+}
+
+// staticFetcher serves the same keys for every issuer
+type staticFetcher struct {
+	keys *tokenauth.IssuerKeys
+}
+
+func (f staticFetcher) Keys(context.Context, string) (*tokenauth.IssuerKeys, error) {
+	return f.keys, nil
+}
+
+// mint signs claims as an RS256 JWT, filling in the default registered claims
+func mint(claims map[string]any, issuerURL string, key *rsa.PrivateKey, keyID string) string {
+	now := time.Now()
+	payload := map[string]any{
+		"iss": issuerURL,
+		"iat": now.Unix(),
+		"exp": now.Add(DefaultTokenLifetime).Unix(),
+	}
+	for name, value := range claims {
+		payload[name] = value
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		panic(fmt.Sprintf("tokenauthtest: failed to encode claims: %v", err))
+	}
+
+	options := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, options)
+	if err != nil {
+		panic(fmt.Sprintf("tokenauthtest: failed to create signer: %v", err))
+	}
+	signed, err := signer.Sign(body)
+	if err != nil {
+		panic(fmt.Sprintf("tokenauthtest: failed to sign token: %v", err))
+	}
+	token, err := signed.CompactSerialize()
+	if err != nil {
+		panic(fmt.Sprintf("tokenauthtest: failed to serialize token: %v", err))
+	}
+	return token
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
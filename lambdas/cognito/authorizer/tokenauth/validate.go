@@ -0,0 +1,192 @@
+// Package tokenauth validates the bearer tokens accepted by the API: access tokens of the
+// region's Cognito user pools and tokens of the configured external OIDC issuers. It is
+// separate from the authorizer Lambda so the validation rules can be exercised against
+// in-process issuers (see package tokenauthtest) without AWS.
+package tokenauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// Issuer types, as reported by Validator.IssuerType
+const (
+	IssuerCognito   = "cognito"
+	IssuerExternal  = "external"
+	IssuerUntrusted = "untrusted"
+)
+
+// TokenInfo contains the validated token information
+type TokenInfo struct {
+	TenantID   string
+	Username   string
+	Expiration int64  // Unix timestamp
+	Scope      string // Space-separated scopes from the access token
+	Admin      bool   // Token carries the admin scope
+}
+
+// HasAdminScope reports whether the space-separated scope claim contains the admin scope,
+// either bare ("admin") or from a resource server ("<resource-server>/admin").
+// Cognito's built-in "aws.cognito.signin.user.admin" scope does not count.
+func HasAdminScope(scope string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == "admin" || strings.HasSuffix(s, "/admin") {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractIssuer extracts the issuer claim from a JWT token without verification.
+// This is safe because the token is then verified with the extracted issuer's keys.
+// It is needed because the issuer's keys can only be found from its URL, but the issuer
+// is inside the token itself.
+func ExtractIssuer(tokenStr string) (string, error) {
+	// JWT format: header.payload.signature
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid token format: expected 3 parts, got %d", len(parts))
+	}
+
+	// Decode the payload (base64url without padding)
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to decode token payload: %w", err)
+	}
+
+	// Parse just enough to get the issuer
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("failed to parse token claims: %w", err)
+	}
+
+	issuer, ok := claims["iss"].(string)
+	if !ok || issuer == "" {
+		return "", fmt.Errorf("missing or invalid issuer claim")
+	}
+
+	return issuer, nil
+}
+
+// Validator verifies tokens and maps their claims onto a TokenInfo
+type Validator struct {
+	Keys            KeyFetcher
+	ExternalIssuers map[string]*ExternalIssuer // By issuer; nil accepts Cognito tokens only
+	CognitoRegion   string                     // Region whose user pools are trusted
+	Now             func() time.Time           // Clock for expiry checks; nil uses time.Now
+}
+
+// NewValidator creates a Validator that discovers issuer keys over OIDC
+func NewValidator(region string, externalIssuers map[string]*ExternalIssuer) *Validator {
+	return &Validator{
+		Keys:            NewDiscoveryKeyFetcher(),
+		ExternalIssuers: externalIssuers,
+		CognitoRegion:   region,
+	}
+}
+
+// IssuerType classifies an issuer as a Cognito user pool of the region, a configured
+// external IdP, or untrusted
+func (v *Validator) IssuerType(issuer string) string {
+	switch {
+	case v.ExternalIssuers[issuer] != nil:
+		return IssuerExternal
+	case strings.HasPrefix(issuer, fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/", v.CognitoRegion)):
+		return IssuerCognito
+	default:
+		return IssuerUntrusted
+	}
+}
+
+// Validate verifies the token's signature, expiry and issuer and returns its tenant,
+// username and scope
+func (v *Validator) Validate(ctx context.Context, tokenStr string) (*TokenInfo, error) {
+	// Extract issuer from the token to know which key set to verify against
+	issuer, err := ExtractIssuer(tokenStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract issuer: %w", err)
+	}
+
+	log.Printf("🔍 Token issuer: %s", issuer)
+
+	// Only Cognito pools and the configured external IdPs are trusted
+	if v.IssuerType(issuer) == IssuerUntrusted {
+		return nil, fmt.Errorf("untrusted issuer %s", issuer)
+	}
+	external := v.ExternalIssuers[issuer]
+
+	// Get the issuer's public keys (cached per issuer)
+	keys, err := v.Keys.Keys(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OIDC provider for issuer %s: %w", issuer, err)
+	}
+
+	// For access tokens, skip audience check as they don't have 'aud' claim
+	verifierConfig := &oidc.Config{
+		SkipClientIDCheck:    true, // Access tokens don't have audience claim
+		SupportedSigningAlgs: keys.Algorithms,
+		Now:                  v.Now,
+	}
+	if external != nil && external.Audience != "" {
+		verifierConfig.SkipClientIDCheck = false
+		verifierConfig.ClientID = external.Audience
+	}
+	verifier := oidc.NewVerifier(issuer, keys.KeySet, verifierConfig)
+
+	// Verify the token signature, expiry, and issuer
+	idToken, err := verifier.Verify(ctx, tokenStr)
+	if err != nil {
+		return nil, fmt.Errorf("token verification failed: %w", err)
+	}
+
+	// Extract claims from the verified token
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to decode claims: %w", err)
+	}
+
+	// External IdP tokens carry groups instead of our claims; map them to the same fields
+	if external != nil {
+		tokenInfo, err := external.mapClaims(claims)
+		if err != nil {
+			return nil, fmt.Errorf("claim mapping for issuer %s failed: %w", issuer, err)
+		}
+		log.Printf("✅ External token validated: issuer=%s, tenant=%s, user=%s, exp=%d",
+			issuer, tokenInfo.TenantID, tokenInfo.Username, tokenInfo.Expiration)
+		return tokenInfo, nil
+	}
+
+	// Extract tenant_id - this is our custom claim added by the pre-token Lambda
+	tenant, _ := claims["tenant_id"].(string)
+	if tenant == "" {
+		return nil, fmt.Errorf("missing tenant_id claim")
+	}
+
+	// Extract username (Cognito uses the "username" claim in access tokens)
+	username, _ := claims["username"].(string)
+
+	// Extract the expiration (standard claim "exp")
+	exp, _ := claims["exp"].(float64)
+	expiration := int64(exp)
+
+	// Admin callers may act on behalf of other tenants (X-Act-As-Tenant)
+	scope, _ := claims["scope"].(string)
+
+	log.Printf("✅ Token validated: tenant=%s, user=%s, exp=%d",
+		tenant, username, expiration)
+
+	return &TokenInfo{
+		TenantID:   tenant,
+		Username:   username,
+		Expiration: expiration,
+		Scope:      scope,
+		Admin:      HasAdminScope(scope),
+	}, nil
+}
@@ -0,0 +1,261 @@
+package tokenauth_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth"
+	"github.com/stefando/uploadDemoAWS/lambda/authorizer/tokenauth/tokenauthtest"
+)
+
+const testRegion = "eu-central-1"
+
+// cognitoValidator trusts the region's user pools, with keys served by the issuer
+func cognitoValidator(issuer *tokenauthtest.Issuer) (*tokenauth.Validator, string) {
+	validator := &tokenauth.Validator{Keys: issuer.Fetcher(), CognitoRegion: testRegion}
+	return validator, tokenauthtest.CognitoIssuerURL(testRegion, "eu-central-1_TestPool")
+}
+
+func TestValidateCognitoToken(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+	validator, poolURL := cognitoValidator(issuer)
+
+	expiration := time.Now().Add(30 * time.Minute).Unix()
+	claims := tokenauthtest.CognitoClaims(poolURL, "tenant-a", "tom", "aws.cognito.signin.user.admin upload-api/admin")
+	claims["exp"] = expiration
+
+	info, err := validator.Validate(context.Background(), issuer.Mint(claims))
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	want := tokenauth.TokenInfo{
+		TenantID:   "tenant-a",
+		Username:   "tom",
+		Expiration: expiration,
+		Scope:      "aws.cognito.signin.user.admin upload-api/admin",
+		Admin:      true,
+	}
+	if *info != want {
+		t.Fatalf("TokenInfo = %+v, want %+v", *info, want)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+	validator, poolURL := cognitoValidator(issuer)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := func(overrides map[string]any) map[string]any {
+		c := tokenauthtest.CognitoClaims(poolURL, "tenant-a", "tom", "aws.cognito.signin.user.admin")
+		for name, value := range overrides {
+			c[name] = value
+		}
+		return c
+	}
+	withoutTenant := claims(nil)
+	delete(withoutTenant, "tenant_id")
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{
+			name:  "wrong signing key",
+			token: issuer.MintWithKey(claims(nil), otherKey, issuer.KeyID),
+			want:  "failed to verify signature",
+		},
+		{
+			name:  "expired",
+			token: issuer.Mint(claims(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})),
+			want:  "token is expired",
+		},
+		{
+			name:  "unknown issuer",
+			token: issuer.Mint(claims(map[string]any{"iss": "https://idp.example.com"})),
+			want:  "untrusted issuer",
+		},
+		{
+			name:  "user pool of another region",
+			token: issuer.Mint(claims(map[string]any{"iss": tokenauthtest.CognitoIssuerURL("us-east-1", "us-east-1_TestPool")})),
+			want:  "untrusted issuer",
+		},
+		{
+			name:  "missing tenant",
+			token: issuer.Mint(withoutTenant),
+			want:  "missing tenant_id claim",
+		},
+		{
+			name:  "malformed",
+			token: "not-a-jwt",
+			want:  "failed to extract issuer",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := validator.Validate(context.Background(), tt.token)
+			if err == nil {
+				t.Fatalf("Validate accepted the token: %+v", info)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Validate error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateExpiryUsesClock(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+	validator, poolURL := cognitoValidator(issuer)
+
+	token := issuer.Mint(tokenauthtest.CognitoClaims(poolURL, "tenant-a", "tom", ""))
+	validator.Now = func() time.Time { return time.Now().Add(2 * tokenauthtest.DefaultTokenLifetime) }
+	if _, err := validator.Validate(context.Background(), token); err == nil || !strings.Contains(err.Error(), "token is expired") {
+		t.Fatalf("Validate error = %v for a token past its expiry, want it expired", err)
+	}
+}
+
+// externalValidator trusts the in-process issuer as an external IdP, discovering its keys
+// over OIDC like the authorizer does
+func externalValidator(external *tokenauth.ExternalIssuer) *tokenauth.Validator {
+	return tokenauth.NewValidator(testRegion, map[string]*tokenauth.ExternalIssuer{external.Issuer: external})
+}
+
+func TestValidateExternalIssuer(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+
+	validator := externalValidator(&tokenauth.ExternalIssuer{
+		Issuer:       issuer.URL,
+		Audience:     "upload-api",
+		GroupsClaim:  "groups",
+		GroupTenants: map[string]string{"acme-users": "acme", "acme-admins": "acme"},
+		GroupScopes:  map[string][]string{"acme-admins": {"admin"}},
+	})
+
+	expiration := time.Now().Add(time.Hour).Unix()
+	token := issuer.Mint(map[string]any{
+		"sub":                "00u1a2b3c4",
+		"preferred_username": "jane@acme.example",
+		"aud":                "upload-api",
+		"exp":                expiration,
+		"groups":             []string{"acme-users", "acme-admins", "unrelated"},
+		"scope":              "everything", // the IdP's own scopes are never taken over
+	})
+	info, err := validator.Validate(context.Background(), token)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	want := tokenauth.TokenInfo{
+		TenantID:   "acme",
+		Username:   "jane@acme.example",
+		Expiration: expiration,
+		Scope:      "admin",
+		Admin:      true,
+	}
+	if *info != want {
+		t.Fatalf("TokenInfo = %+v, want %+v", *info, want)
+	}
+}
+
+func TestValidateExternalIssuerRejects(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+
+	validator := externalValidator(&tokenauth.ExternalIssuer{
+		Issuer:       issuer.URL,
+		Audience:     "upload-api",
+		GroupsClaim:  "groups",
+		GroupTenants: map[string]string{"acme-users": "acme", "globex-users": "globex"},
+	})
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   string
+	}{
+		{
+			name:   "wrong audience",
+			claims: map[string]any{"sub": "jane", "aud": "other-client", "groups": []string{"acme-users"}},
+			want:   "expected audience",
+		},
+		{
+			name:   "no audience",
+			claims: map[string]any{"sub": "jane", "groups": []string{"acme-users"}},
+			want:   "expected audience",
+		},
+		{
+			name:   "no mapped group",
+			claims: map[string]any{"sub": "jane", "aud": "upload-api", "groups": []string{"unrelated"}},
+			want:   "no group maps to a tenant",
+		},
+		{
+			name:   "groups of several tenants",
+			claims: map[string]any{"sub": "jane", "aud": "upload-api", "groups": "acme-users,globex-users"},
+			want:   "several tenants",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := validator.Validate(context.Background(), issuer.Mint(tt.claims))
+			if err == nil {
+				t.Fatalf("Validate accepted the token: %+v", info)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Validate error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractIssuer(t *testing.T) {
+	issuer := tokenauthtest.NewIssuer()
+	defer issuer.Close()
+
+	got, err := tokenauth.ExtractIssuer(issuer.Mint(map[string]any{"sub": "tom"}))
+	if err != nil || got != issuer.URL {
+		t.Fatalf("ExtractIssuer = %q, %v; want %q", got, err, issuer.URL)
+	}
+	for _, token := range []string{"", "a.b", "a.!!!.c", "a.bm90IGpzb24.c", "a.e30.c"} {
+		if got, err := tokenauth.ExtractIssuer(token); err == nil {
+			t.Errorf("ExtractIssuer(%q) = %q, want an error", token, got)
+		}
+	}
+}
+
+func FuzzExtractIssuer(f *testing.F) {
+	f.Add("https://cognito-idp.eu-central-1.amazonaws.com/eu-central-1_TestPool", "")
+	f.Add("", "e30.e30.")
+	f.Add("https://idp.example.com", "a.eyJpc3MiOjF9.c")
+	f.Add("x", "a..b.c")
+
+	f.Fuzz(func(t *testing.T, issuer, raw string) {
+		// Arbitrary tokens never panic and never yield an empty issuer
+		if got, err := tokenauth.ExtractIssuer(raw); err == nil && got == "" {
+			t.Fatalf("ExtractIssuer(%q) returned an empty issuer", raw)
+		}
+
+		// A token carrying the issuer yields it back, whatever the header and signature
+		if issuer == "" || !utf8.ValidString(issuer) {
+			return
+		}
+		payload, _ := json.Marshal(map[string]string{"iss": issuer})
+		token := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+		if got, err := tokenauth.ExtractIssuer(token); err != nil || got != issuer {
+			t.Fatalf("ExtractIssuer = %q, %v; want %q", got, err, issuer)
+		}
+	})
+}
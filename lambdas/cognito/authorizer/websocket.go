@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// webSocketConnectRoute is the only WebSocket route API Gateway runs authorizers on
+const webSocketConnectRoute = "$connect"
+
+// WebSocketConnectAuthorizerRequest is the REQUEST authorizer event of a WebSocket API's
+// $connect route. It carries the handshake's headers and query string like a REST event,
+// but its request context is the WebSocket one, with the route key and connection ID
+// instead of the HTTP method and path.
+type WebSocketConnectAuthorizerRequest struct {
+	Type                            string                                        `json:"type"`
+	MethodArn                       string                                        `json:"methodArn"`
+	Headers                         map[string]string                             `json:"headers"`
+	MultiValueHeaders               map[string][]string                           `json:"multiValueHeaders"`
+	QueryStringParameters           map[string]string                             `json:"queryStringParameters"`
+	MultiValueQueryStringParameters map[string][]string                           `json:"multiValueQueryStringParameters"`
+	StageVariables                  map[string]string                             `json:"stageVariables"`
+	RequestContext                  events.APIGatewayWebsocketProxyRequestContext `json:"requestContext"`
+}
+
+// isWebSocketConnect reports whether an authorizer event comes from a WebSocket $connect
+func isWebSocketConnect(routeKey, eventType string) bool {
+	return routeKey == webSocketConnectRoute || eventType == "CONNECT"
+}
+
+// handleWebSocketConnect authorizes a WebSocket connection. The handshake is validated
+// exactly like a REST request, as a GET of the "$connect" route, so tokens, API tokens,
+// certificate bindings and IP allow-lists apply unchanged and the connection gets the same
+// authorizer context. Browsers cannot set headers on the handshake, so WebSocket
+// deployments read the token from a query parameter (IDENTITY_SOURCE=query).
+func handleWebSocketConnect(ctx context.Context, event WebSocketConnectAuthorizerRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	log.Printf("🔌 WEBSOCKET CONNECT: connection=%s api=%s stage=%s",
+		event.RequestContext.ConnectionID, event.RequestContext.APIID, event.RequestContext.Stage)
+
+	return handler(ctx, events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		Type:                            event.Type,
+		MethodArn:                       event.MethodArn,
+		Resource:                        webSocketConnectRoute,
+		Path:                            webSocketConnectRoute,
+		HTTPMethod:                      http.MethodGet,
+		Headers:                         event.Headers,
+		MultiValueHeaders:               event.MultiValueHeaders,
+		QueryStringParameters:           event.QueryStringParameters,
+		MultiValueQueryStringParameters: event.MultiValueQueryStringParameters,
+		StageVariables:                  event.StageVariables,
+		RequestContext: events.APIGatewayCustomAuthorizerRequestTypeRequestContext{
+			Path:         webSocketConnectRoute,
+			ResourcePath: webSocketConnectRoute,
+			AccountID:    event.RequestContext.AccountID,
+			APIID:        event.RequestContext.APIID,
+			Stage:        event.RequestContext.Stage,
+			RequestID:    event.RequestContext.RequestID,
+			HTTPMethod:   http.MethodGet,
+			Identity: events.APIGatewayCustomAuthorizerRequestTypeRequestIdentity{
+				SourceIP: event.RequestContext.Identity.SourceIP,
+			},
+		},
+	})
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -12,23 +15,36 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// ActiveTenantMetadataKey is the client metadata key the login Lambda uses to request an
+// active tenant other than the user's home tenant
+const ActiveTenantMetadataKey = "tenant_id"
+
 var (
-	dynamoClient *dynamodb.Client
-	tableName    string
+	dynamoClient    *dynamodb.Client
+	tableName       string
+	membershipTable string // Optional; users have only their home tenant when unset
+	clientOnce      sync.Once
 )
 
+// Init only validates the environment; the DynamoDB client is created lazily so that
+// no credentials are resolved before the first invocation (SnapStart-safe).
 func init() {
-	// Initialize the DynamoDB client
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-	
-	dynamoClient = dynamodb.NewFromConfig(cfg)
 	tableName = os.Getenv("TABLE_NAME")
 	if tableName == "" {
 		log.Fatal("TABLE_NAME environment variable not set")
 	}
+	membershipTable = os.Getenv("MEMBERSHIP_TABLE")
+}
+
+// initDynamoClient loads the AWS configuration and creates the DynamoDB client on first use
+func initDynamoClient(ctx context.Context) {
+	clientOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		dynamoClient = dynamodb.NewFromConfig(cfg)
+	})
 }
 
 // HandleRequest processes the Cognito Pre Token Generation V2_0 event
@@ -36,6 +52,7 @@ func HandleRequest(ctx context.Context, event events.CognitoEventUserPoolsPreTok
 	log.Printf("Received event for user: %s in pool: %s", event.UserName, event.UserPoolID)
 
 	// Look up the tenant ID from DynamoDB using the pool ID
+	initDynamoClient(ctx)
 	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: &tableName,
 		Key: map[string]types.AttributeValue{
@@ -66,25 +83,76 @@ func HandleRequest(ctx context.Context, event events.CognitoEventUserPoolsPreTok
 		return event, nil
 	}
 	
-	tenantID := tenantIDValue.Value
-	log.Printf("Found tenant ID: %s for pool: %s", tenantID, event.UserPoolID)
+	homeTenantID := tenantIDValue.Value
+	log.Printf("Found tenant ID: %s for pool: %s", homeTenantID, event.UserPoolID)
+
+	// Resolve the user's tenant memberships and the active tenant they asked for
+	tenantIDs, err := lookupMemberships(ctx, event.UserPoolID, event.UserName, homeTenantID)
+	if err != nil {
+		log.Printf("Failed to look up memberships for user %s: %v", event.UserName, err)
+		tenantIDs = []string{homeTenantID}
+	}
+	tenantID := homeTenantID
+	if requested := event.Request.ClientMetadata[ActiveTenantMetadataKey]; requested != "" {
+		if !slices.Contains(tenantIDs, requested) {
+			// Fail the sign-in rather than silently issuing tokens for another tenant
+			log.Printf("User %s requested tenant %s without membership", event.UserName, requested)
+			return event, fmt.Errorf("user is not a member of tenant %s", requested)
+		}
+		tenantID = requested
+	}
 
 	// Add the tenant_id claim to ID tokens
 	if event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride == nil {
 		event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride = make(map[string]interface{})
 	}
 	event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride["tenant_id"] = tenantID
+	event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride["tenant_ids"] = tenantIDs
 
 	// Add tenant_id to the access tokens (KEY for API Gateway authorization!)
 	if event.Response.ClaimsAndScopeOverrideDetails.AccessTokenGeneration.ClaimsToAddOrOverride == nil {
 		event.Response.ClaimsAndScopeOverrideDetails.AccessTokenGeneration.ClaimsToAddOrOverride = make(map[string]interface{})
 	}
 	event.Response.ClaimsAndScopeOverrideDetails.AccessTokenGeneration.ClaimsToAddOrOverride["tenant_id"] = tenantID
+	event.Response.ClaimsAndScopeOverrideDetails.AccessTokenGeneration.ClaimsToAddOrOverride["tenant_ids"] = tenantIDs
 
-	log.Printf("Added tenant_id claim %s to both ID and access tokens for user %s", tenantID, event.UserName)
+	log.Printf("Added tenant_id claim %s (member of %v) to both ID and access tokens for user %s", tenantID, tenantIDs, event.UserName)
 	return event, nil
 }
 
+// lookupMemberships returns the tenants a user may act in: the pool's home tenant first,
+// followed by any additional tenants from the membership table, sorted
+func lookupMemberships(ctx context.Context, poolID, username, homeTenantID string) ([]string, error) {
+	tenantIDs := []string{homeTenantID}
+	if membershipTable == "" {
+		return tenantIDs, nil
+	}
+
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &membershipTable,
+		Key: map[string]types.AttributeValue{
+			"pool_id":  &types.AttributeValueMemberS{Value: poolID},
+			"username": &types.AttributeValueMemberS{Value: username},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members, ok := result.Item["tenant_ids"].(*types.AttributeValueMemberSS)
+	if !ok {
+		return tenantIDs, nil
+	}
+	extra := slices.Clone(members.Value)
+	slices.Sort(extra)
+	for _, id := range extra {
+		if id != "" && id != homeTenantID {
+			tenantIDs = append(tenantIDs, id)
+		}
+	}
+	return tenantIDs, nil
+}
+
 func main() {
 	lambda.Start(HandleRequest)
 }
@@ -0,0 +1,261 @@
+// Package lock provides lease-based mutual exclusion for the scheduled workers, backed by a
+// DynamoDB table keyed by lock_id.
+//
+// A lock is held for a lease that a heartbeat keeps renewing while the holder runs. A holder
+// that crashes or is frozen stops renewing, so the lock frees itself once the lease expires.
+// Every acquisition increments the lock's fencing token. Because a holder can lose its lease
+// without noticing right away (a long GC pause, a network partition), writes to shared
+// resources should carry the token and be refused when a higher one has been seen.
+//
+// Lock items are never deleted, so fencing tokens keep increasing across acquisitions.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultLease is how long a lock stays held without a heartbeat
+const DefaultLease = time.Minute
+
+// ErrNotAcquired is returned by Acquire when another owner holds an unexpired lease
+var ErrNotAcquired = errors.New("lock is held by another owner")
+
+// ErrLost is the cause of a lock's context once its lease could not be renewed
+var ErrLost = errors.New("lock lease lost")
+
+// DynamoDBAPI is the part of the DynamoDB API the locker uses
+type DynamoDBAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// Locker acquires locks in one table. A nil *Locker hands out locks that exclude nothing,
+// for running without a lock table.
+type Locker struct {
+	client DynamoDBAPI
+	table  string
+	lease  time.Duration
+}
+
+// NewLocker creates a locker for the table; it returns nil when table is empty. lease
+// defaults to DefaultLease.
+func NewLocker(client DynamoDBAPI, table string, lease time.Duration) *Locker {
+	if table == "" {
+		return nil
+	}
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	return &Locker{client: client, table: table, lease: lease}
+}
+
+// Lock is a held lock. Its context is canceled when the lease is lost or the lock released.
+type Lock struct {
+	Name  string
+	Token int64 // Fencing token, higher than that of every earlier holder
+
+	locker  *Locker
+	owner   string
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// Acquire takes the named lock if it is free or its lease has expired, and starts renewing
+// it every third of the lease. It returns ErrNotAcquired while someone else holds it.
+func (l *Locker) Acquire(ctx context.Context, name string) (*Lock, error) {
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	if l == nil {
+		return &Lock{Name: name, ctx: lockCtx, cancel: cancel}, nil
+	}
+
+	owner, err := newOwner()
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	now := time.Now()
+	output, err := l.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(l.table),
+		Key:                 lockKey(name),
+		UpdateExpression:    aws.String("SET #owner = :owner, lease_expires = :expires ADD fencing_token :one"),
+		ConditionExpression: aws.String("attribute_not_exists(lock_id) OR lease_expires < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner":   &types.AttributeValueMemberS{Value: owner},
+			":expires": millis(now.Add(l.lease)),
+			":now":     millis(now),
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		cancel(nil)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil, fmt.Errorf("%w: %s", ErrNotAcquired, name)
+		}
+		return nil, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+
+	token, err := fencingToken(output.Attributes)
+	if err != nil {
+		cancel(nil)
+		return nil, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+
+	lock := &Lock{
+		Name:   name,
+		Token:  token,
+		locker: l,
+		owner:  owner,
+		ctx:    lockCtx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+	}
+	lock.stopped.Add(1)
+	go lock.heartbeat(now.Add(l.lease))
+	return lock, nil
+}
+
+// Context returns the context work under the lock should run with; it is canceled with
+// cause ErrLost when the lease could not be renewed
+func (k *Lock) Context() context.Context {
+	return k.ctx
+}
+
+// Release stops the heartbeat and frees the lock, unless a newer holder already took it
+func (k *Lock) Release(ctx context.Context) error {
+	defer k.cancel(nil)
+	if k.locker == nil {
+		return nil
+	}
+	close(k.stop)
+	k.stopped.Wait()
+
+	_, err := k.locker.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(k.locker.table),
+		Key:                 lockKey(k.Name),
+		UpdateExpression:    aws.String("SET lease_expires = :zero REMOVE #owner"),
+		ConditionExpression: aws.String("#owner = :owner AND fencing_token = :token"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+			":owner": &types.AttributeValueMemberS{Value: k.owner},
+			":token": &types.AttributeValueMemberN{Value: strconv.FormatInt(k.Token, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// The lease expired and someone else holds the lock now; nothing to free
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", k.Name, err)
+	}
+	return nil
+}
+
+// heartbeat renews the lease until the lock is released. A renewal refused because another
+// owner took over, or renewals failing until the lease runs out, cancel the lock's context.
+func (k *Lock) heartbeat(expires time.Time) {
+	defer k.stopped.Done()
+	ticker := time.NewTicker(k.locker.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-k.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := k.renew()
+		var conditionFailed *types.ConditionalCheckFailedException
+		switch {
+		case err == nil:
+			expires = renewed
+		case errors.As(err, &conditionFailed):
+			log.Printf("Lock %s was taken over by another owner", k.Name)
+			k.cancel(ErrLost)
+			return
+		case time.Now().After(expires):
+			log.Printf("Lock %s expired while renewals failed: %v", k.Name, err)
+			k.cancel(ErrLost)
+			return
+		default:
+			log.Printf("Failed to renew lock %s, retrying: %v", k.Name, err)
+		}
+	}
+}
+
+// renew extends the lease if the lock is still this holder's
+func (k *Lock) renew() (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), k.locker.lease/3)
+	defer cancel()
+
+	expires := time.Now().Add(k.locker.lease)
+	_, err := k.locker.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(k.locker.table),
+		Key:                 lockKey(k.Name),
+		UpdateExpression:    aws.String("SET lease_expires = :expires"),
+		ConditionExpression: aws.String("#owner = :owner AND fencing_token = :token"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires": millis(expires),
+			":owner":   &types.AttributeValueMemberS{Value: k.owner},
+			":token":   &types.AttributeValueMemberN{Value: strconv.FormatInt(k.Token, 10)},
+		},
+	})
+	return expires, err
+}
+
+// lockKey returns the table key of a lock
+func lockKey(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"lock_id": &types.AttributeValueMemberS{Value: name},
+	}
+}
+
+// millis encodes a time as Unix milliseconds
+func millis(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+// fencingToken reads the token from the attributes returned by the acquiring update
+func fencingToken(attributes map[string]types.AttributeValue) (int64, error) {
+	value, ok := attributes["fencing_token"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("no fencing token returned")
+	}
+	return strconv.ParseInt(value.Value, 10, 64)
+}
+
+// newOwner returns a random owner ID, unique per acquisition
+func newOwner() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lock owner: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
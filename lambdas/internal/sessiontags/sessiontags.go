@@ -0,0 +1,86 @@
+// Package sessiontags builds the session tags and SourceIdentity of the tenant access role
+// sessions. Every Lambda that assumes the role on a user's behalf must tag the session the same
+// way: the role's policies scope access by tenant_id, and CloudTrail and S3 access logs
+// attribute object writes by username, scope and SourceIdentity.
+package sessiontags
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// Session is the identity a tenant session is created for
+type Session struct {
+	TenantID      string
+	Username      string // Cognito username; set as the username tag and SourceIdentity when present
+	Scope         string // Token scopes; set as the scope tag when present
+	AdminOverride bool   // Admin acting on behalf of TenantID (admin_override=true tag)
+}
+
+// Apply sets the session's tags and SourceIdentity on an AssumeRole request
+func Apply(input *sts.AssumeRoleInput, session Session) {
+	input.Tags = append(input.Tags, types.Tag{
+		Key:   aws.String("tenant_id"),
+		Value: aws.String(session.TenantID),
+	})
+	if session.Username != "" {
+		input.Tags = append(input.Tags, types.Tag{
+			Key:   aws.String("username"),
+			Value: aws.String(SanitizeValue(session.Username)),
+		})
+		if sourceIdentity := SourceIdentity(session.Username); sourceIdentity != "" {
+			input.SourceIdentity = aws.String(sourceIdentity)
+		}
+	}
+	if session.Scope != "" {
+		input.Tags = append(input.Tags, types.Tag{
+			Key:   aws.String("scope"),
+			Value: aws.String(SanitizeValue(session.Scope)),
+		})
+	}
+	if session.AdminOverride {
+		input.Tags = append(input.Tags, types.Tag{
+			Key:   aws.String("admin_override"),
+			Value: aws.String("true"),
+		})
+	}
+}
+
+// SanitizeValue replaces characters STS rejects in session tag values and truncates to the
+// 256 character limit
+func SanitizeValue(value string) string {
+	runes := []rune(value)
+	if len(runes) > 256 {
+		runes = runes[:256]
+	}
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.Is(unicode.Z, r) && !strings.ContainsRune("_.:/=+-@", r) {
+			runes[i] = '_'
+		}
+	}
+	return string(runes)
+}
+
+// SourceIdentity maps a username onto the SourceIdentity alphabet ([\w+=,.@-], 2-64 chars),
+// returning "" when nothing usable remains
+func SourceIdentity(username string) string {
+	var b strings.Builder
+	for _, r := range username {
+		if b.Len() == 64 {
+			break
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_+=,.@-", r)) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() < 2 {
+		return ""
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package sessiontags
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+func tagMap(input *sts.AssumeRoleInput) map[string]string {
+	tags := make(map[string]string, len(input.Tags))
+	for _, tag := range input.Tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags
+}
+
+func TestApply(t *testing.T) {
+	input := &sts.AssumeRoleInput{}
+	Apply(input, Session{
+		TenantID:      "tenant-a",
+		Username:      "tom#1",
+		Scope:         "aws.cognito.signin.user.admin upload/write",
+		AdminOverride: true,
+	})
+
+	want := map[string]string{
+		"tenant_id":      "tenant-a",
+		"username":       "tom_1",
+		"scope":          "aws.cognito.signin.user.admin upload/write",
+		"admin_override": "true",
+	}
+	got := tagMap(input)
+	if len(got) != len(want) {
+		t.Fatalf("tags = %v, want %v", got, want)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("tag %s = %q, want %q", key, got[key], value)
+		}
+	}
+	if aws.ToString(input.SourceIdentity) != "tom_1" {
+		t.Errorf("SourceIdentity = %q, want %q", aws.ToString(input.SourceIdentity), "tom_1")
+	}
+}
+
+func TestApplyTenantOnly(t *testing.T) {
+	input := &sts.AssumeRoleInput{}
+	Apply(input, Session{TenantID: "tenant-a"})
+
+	if got := tagMap(input); len(got) != 1 || got["tenant_id"] != "tenant-a" {
+		t.Fatalf("tags = %v, want only tenant_id", got)
+	}
+	if input.SourceIdentity != nil {
+		t.Fatalf("SourceIdentity = %q, want none", aws.ToString(input.SourceIdentity))
+	}
+}
+
+func TestSanitizeValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"tom@example.com", "tom@example.com"},
+		{"jürgen", "jürgen"},
+		{"a,b;c", "a_b_c"},
+		{strings.Repeat("x", 300), strings.Repeat("x", 256)},
+	}
+	for _, tt := range tests {
+		if got := SanitizeValue(tt.value); got != tt.want {
+			t.Errorf("SanitizeValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSourceIdentity(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"tom", "tom"},
+		{"jürgen", "j_rgen"},
+		{"x", ""},
+		{strings.Repeat("y", 80), strings.Repeat("y", 64)},
+	}
+	for _, tt := range tests {
+		if got := SourceIdentity(tt.username); got != tt.want {
+			t.Errorf("SourceIdentity(%q) = %q, want %q", tt.username, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package wsnotify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// ErrGone is returned when API Gateway no longer knows a connection (GoneException)
+var ErrGone = errors.New("connection is gone")
+
+// managementService is the SigV4 signing name of the API Gateway Management API
+const managementService = "execute-api"
+
+// Notifier pushes events to subscribed connections through the API Gateway Management API.
+// Requests are signed directly, as the Management API is a plain POST of the message to
+// <endpoint>/@connections/<connection ID>.
+type Notifier struct {
+	registry    *Registry
+	endpoint    string
+	region      string
+	credentials aws.CredentialsProvider
+	httpClient  *http.Client
+	signer      *v4.Signer
+}
+
+// NewNotifier creates a notifier for the WebSocket API stage at endpoint, e.g.
+// "https://abc123.execute-api.eu-west-1.amazonaws.com/prod". It returns nil when registry
+// is nil or endpoint is empty; a nil *Notifier drops events.
+func NewNotifier(registry *Registry, cfg aws.Config, endpoint string, httpClient *http.Client) *Notifier {
+	if registry == nil || endpoint == "" {
+		return nil
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	return &Notifier{
+		registry:    registry,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      cfg.Region,
+		credentials: cfg.Credentials,
+		httpClient:  httpClient,
+		signer:      v4.NewSigner(),
+	}
+}
+
+// Notify sends the JSON encoding of event to every connection subscribed to the upload and
+// returns how many received it. Connections reported gone are unsubscribed; other delivery
+// failures are returned joined, after every subscriber was tried.
+func (n *Notifier) Notify(ctx context.Context, tenantID, uploadID string, event any) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode event: %w", err)
+	}
+	connections, err := n.registry.Subscribers(ctx, tenantID, uploadID)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var errs []error
+	for _, connectionID := range connections {
+		err := n.Post(ctx, connectionID, payload)
+		switch {
+		case err == nil:
+			delivered++
+		case errors.Is(err, ErrGone):
+			log.Printf("WebSocket connection %s is gone, removing its subscriptions", connectionID)
+			if err := n.registry.Disconnect(ctx, connectionID); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			errs = append(errs, err)
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// Post sends one message to a connection; it returns ErrGone when the connection is closed
+func (n *Notifier) Post(ctx context.Context, connectionID string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		n.endpoint+"/@connections/"+url.PathEscape(connectionID), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to build message for connection %s: %w", connectionID, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	creds, err := n.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve credentials: %w", err)
+	}
+	hash := sha256.Sum256(payload)
+	if err := n.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), managementService, n.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign message for connection %s: %w", connectionID, err)
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to connection %s: %w", connectionID, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return fmt.Errorf("%w: %s", ErrGone, connectionID)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("failed to post to connection %s: %s: %s", connectionID, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
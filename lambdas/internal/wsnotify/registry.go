@@ -0,0 +1,197 @@
+// Package wsnotify tracks the WebSocket connections subscribed to upload progress and pushes
+// events to them through the API Gateway Management API.
+//
+// Subscriptions live in a DynamoDB table keyed by connection_id and topic, where a topic is
+// "<tenant>/<upload ID>" or "<tenant>/*" for all of a tenant's uploads. The topic-index
+// secondary index (partition key topic, projecting expires_at) finds a topic's subscribers.
+// Items expire through DynamoDB TTL on expires_at, which bounds what a connection that
+// vanished without a $disconnect leaves behind; the notifier also removes connections API
+// Gateway reports as gone.
+package wsnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultTTL is how long a subscription lasts without being renewed. API Gateway closes
+// WebSocket connections after two hours, so no subscription needs to outlive that.
+const DefaultTTL = 2 * time.Hour
+
+// AllUploads subscribes to every upload of a tenant
+const AllUploads = "*"
+
+// TopicIndex is the table index listing a topic's subscribers
+const TopicIndex = "topic-index"
+
+// ErrInvalidSubscription is returned for subscriptions without a connection, tenant or upload
+var ErrInvalidSubscription = errors.New("subscription needs a connection ID, tenant and upload ID")
+
+// DynamoDBAPI is the part of the DynamoDB API the registry uses
+type DynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// Registry records which connections are subscribed to which uploads. A nil *Registry has
+// no subscribers, for running without a connection table.
+type Registry struct {
+	client DynamoDBAPI
+	table  string
+	ttl    time.Duration
+}
+
+// NewRegistry creates a registry for the table; it returns nil when table is empty. ttl
+// defaults to DefaultTTL.
+func NewRegistry(client DynamoDBAPI, table string, ttl time.Duration) *Registry {
+	if table == "" {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Registry{client: client, table: table, ttl: ttl}
+}
+
+// Topic names the events of one upload, or of all a tenant's uploads with AllUploads
+func Topic(tenantID, uploadID string) string {
+	return tenantID + "/" + uploadID
+}
+
+// Subscribe subscribes a connection to an upload's events, or renews the subscription.
+// The tenant must come from the connection's authorizer context, never from the client.
+func (r *Registry) Subscribe(ctx context.Context, connectionID, tenantID, uploadID string) error {
+	if connectionID == "" || tenantID == "" || uploadID == "" {
+		return ErrInvalidSubscription
+	}
+	if r == nil {
+		return nil
+	}
+	now := time.Now()
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.table),
+		Item: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+			"topic":         &types.AttributeValueMemberS{Value: Topic(tenantID, uploadID)},
+			"tenant_id":     &types.AttributeValueMemberS{Value: tenantID},
+			"upload_id":     &types.AttributeValueMemberS{Value: uploadID},
+			"subscribed_at": unix(now),
+			"expires_at":    unix(now.Add(r.ttl)),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe connection %s to %s: %w", connectionID, Topic(tenantID, uploadID), err)
+	}
+	return nil
+}
+
+// Unsubscribe removes one subscription of a connection
+func (r *Registry) Unsubscribe(ctx context.Context, connectionID, tenantID, uploadID string) error {
+	if r == nil {
+		return nil
+	}
+	return r.delete(ctx, connectionID, Topic(tenantID, uploadID))
+}
+
+// Disconnect removes all subscriptions of a connection, on $disconnect or once API Gateway
+// reports the connection gone
+func (r *Registry) Disconnect(ctx context.Context, connectionID string) error {
+	if r == nil {
+		return nil
+	}
+	paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+		TableName:              aws.String(r.table),
+		KeyConditionExpression: aws.String("connection_id = :connection"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":connection": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		ProjectionExpression: aws.String("topic"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list subscriptions of connection %s: %w", connectionID, err)
+		}
+		for _, item := range page.Items {
+			topic, ok := item["topic"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			if err := r.delete(ctx, connectionID, topic.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Subscribers returns the connections subscribed to the upload, directly or through the
+// tenant's AllUploads topic, each once. Subscriptions past their expiry that TTL has not
+// removed yet are skipped.
+func (r *Registry) Subscribers(ctx context.Context, tenantID, uploadID string) ([]string, error) {
+	if r == nil {
+		return nil, nil
+	}
+	topics := []string{Topic(tenantID, uploadID)}
+	if uploadID != AllUploads {
+		topics = append(topics, Topic(tenantID, AllUploads))
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	seen := make(map[string]bool)
+	var connections []string
+	for _, topic := range topics {
+		paginator := dynamodb.NewQueryPaginator(r.client, &dynamodb.QueryInput{
+			TableName:              aws.String(r.table),
+			IndexName:              aws.String(TopicIndex),
+			KeyConditionExpression: aws.String("topic = :topic"),
+			FilterExpression:       aws.String("expires_at > :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":topic": &types.AttributeValueMemberS{Value: topic},
+				":now":   &types.AttributeValueMemberN{Value: now},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list subscribers of %s: %w", topic, err)
+			}
+			for _, item := range page.Items {
+				connection, ok := item["connection_id"].(*types.AttributeValueMemberS)
+				if ok && !seen[connection.Value] {
+					seen[connection.Value] = true
+					connections = append(connections, connection.Value)
+				}
+			}
+		}
+	}
+	return connections, nil
+}
+
+// delete removes one subscription item
+func (r *Registry) delete(ctx context.Context, connectionID, topic string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.table),
+		Key: map[string]types.AttributeValue{
+			"connection_id": &types.AttributeValueMemberS{Value: connectionID},
+			"topic":         &types.AttributeValueMemberS{Value: topic},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unsubscribe connection %s from %s: %w", connectionID, topic, err)
+	}
+	return nil
+}
+
+// unix encodes a time as Unix seconds, the unit DynamoDB TTL expects
+func unix(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
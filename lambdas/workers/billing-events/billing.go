@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Operations of billing events
+const (
+	OperationUpload = "upload" // Object stored under the tenant prefix
+	OperationDelete = "delete" // Object removed from the tenant prefix (soft deletes move it to the trash)
+	OperationTrash  = "trash"  // Soft-deleted copy stored in the tenant's trash
+	OperationPurge  = "purge"  // Trashed copy removed, by the lifecycle rule or a restore
+)
+
+const (
+	// Folders under a tenant prefix, named like in the upload API
+	trashPrefix         = ".trash"
+	presignedUrlsPrefix = ".presigned-urls"
+
+	// defaultStorageClass is the class S3 leaves unnamed in object metadata
+	defaultStorageClass = "STANDARD"
+
+	// S3 detail types of the EventBridge events the worker is subscribed to
+	detailTypeCreated = "Object Created"
+	detailTypeDeleted = "Object Deleted"
+)
+
+// BillingEvent is one metered change of a tenant's stored bytes, written to the stream as
+// JSON. Delivery is at least once, so consumers deduplicate by EventID.
+type BillingEvent struct {
+	EventID      string `json:"event_id"` // EventBridge event ID, unchanged when the event is redelivered
+	TenantID     string `json:"tenant_id"`
+	Operation    string `json:"operation"`
+	Bytes        int64  `json:"bytes"`                   // Object size; S3 reports none for deletes and purges
+	StorageClass string `json:"storage_class,omitempty"` // Set for uploads and trash copies
+	ObjectKey    string `json:"object_key"`
+	VersionID    string `json:"version_id,omitempty"`
+	Sequencer    string `json:"sequencer"` // S3 sequencer; orders the events of one key
+	Reason       string `json:"reason"`    // S3 action, e.g. CompleteMultipartUpload or Lifecycle Expiration
+	OccurredAt   string `json:"occurred_at"`
+}
+
+// s3EventDetail is the part of an S3 EventBridge event's detail the worker reads
+type s3EventDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int64  `json:"size"`
+		VersionID string `json:"version-id"`
+		Sequencer string `json:"sequencer"`
+	} `json:"object"`
+	Reason string `json:"reason"`
+}
+
+// BillingPublisher turns S3 object events into billing events on a Kinesis stream
+type BillingPublisher struct {
+	kinesisClient *kinesis.Client
+	s3Client      *s3.Client
+	streamName    string
+}
+
+// NewBillingPublisher creates a publisher writing to the named stream
+func NewBillingPublisher(cfg aws.Config, streamName string) *BillingPublisher {
+	return &BillingPublisher{
+		kinesisClient: kinesis.NewFromConfig(cfg),
+		s3Client:      s3.NewFromConfig(cfg),
+		streamName:    streamName,
+	}
+}
+
+// Publish writes the billing event for an S3 event, or skips events that meter nothing.
+// Errors are returned so the invocation fails and Lambda retries it; the event ID keeps
+// redeliveries recognizable.
+func (p *BillingPublisher) Publish(ctx context.Context, event events.CloudWatchEvent) error {
+	billing, err := p.billingEvent(ctx, event)
+	if err != nil || billing == nil {
+		return err
+	}
+
+	data, err := json.Marshal(billing)
+	if err != nil {
+		return fmt.Errorf("failed to encode billing event %s: %w", billing.EventID, err)
+	}
+	// The tenant as partition key keeps each tenant's events in order on one shard
+	output, err := p.kinesisClient.PutRecord(ctx, &kinesis.PutRecordInput{
+		StreamName:   aws.String(p.streamName),
+		PartitionKey: aws.String(billing.TenantID),
+		Data:         data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish billing event %s: %w", billing.EventID, err)
+	}
+
+	log.Printf("Billing event %s: tenant=%s operation=%s bytes=%d key=%s shard=%s sequence=%s",
+		billing.EventID, billing.TenantID, billing.Operation, billing.Bytes, billing.ObjectKey,
+		aws.ToString(output.ShardId), aws.ToString(output.SequenceNumber))
+	return nil
+}
+
+// billingEvent maps an S3 event to its billing event; it returns nil for objects that are
+// not tenant data
+func (p *BillingPublisher) billingEvent(ctx context.Context, event events.CloudWatchEvent) (*BillingEvent, error) {
+	var detail s3EventDetail
+	if err := json.Unmarshal(event.Detail, &detail); err != nil {
+		return nil, fmt.Errorf("invalid S3 event %s: %w", event.ID, err)
+	}
+	// Keys arrive URL-encoded, with spaces as "+"
+	key, err := url.QueryUnescape(detail.Object.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object key in S3 event %s: %w", event.ID, err)
+	}
+
+	tenantID, rest, ok := strings.Cut(key, "/")
+	if !ok || tenantID == "" || strings.HasPrefix(rest, presignedUrlsPrefix+"/") {
+		return nil, nil
+	}
+	trashed := strings.HasPrefix(rest, trashPrefix+"/")
+
+	billing := &BillingEvent{
+		EventID:    event.ID,
+		TenantID:   tenantID,
+		ObjectKey:  key,
+		VersionID:  detail.Object.VersionID,
+		Sequencer:  detail.Object.Sequencer,
+		Reason:     detail.Reason,
+		OccurredAt: event.Time.UTC().Format(time.RFC3339),
+	}
+	switch event.DetailType {
+	case detailTypeCreated:
+		billing.Operation = OperationUpload
+		if trashed {
+			billing.Operation = OperationTrash
+		}
+		billing.Bytes = detail.Object.Size
+		if billing.StorageClass, err = p.storageClass(ctx, detail.Bucket.Name, key, detail.Object.VersionID); err != nil {
+			return nil, err
+		}
+	case detailTypeDeleted:
+		billing.Operation = OperationDelete
+		if trashed {
+			billing.Operation = OperationPurge
+		}
+	default:
+		log.Printf("Ignoring S3 event %s of type %q", event.ID, event.DetailType)
+		return nil, nil
+	}
+	return billing, nil
+}
+
+// storageClass reads the object's storage class. An object already deleted again is
+// reported in the default class, which is the only one this stack writes.
+func (p *BillingPublisher) storageClass(ctx context.Context, bucket, key, versionID string) (string, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	output, err := p.s3Client.HeadObject(ctx, input)
+	var notFound *s3types.NotFound
+	if errors.As(err, &notFound) {
+		return defaultStorageClass, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read storage class of %s: %w", key, err)
+	}
+	if output.StorageClass == "" {
+		return defaultStorageClass, nil
+	}
+	return string(output.StorageClass), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+var (
+	publisher     *BillingPublisher
+	streamName    string
+	publisherOnce sync.Once
+)
+
+// Init only validates the environment; AWS clients are created lazily on the first invocation
+func init() {
+	streamName = os.Getenv("BILLING_STREAM_NAME")
+	if streamName == "" {
+		log.Fatal("BILLING_STREAM_NAME environment variable not set")
+	}
+}
+
+// initPublisher loads the AWS configuration and creates the publisher on first use
+func initPublisher(ctx context.Context) {
+	publisherOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		publisher = NewBillingPublisher(cfg, streamName)
+	})
+}
+
+// HandleRequest publishes the billing event of one S3 object event from EventBridge
+func HandleRequest(ctx context.Context, event events.CloudWatchEvent) error {
+	initPublisher(ctx)
+	return publisher.Publish(ctx, event)
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/lock"
+)
+
+const (
+	// DefaultRetryGrace is how old a pending record must be before the worker touches it,
+	// so completions still running in the upload Lambda (30s timeout) are left alone
+	DefaultRetryGrace = 2 * time.Minute
+
+	// DefaultMaxAttempts is how many times the worker retries a completion before giving up
+	DefaultMaxAttempts = 10
+
+	// lockName is the worker lock runs hold, so overlapping runs never retry the same records
+	lockName = "completion-retry"
+)
+
+var (
+	retrier     *CompletionRetrier
+	locker      *lock.Locker
+	tableName   string
+	lockTable   string
+	bucketName  string
+	roleArn     string
+	grace       = DefaultRetryGrace
+	maxAttempts = DefaultMaxAttempts
+	retrierOnce sync.Once
+)
+
+// Init only validates the environment; AWS clients are created lazily on the first invocation
+func init() {
+	tableName = os.Getenv("COMPLETION_PENDING_TABLE")
+	if tableName == "" {
+		log.Fatal("COMPLETION_PENDING_TABLE environment variable not set")
+	}
+	bucketName = os.Getenv("SHARED_BUCKET")
+	if bucketName == "" {
+		log.Fatal("SHARED_BUCKET environment variable not set")
+	}
+	roleArn = os.Getenv("TENANT_ACCESS_ROLE_ARN")
+	if roleArn == "" {
+		log.Fatal("TENANT_ACCESS_ROLE_ARN environment variable not set")
+	}
+
+	// Without a lock table, overlapping runs are not excluded
+	lockTable = os.Getenv("WORKER_LOCK_TABLE")
+
+	if value := os.Getenv("COMPLETION_RETRY_GRACE"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("COMPLETION_RETRY_GRACE must be a positive duration: %q", value)
+		}
+		grace = parsed
+	}
+	if value := os.Getenv("COMPLETION_MAX_ATTEMPTS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("COMPLETION_MAX_ATTEMPTS must be a positive integer: %q", value)
+		}
+		maxAttempts = parsed
+	}
+}
+
+// initRetrier loads the AWS configuration and creates the retrier on first use
+func initRetrier(ctx context.Context) {
+	retrierOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		retrier = NewCompletionRetrier(cfg, tableName, bucketName, roleArn, grace, maxAttempts)
+		locker = lock.NewLocker(dynamodb.NewFromConfig(cfg), lockTable, lock.DefaultLease)
+	})
+}
+
+// HandleRequest processes the scheduled event by retrying all due pending completions
+func HandleRequest(ctx context.Context, event events.CloudWatchEvent) error {
+	initRetrier(ctx)
+
+	held, err := locker.Acquire(ctx, lockName)
+	if errors.Is(err, lock.ErrNotAcquired) {
+		log.Printf("Another completion retry run holds the lock, skipping")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := held.Release(context.Background()); err != nil {
+			log.Printf("Failed to release worker lock: %v", err)
+		}
+	}()
+
+	summary, err := retrier.RetryPending(held.Context(), held.Token)
+	if err != nil {
+		return err
+	}
+	log.Printf("Completion retry run: scanned=%d completed=%d dropped=%d rescheduled=%d",
+		summary.Scanned, summary.Completed, summary.Dropped, summary.Rescheduled)
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
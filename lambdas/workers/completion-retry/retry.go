@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/sessiontags"
+)
+
+// sessionDuration is the lifetime of the tenant credentials used for one retry
+const sessionDuration = 900 // seconds (STS minimum)
+
+// PartTag mirrors the part list stored by the upload Lambda
+type PartTag struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"eTag"`
+}
+
+// PendingCompletion is a completion the upload Lambda could not confirm
+type PendingCompletion struct {
+	UploadID      string
+	TenantID      string
+	ObjectKey     string
+	Bucket        string // Bucket or access point the upload was created in; empty in older records
+	Username      string
+	Scope         string
+	AdminOverride bool
+	Parts         []PartTag
+	Attempts      int
+	CreatedAt     time.Time
+}
+
+// RetrySummary counts the outcomes of one worker run
+type RetrySummary struct {
+	Scanned     int
+	Completed   int
+	Dropped     int
+	Rescheduled int
+}
+
+// CompletionRetrier finishes multipart uploads whose completion was cut short.
+// It assumes the tenant access role per record, so a retry can only ever touch the
+// tenant prefix the record belongs to, exactly like the original request.
+type CompletionRetrier struct {
+	dynamoClient *dynamodb.Client
+	stsClient    *sts.Client
+	awsConfig    aws.Config
+	tableName    string
+	bucketName   string
+	roleArn      string
+	grace        time.Duration
+	maxAttempts  int
+}
+
+// NewCompletionRetrier creates a retrier for the given table and bucket
+func NewCompletionRetrier(cfg aws.Config, tableName, bucketName, roleArn string, grace time.Duration, maxAttempts int) *CompletionRetrier {
+	return &CompletionRetrier{
+		dynamoClient: dynamodb.NewFromConfig(cfg),
+		stsClient:    sts.NewFromConfig(cfg),
+		awsConfig:    cfg,
+		tableName:    tableName,
+		bucketName:   bucketName,
+		roleArn:      roleArn,
+		grace:        grace,
+		maxAttempts:  maxAttempts,
+	}
+}
+
+// RetryPending scans the table and retries every record older than the grace period.
+// The table only holds completions in trouble, so a scan stays small. token is the fencing
+// token of the worker lock the run holds (0 without a lock): record updates carry it and are
+// refused once a later run has written a record, so a run that lost its lock cannot undo
+// that run's work.
+func (r *CompletionRetrier) RetryPending(ctx context.Context, token int64) (*RetrySummary, error) {
+	summary := &RetrySummary{}
+	cutoff := time.Now().Add(-r.grace)
+
+	paginator := dynamodb.NewScanPaginator(r.dynamoClient, &dynamodb.ScanInput{
+		TableName: aws.String(r.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return summary, fmt.Errorf("failed to scan pending completions: %w", err)
+		}
+
+		for _, item := range page.Items {
+			summary.Scanned++
+			pending, err := parsePendingCompletion(item)
+			if err != nil {
+				log.Printf("Dropping unreadable pending completion: %v", err)
+				r.delete(ctx, stringAttribute(item, "upload_id"), token)
+				summary.Dropped++
+				continue
+			}
+			if pending.CreatedAt.After(cutoff) {
+				continue
+			}
+
+			switch r.retry(ctx, pending, token) {
+			case outcomeCompleted:
+				summary.Completed++
+			case outcomeDropped:
+				summary.Dropped++
+			case outcomeRescheduled:
+				summary.Rescheduled++
+			}
+		}
+	}
+	return summary, nil
+}
+
+type retryOutcome int
+
+const (
+	outcomeCompleted retryOutcome = iota
+	outcomeDropped
+	outcomeRescheduled
+)
+
+// retry attempts one completion and updates or removes its record accordingly
+func (r *CompletionRetrier) retry(ctx context.Context, pending *PendingCompletion, token int64) retryOutcome {
+	attempt := pending.Attempts + 1
+	err := r.complete(ctx, pending)
+
+	switch {
+	case err == nil:
+		log.Printf("Completed upload %s for tenant %s (key %s) on retry attempt %d",
+			pending.UploadID, pending.TenantID, pending.ObjectKey, attempt)
+		r.delete(ctx, pending.UploadID, token)
+		return outcomeCompleted
+
+	case isNoSuchUpload(err):
+		// Either the original completion went through after all, or the upload was aborted
+		if r.objectExists(ctx, pending) {
+			log.Printf("Upload %s for tenant %s was already completed", pending.UploadID, pending.TenantID)
+			r.delete(ctx, pending.UploadID, token)
+			return outcomeCompleted
+		}
+		log.Printf("Upload %s for tenant %s no longer exists, dropping", pending.UploadID, pending.TenantID)
+		r.delete(ctx, pending.UploadID, token)
+		return outcomeDropped
+
+	case !isRetryable(err):
+		log.Printf("Giving up on upload %s for tenant %s: %v", pending.UploadID, pending.TenantID, err)
+		r.delete(ctx, pending.UploadID, token)
+		return outcomeDropped
+
+	case attempt >= r.maxAttempts:
+		log.Printf("Giving up on upload %s for tenant %s after %d attempts: %v",
+			pending.UploadID, pending.TenantID, attempt, err)
+		r.delete(ctx, pending.UploadID, token)
+		return outcomeDropped
+	}
+
+	log.Printf("Retry %d of upload %s for tenant %s failed, will retry: %v",
+		attempt, pending.UploadID, pending.TenantID, err)
+	update := &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]dynamotypes.AttributeValue{
+			"upload_id": &dynamotypes.AttributeValueMemberS{Value: pending.UploadID},
+		},
+		UpdateExpression: aws.String("SET attempts = :attempts"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":attempts": &dynamotypes.AttributeValueMemberN{Value: strconv.Itoa(attempt)},
+		},
+	}
+	if token > 0 {
+		update.UpdateExpression = aws.String("SET attempts = :attempts, fencing_token = :token")
+		update.ConditionExpression = aws.String(fencedCondition)
+		update.ExpressionAttributeValues[":token"] = fencingTokenValue(token)
+	}
+	_, updateErr := r.dynamoClient.UpdateItem(ctx, update)
+	if updateErr != nil {
+		log.Printf("Failed to record retry attempt for upload %s: %v", pending.UploadID, updateErr)
+	}
+	return outcomeRescheduled
+}
+
+// complete calls CompleteMultipartUpload with tenant-scoped credentials
+func (r *CompletionRetrier) complete(ctx context.Context, pending *PendingCompletion) error {
+	client, err := r.tenantS3Client(ctx, pending)
+	if err != nil {
+		return err
+	}
+
+	parts := make([]s3types.CompletedPart, 0, len(pending.Parts))
+	for _, part := range pending.Parts {
+		parts = append(parts, s3types.CompletedPart{
+			PartNumber: aws.Int32(int32(part.PartNumber)),
+			ETag:       aws.String(part.ETag),
+		})
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(r.bucketFor(pending)),
+		Key:             aws.String(pending.ObjectKey),
+		UploadId:        aws.String(pending.UploadID),
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// objectExists checks whether the upload's object is already in place
+func (r *CompletionRetrier) objectExists(ctx context.Context, pending *PendingCompletion) bool {
+	client, err := r.tenantS3Client(ctx, pending)
+	if err != nil {
+		return false
+	}
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucketFor(pending)),
+		Key:    aws.String(pending.ObjectKey),
+	})
+	return err == nil
+}
+
+// bucketFor returns where the record's upload lives. The upload Lambda records it, since
+// sandbox tenants and tenants behind an access point do not use the shared bucket; records
+// written before it did were all in the shared bucket.
+func (r *CompletionRetrier) bucketFor(pending *PendingCompletion) string {
+	if pending.Bucket != "" {
+		return pending.Bucket
+	}
+	return r.bucketName
+}
+
+// tenantS3Client assumes the tenant access role for the record's tenant and user
+func (r *CompletionRetrier) tenantS3Client(ctx context.Context, pending *PendingCompletion) (*s3.Client, error) {
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(r.roleArn),
+		RoleSessionName: aws.String(fmt.Sprintf("tenant-%s-completion-retry-%d", pending.TenantID, time.Now().Unix())),
+		DurationSeconds: aws.Int32(sessionDuration),
+	}
+	// Tag the session like the upload Lambda tagged the one that started the completion
+	sessiontags.Apply(input, sessiontags.Session{
+		TenantID:      pending.TenantID,
+		Username:      pending.Username,
+		Scope:         pending.Scope,
+		AdminOverride: pending.AdminOverride,
+	})
+
+	out, err := r.stsClient.AssumeRole(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assume role for tenant %s: %w", pending.TenantID, err)
+	}
+
+	creds := aws.Credentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Source:          "AssumeRoleProvider",
+		CanExpire:       true,
+		Expires:         aws.ToTime(out.Credentials.Expiration),
+	}
+	return s3.NewFromConfig(r.awsConfig, func(o *s3.Options) {
+		o.Credentials = aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return creds, nil
+		}))
+	}), nil
+}
+
+// delete removes a pending record, logging failures (the next run will see it again)
+func (r *CompletionRetrier) delete(ctx context.Context, uploadID string, token int64) {
+	if uploadID == "" {
+		return
+	}
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]dynamotypes.AttributeValue{
+			"upload_id": &dynamotypes.AttributeValueMemberS{Value: uploadID},
+		},
+	}
+	if token > 0 {
+		input.ConditionExpression = aws.String(fencedCondition)
+		input.ExpressionAttributeValues = map[string]dynamotypes.AttributeValue{":token": fencingTokenValue(token)}
+	}
+	_, err := r.dynamoClient.DeleteItem(ctx, input)
+	if err != nil {
+		log.Printf("Failed to delete pending completion %s: %v", uploadID, err)
+	}
+}
+
+// fencedCondition admits a record write only if no run with a higher fencing token has
+// written the record
+const fencedCondition = "attribute_not_exists(fencing_token) OR fencing_token <= :token"
+
+// fencingTokenValue encodes a fencing token as a DynamoDB number
+func fencingTokenValue(token int64) dynamotypes.AttributeValue {
+	return &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(token, 10)}
+}
+
+// isNoSuchUpload reports whether S3 no longer knows the multipart upload
+func isNoSuchUpload(err error) bool {
+	var noSuchUpload *s3types.NoSuchUpload
+	return errors.As(err, &noSuchUpload)
+}
+
+// isRetryable reports whether a failure is transient (throttling, server errors, timeouts)
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// parsePendingCompletion converts a table item into a PendingCompletion
+func parsePendingCompletion(item map[string]dynamotypes.AttributeValue) (*PendingCompletion, error) {
+	pending := &PendingCompletion{
+		UploadID:  stringAttribute(item, "upload_id"),
+		TenantID:  stringAttribute(item, "tenant_id"),
+		ObjectKey: stringAttribute(item, "object_key"),
+		Bucket:    stringAttribute(item, "bucket"),
+		Username:  stringAttribute(item, "username"),
+		Scope:     stringAttribute(item, "scope"),
+	}
+	if value, ok := item["admin_override"].(*dynamotypes.AttributeValueMemberBOOL); ok {
+		pending.AdminOverride = value.Value
+	}
+	if pending.UploadID == "" || pending.TenantID == "" || pending.ObjectKey == "" {
+		return nil, fmt.Errorf("record %q is missing upload, tenant or key", pending.UploadID)
+	}
+	if err := json.Unmarshal([]byte(stringAttribute(item, "parts")), &pending.Parts); err != nil {
+		return nil, fmt.Errorf("record %s has invalid parts: %w", pending.UploadID, err)
+	}
+
+	attempts, _ := strconv.Atoi(numberAttribute(item, "attempts"))
+	pending.Attempts = attempts
+	createdAt, _ := strconv.ParseInt(numberAttribute(item, "created_at"), 10, 64)
+	pending.CreatedAt = time.Unix(createdAt, 0)
+	return pending, nil
+}
+
+// stringAttribute reads a string attribute from a DynamoDB item, returning "" when absent
+func stringAttribute(item map[string]dynamotypes.AttributeValue, name string) string {
+	if attr, ok := item[name].(*dynamotypes.AttributeValueMemberS); ok {
+		return attr.Value
+	}
+	return ""
+}
+
+// numberAttribute reads a number attribute from a DynamoDB item, returning "" when absent
+func numberAttribute(item map[string]dynamotypes.AttributeValue, name string) string {
+	if attr, ok := item[name].(*dynamotypes.AttributeValueMemberN); ok {
+		return attr.Value
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The package's init requires the deployment environment. Package-level variables are
+// initialized before any init function runs, so this sets it up in time.
+var _ = setTestEnvironment()
+
+func setTestEnvironment() bool {
+	for name, value := range map[string]string{
+		"COMPLETION_PENDING_TABLE": "test-completion-pending",
+		"SHARED_BUCKET":            "test-shared-bucket",
+		"TENANT_ACCESS_ROLE_ARN":   "arn:aws:iam::123456789012:role/test-tenant-access",
+	} {
+		if os.Getenv(name) == "" {
+			os.Setenv(name, value)
+		}
+	}
+	return true
+}
+
+func pendingItem(bucket string) map[string]dynamotypes.AttributeValue {
+	item := map[string]dynamotypes.AttributeValue{
+		"upload_id":  &dynamotypes.AttributeValueMemberS{Value: "upload-1"},
+		"tenant_id":  &dynamotypes.AttributeValueMemberS{Value: "tenant-a"},
+		"object_key": &dynamotypes.AttributeValueMemberS{Value: "tenant-a/2026/10/18/file.bin"},
+		"parts":      &dynamotypes.AttributeValueMemberS{Value: `[{"partNumber":1,"eTag":"\"abc\""}]`},
+		"attempts":   &dynamotypes.AttributeValueMemberN{Value: "2"},
+		"created_at": &dynamotypes.AttributeValueMemberN{Value: "1760745600"},
+	}
+	if bucket != "" {
+		item["bucket"] = &dynamotypes.AttributeValueMemberS{Value: bucket}
+	}
+	return item
+}
+
+func TestRetryUsesRecordedBucket(t *testing.T) {
+	retrier := &CompletionRetrier{bucketName: "shared-bucket"}
+	tests := []struct {
+		name     string
+		recorded string
+		want     string
+	}{
+		{"sandbox bucket", "sandbox-bucket", "sandbox-bucket"},
+		{"access point", "arn:aws:s3:eu-central-1:123456789012:accesspoint/tenant-a", "arn:aws:s3:eu-central-1:123456789012:accesspoint/tenant-a"},
+		{"record without bucket", "", "shared-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending, err := parsePendingCompletion(pendingItem(tt.recorded))
+			if err != nil {
+				t.Fatalf("parsePendingCompletion: %v", err)
+			}
+			if got := retrier.bucketFor(pending); got != tt.want {
+				t.Fatalf("bucketFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePendingCompletionIdentity(t *testing.T) {
+	item := pendingItem("")
+	item["username"] = &dynamotypes.AttributeValueMemberS{Value: "tom"}
+	item["scope"] = &dynamotypes.AttributeValueMemberS{Value: "aws.cognito.signin.user.admin"}
+	item["admin_override"] = &dynamotypes.AttributeValueMemberBOOL{Value: true}
+
+	pending, err := parsePendingCompletion(item)
+	if err != nil {
+		t.Fatalf("parsePendingCompletion: %v", err)
+	}
+	if pending.Username != "tom" || pending.Scope != "aws.cognito.signin.user.admin" || !pending.AdminOverride {
+		t.Fatalf("identity = %q/%q/%v, want tom/aws.cognito.signin.user.admin/true", pending.Username, pending.Scope, pending.AdminOverride)
+	}
+	if len(pending.Parts) != 1 || pending.Parts[0].PartNumber != 1 || pending.Parts[0].ETag != `"abc"` {
+		t.Fatalf("parts = %+v", pending.Parts)
+	}
+}
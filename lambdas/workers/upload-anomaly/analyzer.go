@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// MetricNamespace holds the daily per-tenant upload metrics, so CloudWatch alarms can be
+// built on them in addition to the analyzer's own alerts
+const MetricNamespace = "UploadDemo/Uploads"
+
+// Thresholds decide when a day counts as anomalous against the baseline average
+type Thresholds struct {
+	SpikeFactor      float64 `json:"spike_factor"`       // Alert when the day exceeds this multiple of the baseline
+	DropFactor       float64 `json:"drop_factor"`        // Alert when the day falls below this fraction of the baseline
+	MinBaselineCount float64 `json:"min_baseline_count"` // Skip tenants averaging fewer uploads per day (too little signal)
+}
+
+// DefaultThresholds apply to tenants without an override
+var DefaultThresholds = Thresholds{SpikeFactor: 3, DropFactor: 0.2, MinBaselineCount: 10}
+
+// ThresholdConfig holds the default thresholds and per-tenant overrides
+type ThresholdConfig struct {
+	Default Thresholds
+	Tenants map[string]Thresholds
+}
+
+// LoadThresholdConfig reads TENANT_ANOMALY_THRESHOLDS, a JSON object mapping tenants (or
+// "*" for the default) to thresholds, e.g. {"*": {"spike_factor": 4}, "acme": {"drop_factor": 0.5}}.
+// Fields left out keep the default's value.
+func LoadThresholdConfig() (*ThresholdConfig, error) {
+	cfg := &ThresholdConfig{Default: DefaultThresholds, Tenants: map[string]Thresholds{}}
+	raw := strings.TrimSpace(os.Getenv("TENANT_ANOMALY_THRESHOLDS"))
+	if raw == "" {
+		return cfg, nil
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("TENANT_ANOMALY_THRESHOLDS is not a valid JSON object: %w", err)
+	}
+	if entry, ok := entries["*"]; ok {
+		if err := json.Unmarshal(entry, &cfg.Default); err != nil {
+			return nil, fmt.Errorf("TENANT_ANOMALY_THRESHOLDS default: %w", err)
+		}
+	}
+	for tenant, entry := range entries {
+		if tenant == "*" {
+			continue
+		}
+		thresholds := cfg.Default
+		if err := json.Unmarshal(entry, &thresholds); err != nil {
+			return nil, fmt.Errorf("TENANT_ANOMALY_THRESHOLDS tenant %s: %w", tenant, err)
+		}
+		cfg.Tenants[tenant] = thresholds
+	}
+
+	for tenant, thresholds := range cfg.Tenants {
+		if err := thresholds.validate(); err != nil {
+			return nil, fmt.Errorf("TENANT_ANOMALY_THRESHOLDS tenant %s: %w", tenant, err)
+		}
+	}
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("TENANT_ANOMALY_THRESHOLDS default: %w", err)
+	}
+	return cfg, nil
+}
+
+func (t Thresholds) validate() error {
+	if t.SpikeFactor <= 1 || t.DropFactor < 0 || t.DropFactor >= 1 || t.MinBaselineCount < 0 {
+		return fmt.Errorf("need spike_factor > 1, 0 <= drop_factor < 1 and min_baseline_count >= 0")
+	}
+	return nil
+}
+
+// For returns the thresholds of a tenant
+func (c *ThresholdConfig) For(tenantID string) Thresholds {
+	if thresholds, ok := c.Tenants[tenantID]; ok {
+		return thresholds
+	}
+	return c.Default
+}
+
+// DailyVolume is what a tenant uploaded on one UTC day
+type DailyVolume struct {
+	Count int64
+	Bytes int64
+}
+
+// AnalysisSummary counts the outcomes of one analyzer run
+type AnalysisSummary struct {
+	Tenants int
+	Spikes  int
+	Drops   int
+	Skipped int // Tenants below their minimum baseline
+}
+
+// AnomalyAnalyzer compares each tenant's daily upload volume against the trailing
+// baseline. Uploads are stored under <tenant>/YYYY/MM/DD/, so a day's volume is the
+// listing of one prefix and no separate counters are needed.
+type AnomalyAnalyzer struct {
+	s3Client     *s3.Client
+	cwClient     *cloudwatch.Client
+	snsClient    *sns.Client
+	bucketName   string
+	topicArn     string
+	baselineDays int
+	thresholds   *ThresholdConfig
+}
+
+// NewAnomalyAnalyzer creates an analyzer for the given bucket; topicArn may be empty
+func NewAnomalyAnalyzer(cfg aws.Config, bucketName, topicArn string, baselineDays int, thresholds *ThresholdConfig) *AnomalyAnalyzer {
+	return &AnomalyAnalyzer{
+		s3Client:     s3.NewFromConfig(cfg),
+		cwClient:     cloudwatch.NewFromConfig(cfg),
+		snsClient:    sns.NewFromConfig(cfg),
+		bucketName:   bucketName,
+		topicArn:     topicArn,
+		baselineDays: baselineDays,
+		thresholds:   thresholds,
+	}
+}
+
+// Analyze checks every tenant's volume on day against the baselineDays before it,
+// publishes the day's metrics, and alerts on spikes and drops. A failing tenant is
+// logged and skipped so one bad prefix cannot hide anomalies of the others.
+func (a *AnomalyAnalyzer) Analyze(ctx context.Context, day time.Time) (*AnalysisSummary, error) {
+	tenants, err := a.listTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &AnalysisSummary{Tenants: len(tenants)}
+	for _, tenantID := range tenants {
+		if err := a.analyzeTenant(ctx, tenantID, day, summary); err != nil {
+			log.Printf("Failed to analyze tenant %s: %v", tenantID, err)
+		}
+	}
+	return summary, nil
+}
+
+func (a *AnomalyAnalyzer) analyzeTenant(ctx context.Context, tenantID string, day time.Time, summary *AnalysisSummary) error {
+	current, err := a.dailyVolume(ctx, tenantID, day)
+	if err != nil {
+		return err
+	}
+	if err := a.putMetrics(ctx, tenantID, day, current); err != nil {
+		log.Printf("Failed to publish metrics for tenant %s: %v", tenantID, err)
+	}
+
+	var total DailyVolume
+	for i := 1; i <= a.baselineDays; i++ {
+		volume, err := a.dailyVolume(ctx, tenantID, day.AddDate(0, 0, -i))
+		if err != nil {
+			return err
+		}
+		total.Count += volume.Count
+		total.Bytes += volume.Bytes
+	}
+	baselineCount := float64(total.Count) / float64(a.baselineDays)
+	baselineBytes := float64(total.Bytes) / float64(a.baselineDays)
+
+	thresholds := a.thresholds.For(tenantID)
+	if baselineCount < thresholds.MinBaselineCount || baselineCount == 0 {
+		summary.Skipped++
+		return nil
+	}
+
+	var kind string
+	switch {
+	case float64(current.Count) > thresholds.SpikeFactor*baselineCount,
+		float64(current.Bytes) > thresholds.SpikeFactor*baselineBytes:
+		kind = "spike"
+		summary.Spikes++
+	case float64(current.Count) < thresholds.DropFactor*baselineCount:
+		kind = "drop"
+		summary.Drops++
+	default:
+		return nil
+	}
+
+	message := fmt.Sprintf("Upload %s for tenant %s on %s: %d uploads / %d bytes against a %d-day baseline of %.1f uploads / %.0f bytes per day",
+		kind, tenantID, day.Format("2006-01-02"), current.Count, current.Bytes, a.baselineDays, baselineCount, baselineBytes)
+	log.Printf("ANOMALY %s", message)
+	return a.alert(ctx, tenantID, kind, message)
+}
+
+// listTenants returns the top-level prefixes of the bucket, one per tenant
+func (a *AnomalyAnalyzer) listTenants(ctx context.Context) ([]string, error) {
+	var tenants []string
+	paginator := s3.NewListObjectsV2Paginator(a.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(a.bucketName),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tenants: %w", err)
+		}
+		for _, prefix := range page.CommonPrefixes {
+			tenants = append(tenants, strings.TrimSuffix(aws.ToString(prefix.Prefix), "/"))
+		}
+	}
+	return tenants, nil
+}
+
+// dailyVolume sums the objects under a tenant's date prefix
+func (a *AnomalyAnalyzer) dailyVolume(ctx context.Context, tenantID string, day time.Time) (DailyVolume, error) {
+	var volume DailyVolume
+	prefix := fmt.Sprintf("%s/%d/%02d/%02d/", tenantID, day.Year(), day.Month(), day.Day())
+	paginator := s3.NewListObjectsV2Paginator(a.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return volume, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			volume.Count++
+			volume.Bytes += aws.ToInt64(object.Size)
+		}
+	}
+	return volume, nil
+}
+
+// putMetrics publishes the day's volume as per-tenant metrics timestamped at the day
+func (a *AnomalyAnalyzer) putMetrics(ctx context.Context, tenantID string, day time.Time, volume DailyVolume) error {
+	dimensions := []cwtypes.Dimension{{Name: aws.String("TenantId"), Value: aws.String(tenantID)}}
+	timestamp := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	_, err := a.cwClient.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(MetricNamespace),
+		MetricData: []cwtypes.MetricDatum{
+			{
+				MetricName: aws.String("DailyUploadCount"),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(timestamp),
+				Value:      aws.Float64(float64(volume.Count)),
+				Unit:       cwtypes.StandardUnitCount,
+			},
+			{
+				MetricName: aws.String("DailyUploadBytes"),
+				Dimensions: dimensions,
+				Timestamp:  aws.Time(timestamp),
+				Value:      aws.Float64(float64(volume.Bytes)),
+				Unit:       cwtypes.StandardUnitBytes,
+			},
+		},
+	})
+	return err
+}
+
+// alert publishes an anomaly to the SNS topic, if one is configured
+func (a *AnomalyAnalyzer) alert(ctx context.Context, tenantID, kind, message string) error {
+	if a.topicArn == "" {
+		return nil
+	}
+	_, err := a.snsClient.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(a.topicArn),
+		Subject:  aws.String(fmt.Sprintf("Upload %s: tenant %s", kind, tenantID)),
+		Message:  aws.String(message),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"tenant_id": {DataType: aws.String("String"), StringValue: aws.String(tenantID)},
+			"kind":      {DataType: aws.String("String"), StringValue: aws.String(kind)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s alert: %w", kind, err)
+	}
+	return nil
+}
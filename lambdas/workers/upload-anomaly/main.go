@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stefando/uploadDemoAWS/lambda/internal/lock"
+)
+
+const (
+	// DefaultBaselineDays is how many days before the analyzed day form the baseline
+	DefaultBaselineDays = 7
+
+	// MaxBaselineDays bounds the listing work of one run
+	MaxBaselineDays = 28
+
+	// lockName is the worker lock runs hold, so a retried schedule never reports a day twice
+	// at the same time
+	lockName = "upload-anomaly"
+)
+
+var (
+	analyzer     *AnomalyAnalyzer
+	locker       *lock.Locker
+	bucketName   string
+	lockTable    string
+	topicArn     string
+	baselineDays = DefaultBaselineDays
+	thresholds   *ThresholdConfig
+	analyzerOnce sync.Once
+)
+
+// Init only validates the environment; AWS clients are created lazily on the first invocation
+func init() {
+	bucketName = os.Getenv("SHARED_BUCKET")
+	if bucketName == "" {
+		log.Fatal("SHARED_BUCKET environment variable not set")
+	}
+
+	// Without a topic, anomalies are only logged and visible through the metrics
+	topicArn = os.Getenv("ANOMALY_TOPIC_ARN")
+
+	// Without a lock table, overlapping runs are not excluded
+	lockTable = os.Getenv("WORKER_LOCK_TABLE")
+
+	if value := os.Getenv("ANOMALY_BASELINE_DAYS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > MaxBaselineDays {
+			log.Fatalf("ANOMALY_BASELINE_DAYS must be between 1 and %d: %q", MaxBaselineDays, value)
+		}
+		baselineDays = parsed
+	}
+
+	var err error
+	if thresholds, err = LoadThresholdConfig(); err != nil {
+		log.Fatalf("Invalid anomaly thresholds: %v", err)
+	}
+}
+
+// initAnalyzer loads the AWS configuration and creates the analyzer on first use
+func initAnalyzer(ctx context.Context) {
+	analyzerOnce.Do(func() {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		analyzer = NewAnomalyAnalyzer(cfg, bucketName, topicArn, baselineDays, thresholds)
+		locker = lock.NewLocker(dynamodb.NewFromConfig(cfg), lockTable, lock.DefaultLease)
+	})
+}
+
+// HandleRequest processes the scheduled event by analyzing the previous UTC day
+func HandleRequest(ctx context.Context, event events.CloudWatchEvent) error {
+	initAnalyzer(ctx)
+
+	held, err := locker.Acquire(ctx, lockName)
+	if errors.Is(err, lock.ErrNotAcquired) {
+		log.Printf("Another upload anomaly run holds the lock, skipping")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := held.Release(context.Background()); err != nil {
+			log.Printf("Failed to release worker lock: %v", err)
+		}
+	}()
+
+	day := event.Time.UTC().AddDate(0, 0, -1)
+	summary, err := analyzer.Analyze(held.Context(), day)
+	if err != nil {
+		return err
+	}
+	log.Printf("Upload anomaly run for %s: tenants=%d spikes=%d drops=%d skipped=%d",
+		day.Format("2006-01-02"), summary.Tenants, summary.Spikes, summary.Drops, summary.Skipped)
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleRequest)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// Outcomes of a check
+const (
+	OutcomeDenied       = "denied"
+	OutcomeAllowed      = "allowed"
+	OutcomeInconclusive = "inconclusive" // Neither clearly allowed nor denied, e.g. a 5xx
+	OutcomeSkipped      = "skipped"      // The deployment does not offer what the check needs
+)
+
+// Result is the outcome of one check
+type Result struct {
+	Name        string
+	ExpectAllow bool // Controls expect access; isolation checks expect a denial
+	Outcome     string
+	Detail      string
+}
+
+// Passed reports whether the check came out as expected. Inconclusive outcomes fail, so
+// a broken deployment cannot pass the gate.
+func (r Result) Passed() bool {
+	switch r.Outcome {
+	case OutcomeSkipped:
+		return true
+	case OutcomeAllowed:
+		return r.ExpectAllow
+	case OutcomeDenied:
+		return !r.ExpectAllow
+	}
+	return false
+}
+
+// Fixtures are the objects and uploads the checks are aimed at
+type Fixtures struct {
+	TenantA, TenantB   string
+	ObjectA, ObjectB   string            // Simple uploads of each tenant
+	UploadA, UploadB   *initiateResponse // Multipart uploads of each tenant
+	CredentialsA       *delegatedCredentials
+	CredentialsSkipped string // Why A has no delegated credentials
+}
+
+// Suite runs the checks as tenant A against tenant B's fixtures
+type Suite struct {
+	A        *APIClient
+	Fixtures *Fixtures
+	Results  []Result
+}
+
+// judgeResponse classifies an API response: 2xx is access, 401/403/404 a denial (foreign
+// uploads and objects may also be reported as not found)
+func judgeResponse(resp *Response, err error) (string, string) {
+	if err != nil {
+		return OutcomeInconclusive, err.Error()
+	}
+	detail := fmt.Sprintf("status %d", resp.Status)
+	if body := strings.TrimSpace(string(resp.Body)); body != "" {
+		detail += ": " + truncate(body, 120)
+	}
+	switch {
+	case resp.Status >= 200 && resp.Status <= 299:
+		return OutcomeAllowed, detail
+	case resp.Status == http.StatusUnauthorized || resp.Status == http.StatusForbidden || resp.Status == http.StatusNotFound:
+		return OutcomeDenied, detail
+	}
+	return OutcomeInconclusive, detail
+}
+
+// judgeS3 classifies the error of a direct S3 call
+func judgeS3(err error) (string, string) {
+	if err == nil {
+		return OutcomeAllowed, "request succeeded"
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "AccessDenied" || apiErr.ErrorCode() == "Forbidden") {
+		return OutcomeDenied, apiErr.ErrorCode()
+	}
+	return OutcomeInconclusive, truncate(err.Error(), 160)
+}
+
+// record adds a result
+func (s *Suite) record(name string, expectAllow bool, outcome, detail string) {
+	s.Results = append(s.Results, Result{Name: name, ExpectAllow: expectAllow, Outcome: outcome, Detail: detail})
+}
+
+// api runs an API call as tenant A and records it
+func (s *Suite) api(ctx context.Context, name string, expectAllow bool, method, path string, headers map[string]string, in any) {
+	outcome, detail := judgeResponse(s.A.Do(ctx, method, path, headers, in))
+	s.record(name, expectAllow, outcome, detail)
+}
+
+// Run performs every check
+func (s *Suite) Run(ctx context.Context) {
+	f := s.Fixtures
+
+	// Controls: tenant A can reach its own data, so the denials below are not just broken auth
+	s.api(ctx, "control: download own object", true, http.MethodGet, "/objects/"+f.ObjectA+"/content", nil, nil)
+	s.api(ctx, "control: events of own upload", true, http.MethodGet,
+		"/upload/"+url.PathEscape(f.UploadA.UploadID)+"/events?objectKey="+url.QueryEscape(f.UploadA.ObjectKey), nil, nil)
+
+	// Tenant B's multipart upload
+	foreignUpload := map[string]any{"uploadId": f.UploadB.UploadID, "objectKey": f.UploadB.ObjectKey}
+	s.api(ctx, "complete other tenant's upload", false, http.MethodPost, "/upload/complete", nil, map[string]any{
+		"uploadId":  f.UploadB.UploadID,
+		"objectKey": f.UploadB.ObjectKey,
+		"partETags": []map[string]any{{"partNumber": 1, "eTag": `"00000000000000000000000000000000"`}},
+	})
+	s.api(ctx, "refresh other tenant's upload", false, http.MethodPost, "/upload/refresh", nil, map[string]any{
+		"uploadId":    f.UploadB.UploadID,
+		"objectKey":   f.UploadB.ObjectKey,
+		"partNumbers": []int{1},
+	})
+	s.api(ctx, "events of other tenant's upload", false, http.MethodGet,
+		"/upload/"+url.PathEscape(f.UploadB.UploadID)+"/events?objectKey="+url.QueryEscape(f.UploadB.ObjectKey), nil, nil)
+
+	// Tenant B's object
+	s.api(ctx, "download other tenant's object", false, http.MethodGet, "/objects/"+f.ObjectB+"/content", nil, nil)
+	s.api(ctx, "receipt of other tenant's object", false, http.MethodGet, "/objects/"+f.ObjectB+"/receipt", nil, nil)
+	s.api(ctx, "presign other tenant's object", false, http.MethodPost, "/download/presign-batch", nil,
+		map[string]any{"objectKeys": []string{f.ObjectB}})
+	s.api(ctx, "delete other tenant's object", false, http.MethodDelete, "/objects/"+f.ObjectB, nil, nil)
+	s.api(ctx, "restore into other tenant's prefix", false, http.MethodPost, "/objects/"+f.ObjectB+"/restore", nil, nil)
+
+	// Acting as tenant B without being an admin allowed to
+	s.api(ctx, "act as other tenant", false, http.MethodPost, "/upload/initiate",
+		map[string]string{"X-Act-As-Tenant": f.TenantB}, map[string]any{"size": 1, "partSize": 5 << 20})
+
+	s.tamperedPresignedURL(ctx)
+	s.directS3(ctx)
+
+	// Aborting is destructive, so it runs last
+	s.api(ctx, "abort other tenant's upload", false, http.MethodPost, "/upload/abort", nil, foreignUpload)
+}
+
+// tamperedPresignedURL points one of tenant A's presigned part URLs at tenant B's prefix
+func (s *Suite) tamperedPresignedURL(ctx context.Context) {
+	const name = "upload to other prefix with a rewritten presigned URL"
+	f := s.Fixtures
+	partURL, ok := f.UploadA.PresignedUrls[1]
+	if !ok {
+		s.record(name, false, OutcomeSkipped, "no presigned URL for part 1")
+		return
+	}
+	u, err := url.Parse(partURL)
+	if err != nil || !strings.Contains(u.Path, "/"+f.TenantA+"/") {
+		s.record(name, false, OutcomeSkipped, "presigned URL does not contain the tenant prefix")
+		return
+	}
+	u.Path = strings.Replace(u.Path, "/"+f.TenantA+"/", "/"+f.TenantB+"/", 1)
+	u.RawPath = ""
+
+	status, err := s.A.PutPresigned(ctx, u.String(), []byte("isolation test"))
+	if err != nil {
+		s.record(name, false, OutcomeInconclusive, err.Error())
+		return
+	}
+	outcome := OutcomeInconclusive
+	switch {
+	case status >= 200 && status <= 299:
+		outcome = OutcomeAllowed
+	case status == http.StatusForbidden:
+		outcome = OutcomeDenied
+	}
+	s.record(name, false, outcome, fmt.Sprintf("status %d", status))
+}
+
+// directS3 uses tenant A's delegated credentials against tenant B's prefix
+func (s *Suite) directS3(ctx context.Context) {
+	f := s.Fixtures
+	names := []string{
+		"list other tenant's prefix with delegated credentials",
+		"read other tenant's object with delegated credentials",
+		"write into other tenant's prefix with delegated credentials",
+	}
+	if f.CredentialsA == nil {
+		for _, name := range names {
+			s.record(name, false, OutcomeSkipped, f.CredentialsSkipped)
+		}
+		return
+	}
+
+	creds := f.CredentialsA
+	client := s3.New(s3.Options{
+		Region:      creds.Region,
+		Credentials: credentials.NewStaticCredentialsProvider(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken),
+	})
+
+	_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(creds.Bucket),
+		Prefix: aws.String(f.TenantB + "/"),
+	})
+	outcome, detail := judgeS3(err)
+	s.record(names[0], false, outcome, detail)
+
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(creds.Bucket),
+		Key:    aws.String(f.ObjectB),
+	})
+	if err == nil {
+		_, _ = io.Copy(io.Discard, output.Body)
+		output.Body.Close()
+	}
+	outcome, detail = judgeS3(err)
+	s.record(names[1], false, outcome, detail)
+
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(creds.Bucket),
+		Key:    aws.String(f.TenantB + "/isolation-test.txt"),
+		Body:   strings.NewReader("isolation test"),
+	})
+	outcome, detail = judgeS3(err)
+	s.record(names[2], false, outcome, detail)
+}
+
+// truncate shortens s to at most n bytes for the report
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
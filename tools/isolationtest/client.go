@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Sent as X-Client-Name / X-Client-Version, so the API can tell isolation test traffic apart
+const (
+	clientName    = "upload-isolationtest"
+	clientVersion = "1.0.0"
+)
+
+// APIClient talks to the upload demo API as one tenant
+type APIClient struct {
+	baseURL     string
+	httpClient  *http.Client
+	accessToken string
+}
+
+// Response is a finished API call
+type Response struct {
+	Status int
+	Body   []byte
+}
+
+// loginRequest mirrors the login Lambda request payload
+type loginRequest struct {
+	Tenant   string `json:"tenant"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginResponse mirrors the subset of the login Lambda response we need
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// uploadResponse mirrors the upload Lambda UploadResponse
+type uploadResponse struct {
+	FilePath string `json:"file_path"`
+	TenantID string `json:"tenant_id"`
+}
+
+// initiateResponse mirrors the part of the upload Lambda InitiateUploadResponse we need
+type initiateResponse struct {
+	PresignedUrls map[int]string `json:"presignedUrls"`
+	UploadID      string         `json:"uploadId"`
+	ObjectKey     string         `json:"objectKey"`
+}
+
+// delegatedCredentials mirrors the upload Lambda DelegatedCredentials
+type delegatedCredentials struct {
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+}
+
+// NewAPIClient creates a client for the given API base URL, authenticated with accessToken
+// when it is not empty (an access token or an API token)
+func NewAPIClient(baseURL string, httpClient *http.Client, accessToken string) *APIClient {
+	return &APIClient{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		httpClient:  httpClient,
+		accessToken: accessToken,
+	}
+}
+
+// Login authenticates against /login and keeps the access token for later calls
+func (c *APIClient) Login(ctx context.Context, tenant, username, password string) error {
+	resp, err := c.Do(ctx, http.MethodPost, "/login", nil, &loginRequest{
+		Tenant:   tenant,
+		Username: username,
+		Password: password,
+	})
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	var login loginResponse
+	if err := resp.Decode(&login); err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	if login.AccessToken == "" {
+		return fmt.Errorf("login response did not contain an access token")
+	}
+	c.accessToken = login.AccessToken
+	return nil
+}
+
+// Do sends a request with an optional JSON body. Only transport failures are errors; the
+// caller judges the status.
+func (c *APIClient) Do(ctx context.Context, method, path string, headers map[string]string, in any) (*Response, error) {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Client-Name", clientName)
+	req.Header.Set("X-Client-Version", clientVersion)
+	if c.accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Status: resp.StatusCode, Body: respBody}, nil
+}
+
+// Decode decodes a successful JSON response into out
+func (r *Response) Decode(out any) error {
+	if r.Status < 200 || r.Status > 299 {
+		return fmt.Errorf("returned status %d: %s", r.Status, strings.TrimSpace(string(r.Body)))
+	}
+	return json.Unmarshal(r.Body, out)
+}
+
+// PutPresigned sends a small body to a presigned PUT URL and returns the status
+func (c *APIClient) PutPresigned(ctx context.Context, presignedURL string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,213 @@
+// Command isolationtest checks tenant isolation of a deployed stack. Given credentials of
+// two tenants, it creates an object and a multipart upload as tenant B, then attempts to
+// reach them as tenant A through every API route and, with delegated credentials, S3
+// directly. Every attempt must be denied; the command exits non-zero otherwise, so it can
+// gate releases to staging.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Config holds the isolation test parameters
+type Config struct {
+	BaseURL string
+	A, B    TenantConfig
+	Timeout time.Duration
+}
+
+// TenantConfig holds one tenant's credentials: a token, or a user to log in as
+type TenantConfig struct {
+	Tenant   string
+	Username string
+	Password string
+	Token    string
+}
+
+func parseFlags() *Config {
+	cfg := &Config{}
+	flag.StringVar(&cfg.BaseURL, "url", os.Getenv("API_URL"), "API base URL (defaults to $API_URL)")
+	flag.StringVar(&cfg.A.Tenant, "tenant-a", "tenant-a", "tenant attempting cross-tenant access")
+	flag.StringVar(&cfg.A.Username, "username-a", "tom", "user of tenant A")
+	flag.StringVar(&cfg.A.Password, "password-a", os.Getenv("TEST_PASSWORD"), "password of tenant A's user (defaults to $TEST_PASSWORD)")
+	flag.StringVar(&cfg.A.Token, "token-a", os.Getenv("TENANT_A_TOKEN"), "access or API token of tenant A instead of logging in (defaults to $TENANT_A_TOKEN)")
+	flag.StringVar(&cfg.B.Tenant, "tenant-b", "tenant-b", "tenant whose data is targeted")
+	flag.StringVar(&cfg.B.Username, "username-b", "tom", "user of tenant B")
+	flag.StringVar(&cfg.B.Password, "password-b", os.Getenv("TEST_PASSWORD"), "password of tenant B's user (defaults to $TEST_PASSWORD)")
+	flag.StringVar(&cfg.B.Token, "token-b", os.Getenv("TENANT_B_TOKEN"), "access or API token of tenant B instead of logging in (defaults to $TENANT_B_TOKEN)")
+	flag.DurationVar(&cfg.Timeout, "timeout", 5*time.Minute, "overall test timeout")
+	flag.Parse()
+	return cfg
+}
+
+// validate checks the configuration before any requests are made
+func (c *Config) validate() error {
+	if c.BaseURL == "" {
+		return fmt.Errorf("-url (or API_URL) is required")
+	}
+	if c.A.Tenant == "" || c.B.Tenant == "" || c.A.Tenant == c.B.Tenant {
+		return fmt.Errorf("-tenant-a and -tenant-b must name two different tenants")
+	}
+	for _, tenant := range []TenantConfig{c.A, c.B} {
+		if tenant.Token == "" && tenant.Password == "" {
+			return fmt.Errorf("tenant %s needs a token or a password", tenant.Tenant)
+		}
+	}
+	return nil
+}
+
+// connect returns a client authenticated as the tenant
+func connect(ctx context.Context, baseURL string, httpClient *http.Client, tenant TenantConfig) (*APIClient, error) {
+	client := NewAPIClient(baseURL, httpClient, tenant.Token)
+	if tenant.Token == "" {
+		if err := client.Login(ctx, tenant.Tenant, tenant.Username, tenant.Password); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.Tenant, err)
+		}
+	}
+	return client, nil
+}
+
+// createFixtures uploads an object and starts a multipart upload as the client's tenant
+func createFixtures(ctx context.Context, client *APIClient, tenant string) (string, *initiateResponse, error) {
+	resp, err := client.Do(ctx, http.MethodPost, "/upload", nil, map[string]any{
+		"isolation_test": true,
+		"created_at":     time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("tenant %s upload: %w", tenant, err)
+	}
+	var upload uploadResponse
+	if err := resp.Decode(&upload); err != nil {
+		return "", nil, fmt.Errorf("tenant %s upload: %w", tenant, err)
+	}
+	if upload.TenantID != tenant {
+		return "", nil, fmt.Errorf("credentials of tenant %s act as tenant %s", tenant, upload.TenantID)
+	}
+
+	resp, err = client.Do(ctx, http.MethodPost, "/upload/initiate", nil, map[string]any{"size": 1, "partSize": 5 << 20})
+	if err != nil {
+		return "", nil, fmt.Errorf("tenant %s initiate: %w", tenant, err)
+	}
+	var initiated initiateResponse
+	if err := resp.Decode(&initiated); err != nil {
+		return "", nil, fmt.Errorf("tenant %s initiate: %w", tenant, err)
+	}
+	return upload.FilePath, &initiated, nil
+}
+
+// cleanup aborts the fixtures' uploads and soft deletes their objects as their owners
+func cleanup(ctx context.Context, client *APIClient, objectKey string, upload *initiateResponse) {
+	if upload != nil {
+		if resp, err := client.Do(ctx, http.MethodPost, "/upload/abort", nil, map[string]any{
+			"uploadId": upload.UploadID, "objectKey": upload.ObjectKey,
+		}); err != nil || (resp.Status != http.StatusNoContent && resp.Status != http.StatusNotFound) {
+			log.Printf("Failed to abort fixture upload %s: %v", upload.UploadID, describe(resp, err))
+		}
+	}
+	if objectKey != "" {
+		if resp, err := client.Do(ctx, http.MethodDelete, "/objects/"+objectKey, nil, nil); err != nil || resp.Status != http.StatusOK {
+			log.Printf("Failed to delete fixture object %s: %v", objectKey, describe(resp, err))
+		}
+	}
+}
+
+// describe summarizes a failed call for the log
+func describe(resp *Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("status %d", resp.Status)
+}
+
+// report prints the results and returns how many failed
+func report(results []Result) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RESULT\tCHECK\tEXPECTED\tOUTCOME\tDETAIL")
+	failed := 0
+	for _, r := range results {
+		verdict, expected := "PASS", OutcomeDenied
+		if r.ExpectAllow {
+			expected = OutcomeAllowed
+		}
+		if !r.Passed() {
+			verdict = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", verdict, r.Name, expected, r.Outcome, r.Detail)
+	}
+	w.Flush()
+	fmt.Printf("\n%d checks, %d failed\n", len(results), failed)
+	return failed
+}
+
+// run performs the test and returns the exit code
+func run(cfg *Config) int {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+		// Redirects are judged, not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	clientA, err := connect(ctx, cfg.BaseURL, httpClient, cfg.A)
+	if err != nil {
+		log.Printf("Login failed: %v", err)
+		return 2
+	}
+	clientB, err := connect(ctx, cfg.BaseURL, httpClient, cfg.B)
+	if err != nil {
+		log.Printf("Login failed: %v", err)
+		return 2
+	}
+
+	fixtures := &Fixtures{TenantA: cfg.A.Tenant, TenantB: cfg.B.Tenant}
+	fixtures.ObjectB, fixtures.UploadB, err = createFixtures(ctx, clientB, cfg.B.Tenant)
+	defer cleanup(context.WithoutCancel(ctx), clientB, fixtures.ObjectB, fixtures.UploadB)
+	if err != nil {
+		log.Printf("Failed to create fixtures: %v", err)
+		return 2
+	}
+	fixtures.ObjectA, fixtures.UploadA, err = createFixtures(ctx, clientA, cfg.A.Tenant)
+	defer cleanup(context.WithoutCancel(ctx), clientA, fixtures.ObjectA, fixtures.UploadA)
+	if err != nil {
+		log.Printf("Failed to create fixtures: %v", err)
+		return 2
+	}
+
+	// Direct S3 checks need delegated credentials, which tenants may not be enabled for
+	resp, err := clientA.Do(ctx, http.MethodPost, "/upload/credentials", nil, map[string]any{})
+	if err == nil && resp.Status == http.StatusOK {
+		fixtures.CredentialsA = &delegatedCredentials{}
+		if err := resp.Decode(fixtures.CredentialsA); err != nil {
+			log.Printf("Failed to decode delegated credentials: %v", err)
+			return 2
+		}
+	} else {
+		fixtures.CredentialsSkipped = "no delegated credentials for tenant A (" + describe(resp, err) + ")"
+	}
+
+	log.Printf("Checking isolation of tenant %s from tenant %s", cfg.B.Tenant, cfg.A.Tenant)
+	suite := &Suite{A: clientA, Fixtures: fixtures}
+	suite.Run(ctx)
+
+	if report(suite.Results) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	cfg := parseFlags()
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	os.Exit(run(cfg))
+}
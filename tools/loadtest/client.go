@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sent as X-Client-Name / X-Client-Version, so the API can tell load test traffic apart
+const (
+	clientName    = "upload-loadtest"
+	clientVersion = "1.0.0"
+)
+
+// APIClient talks to the upload demo API on behalf of a single tenant user
+type APIClient struct {
+	baseURL     string
+	httpClient  *http.Client
+	accessToken string
+}
+
+// loginRequest mirrors the login Lambda request payload
+type loginRequest struct {
+	Tenant   string `json:"tenant"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginResponse mirrors the subset of the login Lambda response we need
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// initiateRequest mirrors the upload Lambda InitiateUploadRequest
+type initiateRequest struct {
+	Size        int64  `json:"size"`
+	PartSize    int64  `json:"partSize"`
+	URLDelivery string `json:"urlDelivery,omitempty"`
+}
+
+// initiateResponse mirrors the upload Lambda InitiateUploadResponse
+type initiateResponse struct {
+	PresignedUrls         map[int]string `json:"presignedUrls"`
+	PresignedUrlsLocation string         `json:"presignedUrlsLocation"`
+	UploadID              string         `json:"uploadId"`
+	ObjectKey             string         `json:"objectKey"`
+	Hints                 *uploadHints   `json:"hints"`
+}
+
+// uploadHints mirrors the upload Lambda UploadHints
+type uploadHints struct {
+	Tier              string `json:"tier"`
+	MaxParallelParts  int    `json:"maxParallelParts"`
+	MaxBytesPerSecond int64  `json:"maxBytesPerSecond"`
+}
+
+// partTag mirrors the upload Lambda PartTag
+type partTag struct {
+	PartNumber int    `json:"partNumber"`
+	ETag       string `json:"eTag"`
+}
+
+// completeRequest mirrors the upload Lambda CompleteUploadRequest
+type completeRequest struct {
+	UploadID  string    `json:"uploadId"`
+	ObjectKey string    `json:"objectKey"`
+	PartETags []partTag `json:"partETags"`
+}
+
+// NewAPIClient creates a client for the given API base URL
+func NewAPIClient(baseURL string, httpClient *http.Client) *APIClient {
+	return &APIClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// Login authenticates against /login and keeps the access token for later calls
+func (c *APIClient) Login(ctx context.Context, tenant, username, password string) error {
+	var resp loginResponse
+	err := c.postJSON(ctx, "/login", false, &loginRequest{
+		Tenant:   tenant,
+		Username: username,
+		Password: password,
+	}, &resp)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return fmt.Errorf("login response did not contain an access token")
+	}
+
+	c.accessToken = resp.AccessToken
+	return nil
+}
+
+// Initiate starts a multipart upload and returns the presigned part URLs.
+// When the server delivers the URLs via an S3 object, they are fetched before returning.
+func (c *APIClient) Initiate(ctx context.Context, size, partSize int64, urlDelivery string) (*initiateResponse, error) {
+	var resp initiateResponse
+	req := &initiateRequest{Size: size, PartSize: partSize, URLDelivery: urlDelivery}
+	if err := c.postJSON(ctx, "/upload/initiate", true, req, &resp); err != nil {
+		return nil, fmt.Errorf("initiate failed: %w", err)
+	}
+
+	if resp.PresignedUrlsLocation != "" {
+		urls, err := c.fetchPresignedUrls(ctx, resp.PresignedUrlsLocation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch presigned URLs: %w", err)
+		}
+		resp.PresignedUrls = urls
+	}
+	return &resp, nil
+}
+
+// fetchPresignedUrls downloads a URL map delivered through S3
+func (c *APIClient) fetchPresignedUrls(ctx context.Context, location string) (map[int]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching presigned URLs returned status %d", resp.StatusCode)
+	}
+
+	var urls map[int]string
+	if err := json.NewDecoder(resp.Body).Decode(&urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// Complete finishes a multipart upload with the collected part ETags
+func (c *APIClient) Complete(ctx context.Context, uploadID, objectKey string, parts []partTag) error {
+	req := &completeRequest{
+		UploadID:  uploadID,
+		ObjectKey: objectKey,
+		PartETags: parts,
+	}
+	if err := c.postJSON(ctx, "/upload/complete", true, req, nil); err != nil {
+		return fmt.Errorf("complete failed: %w", err)
+	}
+	return nil
+}
+
+// PutPart uploads a single part directly to S3 using its presigned URL and returns the ETag.
+// A positive bytesPerSecond paces the body to that rate.
+func (c *APIClient) PutPart(ctx context.Context, presignedURL string, body []byte, bytesPerSecond int64) (string, error) {
+	var reader io.Reader = bytes.NewReader(body)
+	if bytesPerSecond > 0 {
+		reader = &pacedReader{r: reader, bytesPerSecond: bytesPerSecond, start: time.Now()}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, reader)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(body))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("part upload returned status %d", resp.StatusCode)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("part upload response did not contain an ETag")
+	}
+	return etag, nil
+}
+
+// pacedReader limits reads to bytesPerSecond on average by sleeping once ahead of schedule
+type pacedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func (p *pacedReader) Read(buf []byte) (int, error) {
+	// Small reads keep the pacing smooth
+	if limit := p.bytesPerSecond / 10; limit > 0 && int64(len(buf)) > limit {
+		buf = buf[:limit]
+	}
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	due := time.Duration(float64(p.read) / float64(p.bytesPerSecond) * float64(time.Second))
+	if wait := due - time.Since(p.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// postJSON sends a JSON body to the API and decodes the JSON response into out (if not nil)
+func (c *APIClient) postJSON(ctx context.Context, path string, authenticated bool, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-Name", clientName)
+	req.Header.Set("X-Client-Version", clientVersion)
+	if authenticated {
+		req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,3 @@
+module github.com/stefando/uploadDemoAWS/tools/loadtest
+
+go 1.24
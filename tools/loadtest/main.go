@@ -0,0 +1,223 @@
+// Command loadtest drives the full multipart upload flow against a deployed stack:
+// login, initiate, parallel part PUTs against presigned URLs, and complete.
+// It reports p50/p99 latencies per stage and overall throughput.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds the load test parameters
+type Config struct {
+	BaseURL         string
+	Tenant          string
+	Username        string
+	Password        string
+	Uploads         int
+	Concurrency     int
+	PartConcurrency int
+	Size            int64
+	PartSize        int64
+	URLDelivery     string
+	IgnoreHints     bool
+	Timeout         time.Duration
+}
+
+func parseFlags() *Config {
+	cfg := &Config{}
+	flag.StringVar(&cfg.BaseURL, "url", os.Getenv("API_URL"), "API base URL (defaults to $API_URL)")
+	flag.StringVar(&cfg.Tenant, "tenant", "tenant-a", "tenant to log in to")
+	flag.StringVar(&cfg.Username, "username", "tom", "username to log in with")
+	flag.StringVar(&cfg.Password, "password", os.Getenv("TEST_PASSWORD"), "password (defaults to $TEST_PASSWORD)")
+	flag.IntVar(&cfg.Uploads, "uploads", 10, "total number of multipart uploads to perform")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 2, "number of uploads running in parallel")
+	flag.IntVar(&cfg.PartConcurrency, "part-concurrency", 4, "number of parallel part PUTs per upload")
+	flag.Int64Var(&cfg.Size, "size", 20<<20, "size of each upload in bytes")
+	flag.Int64Var(&cfg.PartSize, "part-size", 5<<20, "part size in bytes (S3 minimum is 5 MiB except for the last part)")
+	flag.StringVar(&cfg.URLDelivery, "url-delivery", "", "presigned URL delivery mode: inline or object (server default if empty)")
+	flag.BoolVar(&cfg.IgnoreHints, "ignore-hints", false, "ignore the parallelism and rate hints returned by initiate")
+	flag.DurationVar(&cfg.Timeout, "timeout", 30*time.Minute, "overall test timeout")
+	flag.Parse()
+	return cfg
+}
+
+// validate checks the configuration before any requests are made
+func (c *Config) validate() error {
+	if c.BaseURL == "" {
+		return fmt.Errorf("-url (or API_URL) is required")
+	}
+	if c.Password == "" {
+		return fmt.Errorf("-password (or TEST_PASSWORD) is required")
+	}
+	if c.Uploads <= 0 || c.Concurrency <= 0 || c.PartConcurrency <= 0 {
+		return fmt.Errorf("uploads, concurrency and part-concurrency must be greater than zero")
+	}
+	if c.Size <= 0 || c.PartSize <= 0 {
+		return fmt.Errorf("size and part-size must be greater than zero")
+	}
+	return nil
+}
+
+// runUpload performs one complete multipart upload and returns the number of bytes sent
+func runUpload(ctx context.Context, cfg *Config, client *APIClient, rec *Recorder, payload []byte) (int64, error) {
+	var initResp *initiateResponse
+	err := rec.Time("initiate", func() error {
+		var err error
+		initResp, err = client.Initiate(ctx, cfg.Size, cfg.PartSize, cfg.URLDelivery)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Honor the server's hints unless told otherwise; they only ever lower the flags
+	partConcurrency, bytesPerSecond := cfg.PartConcurrency, int64(0)
+	if hints := initResp.Hints; hints != nil && !cfg.IgnoreHints {
+		if hints.MaxParallelParts > 0 {
+			partConcurrency = min(partConcurrency, hints.MaxParallelParts)
+		}
+		bytesPerSecond = hints.MaxBytesPerSecond
+	}
+
+	// Upload parts in parallel, bounded by the part concurrency
+	partNumbers := make([]int, 0, len(initResp.PresignedUrls))
+	for partNumber := range initResp.PresignedUrls {
+		partNumbers = append(partNumbers, partNumber)
+	}
+	sort.Ints(partNumbers)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    = make([]partTag, 0, len(partNumbers))
+		firstErr error
+		sent     int64
+		sem      = make(chan struct{}, partConcurrency)
+	)
+	for _, partNumber := range partNumbers {
+		// The last part may be shorter than PartSize
+		offset := int64(partNumber-1) * cfg.PartSize
+		length := cfg.PartSize
+		if offset+length > cfg.Size {
+			length = cfg.Size - offset
+		}
+		body := payload[:length]
+		url := initResp.PresignedUrls[partNumber]
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(partNumber int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var etag string
+			err := rec.Time("part", func() error {
+				var err error
+				etag, err = client.PutPart(ctx, url, body, bytesPerSecond)
+				return err
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %w", partNumber, err)
+				}
+				return
+			}
+			parts = append(parts, partTag{PartNumber: partNumber, ETag: etag})
+			sent += int64(len(body))
+		}(partNumber)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	// S3 requires parts in ascending order on completion
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	err = rec.Time("complete", func() error {
+		return client.Complete(ctx, initResp.UploadID, initResp.ObjectKey, parts)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sent, nil
+}
+
+func main() {
+	cfg := parseFlags()
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	// Share one transport so connections to API Gateway and S3 are reused across workers
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        cfg.Concurrency * cfg.PartConcurrency * 2,
+			MaxIdleConnsPerHost: cfg.Concurrency * cfg.PartConcurrency,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	client := NewAPIClient(cfg.BaseURL, httpClient)
+	rec := NewRecorder()
+
+	err := rec.Time("login", func() error {
+		return client.Login(ctx, cfg.Tenant, cfg.Username, cfg.Password)
+	})
+	if err != nil {
+		log.Fatalf("Login failed: %v", err)
+	}
+
+	// A single random buffer is sliced for every part to keep memory flat
+	payload := make([]byte, min(cfg.PartSize, cfg.Size))
+	if _, err := rand.Read(payload); err != nil {
+		log.Fatalf("Failed to generate payload: %v", err)
+	}
+
+	log.Printf("Starting %d uploads of %d bytes (part size %d) with concurrency %d x %d",
+		cfg.Uploads, cfg.Size, cfg.PartSize, cfg.Concurrency, cfg.PartConcurrency)
+
+	var (
+		bytesUploaded int64
+		next          int64
+		wg            sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(cfg.Uploads) {
+				var sent int64
+				err := rec.Time("upload", func() error {
+					var err error
+					sent, err = runUpload(ctx, cfg, client, rec, payload)
+					return err
+				})
+				if err != nil {
+					log.Printf("Upload failed: %v", err)
+					continue
+				}
+				atomic.AddInt64(&bytesUploaded, sent)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rec.Report(os.Stdout, time.Since(start), bytesUploaded)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recorder collects latency samples and error counts per named stage
+type Recorder struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	errors  map[string]int
+	order   []string
+}
+
+// NewRecorder creates an empty recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		samples: make(map[string][]time.Duration),
+		errors:  make(map[string]int),
+	}
+}
+
+// Observe records the outcome of a single operation for a stage
+func (r *Recorder) Observe(stage string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, seen := r.samples[stage]; !seen {
+		r.order = append(r.order, stage)
+		r.samples[stage] = nil
+	}
+
+	if err != nil {
+		r.errors[stage]++
+		return
+	}
+	r.samples[stage] = append(r.samples[stage], latency)
+}
+
+// Time runs fn and records its latency and error under the given stage
+func (r *Recorder) Time(stage string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.Observe(stage, time.Since(start), err)
+	return err
+}
+
+// percentile returns the p-th percentile (0-100) of sorted samples using nearest-rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Report writes a per-stage latency table followed by overall throughput
+func (r *Recorder) Report(w io.Writer, elapsed time.Duration, bytesUploaded int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintf(w, "%-10s %8s %8s %12s %12s %12s\n", "stage", "ok", "errors", "p50", "p99", "max")
+	for _, stage := range r.order {
+		sorted := append([]time.Duration(nil), r.samples[stage]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		var maxLatency time.Duration
+		if len(sorted) > 0 {
+			maxLatency = sorted[len(sorted)-1]
+		}
+
+		fmt.Fprintf(w, "%-10s %8d %8d %12s %12s %12s\n",
+			stage,
+			len(sorted),
+			r.errors[stage],
+			percentile(sorted, 50).Round(time.Millisecond),
+			percentile(sorted, 99).Round(time.Millisecond),
+			maxLatency.Round(time.Millisecond),
+		)
+	}
+
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return
+	}
+	completed := len(r.samples["upload"])
+	fmt.Fprintf(w, "\nelapsed:    %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "uploads/s:  %.2f\n", float64(completed)/seconds)
+	fmt.Fprintf(w, "throughput: %.2f MiB/s\n", float64(bytesUploaded)/seconds/(1<<20))
+}